@@ -0,0 +1,74 @@
+package newdns
+
+import (
+	"context"
+
+	"github.com/miekg/dns"
+)
+
+// AnyPolicy defines how queries for the ANY type are answered.
+type AnyPolicy int
+
+const (
+	// AnyNotImplemented answers ANY queries with NOTIMP.
+	AnyNotImplemented AnyPolicy = iota
+
+	// AnyHINFO answers ANY queries for existing names with a synthesized
+	// HINFO record as described in RFC 8482.
+	AnyHINFO
+
+	// AnyRRset answers ANY queries for existing names with one of their sets
+	// as described in RFC 8482.
+	AnyRRset
+)
+
+// anyHINFOTTL is the TTL of synthesized HINFO records.
+const anyHINFOTTL = 3600
+
+var anyTypes = []Type{A, AAAA, CNAME, MX, TXT, NS, PTR, SRV}
+
+func (s *Server) handleANY(ctx context.Context, w dns.ResponseWriter, rq, rs *dns.Msg, zone *Zone, name string) {
+	// get question
+	question := rq.Question[0]
+
+	// lookup any set
+	answer, exists, err := zone.Lookup(ctx, name, anyTypes...)
+	if err != nil {
+		log(s.logger(w), BackendError, nil, err, "")
+		s.writeError(w, rq, rs, nil, dns.RcodeServerFailure)
+		return
+	}
+
+	// handle absence
+	if len(answer) == 0 && !exists {
+		s.writeError(w, rq, rs, zone, dns.RcodeNameError)
+		return
+	}
+
+	// set answer
+	switch {
+	case s.config.AnyPolicy == AnyHINFO:
+		rs.Answer = append(rs.Answer, &dns.HINFO{
+			Hdr: dns.RR_Header{
+				Name:   question.Name,
+				Rrtype: dns.TypeHINFO,
+				Class:  dns.ClassINET,
+				Ttl:    anyHINFOTTL,
+			},
+			Cpu: "RFC8482",
+		})
+	case len(answer) > 0:
+		rs.Answer = convertSet(rs.Answer, question.Name, zone, answer[0])
+	case name == zone.Name:
+		rs.Answer = append(rs.Answer, zone.soaRecord())
+	default:
+		s.writeError(w, rq, rs, zone, dns.RcodeSuccess)
+		return
+	}
+
+	// add ns records
+	rs.Ns = append(rs.Ns, zone.nsRecords(TransferCase(question.Name, zone.Name))...)
+
+	// write message
+	s.writeMessage(w, rq, rs)
+}
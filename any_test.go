@@ -0,0 +1,72 @@
+package newdns
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerAnyPolicy(t *testing.T) {
+	zone := testZone(func(ctx context.Context, name string) ([]Set, error) {
+		if name == "foo" {
+			return []Set{
+				{Name: "foo.example.com.", Type: A, Records: []Record{{Address: "1.2.3.4"}}},
+				{Name: "foo.example.com.", Type: TXT, Records: []Record{{Data: []string{"foo"}}}},
+			}, nil
+		}
+		if name == "_sip._tcp" {
+			return []Set{
+				{Name: "_sip._tcp.example.com.", Type: SRV, Records: []Record{{Address: "sip.example.com.", Priority: 10, Weight: 5, Port: 5060}}},
+			}, nil
+		}
+
+		return nil, nil
+	})
+
+	for _, policy := range []AnyPolicy{AnyNotImplemented, AnyHINFO, AnyRRset} {
+		server := NewServer(Config{
+			AnyPolicy: policy,
+			Handler:   testHandler(zone),
+		})
+
+		run(server, "127.0.0.1:0", func() {
+			addr := server.Addr().String()
+
+			ret, err := Query("udp", addr, "foo.example.com.", "ANY", nil)
+			assert.NoError(t, err)
+
+			switch policy {
+			case AnyNotImplemented:
+				assert.Equal(t, dns.RcodeNotImplemented, ret.Rcode)
+				return
+			case AnyHINFO:
+				assert.Equal(t, dns.RcodeSuccess, ret.Rcode)
+				assert.Len(t, ret.Answer, 1)
+				assert.Equal(t, "RFC8482", ret.Answer[0].(*dns.HINFO).Cpu)
+			case AnyRRset:
+				assert.Equal(t, dns.RcodeSuccess, ret.Rcode)
+				assert.Len(t, ret.Answer, 1)
+				assert.Equal(t, dns.TypeA, ret.Answer[0].Header().Rrtype)
+			}
+
+			ret, err = Query("udp", addr, "example.com.", "ANY", nil)
+			assert.NoError(t, err)
+			assert.Equal(t, dns.RcodeSuccess, ret.Rcode)
+			assert.Len(t, ret.Answer, 1)
+
+			ret, err = Query("udp", addr, "_sip._tcp.example.com.", "ANY", nil)
+			assert.NoError(t, err)
+			assert.Equal(t, dns.RcodeSuccess, ret.Rcode)
+			assert.Len(t, ret.Answer, 1)
+			if policy == AnyRRset {
+				assert.Equal(t, dns.TypeSRV, ret.Answer[0].Header().Rrtype)
+			}
+
+			ret, err = Query("udp", addr, "bar.example.com.", "ANY", nil)
+			assert.NoError(t, err)
+			assert.Equal(t, dns.RcodeNameError, ret.Rcode)
+		})
+	}
+}
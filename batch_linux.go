@@ -0,0 +1,185 @@
+//go:build linux
+// +build linux
+
+package newdns
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+type batchPacketConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+type batchWrite struct {
+	data []byte
+	addr net.Addr
+	err  chan error
+}
+
+type batchConn struct {
+	net.PacketConn
+	batch batchPacketConn
+	size  int
+
+	readMutex sync.Mutex
+	readMsgs  []ipv4.Message
+	readQueue []ipv4.Message
+
+	writes chan batchWrite
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newBatchConn(conn net.PacketConn, size int) net.PacketConn {
+	// check size
+	if size <= 1 {
+		return conn
+	}
+
+	// get batch conn
+	var batch batchPacketConn
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+		batch = ipv4.NewPacketConn(conn)
+	} else {
+		batch = ipv6.NewPacketConn(conn)
+	}
+
+	// prepare read messages
+	msgs := make([]ipv4.Message, size)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, 65535)}
+	}
+
+	// create conn
+	bc := &batchConn{
+		PacketConn: conn,
+		batch:      batch,
+		size:       size,
+		readMsgs:   msgs,
+		writes:     make(chan batchWrite, size),
+		done:       make(chan struct{}),
+	}
+
+	// run writer
+	go bc.writer()
+
+	return bc
+}
+
+func (c *batchConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	// acquire mutex
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+
+	// read batch if queue is empty
+	if len(c.readQueue) == 0 {
+		n, err := c.batch.ReadBatch(c.readMsgs, 0)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		// set queue
+		c.readQueue = c.readMsgs[:n]
+	}
+
+	// get message
+	msg := c.readQueue[0]
+	c.readQueue = c.readQueue[1:]
+
+	// copy data
+	n := copy(p, msg.Buffers[0][:msg.N])
+
+	return n, msg.Addr, nil
+}
+
+func (c *batchConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	// prepare write
+	write := batchWrite{
+		data: p,
+		addr: addr,
+		err:  make(chan error, 1),
+	}
+
+	// queue write
+	select {
+	case c.writes <- write:
+	case <-c.done:
+		return 0, net.ErrClosed
+	}
+
+	// await result
+	err := <-write.err
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (c *batchConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.PacketConn.Close()
+}
+
+func (c *batchConn) writer() {
+	// prepare list and messages
+	list := make([]batchWrite, 0, c.size)
+	msgs := make([]ipv4.Message, c.size)
+
+	for {
+		// await first write
+		select {
+		case write := <-c.writes:
+			list = append(list[:0], write)
+		case <-c.done:
+			return
+		}
+
+		// collect queued writes
+	collect:
+		for len(list) < c.size {
+			select {
+			case write := <-c.writes:
+				list = append(list, write)
+			default:
+				break collect
+			}
+		}
+
+		// prepare messages
+		for i, write := range list {
+			msgs[i] = ipv4.Message{
+				Buffers: [][]byte{write.data},
+				Addr:    write.addr,
+			}
+		}
+
+		// write messages
+		var off int
+		for off < len(list) {
+			n, err := c.batch.WriteBatch(msgs[off:len(list)], 0)
+			if err == nil && n == 0 {
+				err = io.ErrShortWrite
+			}
+			if err != nil {
+				for _, write := range list[off:] {
+					write.err <- err
+				}
+				break
+			}
+
+			for _, write := range list[off : off+n] {
+				write.err <- nil
+			}
+
+			off += n
+		}
+	}
+}
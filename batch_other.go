@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package newdns
+
+import "net"
+
+func newBatchConn(conn net.PacketConn, _ int) net.PacketConn {
+	return conn
+}
@@ -0,0 +1,189 @@
+package newdns
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+var benchAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+
+type benchWriter struct {
+	n int
+}
+
+func (w *benchWriter) LocalAddr() net.Addr         { return benchAddr }
+func (w *benchWriter) RemoteAddr() net.Addr        { return benchAddr }
+func (w *benchWriter) WriteMsg(msg *dns.Msg) error { return nil }
+func (w *benchWriter) Write(data []byte) (int, error) {
+	w.n += len(data)
+	return len(data), nil
+}
+func (w *benchWriter) Close() error        { return nil }
+func (w *benchWriter) TsigStatus() error   { return nil }
+func (w *benchWriter) TsigTimersOnly(bool) {}
+func (w *benchWriter) Hijack()             {}
+
+func benchServer() *Server {
+	sets := map[string][]Set{
+		"a": {
+			{
+				Name: "a.example.com.",
+				Type: A,
+				Records: []Record{
+					{Address: "1.2.3.4"},
+					{Address: "5.6.7.8"},
+				},
+			},
+		},
+		"c1": {
+			{
+				Name: "c1.example.com.",
+				Type: CNAME,
+				Records: []Record{
+					{Address: "c2.example.com."},
+				},
+			},
+		},
+		"c2": {
+			{
+				Name: "c2.example.com.",
+				Type: CNAME,
+				Records: []Record{
+					{Address: "a.example.com."},
+				},
+			},
+		},
+	}
+
+	zone := testZone(func(ctx context.Context, name string) ([]Set, error) {
+		return sets[name], nil
+	})
+
+	server := NewServer(Config{
+		Handler: testHandler(zone),
+	})
+
+	// write raw messages like to listener writers
+	server.raw.Store(reflect.TypeOf(&benchWriter{}))
+
+	return server
+}
+
+func BenchmarkServeDNS(b *testing.B) {
+	server := benchServer()
+
+	for _, item := range []struct {
+		name  string
+		qname string
+	}{
+		{name: "A", qname: "a.example.com."},
+		{name: "CNAMEChain", qname: "c1.example.com."},
+		{name: "NXDOMAIN", qname: "missing.example.com."},
+	} {
+		b.Run(item.name, func(b *testing.B) {
+			req := new(dns.Msg)
+			req.SetQuestion(item.qname, dns.TypeA)
+			w := &benchWriter{}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				server.ServeDNS(w, req)
+			}
+		})
+	}
+}
+
+func TestServeDNSAllocs(t *testing.T) {
+	server := benchServer()
+
+	for _, item := range []struct {
+		qname  string
+		allocs float64
+	}{
+		{qname: "a.example.com.", allocs: 45},
+		{qname: "c1.example.com.", allocs: 85},
+		{qname: "missing.example.com.", allocs: 36},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(item.qname, dns.TypeA)
+		w := &benchWriter{}
+
+		server.ServeDNS(w, req)
+		assert.True(t, w.n > 0, item.qname)
+
+		allocs := testing.AllocsPerRun(100, func() {
+			server.ServeDNS(w, req)
+		})
+		assert.True(t, allocs <= item.allocs, "%s: %f", item.qname, allocs)
+	}
+}
+
+func TestConvertAllocs(t *testing.T) {
+	zone := &Zone{Name: "example.com."}
+	list := make([]dns.RR, 0, 8)
+
+	for _, set := range []Set{
+		{
+			Name: "a.example.com.",
+			Type: A,
+			Records: []Record{
+				{Address: "1.2.3.4"},
+				{Address: "5.6.7.8"},
+			},
+		},
+		{
+			Name: "a.example.com.",
+			Type: CNAME,
+			Records: []Record{
+				{Address: "b.example.com."},
+			},
+		},
+	} {
+		var expected float64 = 1
+		if set.Type == A {
+			expected = 2
+		}
+
+		allocs := testing.AllocsPerRun(100, func() {
+			list = convertSet(list[:0], "a.example.com.", zone, set)
+		})
+		assert.Equal(t, expected, allocs, set.Type)
+		assert.Len(t, list, len(set.Records))
+	}
+}
+
+func TestParseIPv4(t *testing.T) {
+	for _, item := range []struct {
+		addr string
+		ok   bool
+	}{
+		{"1.2.3.4", true},
+		{"255.255.255.255", true},
+		{"0.0.0.0", true},
+		{"256.1.1.1", false},
+		{"1.2.3", false},
+		{"1.2.3.4.5", false},
+		{"1..3.4", false},
+		{"1.2.3.4.", false},
+		{"1111.2.3.4", false},
+		{"01.2.3.4", false},
+		{"1.2.3.00", false},
+		{"10.20.30.40", true},
+		{"::1", false},
+		{"", false},
+	} {
+		ip := make(net.IP, 4)
+		ok := parseIPv4(ip, item.addr)
+		assert.Equal(t, item.ok, ok, item.addr)
+		if ok {
+			assert.Equal(t, net.ParseIP(item.addr).To4(), ip, item.addr)
+		}
+	}
+}
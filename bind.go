@@ -0,0 +1,100 @@
+package newdns
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// BINDLogger returns a logger that writes one line per response in the query
+// log format of BIND to the provided writer and forwards all events to an
+// optional logger. A line looks like:
+//
+//	16-Oct-2026 12:00:00.000 client 192.0.2.1#53145 (www.example.com): query: www.example.com IN A -E(0)T NOERROR 1/1/0
+//
+// The flags are "+" or "-" for whether recursion was desired, "S" for signed
+// requests, "E(n)" for requests with EDNS, "T" for requests over TCP and "C"
+// for requests with the checking disabled bit. The line ends with the response
+// code and the number of answer, authority and additional records.
+func BINDLogger(w io.Writer, next Logger) Logger {
+	var mutex sync.Mutex
+	return LoggerFunc(func(entry Entry) {
+		// forward event
+		if next != nil {
+			next.Log(entry)
+		}
+
+		// check event
+		if entry.Event != Response || entry.Msg == nil || entry.Info == nil {
+			return
+		}
+
+		// format line
+		line := formatBIND(time.Now(), entry.Msg, entry.Info)
+
+		// write line
+		mutex.Lock()
+		_, _ = io.WriteString(w, line)
+		mutex.Unlock()
+	})
+}
+
+func formatBIND(now time.Time, msg *dns.Msg, info *EventInfo) string {
+	// get client
+	client := "-"
+	switch addr := info.Remote.(type) {
+	case *net.UDPAddr:
+		client = addr.IP.String() + "#" + strconv.Itoa(addr.Port)
+	case *net.TCPAddr:
+		client = addr.IP.String() + "#" + strconv.Itoa(addr.Port)
+	case nil:
+	default:
+		client = addr.String()
+	}
+
+	// get name
+	name := info.Question.Name
+	if name != "." {
+		name = strings.TrimSuffix(name, ".")
+	}
+
+	// get flags
+	var flags strings.Builder
+	if msg.RecursionDesired {
+		flags.WriteByte('+')
+	} else {
+		flags.WriteByte('-')
+	}
+	if msg.IsTsig() != nil {
+		flags.WriteByte('S')
+	}
+	if opt := msg.IsEdns0(); opt != nil {
+		fmt.Fprintf(&flags, "E(%d)", opt.Version())
+	}
+	if info.Transport == "tcp" {
+		flags.WriteByte('T')
+	}
+	if msg.CheckingDisabled {
+		flags.WriteByte('C')
+	}
+
+	// get additional count
+	extra := len(msg.Extra)
+	if msg.IsEdns0() != nil {
+		extra--
+	}
+	if msg.IsTsig() != nil {
+		extra--
+	}
+
+	return fmt.Sprintf("%s client %s (%s): query: %s %s %s %s %s %d/%d/%d\n",
+		now.Format("02-Jan-2006 15:04:05.000"), client, name, name,
+		dns.ClassToString[info.Question.Qclass], dns.TypeToString[info.Question.Qtype],
+		flags.String(), dns.RcodeToString[msg.Rcode], len(msg.Answer), len(msg.Ns), extra)
+}
@@ -0,0 +1,72 @@
+package newdns
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatBIND(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	req.RecursionDesired = false
+
+	res := new(dns.Msg)
+	res.SetReply(req)
+	res.SetEdns0(1232, false)
+	res.Answer = append(res.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.ParseIP("1.2.3.4"),
+	})
+
+	info := &EventInfo{
+		Remote:    &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53145},
+		Transport: "tcp",
+		Question:  req.Question[0],
+	}
+
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	line := formatBIND(now, res, info)
+	assert.Equal(t, "16-Oct-2026 12:00:00.000 client 192.0.2.1#53145 (www.example.com): query: www.example.com IN A -E(0)T NOERROR 1/0/0\n", line)
+
+	res.RecursionDesired = true
+	res.Rcode = dns.RcodeNameError
+	res.Answer = nil
+	res.Extra = nil
+	info.Transport = "udp"
+	info.Remote = &net.UDPAddr{IP: net.ParseIP("::1"), Port: 1234}
+	line = formatBIND(now, res, info)
+	assert.Equal(t, "16-Oct-2026 12:00:00.000 client ::1#1234 (www.example.com): query: www.example.com IN A + NXDOMAIN 0/0/0\n", line)
+}
+
+func TestBINDLogger(t *testing.T) {
+	var buf bytes.Buffer
+	var events []Event
+	logger := BINDLogger(&buf, LoggerFunc(func(entry Entry) {
+		events = append(events, entry.Event)
+	}))
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeNS)
+
+	res := new(dns.Msg)
+	res.SetReply(req)
+
+	info := &EventInfo{
+		Transport: "udp",
+		Question:  req.Question[0],
+	}
+
+	logger.Log(Entry{Event: Request, Msg: req, Info: info})
+	logger.Log(Entry{Event: Response, Msg: res, Info: info})
+	logger.Log(Entry{Event: Finish, Info: info})
+
+	assert.Equal(t, []Event{Request, Response, Finish}, events)
+	assert.Equal(t, 1, strings.Count(buf.String(), "\n"))
+	assert.Contains(t, buf.String(), "client - (example.com): query: example.com IN NS + NOERROR 0/0/0")
+}
@@ -0,0 +1,189 @@
+package newdns
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// breakerFailures is the default number of consecutive transport errors after
+// which the circuit of an upstream server is opened.
+const breakerFailures = 5
+
+// breakerTimeout is the default duration for which an upstream server is
+// skipped after its circuit has been opened.
+const breakerTimeout = 10 * time.Second
+
+// breaker is a circuit breaker that temporarily skips an upstream server
+// after sustained failures. After the timeout a single trial exchange is
+// allowed which closes the circuit if it succeeds.
+type breaker struct {
+	max      int
+	timeout  time.Duration
+	mutex    sync.Mutex
+	failures int
+	open     bool
+	until    time.Time
+	trial    bool
+}
+
+// breakers holds the circuit breakers of the upstream servers of a proxy.
+type breakers struct {
+	failures int
+	timeout  time.Duration
+	mutex    sync.Mutex
+	list     map[string]*breaker
+}
+
+func newBreakers(failures int, timeout time.Duration) *breakers {
+	// set default failures
+	if failures <= 0 {
+		failures = breakerFailures
+	}
+
+	// set default timeout
+	if timeout <= 0 {
+		timeout = breakerTimeout
+	}
+
+	return &breakers{
+		failures: failures,
+		timeout:  timeout,
+		list:     map[string]*breaker{},
+	}
+}
+
+func (b *breakers) get(addr string) *breaker {
+	// acquire mutex
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// get or create breaker
+	br, ok := b.list[addr]
+	if !ok {
+		br = newBreaker(b.failures, b.timeout)
+		b.list[addr] = br
+	}
+
+	return br
+}
+
+func newBreaker(failures int, timeout time.Duration) *breaker {
+	return &breaker{
+		max:     failures,
+		timeout: timeout,
+	}
+}
+
+func (b *breaker) healthy() bool {
+	// acquire mutex
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return !b.open
+}
+
+func (b *breaker) allow(now time.Time) bool {
+	// acquire mutex
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// allow if closed
+	if !b.open {
+		return true
+	}
+
+	// allow a single trial after the timeout
+	if !b.trial && !now.Before(b.until) {
+		b.trial = true
+		return true
+	}
+
+	return false
+}
+
+func (b *breaker) record(failed bool, now time.Time) (opened bool, closed bool) {
+	// acquire mutex
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// handle success
+	if !failed {
+		closed = b.open
+		b.failures = 0
+		b.open = false
+		b.trial = false
+		return false, closed
+	}
+
+	// count failure
+	b.failures++
+
+	// reopen after failed trial or open after sustained failures
+	if b.trial || (!b.open && b.failures >= b.max) {
+		opened = !b.open
+		b.open = true
+		b.trial = false
+		b.until = now.Add(b.timeout)
+	}
+
+	return opened, false
+}
+
+func forward(ctx context.Context, req *dns.Msg, addr string, b *breaker, config *tls.Config, logger Logger) (*dns.Msg, error) {
+	// check circuit
+	if !b.allow(time.Now()) {
+		return nil, fmt.Errorf("upstream circuit open: %s", addr)
+	}
+
+	return observe(ctx, req, addr, b, config, logger)
+}
+
+// observe exchanges the message with the upstream server and records the
+// result with the breaker regardless of the state of its circuit.
+func observe(ctx context.Context, req *dns.Msg, addr string, b *breaker, config *tls.Config, logger Logger) (*dns.Msg, error) {
+	// exchange message
+	start := time.Now()
+	rs, err := exchange(ctx, req, addr, config)
+	rtt := time.Since(start)
+
+	// ignore cancelled exchanges
+	if err != nil && ctx.Err() == context.Canceled {
+		b.release()
+		return nil, err
+	}
+
+	// log exchange
+	log(logger, UpstreamExchange, rs, err, "", Field{Key: "upstream", Value: addr}, Field{Key: "rtt", Value: rtt})
+
+	// record transport errors, error responses do not indicate a broken
+	// upstream server
+	b.report(err != nil, addr, logger)
+
+	return rs, err
+}
+
+func (b *breaker) report(failed bool, addr string, logger Logger) {
+	// record result
+	opened, closed := b.record(failed, time.Now())
+
+	// log state changes
+	if opened {
+		log(logger, UpstreamDown, nil, nil, "circuit opened", Field{Key: "upstream", Value: addr})
+	} else if closed {
+		log(logger, UpstreamUp, nil, nil, "circuit closed", Field{Key: "upstream", Value: addr})
+	}
+}
+
+func (b *breaker) release() {
+	// acquire mutex
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// allow another trial
+	b.trial = false
+}
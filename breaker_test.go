@@ -0,0 +1,96 @@
+package newdns
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreaker(t *testing.T) {
+	b := newBreaker(breakerFailures, breakerTimeout)
+	now := time.Now()
+
+	for i := 0; i < breakerFailures-1; i++ {
+		assert.True(t, b.allow(now))
+		opened, closed := b.record(true, now)
+		assert.False(t, opened)
+		assert.False(t, closed)
+	}
+
+	assert.True(t, b.allow(now))
+	opened, closed := b.record(true, now)
+	assert.True(t, opened)
+	assert.False(t, closed)
+	assert.False(t, b.allow(now))
+
+	now = now.Add(breakerTimeout)
+	assert.True(t, b.allow(now))
+	assert.False(t, b.allow(now))
+	opened, closed = b.record(true, now)
+	assert.False(t, opened)
+	assert.False(t, closed)
+	assert.False(t, b.allow(now))
+
+	now = now.Add(breakerTimeout)
+	assert.True(t, b.allow(now))
+	opened, closed = b.record(false, now)
+	assert.False(t, opened)
+	assert.True(t, closed)
+	assert.True(t, b.allow(now))
+}
+
+func TestForwardCircuit(t *testing.T) {
+	var events []Event
+	logger := LoggerFunc(func(entry Entry) {
+		events = append(events, entry.Event)
+	})
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	addr := "127.0.0.1:53101"
+	breakers := newBreakers(0, 0)
+	for i := 0; i < breakerFailures+1; i++ {
+		_, err := forward(context.Background(), req, addr, breakers.get(addr), nil, logger)
+		assert.Error(t, err)
+	}
+
+	assert.False(t, breakers.get(addr).healthy())
+	assert.True(t, newBreakers(0, 0).get(addr).healthy())
+
+	assert.Equal(t, []Event{
+		UpstreamExchange,
+		UpstreamExchange,
+		UpstreamExchange,
+		UpstreamExchange,
+		UpstreamExchange,
+		UpstreamDown,
+	}, events)
+}
+
+func TestForwardErrorResponses(t *testing.T) {
+	upstream := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		res := new(dns.Msg)
+		res.SetRcode(req, dns.RcodeServerFailure)
+		_ = w.WriteMsg(res)
+	})
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	addr := "127.0.0.1:53102"
+	breaker := newBreakers(2, 0).get(addr)
+
+	serve(upstream, addr, func() {
+		for i := 0; i < 5; i++ {
+			ret, err := forward(context.Background(), req, addr, breaker, nil, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, dns.RcodeServerFailure, ret.Rcode)
+		}
+	})
+
+	assert.True(t, breaker.healthy())
+}
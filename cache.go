@@ -0,0 +1,189 @@
+package newdns
+
+import (
+	"sync"
+	"time"
+)
+
+type cacheEntry struct {
+	sets       []Set
+	ttl        time.Duration
+	expires    time.Time
+	hits       int
+	refreshing bool
+}
+
+type cacheKey struct {
+	zone string
+	name string
+}
+
+// Cache stores the sets returned by zone handlers until the lowest TTL of the
+// returned sets expires. Sets without a TTL use the default TTL of the zone
+// and empty results are stored for the minimum TTL of the zone. A cache may be
+// shared by multiple zones. Popular names may optionally be refreshed before
+// they expire.
+type Cache struct {
+	size      int
+	threshold float64
+	minHits   int
+	mutex     sync.Mutex
+	entries   map[cacheKey]cacheEntry
+}
+
+// NewCache creates and returns a new cache that stores up to the specified
+// number of names.
+func NewCache(size int) *Cache {
+	// check size
+	if size <= 0 {
+		size = 1
+	}
+
+	return &Cache{
+		size:    size,
+		entries: map[cacheKey]cacheEntry{},
+	}
+}
+
+// SetPrefetch enables the refreshing of popular names before they expire.
+// A name is refreshed in the background when it is requested within the
+// specified fraction of its TTL before the expiry, e.g. 0.1 for the last ten
+// percent, and has been requested at least the specified number of times since
+// it has been cached. Clients are served the cached sets meanwhile.
+func (c *Cache) SetPrefetch(threshold float64, hits int) {
+	// acquire mutex
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// set config
+	c.threshold = threshold
+	c.minHits = hits
+}
+
+// Purge will remove all cached names that belong to the specified zone. All
+// names are removed if the zone is empty.
+func (c *Cache) Purge(zone string) {
+	// acquire mutex
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// remove entries
+	for key := range c.entries {
+		if zone == "" || key.zone == zone {
+			delete(c.entries, key)
+		}
+	}
+}
+
+func (c *Cache) get(zone, name string) ([]Set, bool, time.Time) {
+	// check cache
+	if c == nil {
+		return nil, false, time.Time{}
+	}
+
+	// get time
+	now := time.Now()
+
+	// acquire mutex
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// get entry
+	key := cacheKey{zone: zone, name: name}
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false, time.Time{}
+	}
+
+	// check expiry
+	if !now.Before(entry.expires) {
+		delete(c.entries, key)
+		return nil, false, time.Time{}
+	}
+
+	// count hit
+	entry.hits++
+
+	// check prefetch
+	var prefetch time.Time
+	if c.threshold > 0 && !entry.refreshing && entry.hits >= c.minHits {
+		window := time.Duration(float64(entry.ttl) * c.threshold)
+		if entry.expires.Sub(now) <= window {
+			entry.refreshing = true
+			prefetch = entry.expires
+		}
+	}
+
+	// update entry
+	c.entries[key] = entry
+
+	return entry.sets, true, prefetch
+}
+
+func (c *Cache) put(zone *Zone, name string, sets []Set) {
+	// check cache
+	if c == nil {
+		return
+	}
+
+	// get lowest TTL
+	ttl := zone.MinTTL
+	for i, set := range sets {
+		if set.TTL == 0 {
+			set.TTL = zone.defaultTTL(set.Type)
+		}
+		if i == 0 || set.TTL < ttl {
+			ttl = set.TTL
+		}
+	}
+
+	// check TTL
+	if ttl <= 0 {
+		return
+	}
+
+	// get time
+	now := time.Now()
+
+	// acquire mutex
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// remove expired entries if full
+	if len(c.entries) >= c.size {
+		for key, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+	}
+
+	// remove arbitrary entries if still full
+	for key := range c.entries {
+		if len(c.entries) < c.size {
+			break
+		}
+		delete(c.entries, key)
+	}
+
+	// add entry
+	c.entries[cacheKey{zone: zone.Name, name: name}] = cacheEntry{
+		sets:    sets,
+		ttl:     ttl,
+		expires: now.Add(ttl),
+	}
+}
+
+func (c *Cache) release(zone, name string) {
+	// acquire mutex
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// reset refreshing flag
+	key := cacheKey{zone: zone, name: name}
+	entry, ok := c.entries[key]
+	if ok {
+		entry.refreshing = false
+		c.entries[key] = entry
+	}
+}
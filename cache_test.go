@@ -0,0 +1,163 @@
+package newdns
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestZoneCache(t *testing.T) {
+	calls := map[string]int{}
+
+	zone := testZone(func(ctx context.Context, name string) ([]Set, error) {
+		calls[name]++
+
+		switch name {
+		case "foo":
+			return []Set{
+				{
+					Name: "foo.example.com.",
+					Type: A,
+					Records: []Record{
+						{Address: "1.2.3.4"},
+					},
+					TTL: time.Hour,
+				},
+			}, nil
+		case "bar":
+			return []Set{
+				{
+					Name: "bar.example.com.",
+					Type: A,
+					Records: []Record{
+						{Address: "1.2.3.4"},
+					},
+					TTL: 10 * time.Millisecond,
+				},
+			}, nil
+		}
+
+		return nil, nil
+	})
+	zone.MinTTL = time.Minute
+	zone.Cache = NewCache(10)
+
+	for i := 0; i < 3; i++ {
+		res, _, err := zone.Lookup(context.Background(), "foo.example.com.", A)
+		assert.NoError(t, err)
+		assert.Len(t, res, 1)
+
+		res, _, err = zone.Lookup(context.Background(), "bar.example.com.", A)
+		assert.NoError(t, err)
+		assert.Len(t, res, 1)
+
+		res, _, err = zone.Lookup(context.Background(), "baz.example.com.", A)
+		assert.NoError(t, err)
+		assert.Len(t, res, 0)
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	assert.Equal(t, map[string]int{
+		"foo": 1,
+		"bar": 3,
+		"baz": 1,
+	}, calls)
+
+	zone.Cache.Purge("example.com.")
+
+	_, _, err := zone.Lookup(context.Background(), "foo.example.com.", A)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls["foo"])
+}
+
+func TestCacheSize(t *testing.T) {
+	cache := NewCache(2)
+	zone := &Zone{Name: "example.com."}
+
+	set := []Set{{Name: "a.example.com.", Type: A, TTL: time.Hour}}
+	cache.put(zone, "a.example.com.", set)
+	cache.put(zone, "b.example.com.", set)
+	cache.put(zone, "c.example.com.", set)
+	assert.Len(t, cache.entries, 2)
+
+	_, ok, _ := cache.get("example.com.", "c.example.com.")
+	assert.True(t, ok)
+
+	_, ok, _ = cache.get("sub.example.com.", "c.example.com.")
+	assert.False(t, ok)
+
+	cache.put(zone, "d.example.com.", nil)
+	assert.Len(t, cache.entries, 2)
+
+	cache.Purge("")
+	assert.Len(t, cache.entries, 0)
+
+	zone.MinTTL = time.Hour
+	zone.DefaultTTL = time.Minute
+	cache.put(zone, "e.example.com.", []Set{{Name: "e.example.com.", Type: A}})
+	assert.Equal(t, time.Minute, cache.entries[cacheKey{zone: "example.com.", name: "e.example.com."}].ttl)
+
+	var nilCache *Cache
+	_, ok, _ = nilCache.get("example.com.", "a.example.com.")
+	assert.False(t, ok)
+}
+
+func TestZoneCachePrefetch(t *testing.T) {
+	var mutex sync.Mutex
+	var calls int
+	var deadlines int
+
+	zone := testZone(func(ctx context.Context, name string) ([]Set, error) {
+		mutex.Lock()
+		calls++
+		if _, ok := ctx.Deadline(); ok {
+			deadlines++
+		}
+		mutex.Unlock()
+
+		return []Set{
+			{
+				Name: "foo.example.com.",
+				Type: A,
+				Records: []Record{
+					{Address: "1.2.3.4"},
+				},
+				TTL: time.Second,
+			},
+		}, nil
+	})
+	zone.Cache = NewCache(10)
+	zone.Cache.SetPrefetch(0.5, 2)
+
+	lookup := func() {
+		res, _, err := zone.Lookup(context.Background(), "foo.example.com.", A)
+		assert.NoError(t, err)
+		assert.Len(t, res, 1)
+	}
+
+	// populate and hit once
+	lookup()
+	lookup()
+
+	// wait for threshold and hit again
+	time.Sleep(600 * time.Millisecond)
+	lookup()
+	time.Sleep(10 * time.Millisecond)
+
+	mutex.Lock()
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, 1, deadlines)
+	mutex.Unlock()
+
+	// entry has been refreshed
+	time.Sleep(500 * time.Millisecond)
+	lookup()
+
+	mutex.Lock()
+	assert.Equal(t, 2, calls)
+	mutex.Unlock()
+}
@@ -0,0 +1,85 @@
+package newdns
+
+import (
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// CaptureFunc is called with the raw messages received from and sent to
+// clients. Inbound messages are captured before they are parsed and outbound
+// messages after they have been packed. The data may be retained.
+type CaptureFunc func(inbound bool, remote net.Addr, data []byte)
+
+type captureReader struct {
+	dns.Reader
+	fn CaptureFunc
+}
+
+func (r *captureReader) ReadTCP(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	// read message
+	data, err := r.Reader.ReadTCP(conn, timeout)
+	if err == nil {
+		r.fn(true, conn.RemoteAddr(), copyBytes(data))
+	}
+
+	return data, err
+}
+
+func (r *captureReader) ReadUDP(conn *net.UDPConn, timeout time.Duration) ([]byte, *dns.SessionUDP, error) {
+	// read message
+	data, session, err := r.Reader.ReadUDP(conn, timeout)
+	if err == nil {
+		r.fn(true, session.RemoteAddr(), copyBytes(data))
+	}
+
+	return data, session, err
+}
+
+func (r *captureReader) ReadPacketConn(conn net.PacketConn, timeout time.Duration) ([]byte, net.Addr, error) {
+	// read message
+	data, addr, err := r.Reader.(dns.PacketConnReader).ReadPacketConn(conn, timeout)
+	if err == nil {
+		r.fn(true, addr, copyBytes(data))
+	}
+
+	return data, addr, err
+}
+
+type captureWriter struct {
+	dns.Writer
+	fn CaptureFunc
+}
+
+func (w *captureWriter) Write(data []byte) (int, error) {
+	// get remote address
+	var remote net.Addr
+	if rw, ok := w.Writer.(interface{ RemoteAddr() net.Addr }); ok {
+		remote = rw.RemoteAddr()
+	}
+
+	// capture message
+	w.fn(false, remote, copyBytes(data))
+
+	return w.Writer.Write(data)
+}
+
+// writeRaw captures and writes the packed message. Messages written using
+// Write bypass the decorated writer that captures messages written using
+// WriteMsg.
+func writeRaw(w dns.ResponseWriter, capture CaptureFunc, data []byte) error {
+	// capture message
+	if capture != nil {
+		capture(false, w.RemoteAddr(), copyBytes(data))
+	}
+
+	// write message
+	_, err := w.Write(data)
+
+	return err
+}
+
+func copyBytes(data []byte) []byte {
+	return append([]byte(nil), data...)
+}
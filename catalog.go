@@ -0,0 +1,129 @@
+package newdns
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// CatalogZone returns a zone that serves an RFC 9432 catalog zone listing the
+// member zones returned by the provided function. The provided zone is used as
+// a template for the SOA and transfer settings while the handler and lister
+// are replaced. If not set, the name servers default to "invalid." as
+// recommended by the RFC. The serial of the template must be increased
+// whenever the list of members changes.
+func CatalogZone(zone Zone, members func(ctx context.Context) ([]string, error)) (*Zone, error) {
+	// set default name servers
+	if zone.MasterNameServer == "" {
+		zone.MasterNameServer = "invalid."
+	}
+	if len(zone.AllNameServers) == 0 {
+		zone.AllNameServers = []string{zone.MasterNameServer}
+	}
+
+	// get sets
+	getSets := func(ctx context.Context) ([]Set, error) {
+		// get members
+		list, err := members(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		// prepare sets
+		sets := []Set{
+			{
+				Name: "version." + zone.Name,
+				Type: TXT,
+				Records: []Record{
+					{Data: []string{"2"}},
+				},
+			},
+		}
+
+		// normalize and sort members
+		normalized := make([]string, 0, len(list))
+		for _, member := range list {
+			normalized = append(normalized, NormalizeDomain(member, true, true, false))
+		}
+		sort.Strings(normalized)
+
+		// add members
+		for _, member := range normalized {
+			// check member
+			if !IsDomain(member, true) {
+				return nil, fmt.Errorf("invalid catalog member: %s", member)
+			}
+
+			// add set
+			sets = append(sets, Set{
+				Name: catalogID(member) + ".zones." + zone.Name,
+				Type: PTR,
+				Records: []Record{
+					{Address: member},
+				},
+			})
+		}
+
+		return sets, nil
+	}
+
+	// set handler
+	zone.Handler = func(ctx context.Context, name string) ([]Set, error) {
+		// get sets
+		sets, err := getSets(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		// get full name
+		full := zone.Name
+		if name != "" {
+			full = name + "." + zone.Name
+		}
+
+		// find sets
+		var result []Set
+		for _, set := range sets {
+			if set.Name == strings.ToLower(full) {
+				result = append(result, set)
+			}
+		}
+
+		return result, nil
+	}
+
+	// set lister
+	zone.Lister = func(ctx context.Context, fn func(Set) error) error {
+		// get sets
+		sets, err := getSets(ctx)
+		if err != nil {
+			return err
+		}
+
+		// yield sets
+		for _, set := range sets {
+			err = fn(set)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	// validate zone
+	err := zone.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &zone, nil
+}
+
+func catalogID(member string) string {
+	sum := sha1.Sum([]byte(member))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,60 @@
+package newdns
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCatalogZone(t *testing.T) {
+	zone, err := CatalogZone(Zone{
+		Name: "catalog.example.com.",
+	}, func(ctx context.Context) ([]string, error) {
+		return []string{"foo.com", "bar.com."}, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "invalid.", zone.MasterNameServer)
+	assert.Equal(t, []string{"invalid."}, zone.AllNameServers)
+
+	var sets []Set
+	err = zone.Lister(context.Background(), func(set Set) error {
+		sets = append(sets, set)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []Set{
+		{
+			Name: "version.catalog.example.com.",
+			Type: TXT,
+			Records: []Record{
+				{Data: []string{"2"}},
+			},
+		},
+		{
+			Name: catalogID("bar.com.") + ".zones.catalog.example.com.",
+			Type: PTR,
+			Records: []Record{
+				{Address: "bar.com."},
+			},
+		},
+		{
+			Name: catalogID("foo.com.") + ".zones.catalog.example.com.",
+			Type: PTR,
+			Records: []Record{
+				{Address: "foo.com."},
+			},
+		},
+	}, sets)
+
+	res, exists, err := zone.Lookup(context.Background(), catalogID("foo.com.")+".zones.catalog.example.com.", PTR)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.Len(t, res, 1)
+	assert.Equal(t, "foo.com.", res[0].Records[0].Address)
+
+	res, exists, err = zone.Lookup(context.Background(), "version.catalog.example.com.", TXT)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.Len(t, res, 1)
+}
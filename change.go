@@ -0,0 +1,17 @@
+package newdns
+
+// Change describes the changes that turned one version of a zone into the
+// next version.
+type Change struct {
+	// The serial of the zone before the change.
+	From uint32
+
+	// The serial of the zone after the change.
+	To uint32
+
+	// The sets or records that have been removed.
+	Removed []Set
+
+	// The sets or records that have been added.
+	Added []Set
+}
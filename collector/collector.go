@@ -0,0 +1,55 @@
+// Package collector provides a Prometheus collector for newdns metrics.
+package collector
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/256dpi/newdns"
+)
+
+// Collector exports the metrics collected by a newdns.Metrics logger as
+// Prometheus metrics.
+type Collector struct {
+	metrics *newdns.Metrics
+}
+
+// New creates and returns a new collector for the provided metrics.
+func New(metrics *newdns.Metrics) *Collector {
+	return &Collector{
+		metrics: metrics,
+	}
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, family := range c.metrics.Families() {
+		ch <- describe(family)
+	}
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	for _, family := range c.metrics.Families() {
+		// get description
+		desc := describe(family)
+
+		for _, metric := range family.Metrics {
+			switch family.Type {
+			case "histogram":
+				buckets := make(map[float64]uint64, len(metric.Buckets))
+				for _, bucket := range metric.Buckets {
+					buckets[bucket.Bound] = bucket.Count
+				}
+				ch <- prometheus.MustNewConstHistogram(desc, metric.Count, metric.Sum, buckets, metric.Values...)
+			case "summary":
+				ch <- prometheus.MustNewConstSummary(desc, metric.Count, metric.Sum, nil, metric.Values...)
+			default:
+				ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(metric.Value), metric.Values...)
+			}
+		}
+	}
+}
+
+func describe(family newdns.MetricFamily) *prometheus.Desc {
+	return prometheus.NewDesc(family.Name, family.Help, family.Labels, nil)
+}
@@ -0,0 +1,61 @@
+package collector
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/256dpi/newdns"
+)
+
+func TestCollector(t *testing.T) {
+	metrics := newdns.NewMetrics(nil, 0.01, 0.1)
+	metrics.Log(newdns.Entry{Event: newdns.Finish, Info: &newdns.EventInfo{
+		Remote:       &net.UDPAddr{},
+		Transport:    "udp",
+		Question:     dns.Question{Name: "example.com.", Qtype: dns.TypeA},
+		Zone:         "example.com.",
+		Rcode:        dns.RcodeSuccess,
+		ResponseSize: 100,
+		Elapsed:      50 * time.Millisecond,
+	}})
+
+	registry := prometheus.NewPedanticRegistry()
+	err := registry.Register(New(metrics))
+	assert.NoError(t, err)
+
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+
+	values := map[string]*dto{}
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			item := &dto{}
+			for _, label := range metric.Label {
+				item.labels = append(item.labels, label.GetName()+"="+label.GetValue())
+			}
+			if metric.Counter != nil {
+				item.value = metric.Counter.GetValue()
+			} else if metric.Histogram != nil {
+				item.value = float64(metric.Histogram.GetSampleCount())
+			}
+			values[family.GetName()] = item
+		}
+	}
+
+	assert.Equal(t, &dto{
+		labels: []string{"rcode=NOERROR", "type=A", "zone=example.com."},
+		value:  1,
+	}, values["newdns_queries_total"])
+	assert.Equal(t, &dto{value: 1}, values["newdns_query_duration_seconds"])
+	assert.Equal(t, &dto{value: 0}, values["newdns_backend_errors_total"])
+}
+
+type dto struct {
+	labels []string
+	value  float64
+}
@@ -0,0 +1,288 @@
+package newdns
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+type contextKey int
+
+const requestKey contextKey = iota
+
+type requestState struct {
+	mutex     sync.Mutex
+	ctx       context.Context
+	opt       *dns.OPT
+	options   []dns.EDNS0
+	tls       bool
+	response  []dns.EDNS0
+	udpLimit  int
+	info      *requestInfo
+	id        uint64
+	logger    Logger
+	cacheKey  *responseKey
+	cacheZone string
+	jitter    float64
+	minTTL    uint32
+	sets      map[string][]Set
+	authority []Set
+	extra     []Set
+}
+
+type baseContext struct {
+	ctx context.Context
+}
+
+func withRequestState(ctx context.Context, req *dns.Msg) (context.Context, *requestState) {
+	// prepare state
+	state := &requestState{}
+	if opt := req.IsEdns0(); opt != nil {
+		state.opt = opt
+		state.options = opt.Option
+	}
+
+	return context.WithValue(ctx, requestKey, state), state
+}
+
+func getRequestState(ctx context.Context) *requestState {
+	state, _ := ctx.Value(requestKey).(*requestState)
+	return state
+}
+
+func (s *requestState) take() []dns.EDNS0 {
+	// acquire mutex
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// get options
+	options := s.response
+	s.response = nil
+
+	return options
+}
+
+func (s *requestState) loaded(name string) ([]Set, bool) {
+	// check state
+	if s == nil {
+		return nil, false
+	}
+
+	// acquire mutex
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// get sets
+	sets, ok := s.sets[name]
+
+	return sets, ok
+}
+
+func (s *requestState) load(name string, sets []Set) {
+	// check state
+	if s == nil {
+		return
+	}
+
+	// acquire mutex
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// store sets
+	if s.sets == nil {
+		s.sets = map[string][]Set{}
+	}
+	s.sets[name] = sets
+}
+
+// RequestID returns the ID of the request that is served with the provided
+// context. The ID is unique per server and also included in all logging events
+// for the request. It returns zero if the context does not belong to a request.
+func RequestID(ctx context.Context) uint64 {
+	// get state
+	state := getRequestState(ctx)
+	if state == nil {
+		return 0
+	}
+
+	return state.id
+}
+
+// RequestOptions returns the EDNS options of the request that is served with
+// the provided context. It returns nil if the client did not use EDNS.
+func RequestOptions(ctx context.Context) []dns.EDNS0 {
+	// get state
+	state := getRequestState(ctx)
+	if state == nil {
+		return nil
+	}
+
+	return state.options
+}
+
+// AddResponseOption will add the EDNS option to the response of the request
+// that is served with the provided context. Options are dropped if the client
+// did not use EDNS.
+func AddResponseOption(ctx context.Context, option dns.EDNS0) {
+	// get state
+	state := getRequestState(ctx)
+	if state == nil {
+		return
+	}
+
+	// add option
+	state.mutex.Lock()
+	state.response = append(state.response, option)
+	state.mutex.Unlock()
+}
+
+type requestWriter struct {
+	dns.ResponseWriter
+	state *requestState
+}
+
+func requestStateOf(w dns.ResponseWriter) *requestState {
+	rw, _ := w.(*requestWriter)
+	if rw == nil {
+		return nil
+	}
+
+	return rw.state
+}
+
+func (w *requestWriter) WriteMsg(msg *dns.Msg) error {
+	// add response options
+	if opt := msg.IsEdns0(); opt != nil {
+		opt.Option = append(opt.Option, w.state.take()...)
+	}
+
+	return w.ResponseWriter.WriteMsg(msg)
+}
+
+// AddAuthority will add the sets to the authority section of the response of
+// the request that is served with the provided context. The sets must belong
+// to the zone and are validated and converted like answers. They are only
+// added to responses with answers and are removed after the additional records
+// if the response needs to be truncated. Their removal alone does not set the
+// truncated flag. Sets are not added if the zone handler results are served
+// from the zone cache.
+func AddAuthority(ctx context.Context, sets ...Set) {
+	// get state
+	state := getRequestState(ctx)
+	if state == nil {
+		return
+	}
+
+	// add sets
+	state.mutex.Lock()
+	state.authority = append(state.authority, sets...)
+	state.mutex.Unlock()
+}
+
+// AddAdditional will add the sets to the additional section of the response
+// of the request that is served with the provided context. See AddAuthority
+// for details.
+func AddAdditional(ctx context.Context, sets ...Set) {
+	// get state
+	state := getRequestState(ctx)
+	if state == nil {
+		return
+	}
+
+	// add sets
+	state.mutex.Lock()
+	state.extra = append(state.extra, sets...)
+	state.mutex.Unlock()
+}
+
+func (s *requestState) sections() ([]Set, []Set) {
+	// acquire mutex
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.authority, s.extra
+}
+
+// RequestInfo describes the request that is served with a context.
+type RequestInfo struct {
+	// The ID of the request, see RequestID.
+	ID uint64
+
+	// The address of the client.
+	Remote net.Addr
+
+	// The transport used by the client e.g. "udp", "tcp", "tcp-tls" or "unix".
+	Transport string
+
+	// The question of the request.
+	Question dns.Question
+
+	// Whether the client uses EDNS.
+	EDNS bool
+
+	// The UDP buffer size announced by the client using EDNS.
+	UDPSize uint16
+
+	// Whether the client requested DNSSEC records using the DO bit.
+	DNSSEC bool
+
+	// The EDNS options of the request, see RequestOptions.
+	Options []dns.EDNS0
+
+	// The client subnet provided using the EDNS Client Subnet option (RFC
+	// 7871), if available.
+	ClientSubnet *net.IPNet
+}
+
+// GetRequestInfo returns a description of the request that is served with the
+// provided context. It returns nil if the context does not belong to a
+// request.
+func GetRequestInfo(ctx context.Context) *RequestInfo {
+	// get state
+	state := getRequestState(ctx)
+	if state == nil || state.info == nil {
+		return nil
+	}
+
+	// prepare info
+	info := &RequestInfo{
+		ID:        state.id,
+		Remote:    state.info.Remote,
+		Transport: state.info.Transport,
+		Question:  state.info.Question,
+		Options:   state.options,
+	}
+
+	// set TLS transport
+	if state.tls {
+		info.Transport = "tcp-tls"
+	}
+
+	// check EDNS
+	if state.opt == nil {
+		return info
+	}
+
+	// set EDNS details
+	info.EDNS = true
+	info.UDPSize = state.opt.UDPSize()
+	info.DNSSEC = state.opt.Do()
+
+	// get client subnet
+	for _, option := range state.options {
+		if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+			bits := 32
+			if subnet.Family == 2 {
+				bits = 128
+			}
+			info.ClientSubnet = &net.IPNet{
+				IP:   subnet.Address,
+				Mask: net.CIDRMask(int(subnet.SourceNetmask), bits),
+			}
+		}
+	}
+
+	return info
+}
@@ -0,0 +1,391 @@
+// Package control provides a gRPC service to manage the zones of a newdns
+// admin service.
+//
+// The service is defined in control.proto and the messages and stubs are
+// generated using protoc-gen-go and protoc-gen-go-grpc. Standard gRPC clients
+// and tools can use the definition to talk to the service. Go clients may use
+// NewControlClient together with Token to authenticate calls.
+package control
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative control.proto
+
+import (
+	"context"
+	"errors"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/256dpi/newdns"
+	"github.com/256dpi/newdns/store"
+)
+
+// Service implements the control service using an admin service.
+type Service struct {
+	UnimplementedControlServer
+
+	admin *store.Admin
+}
+
+// NewService creates and returns a new control service. The API keys of the
+// admin service are required in the "authorization" metadata using the
+// "Bearer" scheme. The status is reported using the server configured with
+// the admin service.
+func NewService(admin *store.Admin) *Service {
+	return &Service{
+		admin: admin,
+	}
+}
+
+// Register will register the service with the provided gRPC server.
+func (s *Service) Register(server grpc.ServiceRegistrar) {
+	RegisterControlServer(server, s)
+}
+
+// ListZones implements the ControlServer interface.
+func (s *Service) ListZones(ctx context.Context, _ *ListZonesRequest) (*ListZonesResponse, error) {
+	// check authorization
+	err := s.authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// convert zones
+	res := &ListZonesResponse{}
+	for _, info := range s.admin.Zones() {
+		res.Zones = append(res.Zones, toZone(info))
+	}
+
+	return res, nil
+}
+
+// GetZone implements the ControlServer interface.
+func (s *Service) GetZone(ctx context.Context, req *GetZoneRequest) (*Zone, error) {
+	// check authorization
+	err := s.authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// get zone
+	info, err := s.admin.Zone(req.Zone)
+	if err != nil {
+		return nil, convertError(err)
+	}
+
+	return toZone(info), nil
+}
+
+// CreateZone implements the ControlServer interface.
+func (s *Service) CreateZone(ctx context.Context, req *CreateZoneRequest) (*Zone, error) {
+	// check authorization
+	err := s.authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// check zone
+	if req.Zone == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing zone")
+	}
+
+	// create zone
+	info, err := s.admin.CreateZone(store.ZoneInfo{
+		Name:             req.Zone.Name,
+		MasterNameServer: req.Zone.MasterNameServer,
+		AllNameServers:   req.Zone.AllNameServers,
+		AdminEmail:       req.Zone.AdminEmail,
+	})
+	if err != nil {
+		return nil, convertError(err)
+	}
+
+	return toZone(info), nil
+}
+
+// DeleteZone implements the ControlServer interface.
+func (s *Service) DeleteZone(ctx context.Context, req *DeleteZoneRequest) (*DeleteZoneResponse, error) {
+	// check authorization
+	err := s.authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// delete zone
+	err = s.admin.DeleteZone(req.Zone)
+	if err != nil {
+		return nil, convertError(err)
+	}
+
+	return &DeleteZoneResponse{}, nil
+}
+
+// ListSets implements the ControlServer interface.
+func (s *Service) ListSets(ctx context.Context, req *ListSetsRequest) (*ListSetsResponse, error) {
+	// check authorization
+	err := s.authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// list sets
+	sets, err := s.admin.Sets(ctx, req.Zone, req.Search)
+	if err != nil {
+		return nil, convertError(err)
+	}
+
+	// convert sets
+	res := &ListSetsResponse{}
+	for _, def := range sets {
+		res.Sets = append(res.Sets, toSet(def))
+	}
+
+	return res, nil
+}
+
+// GetSet implements the ControlServer interface.
+func (s *Service) GetSet(ctx context.Context, req *GetSetRequest) (*Set, error) {
+	// check authorization
+	err := s.authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// get set
+	def, err := s.admin.Set(ctx, req.Zone, req.Name, req.Type)
+	if err != nil {
+		return nil, convertError(err)
+	}
+
+	return toSet(def), nil
+}
+
+// PutSet implements the ControlServer interface.
+func (s *Service) PutSet(ctx context.Context, req *PutSetRequest) (*Set, error) {
+	// check authorization
+	err := s.authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// check set
+	if req.Set == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing set")
+	}
+
+	// put set
+	def, err := s.admin.PutSet(ctx, req.Zone, fromSet(req.Set))
+	if err != nil {
+		return nil, convertError(err)
+	}
+
+	return toSet(def), nil
+}
+
+// DeleteSet implements the ControlServer interface.
+func (s *Service) DeleteSet(ctx context.Context, req *DeleteSetRequest) (*DeleteSetResponse, error) {
+	// check authorization
+	err := s.authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// delete set
+	err = s.admin.DeleteSet(ctx, req.Zone, req.Name, req.Type)
+	if err != nil {
+		return nil, convertError(err)
+	}
+
+	return &DeleteSetResponse{}, nil
+}
+
+// AddRecord implements the ControlServer interface.
+func (s *Service) AddRecord(ctx context.Context, req *AddRecordRequest) (*AddRecordResponse, error) {
+	// check authorization
+	err := s.authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// check record
+	if req.Record == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing record")
+	}
+
+	// add record
+	err = s.admin.AddRecord(ctx, req.Zone, req.Name, req.Type, fromRecord(req.Record))
+	if err != nil {
+		return nil, convertError(err)
+	}
+
+	return &AddRecordResponse{}, nil
+}
+
+// DeleteRecord implements the ControlServer interface.
+func (s *Service) DeleteRecord(ctx context.Context, req *DeleteRecordRequest) (*DeleteRecordResponse, error) {
+	// check authorization
+	err := s.authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// check record
+	if req.Record == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing record")
+	}
+
+	// delete record
+	err = s.admin.DeleteRecord(ctx, req.Zone, req.Name, req.Type, fromRecord(req.Record))
+	if err != nil {
+		return nil, convertError(err)
+	}
+
+	return &DeleteRecordResponse{}, nil
+}
+
+// Status implements the ControlServer interface.
+func (s *Service) Status(ctx context.Context, _ *StatusRequest) (*StatusResponse, error) {
+	// check authorization
+	err := s.authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// get status
+	st := s.admin.Status()
+
+	return &StatusResponse{
+		Zones:   uint32(st.Zones),
+		Queries: st.Queries,
+		Rcodes:  st.Rcodes,
+		Types:   st.Types,
+	}, nil
+}
+
+// Watch implements the ControlServer interface.
+func (s *Service) Watch(_ *WatchRequest, stream grpc.ServerStreamingServer[Change]) error {
+	// check authorization
+	err := s.authorize(stream.Context())
+	if err != nil {
+		return err
+	}
+
+	// watch changes
+	watcher := s.admin.Watch()
+	defer watcher.Close()
+
+	// send header to signal the subscription
+	err = stream.SendHeader(nil)
+	if err != nil {
+		return err
+	}
+
+	for {
+		// get change
+		change, err := watcher.Next(stream.Context())
+		if errors.Is(err, store.ErrWatcherBehind) {
+			return status.Error(codes.ResourceExhausted, err.Error())
+		} else if err != nil {
+			return status.FromContextError(err).Err()
+		}
+
+		// send change
+		err = stream.Send(&Change{
+			Zone:    change.Zone,
+			Name:    change.Name,
+			Type:    change.Type,
+			Deleted: change.Deleted,
+			Serial:  change.Serial,
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Service) authorize(ctx context.Context) error {
+	// get metadata
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	// check keys
+	for _, value := range md.Get("authorization") {
+		if s.admin.Authorized(value) {
+			return nil
+		}
+	}
+
+	return status.Error(codes.Unauthenticated, "invalid API key")
+}
+
+func convertError(err error) error {
+	switch {
+	case errors.Is(err, store.ErrUnknownZone) || errors.Is(err, store.ErrUnknownSet):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, store.ErrZoneExists):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, newdns.ErrValidation):
+		return status.Error(codes.InvalidArgument, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+func toZone(info store.ZoneInfo) *Zone {
+	return &Zone{
+		Name:             info.Name,
+		MasterNameServer: info.MasterNameServer,
+		AllNameServers:   info.AllNameServers,
+		AdminEmail:       info.AdminEmail,
+		Serial:           info.Serial,
+	}
+}
+
+func toSet(def newdns.SetDefinition) *Set {
+	// prepare set
+	set := &Set{
+		Name: def.Name,
+		Type: def.Type,
+		Ttl:  def.TTL,
+	}
+
+	// add records
+	for _, record := range def.Records {
+		set.Records = append(set.Records, &Record{
+			Address:  record.Address,
+			Priority: int32(record.Priority),
+			Weight:   int32(record.Weight),
+			Port:     int32(record.Port),
+			Data:     record.Data,
+		})
+	}
+
+	return set
+}
+
+func fromSet(set *Set) newdns.SetDefinition {
+	// prepare definition
+	def := newdns.SetDefinition{
+		Name: set.Name,
+		Type: set.Type,
+		TTL:  set.Ttl,
+	}
+
+	// add records
+	for _, record := range set.Records {
+		def.Records = append(def.Records, fromRecord(record))
+	}
+
+	return def
+}
+
+func fromRecord(record *Record) newdns.RecordDefinition {
+	return newdns.RecordDefinition{
+		Address:  record.Address,
+		Priority: int(record.Priority),
+		Weight:   int(record.Weight),
+		Port:     int(record.Port),
+		Data:     record.Data,
+	}
+}
@@ -0,0 +1,186 @@
+package control
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"github.com/256dpi/newdns"
+	"github.com/256dpi/newdns/store"
+)
+
+func TestService(t *testing.T) {
+	mux := newdns.NewZoneMux()
+	admin := store.NewAdmin(store.AdminConfig{
+		Mux:  mux,
+		Keys: []string{"secret"},
+	})
+
+	server := grpc.NewServer()
+	NewService(admin).Register(server)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	defer server.Stop()
+
+	dial := func(key string) ControlClient {
+		conn, err := grpc.NewClient(listener.Addr().String(),
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithPerRPCCredentials(Token(key)),
+		)
+		assert.NoError(t, err)
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+		return NewControlClient(conn)
+	}
+
+	ctx := context.Background()
+
+	_, err = dial("foo").ListZones(ctx, &ListZonesRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	client := dial("secret")
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := client.Watch(watchCtx, &WatchRequest{})
+	assert.NoError(t, err)
+	_, err = stream.Header()
+	assert.NoError(t, err)
+
+	zone, err := client.CreateZone(ctx, &CreateZoneRequest{
+		Zone: &Zone{
+			Name:           "example.com.",
+			AllNameServers: []string{"ns1.example.com."},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "example.com.", zone.Name)
+	assert.Equal(t, uint32(1), zone.Serial)
+
+	_, err = client.CreateZone(ctx, &CreateZoneRequest{
+		Zone: &Zone{
+			Name:           "example.com.",
+			AllNameServers: []string{"ns1.example.com."},
+		},
+	})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	zones, err := client.ListZones(ctx, &ListZonesRequest{})
+	assert.NoError(t, err)
+	assert.Len(t, zones.Zones, 1)
+
+	set, err := client.PutSet(ctx, &PutSetRequest{
+		Zone: "example.com.",
+		Set: &Set{
+			Name:    "www",
+			Type:    "A",
+			Records: []*Record{{Address: "1.2.3.4"}},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "www", set.Name)
+
+	_, err = client.AddRecord(ctx, &AddRecordRequest{
+		Zone:   "example.com.",
+		Name:   "www",
+		Type:   "A",
+		Record: &Record{Address: "1.2.3.5"},
+	})
+	assert.NoError(t, err)
+
+	set, err = client.GetSet(ctx, &GetSetRequest{Zone: "example.com.", Name: "www", Type: "A"})
+	assert.NoError(t, err)
+	assert.Len(t, set.Records, 2)
+	assert.Equal(t, "1.2.3.4", set.Records[0].Address)
+	assert.Equal(t, "1.2.3.5", set.Records[1].Address)
+
+	sets, err := client.ListSets(ctx, &ListSetsRequest{Zone: "example.com.", Search: "www"})
+	assert.NoError(t, err)
+	assert.Len(t, sets.Sets, 1)
+
+	_, err = client.DeleteRecord(ctx, &DeleteRecordRequest{
+		Zone:   "example.com.",
+		Name:   "www",
+		Type:   "A",
+		Record: &Record{Address: "1.2.3.4"},
+	})
+	assert.NoError(t, err)
+
+	_, err = client.DeleteSet(ctx, &DeleteSetRequest{Zone: "example.com.", Name: "www", Type: "A"})
+	assert.NoError(t, err)
+
+	_, err = client.GetSet(ctx, &GetSetRequest{Zone: "example.com.", Name: "www", Type: "A"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = client.PutSet(ctx, &PutSetRequest{Zone: "example.com.", Set: &Set{Name: "www", Type: "CAA"}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	res, err := client.Status(ctx, &StatusRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1), res.Zones)
+
+	_, err = client.DeleteZone(ctx, &DeleteZoneRequest{Zone: "example.com."})
+	assert.NoError(t, err)
+
+	_, err = client.GetZone(ctx, &GetZoneRequest{Zone: "example.com."})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	changes := make(chan *Change, 10)
+	go func() {
+		for {
+			change, err := stream.Recv()
+			if err != nil {
+				close(changes)
+				return
+			}
+			changes <- change
+		}
+	}()
+
+	var list []store.AdminChange
+	for len(list) < 6 {
+		select {
+		case change := <-changes:
+			list = append(list, store.AdminChange{
+				Zone:    change.Zone,
+				Name:    change.Name,
+				Type:    change.Type,
+				Deleted: change.Deleted,
+				Serial:  change.Serial,
+			})
+		case <-time.After(time.Second):
+			t.Fatal("missing change")
+		}
+	}
+	assert.Equal(t, []store.AdminChange{
+		{Zone: "example.com.", Serial: 1},
+		{Zone: "example.com.", Name: "www", Type: "A", Serial: 2},
+		{Zone: "example.com.", Name: "www", Type: "A", Serial: 3},
+		{Zone: "example.com.", Name: "www", Type: "A", Serial: 4},
+		{Zone: "example.com.", Name: "www", Type: "A", Deleted: true, Serial: 5},
+		{Zone: "example.com.", Deleted: true},
+	}, list)
+
+	cancel()
+
+	select {
+	case _, ok := <-changes:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("stream not closed")
+	}
+}
@@ -0,0 +1,22 @@
+package control
+
+import "context"
+
+// Token provides an API key as per-call credentials using the "Bearer" scheme
+// e.g. with grpc.WithPerRPCCredentials. The key is also sent over insecure
+// connections and should therefore only be used with transport security in
+// production.
+type Token string
+
+// GetRequestMetadata implements the credentials.PerRPCCredentials interface.
+func (t Token) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{
+		"authorization": "Bearer " + string(t),
+	}, nil
+}
+
+// RequireTransportSecurity implements the credentials.PerRPCCredentials
+// interface.
+func (t Token) RequireTransportSecurity() bool {
+	return false
+}
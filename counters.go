@@ -0,0 +1,87 @@
+package newdns
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Counters are the numbers of queries processed by a server since it has been
+// created.
+type Counters struct {
+	// The total number of processed queries.
+	Queries uint64
+
+	// The number of answered queries by response code name e.g. "NOERROR".
+	Rcodes map[string]uint64
+
+	// The number of processed queries by question type name e.g. "AAAA".
+	Types map[string]uint64
+}
+
+type counters struct {
+	mutex   sync.Mutex
+	queries uint64
+	rcodes  map[int]uint64
+	types   map[uint16]uint64
+}
+
+func (c *counters) count(info *requestInfo) {
+	// get info
+	info.mutex.Lock()
+	qtype := info.Question.Qtype
+	rcode := info.Rcode
+	answered := info.ResponseSize > 0
+	info.mutex.Unlock()
+
+	// acquire mutex
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// ensure maps
+	if c.rcodes == nil {
+		c.rcodes = map[int]uint64{}
+		c.types = map[uint16]uint64{}
+	}
+
+	// count query
+	c.queries++
+	c.types[qtype]++
+	if answered {
+		c.rcodes[rcode]++
+	}
+}
+
+func (c *counters) snapshot() Counters {
+	// acquire mutex
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// prepare counters
+	counters := Counters{
+		Queries: c.queries,
+		Rcodes:  map[string]uint64{},
+		Types:   map[string]uint64{},
+	}
+
+	// copy rcodes
+	for rcode, n := range c.rcodes {
+		name, ok := dns.RcodeToString[rcode]
+		if !ok {
+			name = "RCODE" + strconv.Itoa(rcode)
+		}
+		counters.Rcodes[name] += n
+	}
+
+	// copy types
+	for qtype, n := range c.types {
+		name, ok := dns.TypeToString[qtype]
+		if !ok {
+			name = "TYPE" + strconv.Itoa(int(qtype))
+		}
+		counters.Types[name] += n
+	}
+
+	return counters
+}
@@ -0,0 +1,377 @@
+package newdns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v3"
+)
+
+// DefinitionFormat denotes the encoding of a zone definition.
+type DefinitionFormat int
+
+const (
+	// DefinitionJSON encodes zone definitions as JSON documents.
+	DefinitionJSON DefinitionFormat = iota
+
+	// DefinitionYAML encodes zone definitions as YAML documents.
+	DefinitionYAML
+)
+
+// ZoneDefinition is the serializable definition of a static zone. Durations
+// are encoded as strings like "5m" or "48h" and omitted fields use the zone
+// defaults. An example definition in YAML:
+//
+//	name: example.com.
+//	admin_email: hostmaster@example.com
+//	serial: 42
+//	min_ttl: 5m
+//	sets:
+//	  - name: "@"
+//	    type: NS
+//	    records:
+//	      - address: ns1.example.com.
+//	      - address: ns2.example.com.
+//	  - name: www
+//	    type: A
+//	    ttl: 1h
+//	    records:
+//	      - address: 1.2.3.4
+//	  - name: "@"
+//	    type: MX
+//	    records:
+//	      - address: mail.example.com.
+//	        priority: 10
+type ZoneDefinition struct {
+	// The FQDN of the zone.
+	Name string `json:"name" yaml:"name"`
+
+	// The FQDN of the master name server.
+	//
+	// Default: The first name server of the apex NS set.
+	MasterNameServer string `json:"master_name_server,omitempty" yaml:"master_name_server,omitempty"`
+
+	// The email address of the administrator.
+	AdminEmail string `json:"admin_email,omitempty" yaml:"admin_email,omitempty"`
+
+	// The serial of the zone.
+	Serial uint32 `json:"serial,omitempty" yaml:"serial,omitempty"`
+
+	// The SOA timers and TTLs.
+	Refresh string `json:"refresh,omitempty" yaml:"refresh,omitempty"`
+	Retry   string `json:"retry,omitempty" yaml:"retry,omitempty"`
+	Expire  string `json:"expire,omitempty" yaml:"expire,omitempty"`
+	SOATTL  string `json:"soa_ttl,omitempty" yaml:"soa_ttl,omitempty"`
+	NSTTL   string `json:"ns_ttl,omitempty" yaml:"ns_ttl,omitempty"`
+	MinTTL  string `json:"min_ttl,omitempty" yaml:"min_ttl,omitempty"`
+	MaxTTL  string `json:"max_ttl,omitempty" yaml:"max_ttl,omitempty"`
+
+	// The sets of the zone. The apex NS set defines the name servers.
+	Sets []SetDefinition `json:"sets" yaml:"sets"`
+}
+
+// SetDefinition is the serializable definition of a set.
+type SetDefinition struct {
+	// The name of the set relative to the zone e.g. "www" or "@" for the apex.
+	Name string `json:"name" yaml:"name"`
+
+	// The type of the set e.g. "A" or "MX".
+	Type string `json:"type" yaml:"type"`
+
+	// The TTL of the set.
+	//
+	// Default: 5m.
+	TTL string `json:"ttl,omitempty" yaml:"ttl,omitempty"`
+
+	// The records of the set.
+	Records []RecordDefinition `json:"records" yaml:"records"`
+}
+
+// RecordDefinition is the serializable definition of a record.
+type RecordDefinition struct {
+	// The target address for A, AAAA, CNAME, MX, NS, PTR and SRV records.
+	Address string `json:"address,omitempty" yaml:"address,omitempty"`
+
+	// The priority for MX and SRV records.
+	Priority int `json:"priority,omitempty" yaml:"priority,omitempty"`
+
+	// The weight for SRV records.
+	Weight int `json:"weight,omitempty" yaml:"weight,omitempty"`
+
+	// The port for SRV records.
+	Port int `json:"port,omitempty" yaml:"port,omitempty"`
+
+	// The data for TXT records.
+	Data []string `json:"data,omitempty" yaml:"data,omitempty"`
+}
+
+// LoadDefinition decodes a zone definition in the provided format from the
+// reader and returns the validated static zone. The options are applied
+// before the zone is validated.
+func LoadDefinition(r io.Reader, format DefinitionFormat, opts ...ZoneOption) (*Zone, error) {
+	// read document
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// decode definition
+	var def ZoneDefinition
+	switch format {
+	case DefinitionJSON:
+		err = json.Unmarshal(data, &def)
+	case DefinitionYAML:
+		err = yaml.Unmarshal(data, &def)
+	default:
+		err = fmt.Errorf("unsupported format: %d", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return def.Zone(opts...)
+}
+
+// SaveDefinition encodes the definition of the provided zone in the provided
+// format to the writer. The zone must have a lister.
+func SaveDefinition(ctx context.Context, w io.Writer, zone *Zone, format DefinitionFormat) error {
+	// get definition
+	def, err := DefineZone(ctx, zone)
+	if err != nil {
+		return err
+	}
+
+	// encode definition
+	var data []byte
+	switch format {
+	case DefinitionJSON:
+		data, err = json.MarshalIndent(def, "", "  ")
+		data = append(data, '\n')
+	case DefinitionYAML:
+		data, err = yaml.Marshal(def)
+	default:
+		err = fmt.Errorf("unsupported format: %d", format)
+	}
+	if err != nil {
+		return err
+	}
+
+	// write document
+	_, err = w.Write(data)
+
+	return err
+}
+
+// Zone returns a validated static zone for the definition. The options are
+// applied before the zone is validated.
+func (d *ZoneDefinition) Zone(opts ...ZoneOption) (*Zone, error) {
+	// check name
+	name := NormalizeDomain(d.Name, true, false, false)
+	if !IsDomain(name, true) {
+		return nil, fmt.Errorf("name not fully qualified: %s", d.Name)
+	}
+
+	// parse durations
+	var durations [7]time.Duration
+	for i, value := range []string{d.Refresh, d.Retry, d.Expire, d.SOATTL, d.NSTTL, d.MinTTL, d.MaxTTL} {
+		duration, err := parseDuration(value)
+		if err != nil {
+			return nil, err
+		}
+		durations[i] = duration
+	}
+
+	// convert sets
+	sets := map[string][]Set{}
+	for _, setDef := range d.Sets {
+		// convert set
+		set, err := setDef.Set(name)
+		if err != nil {
+			return nil, err
+		}
+
+		// add set
+		sub := TrimZone(name, set.Name)
+		sets[sub] = append(sets[sub], set)
+	}
+
+	// prepare options
+	opts = append([]ZoneOption{func(zone *Zone) {
+		if d.MasterNameServer != "" {
+			zone.MasterNameServer = d.MasterNameServer
+		}
+		zone.AdminEmail = d.AdminEmail
+		zone.Serial = d.Serial
+		zone.Refresh = durations[0]
+		zone.Retry = durations[1]
+		zone.Expire = durations[2]
+		zone.SOATTL = durations[3]
+		zone.NSTTL = durations[4]
+		zone.MinTTL = durations[5]
+		zone.MaxTTL = durations[6]
+	}}, opts...)
+
+	return NewStaticZone(name, sets, opts...)
+}
+
+// DefineZone returns the definition of the provided zone. The apex NS set is
+// derived from the name servers and the other sets are collected using the
+// zone lister. Sets with raw records cause an error.
+func DefineZone(ctx context.Context, zone *Zone) (*ZoneDefinition, error) {
+	// prepare definition
+	def := &ZoneDefinition{
+		Name:             zone.Name,
+		MasterNameServer: zone.MasterNameServer,
+		AdminEmail:       zone.AdminEmail,
+		Serial:           zone.Serial,
+		Refresh:          formatDuration(zone.Refresh),
+		Retry:            formatDuration(zone.Retry),
+		Expire:           formatDuration(zone.Expire),
+		SOATTL:           formatDuration(zone.SOATTL),
+		NSTTL:            formatDuration(zone.NSTTL),
+		MinTTL:           formatDuration(zone.MinTTL),
+		MaxTTL:           formatDuration(zone.MaxTTL),
+	}
+
+	// add apex NS set
+	nsSet := SetDefinition{
+		Name: "@",
+		Type: "NS",
+		TTL:  formatDuration(zone.NSTTL),
+	}
+	for _, ns := range zone.AllNameServers {
+		nsSet.Records = append(nsSet.Records, RecordDefinition{
+			Address: ns,
+		})
+	}
+	def.Sets = append(def.Sets, nsSet)
+
+	// collect sets
+	err := zone.List(ctx, func(set Set) error {
+		// check raw records
+		if len(set.Raw) > 0 {
+			return fmt.Errorf("unsupported raw set: %s", set.Name)
+		}
+
+		def.Sets = append(def.Sets, DefineSet(zone.Name, set))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return def, nil
+}
+
+// Set returns the set for the definition in the specified zone. The set is not
+// validated.
+func (d *SetDefinition) Set(zone string) (Set, error) {
+	// get relative name
+	sub := NormalizeDomain(d.Name, true, false, false)
+	if sub == "@" {
+		sub = ""
+	}
+
+	// get type
+	typ := Type(dns.StringToType[strings.ToUpper(d.Type)])
+	if !typ.supported() {
+		return Set{}, fmt.Errorf("unsupported type: %s", d.Type)
+	}
+
+	// parse TTL
+	ttl, err := parseDuration(d.TTL)
+	if err != nil {
+		return Set{}, err
+	}
+
+	// prepare set
+	set := Set{
+		Name: zone,
+		Type: typ,
+		TTL:  ttl,
+	}
+	if sub != "" {
+		set.Name = sub + "." + zone
+	}
+
+	// add records
+	for _, record := range d.Records {
+		set.Records = append(set.Records, Record{
+			Address:  record.Address,
+			Priority: record.Priority,
+			Weight:   record.Weight,
+			Port:     record.Port,
+			Data:     record.Data,
+		})
+	}
+
+	return set, nil
+}
+
+// DefineSet returns the definition of the provided set in the specified zone.
+func DefineSet(zone string, set Set) SetDefinition {
+	// get relative name
+	sub := TrimZone(zone, set.Name)
+	if sub == "" {
+		sub = "@"
+	}
+
+	// prepare definition
+	def := SetDefinition{
+		Name: sub,
+		Type: dns.TypeToString[uint16(set.Type)],
+		TTL:  formatDuration(set.TTL),
+	}
+
+	// add records
+	for _, record := range set.Records {
+		def.Records = append(def.Records, RecordDefinition{
+			Address:  record.Address,
+			Priority: record.Priority,
+			Weight:   record.Weight,
+			Port:     record.Port,
+			Data:     record.Data,
+		})
+	}
+
+	return def
+}
+
+func parseDuration(value string) (time.Duration, error) {
+	// check value
+	if value == "" {
+		return 0, nil
+	}
+
+	// parse duration
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration: %s", value)
+	}
+
+	return duration, nil
+}
+
+func formatDuration(duration time.Duration) string {
+	// check duration
+	if duration == 0 {
+		return ""
+	}
+
+	// trim zero units e.g. "1h0m0s" to "1h"
+	str := duration.String()
+	if strings.HasSuffix(str, "m0s") {
+		str = str[:len(str)-2]
+	}
+	if strings.HasSuffix(str, "h0m") {
+		str = str[:len(str)-2]
+	}
+
+	return str
+}
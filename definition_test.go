@@ -0,0 +1,147 @@
+package newdns
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testDefinitionJSON = `{
+  "name": "example.com.",
+  "admin_email": "admin@example.com",
+  "serial": 42,
+  "min_ttl": "1m",
+  "sets": [
+    {
+      "name": "@",
+      "type": "NS",
+      "records": [
+        {"address": "ns1.example.com."},
+        {"address": "ns2.example.com."}
+      ]
+    },
+    {
+      "name": "@",
+      "type": "MX",
+      "records": [
+        {"address": "mail.example.com.", "priority": 10}
+      ]
+    },
+    {
+      "name": "www",
+      "type": "A",
+      "ttl": "1h",
+      "records": [
+        {"address": "1.2.3.4"}
+      ]
+    },
+    {
+      "name": "txt",
+      "type": "TXT",
+      "records": [
+        {"data": ["foo", "bar"]}
+      ]
+    }
+  ]
+}
+`
+
+const testDefinitionYAML = `name: example.com.
+admin_email: admin@example.com
+serial: 42
+min_ttl: 1m
+sets:
+  - name: "@"
+    type: NS
+    records:
+      - address: ns1.example.com.
+      - address: ns2.example.com.
+  - name: www
+    type: A
+    ttl: 1h
+    records:
+      - address: 1.2.3.4
+`
+
+func TestLoadDefinition(t *testing.T) {
+	zone, err := LoadDefinition(strings.NewReader(testDefinitionJSON), DefinitionJSON)
+	assert.NoError(t, err)
+	assert.Equal(t, "example.com.", zone.Name)
+	assert.Equal(t, "ns1.example.com.", zone.MasterNameServer)
+	assert.Equal(t, []string{"ns1.example.com.", "ns2.example.com."}, zone.AllNameServers)
+	assert.Equal(t, "admin@example.com", zone.AdminEmail)
+	assert.Equal(t, uint32(42), zone.Serial)
+	assert.Equal(t, time.Minute, zone.MinTTL)
+
+	res, exists, err := zone.Lookup(context.Background(), "www.example.com.", A)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, []Set{
+		{Name: "www.example.com.", Type: A, Records: []Record{{Address: "1.2.3.4"}}, TTL: time.Hour},
+	}, res)
+
+	res, exists, err = zone.Lookup(context.Background(), "example.com.", MX)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, 10, res[0].Records[0].Priority)
+
+	zone, err = LoadDefinition(strings.NewReader(testDefinitionYAML), DefinitionYAML)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ns1.example.com.", "ns2.example.com."}, zone.AllNameServers)
+
+	res, exists, err = zone.Lookup(context.Background(), "www.example.com.", A)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, time.Hour, res[0].TTL)
+}
+
+func TestLoadDefinitionErrors(t *testing.T) {
+	_, err := LoadDefinition(strings.NewReader(`{"name": "example.com"}`), DefinitionJSON)
+	assert.Error(t, err)
+	assert.Equal(t, "name not fully qualified: example.com", err.Error())
+
+	_, err = LoadDefinition(strings.NewReader(`{"name": "example.com.", "min_ttl": "foo"}`), DefinitionJSON)
+	assert.Error(t, err)
+	assert.Equal(t, "invalid duration: foo", err.Error())
+
+	_, err = LoadDefinition(strings.NewReader(`{"name": "example.com.", "sets": [{"name": "@", "type": "CAA"}]}`), DefinitionJSON)
+	assert.Error(t, err)
+	assert.Equal(t, "unsupported type: CAA", err.Error())
+}
+
+func TestSaveDefinition(t *testing.T) {
+	zone, err := LoadDefinition(strings.NewReader(testDefinitionJSON), DefinitionJSON)
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	err = SaveDefinition(context.Background(), &buf, zone, DefinitionJSON)
+	assert.NoError(t, err)
+
+	def, err := DefineZone(context.Background(), zone)
+	assert.NoError(t, err)
+	assert.Equal(t, "1m", def.MinTTL)
+	assert.Equal(t, "48h", def.NSTTL)
+	assert.Len(t, def.Sets, 4)
+
+	zone2, err := LoadDefinition(&buf, DefinitionJSON)
+	assert.NoError(t, err)
+
+	def2, err := DefineZone(context.Background(), zone2)
+	assert.NoError(t, err)
+	assert.Equal(t, def, def2)
+
+	buf.Reset()
+	err = SaveDefinition(context.Background(), &buf, zone, DefinitionYAML)
+	assert.NoError(t, err)
+
+	zone3, err := LoadDefinition(&buf, DefinitionYAML)
+	assert.NoError(t, err)
+
+	def3, err := DefineZone(context.Background(), zone3)
+	assert.NoError(t, err)
+	assert.Equal(t, def, def3)
+}
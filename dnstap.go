@@ -0,0 +1,461 @@
+package newdns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const dnstapContentType = "protobuf:dnstap.Dnstap"
+
+const (
+	fstrmControlAccept = 0x01
+	fstrmControlStart  = 0x02
+	fstrmControlStop   = 0x03
+	fstrmControlReady  = 0x04
+	fstrmControlFinish = 0x05
+
+	fstrmFieldContentType = 0x01
+)
+
+const (
+	dnstapAuthQuery         = 1
+	dnstapAuthResponse      = 2
+	dnstapForwarderQuery    = 7
+	dnstapForwarderResponse = 8
+)
+
+// Dnstap writes dnstap messages for requests and responses using the Frame
+// Streams protocol. Requests and responses are logged as AUTH_QUERY and
+// AUTH_RESPONSE messages while requests forwarded to the fallback are logged
+// as FORWARDER_QUERY and FORWARDER_RESPONSE messages. It may be used as the
+// server logger and forwards all events to an optional logger. Messages are
+// queued and written by a background goroutine. Messages are dropped if the
+// queue is full or the output fails. Sockets are reconnected after errors.
+type Dnstap struct {
+	next     Logger
+	identity string
+	path     string
+	conn     io.ReadWriter
+	closer   io.Closer
+	writer   *bufio.Writer
+	frames   chan []byte
+	done     chan struct{}
+	dropped  uint64
+	mutex    sync.RWMutex
+	closed   bool
+}
+
+const dnstapQueueSize = 1024
+
+// NewDnstap creates and returns a new dnstap logger that writes a
+// unidirectional frame stream to the provided writer e.g. a file. The
+// identity is included in every message.
+func NewDnstap(w io.Writer, identity string, next Logger) (*Dnstap, error) {
+	// create dnstap
+	d := &Dnstap{
+		next:     next,
+		identity: identity,
+		writer:   bufio.NewWriter(w),
+	}
+
+	// get closer
+	if closer, ok := w.(io.Closer); ok {
+		d.closer = closer
+	}
+
+	// write start frame
+	err := d.writeControl(fstrmControlStart, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// run writer
+	d.start()
+
+	return d, nil
+}
+
+// DialDnstap creates and returns a new dnstap logger that writes a
+// bidirectional frame stream to the unix socket at the provided path. The
+// socket is redialed if writing fails.
+func DialDnstap(path, identity string, next Logger) (*Dnstap, error) {
+	// create dnstap
+	d := &Dnstap{
+		next:     next,
+		identity: identity,
+		path:     path,
+	}
+
+	// connect
+	err := d.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	// run writer
+	d.start()
+
+	return d, nil
+}
+
+// Log implements the Logger interface.
+func (d *Dnstap) Log(entry Entry) {
+	// forward event
+	if d.next != nil {
+		d.next.Log(entry)
+	}
+
+	// get type
+	var typ int
+	switch entry.Event {
+	case Request:
+		typ = dnstapAuthQuery
+	case Response:
+		typ = dnstapAuthResponse
+	case ProxyRequest:
+		typ = dnstapForwarderQuery
+	case ProxyResponse:
+		typ = dnstapForwarderResponse
+	default:
+		return
+	}
+
+	// check message
+	if entry.Msg == nil {
+		return
+	}
+
+	// pack message
+	data, err := entry.Msg.Pack()
+	if err != nil {
+		return
+	}
+
+	// prepare frame
+	frame := d.frame(typ, data, entry.Info)
+
+	// acquire mutex
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	// check state
+	if d.closed {
+		return
+	}
+
+	// queue frame or drop if full
+	select {
+	case d.frames <- frame:
+	default:
+		atomic.AddUint64(&d.dropped, 1)
+	}
+}
+
+// Dropped returns the number of messages that have been dropped because the
+// queue was full or the output failed.
+func (d *Dnstap) Dropped() uint64 {
+	return atomic.LoadUint64(&d.dropped)
+}
+
+// Close will write the queued messages and the stop frame and close the
+// underlying writer or socket if it implements io.Closer.
+func (d *Dnstap) Close() error {
+	// acquire mutex
+	d.mutex.Lock()
+
+	// check state
+	if d.closed {
+		d.mutex.Unlock()
+		return nil
+	}
+	d.closed = true
+
+	// stop writer
+	close(d.frames)
+	d.mutex.Unlock()
+	<-d.done
+
+	// check output
+	if d.writer == nil {
+		return nil
+	}
+
+	// write stop frame
+	err := d.writeControl(fstrmControlStop, false)
+
+	// await finish frame on sockets
+	if err == nil && d.conn != nil {
+		err = d.readControl(fstrmControlFinish)
+	}
+
+	// close writer
+	if d.closer != nil {
+		cerr := d.closer.Close()
+		if err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+func (d *Dnstap) start() {
+	// prepare queue
+	d.frames = make(chan []byte, dnstapQueueSize)
+	d.done = make(chan struct{})
+
+	// run writer
+	go d.write()
+}
+
+func (d *Dnstap) write() {
+	// signal exit
+	defer close(d.done)
+
+	// prepare reconnect time
+	var retry time.Time
+
+	for frame := range d.frames {
+		// reconnect socket if needed
+		if d.writer == nil && d.path != "" && time.Now().After(retry) {
+			err := d.connect()
+			if err != nil {
+				retry = time.Now().Add(time.Second)
+			}
+		}
+
+		// drop frame if the output failed
+		if d.writer == nil {
+			atomic.AddUint64(&d.dropped, 1)
+			continue
+		}
+
+		// write frame and flush if no more frames are queued
+		err := d.writeFrame(frame, len(d.frames) == 0)
+		if err != nil {
+			atomic.AddUint64(&d.dropped, 1)
+			d.disconnect()
+		}
+	}
+}
+
+func (d *Dnstap) connect() error {
+	// dial socket
+	conn, err := net.Dial("unix", d.path)
+	if err != nil {
+		return err
+	}
+
+	// set output
+	d.conn = conn
+	d.closer = conn
+	d.writer = bufio.NewWriter(conn)
+
+	// perform handshake
+	err = d.writeControl(fstrmControlReady, true)
+	if err == nil {
+		err = d.readControl(fstrmControlAccept)
+	}
+	if err == nil {
+		err = d.writeControl(fstrmControlStart, true)
+	}
+	if err != nil {
+		d.disconnect()
+		return err
+	}
+
+	return nil
+}
+
+func (d *Dnstap) disconnect() {
+	// close output
+	if d.closer != nil {
+		_ = d.closer.Close()
+	}
+
+	// reset output
+	d.conn = nil
+	d.closer = nil
+	d.writer = nil
+}
+
+func (d *Dnstap) writeFrame(frame []byte, flush bool) error {
+	// write frame
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(frame)))
+	_, err := d.writer.Write(header[:])
+	if err == nil {
+		_, err = d.writer.Write(frame)
+	}
+	if err == nil && flush {
+		err = d.writer.Flush()
+	}
+
+	return err
+}
+
+func (d *Dnstap) frame(typ int, data []byte, info *EventInfo) []byte {
+	// get time
+	now := time.Now()
+
+	// prepare message
+	msg := appendVarintField(nil, 1, uint64(typ))
+
+	// add address information
+	if info != nil {
+		// get query time
+		queryTime := now.Add(-info.Elapsed)
+
+		// get address
+		var ip net.IP
+		var port int
+		switch addr := info.Remote.(type) {
+		case *net.UDPAddr:
+			ip, port = addr.IP, addr.Port
+		case *net.TCPAddr:
+			ip, port = addr.IP, addr.Port
+		}
+
+		// add socket family and address
+		if ip4 := ip.To4(); ip4 != nil {
+			msg = appendVarintField(msg, 2, 1)
+			msg = appendBytesField(msg, 4, ip4)
+		} else if ip != nil {
+			msg = appendVarintField(msg, 2, 2)
+			msg = appendBytesField(msg, 4, ip.To16())
+		}
+
+		// add socket protocol
+		switch info.Transport {
+		case "udp":
+			msg = appendVarintField(msg, 3, 1)
+		case "tcp":
+			msg = appendVarintField(msg, 3, 2)
+		}
+
+		// add port
+		if ip != nil {
+			msg = appendVarintField(msg, 6, uint64(port))
+		}
+
+		// add query time
+		msg = appendVarintField(msg, 8, uint64(queryTime.Unix()))
+		msg = appendFixed32Field(msg, 9, uint32(queryTime.Nanosecond()))
+	}
+
+	// add message
+	if typ == dnstapAuthQuery || typ == dnstapForwarderQuery {
+		if info == nil {
+			msg = appendVarintField(msg, 8, uint64(now.Unix()))
+			msg = appendFixed32Field(msg, 9, uint32(now.Nanosecond()))
+		}
+		msg = appendBytesField(msg, 10, data)
+	} else {
+		msg = appendVarintField(msg, 12, uint64(now.Unix()))
+		msg = appendFixed32Field(msg, 13, uint32(now.Nanosecond()))
+		msg = appendBytesField(msg, 14, data)
+	}
+
+	// prepare frame
+	var buf []byte
+	if d.identity != "" {
+		buf = appendBytesField(buf, 1, []byte(d.identity))
+	}
+	buf = appendBytesField(buf, 2, []byte("newdns"))
+	buf = appendBytesField(buf, 14, msg)
+	buf = appendVarintField(buf, 15, 1)
+
+	return buf
+}
+
+func (d *Dnstap) writeControl(typ uint32, contentType bool) error {
+	// prepare frame
+	frame := make([]byte, 12, 64)
+	binary.BigEndian.PutUint32(frame[8:], typ)
+
+	// add content type
+	if contentType {
+		frame = appendUint32(frame, fstrmFieldContentType)
+		frame = appendUint32(frame, uint32(len(dnstapContentType)))
+		frame = append(frame, dnstapContentType...)
+	}
+
+	// set length
+	binary.BigEndian.PutUint32(frame[4:], uint32(len(frame)-8))
+
+	// write frame
+	_, err := d.writer.Write(frame)
+	if err != nil {
+		return err
+	}
+
+	return d.writer.Flush()
+}
+
+func (d *Dnstap) readControl(typ uint32) error {
+	// read header
+	var header [12]byte
+	_, err := io.ReadFull(d.conn, header[:])
+	if err != nil {
+		return err
+	}
+
+	// check escape
+	if binary.BigEndian.Uint32(header[:4]) != 0 {
+		return errors.New("dnstap: expected control frame")
+	}
+
+	// check length
+	length := binary.BigEndian.Uint32(header[4:8])
+	if length < 4 || length > 512 {
+		return errors.New("dnstap: invalid control frame length")
+	}
+
+	// discard fields
+	_, err = io.CopyN(io.Discard, d.conn, int64(length-4))
+	if err != nil {
+		return err
+	}
+
+	// check type
+	if binary.BigEndian.Uint32(header[8:]) != typ {
+		return errors.New("dnstap: unexpected control frame")
+	}
+
+	return nil
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	return append(buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendVarint(buf []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+
+	return append(buf, byte(v))
+}
+
+func appendVarintField(buf []byte, num int, v uint64) []byte {
+	buf = appendVarint(buf, uint64(num)<<3)
+	return appendVarint(buf, v)
+}
+
+func appendFixed32Field(buf []byte, num int, v uint32) []byte {
+	buf = appendVarint(buf, uint64(num)<<3|5)
+	return append(buf, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func appendBytesField(buf []byte, num int, data []byte) []byte {
+	buf = appendVarint(buf, uint64(num)<<3|2)
+	buf = appendVarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
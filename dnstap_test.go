@@ -0,0 +1,152 @@
+package newdns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDnstap(t *testing.T) {
+	var buf bytes.Buffer
+	dt, err := NewDnstap(&buf, "test", nil)
+	assert.NoError(t, err)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	data, err := req.Pack()
+	assert.NoError(t, err)
+
+	dt.Log(Entry{Event: Request, Msg: req, Info: &EventInfo{
+		Remote:    &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 5353},
+		Transport: "udp",
+	}})
+	dt.Log(Entry{Event: Finish})
+
+	err = dt.Close()
+	assert.NoError(t, err)
+
+	out := buf.Bytes()
+
+	/* start frame */
+
+	assert.Equal(t, uint32(0), binary.BigEndian.Uint32(out[0:]))
+	length := binary.BigEndian.Uint32(out[4:])
+	assert.Equal(t, uint32(fstrmControlStart), binary.BigEndian.Uint32(out[8:]))
+	assert.Equal(t, dnstapContentType, string(out[20:8+length]))
+	out = out[8+length:]
+
+	/* data frame */
+
+	length = binary.BigEndian.Uint32(out)
+	frame := out[4 : 4+length]
+	assert.True(t, bytes.HasPrefix(frame, appendBytesField(nil, 1, []byte("test"))))
+	assert.True(t, bytes.Contains(frame, appendBytesField(nil, 10, data)))
+	assert.True(t, bytes.Contains(frame, appendBytesField(nil, 4, []byte{1, 2, 3, 4})))
+	assert.True(t, bytes.HasSuffix(frame, appendVarintField(nil, 15, 1)))
+	out = out[4+length:]
+
+	/* stop frame */
+
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 4, 0, 0, 0, fstrmControlStop}, out)
+}
+
+func TestDnstapReconnect(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnstap.sock")
+
+	ln, err := net.Listen("unix", path)
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	readFrame := func(conn net.Conn) ([]byte, bool, error) {
+		var header [4]byte
+		_, err := io.ReadFull(conn, header[:])
+		if err != nil {
+			return nil, false, err
+		}
+		control := binary.BigEndian.Uint32(header[:]) == 0
+		if control {
+			_, err = io.ReadFull(conn, header[:])
+			if err != nil {
+				return nil, false, err
+			}
+		}
+		frame := make([]byte, binary.BigEndian.Uint32(header[:]))
+		_, err = io.ReadFull(conn, frame)
+		return frame, control, err
+	}
+
+	writeControl := func(conn net.Conn, typ uint32) {
+		frame := make([]byte, 12)
+		binary.BigEndian.PutUint32(frame[4:], 4)
+		binary.BigEndian.PutUint32(frame[8:], typ)
+		_, _ = conn.Write(frame)
+	}
+
+	received := make(chan int, 16)
+	go func() {
+		for i := 1; ; i++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(i int) {
+				defer conn.Close()
+				for {
+					frame, control, err := readFrame(conn)
+					if err != nil {
+						return
+					}
+					if control {
+						switch binary.BigEndian.Uint32(frame) {
+						case fstrmControlReady:
+							writeControl(conn, fstrmControlAccept)
+						case fstrmControlStop:
+							writeControl(conn, fstrmControlFinish)
+							return
+						}
+						continue
+					}
+					received <- i
+					if i == 1 {
+						return
+					}
+				}
+			}(i)
+		}
+	}()
+
+	dt, err := DialDnstap(path, "test", nil)
+	assert.NoError(t, err)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	dt.Log(Entry{Event: Request, Msg: req})
+	assert.Equal(t, 1, <-received)
+
+	deadline := time.After(5 * time.Second)
+	for reconnected := false; !reconnected; {
+		dt.Log(Entry{Event: Request, Msg: req})
+		select {
+		case i := <-received:
+			reconnected = i == 2
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("not reconnected")
+		}
+	}
+
+	assert.True(t, dt.Dropped() > 0)
+
+	err = dt.Close()
+	assert.NoError(t, err)
+}
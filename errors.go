@@ -0,0 +1,76 @@
+package newdns
+
+import "errors"
+
+// The error kinds of errors received by the logger and reporter. Use
+// errors.Is to check the kind of an error e.g. errors.Is(err, ErrHandler).
+var (
+	// ErrHandler denotes errors returned by or panics in the server and zone
+	// handlers.
+	ErrHandler = errors.New("handler error")
+
+	// ErrValidation denotes invalid zones and sets returned by handlers.
+	ErrValidation = errors.New("validation error")
+
+	// ErrNetwork denotes errors returned by connections and the fallback.
+	ErrNetwork = errors.New("network error")
+
+	// ErrRefused denotes requests that have been refused. The message of the
+	// error is the reason.
+	ErrRefused = errors.New("refused")
+)
+
+// Error is an error of a specific kind.
+type Error struct {
+	// The kind of the error e.g. ErrHandler.
+	Kind error
+
+	// The underlying error.
+	Err error
+}
+
+// Error implements the error interface.
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is returns whether the target is the kind of the error.
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+func kindError(kind, err error) error {
+	// check error
+	if err == nil {
+		return nil
+	}
+
+	// check kind
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+
+	return &Error{Kind: kind, Err: err}
+}
+
+func classifyError(e Event, err error, reason string) error {
+	switch e {
+	case BackendError:
+		return kindError(ErrHandler, err)
+	case NetworkError, ProxyError, UpstreamExchange:
+		return kindError(ErrNetwork, err)
+	case Refused:
+		if err == nil && reason != "" {
+			return &Error{Kind: ErrRefused, Err: errors.New(reason)}
+		}
+		return kindError(ErrRefused, err)
+	default:
+		return err
+	}
+}
@@ -1,6 +1,12 @@
 package newdns
 
-import "github.com/miekg/dns"
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
 
 // Event denotes an event type emitted to the logger.
 type Event int
@@ -45,6 +51,23 @@ const (
 	// ProxyError is emitted with errors returned by the fallback DNS server.
 	// Inspect the error for more information.
 	ProxyError Event = iota
+
+	// ProxyCacheHit is emitted with every request that has been answered
+	// from the fallback cache.
+	ProxyCacheHit Event = iota
+
+	// UpstreamExchange is emitted with every exchange with an upstream server
+	// of a proxy. The fields contain the "upstream" address and the "rtt".
+	// Inspect the message or error for the result of the exchange.
+	UpstreamExchange Event = iota
+
+	// UpstreamDown is emitted when an upstream server of a proxy is skipped
+	// due to sustained failures. The fields contain the "upstream" address.
+	UpstreamDown Event = iota
+
+	// UpstreamUp is emitted when a skipped upstream server of a proxy has
+	// recovered. The fields contain the "upstream" address.
+	UpstreamUp Event = iota
 )
 
 // String will return the name of the event.
@@ -70,16 +93,173 @@ func (e Event) String() string {
 		return "ProxyResponse"
 	case ProxyError:
 		return "ProxyError"
+	case ProxyCacheHit:
+		return "ProxyCacheHit"
+	case UpstreamExchange:
+		return "UpstreamExchange"
+	case UpstreamDown:
+		return "UpstreamDown"
+	case UpstreamUp:
+		return "UpstreamUp"
 	default:
 		return "Unknown"
 	}
 }
 
-// Logger is function that accepts logging events.
-type Logger func(e Event, msg *dns.Msg, err error, reason string)
+// Field is a key/value pair that provides structured information about an
+// event.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Entry is a single logging event.
+type Entry struct {
+	// The event type.
+	Event Event
+
+	// The request or response message, if available.
+	Msg *dns.Msg
+
+	// The error, if available. Errors of BackendError, NetworkError,
+	// ProxyError, UpstreamExchange and Refused events are of type *Error and
+	// may be checked with errors.Is against ErrHandler, ErrValidation,
+	// ErrNetwork and ErrRefused.
+	Error error
+
+	// The reason for Ignored, Refused, UpstreamDown and UpstreamUp events.
+	Reason string
+
+	// Additional structured information about the event.
+	Fields []Field
+
+	// Information about the request for Request, Response and Finish events.
+	Info *EventInfo
+
+	// The ID of the request the event belongs to, if available.
+	RequestID uint64
+}
+
+// EventInfo provides information about the request an event belongs to.
+type EventInfo struct {
+	// The address of the client.
+	Remote net.Addr
+
+	// The transport used by the client e.g. "udp", "tcp" or "unix".
+	Transport string
+
+	// The question of the request.
+	Question dns.Question
+
+	// The name of the zone that handled the request, if available.
+	Zone string
+
+	// The response code. It is only available for Response and Finish events
+	// and only if a response has been written.
+	Rcode int
+
+	// The size of the request message in bytes.
+	RequestSize int
+
+	// The size of the last response message in bytes.
+	ResponseSize int
+
+	// The time elapsed since the request has been received. For Finish
+	// events, this is the total processing duration.
+	Elapsed time.Duration
+
+	// The accumulated time spent in the server and zone handlers.
+	HandlerDuration time.Duration
+}
+
+// Logger is the interface implemented by loggers that accept logging events.
+type Logger interface {
+	Log(entry Entry)
+}
+
+// LoggerFunc is a function that implements the Logger interface.
+type LoggerFunc func(entry Entry)
+
+// Log implements the Logger interface.
+func (f LoggerFunc) Log(entry Entry) {
+	f(entry)
+}
+
+type requestLogger struct {
+	next Logger
+	id   uint64
+}
+
+func (l *requestLogger) Log(entry Entry) {
+	entry.RequestID = l.id
+	l.next.Log(entry)
+}
+
+func logInfo(l Logger, e Event, msg *dns.Msg, info *requestInfo) {
+	if l != nil {
+		// copy info
+		info.mutex.Lock()
+		ei := info.EventInfo
+		ei.Elapsed = time.Since(info.start)
+		info.mutex.Unlock()
+
+		l.Log(Entry{
+			Event: e,
+			Msg:   msg,
+			Info:  &ei,
+		})
+	}
+}
+
+type requestInfo struct {
+	EventInfo
+	mutex sync.Mutex
+	start time.Time
+}
+
+func newRequestInfo(w dns.ResponseWriter, req *dns.Msg) *requestInfo {
+	return &requestInfo{
+		EventInfo: EventInfo{
+			Remote:      w.RemoteAddr(),
+			Transport:   w.RemoteAddr().Network(),
+			Question:    req.Question[0],
+			RequestSize: req.Len(),
+		},
+		start: time.Now(),
+	}
+}
+
+func (i *requestInfo) zone(name string) {
+	i.mutex.Lock()
+	i.Zone = name
+	i.mutex.Unlock()
+}
+
+func (i *requestInfo) handler(d time.Duration) {
+	i.mutex.Lock()
+	i.HandlerDuration += d
+	i.mutex.Unlock()
+}
+
+func (i *requestInfo) response(msg *dns.Msg) {
+	i.written(msg.Rcode, msg.Len())
+}
+
+func (i *requestInfo) written(rcode, size int) {
+	i.mutex.Lock()
+	i.Rcode = rcode
+	i.ResponseSize = size
+	i.mutex.Unlock()
+}
 
-func log(l Logger, e Event, msg *dns.Msg, err error, reason string) {
+func log(l Logger, e Event, msg *dns.Msg, err error, reason string, fields ...Field) {
 	if l != nil {
-		l(e, msg, err, reason)
+		l.Log(Entry{
+			Event:  e,
+			Msg:    msg,
+			Error:  classifyError(e, err, reason),
+			Reason: reason,
+			Fields: fields,
+		})
 	}
 }
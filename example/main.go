@@ -1,10 +1,9 @@
 package main
 
 import (
+	"context"
 	"fmt"
 
-	"github.com/miekg/dns"
-
 	"github.com/256dpi/newdns"
 )
 
@@ -18,7 +17,7 @@ func main() {
 			"ns2.hostmaster.com.",
 			"ns3.hostmaster.com.",
 		},
-		Handler: func(name string) ([]newdns.Set, error) {
+		Handler: func(ctx context.Context, name string) ([]newdns.Set, error) {
 			// return apex records
 			if name == "" {
 				return []newdns.Set{
@@ -58,7 +57,7 @@ func main() {
 
 	// create server
 	server := newdns.NewServer(newdns.Config{
-		Handler: func(name string) (*newdns.Zone, error) {
+		Handler: func(ctx context.Context, name string) (*newdns.Zone, error) {
 			// check name
 			if newdns.InZone("example.com.", name) {
 				return zone, nil
@@ -66,9 +65,9 @@ func main() {
 
 			return nil, nil
 		},
-		Logger: func(e newdns.Event, msg *dns.Msg, err error, reason string) {
-			fmt.Println(e, err, reason)
-		},
+		Logger: newdns.LoggerFunc(func(entry newdns.Entry) {
+			fmt.Println(entry.Event, entry.Error, entry.Reason, entry.Fields)
+		}),
 	})
 
 	// run server
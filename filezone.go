@@ -0,0 +1,236 @@
+package newdns
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/miekg/dns"
+)
+
+// FileConfig provides configuration for a file zone.
+type FileConfig struct {
+	// The FQDN of the zone e.g. "example.com.".
+	Name string
+
+	// The path of the file that defines the zone.
+	Path string
+
+	// The function used to parse the file.
+	//
+	// Default: LoadZone with the name and path.
+	Load func(r io.Reader) (*Zone, error)
+
+	// The addresses of secondary servers e.g. "ns2.example.com:53" that are
+	// sent a NOTIFY message when the zone has been reloaded.
+	Notify []string
+
+	// The delay used to coalesce multiple file changes into a single reload.
+	//
+	// Default: 100ms.
+	Delay time.Duration
+
+	// The timeout for NOTIFY messages.
+	//
+	// Default: 10s.
+	Timeout time.Duration
+
+	// The logger called with errors encountered while reloading the zone or
+	// notifying secondary servers.
+	Logger Logger
+}
+
+// FileZone serves a zone that is loaded from a file and automatically
+// reloaded when the file changes. The serial of the reloaded zone is bumped if
+// it has not been incremented in the file.
+type FileZone struct {
+	config FileConfig
+	mutex  sync.RWMutex
+	zone   *Zone
+	close  chan struct{}
+	once   sync.Once
+}
+
+// NewFileZone creates and returns a new file zone. It returns an error if the
+// file cannot be loaded initially.
+func NewFileZone(config FileConfig) (*FileZone, error) {
+	// normalize name
+	config.Name = NormalizeDomain(config.Name, true, true, false)
+
+	// set default loader
+	if config.Load == nil {
+		name, path := config.Name, config.Path
+		config.Load = func(r io.Reader) (*Zone, error) {
+			return LoadZone(r, name, path)
+		}
+	}
+
+	// set default delay
+	if config.Delay <= 0 {
+		config.Delay = 100 * time.Millisecond
+	}
+
+	// set default timeout
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+
+	// prepare zone
+	fz := &FileZone{
+		config: config,
+		close:  make(chan struct{}),
+	}
+
+	// load zone
+	zone, err := fz.load()
+	if err != nil {
+		return nil, err
+	}
+
+	// set zone
+	fz.zone = zone
+
+	return fz, nil
+}
+
+// Zone returns the currently loaded zone.
+func (z *FileZone) Zone() *Zone {
+	// acquire lock
+	z.mutex.RLock()
+	defer z.mutex.RUnlock()
+
+	return z.zone
+}
+
+// Reload will load the file and replace the current zone. The serial is
+// bumped if it is not ahead of the current serial. Secondary servers are
+// notified asynchronously once the zone has been replaced. The current zone is
+// kept if the file cannot be loaded.
+func (z *FileZone) Reload() error {
+	// load zone
+	zone, err := z.load()
+	if err != nil {
+		return err
+	}
+
+	// acquire lock
+	z.mutex.Lock()
+
+	// bump serial if not ahead
+	if !serialLess(z.zone.Serial, zone.Serial) {
+		zone.Serial = DateSerial(time.Now(), z.zone.Serial)
+	}
+
+	// set zone
+	z.zone = zone
+
+	// release lock
+	z.mutex.Unlock()
+
+	// notify secondaries
+	for _, addr := range z.config.Notify {
+		go z.notify(addr)
+	}
+
+	return nil
+}
+
+// Run will watch the file and reload the zone on changes until the file zone
+// is closed. The directory of the file is watched to also detect files that
+// are replaced by renaming.
+func (z *FileZone) Run() error {
+	// create watcher
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	// watch directory
+	err = watcher.Add(filepath.Dir(z.config.Path))
+	if err != nil {
+		return err
+	}
+
+	// prepare timer
+	var timer <-chan time.Time
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+
+			// schedule reload if file changed
+			if filepath.Clean(event.Name) == filepath.Clean(z.config.Path) && !event.Has(fsnotify.Chmod) {
+				timer = time.After(z.config.Delay)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log(z.config.Logger, BackendError, nil, err, "")
+		case <-timer:
+			timer = nil
+
+			// reload zone
+			err := z.Reload()
+			if err != nil {
+				log(z.config.Logger, BackendError, nil, err, "")
+			}
+		case <-z.close:
+			return nil
+		}
+	}
+}
+
+// Close will stop watching the file.
+func (z *FileZone) Close() {
+	z.once.Do(func() {
+		close(z.close)
+	})
+}
+
+func (z *FileZone) load() (*Zone, error) {
+	// open file
+	file, err := os.Open(z.config.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// load zone
+	zone, err := z.config.Load(file)
+	if err != nil {
+		return nil, err
+	}
+
+	// check name
+	if NormalizeDomain(zone.Name, true, true, false) != z.config.Name {
+		return nil, errors.New("zone name does not match file zone")
+	}
+
+	return zone, nil
+}
+
+func (z *FileZone) notify(addr string) {
+	// prepare client
+	client := dns.Client{
+		Timeout: z.config.Timeout,
+	}
+
+	// prepare request
+	req := new(dns.Msg)
+	req.SetNotify(z.config.Name)
+
+	// notify secondary
+	_, _, err := client.Exchange(req, addr)
+	if err != nil {
+		log(z.config.Logger, NetworkError, nil, err, "")
+	}
+}
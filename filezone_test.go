@@ -0,0 +1,94 @@
+package newdns
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileZone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "newdns")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "example.com.zone")
+	err = ioutil.WriteFile(path, []byte(testZoneFile), 0644)
+	assert.NoError(t, err)
+
+	notified := make(chan struct{}, 1)
+	secondary, err := NewStaticZone("example.com.", map[string][]Set{}, func(zone *Zone) {
+		zone.MasterNameServer = "ns1.example.com."
+		zone.AllNameServers = []string{"ns1.example.com."}
+		zone.Notify = func(net.Addr) {
+			notified <- struct{}{}
+		}
+	})
+	assert.NoError(t, err)
+
+	server := NewServer(Config{
+		Handler: testHandler(secondary),
+	})
+
+	run(server, "127.0.0.1:0", func() {
+		fz, err := NewFileZone(FileConfig{
+			Name:   "example.com.",
+			Path:   path,
+			Notify: []string{server.Addr().String()},
+		})
+		assert.NoError(t, err)
+		defer fz.Close()
+
+		zone := fz.Zone()
+		assert.Equal(t, uint32(42), zone.Serial)
+
+		go func() {
+			_ = fz.Run()
+		}()
+
+		time.Sleep(50 * time.Millisecond)
+
+		// same serial
+		data := strings.Replace(testZoneFile, "1.2.3.4", "5.6.7.8", 1)
+		err = ioutil.WriteFile(path, []byte(data), 0644)
+		assert.NoError(t, err)
+
+		select {
+		case <-notified:
+		case <-time.After(time.Second):
+			t.Fatal("missing notify")
+		}
+
+		zone = fz.Zone()
+		assert.Equal(t, DateSerial(time.Now(), 42), zone.Serial)
+
+		res, _, err := zone.Lookup(context.Background(), "example.com.", A)
+		assert.NoError(t, err)
+		assert.Equal(t, "5.6.7.8", res[0].Records[0].Address)
+
+		// invalid file
+		err = ioutil.WriteFile(path, []byte("foo"), 0644)
+		assert.NoError(t, err)
+
+		time.Sleep(200 * time.Millisecond)
+		assert.Equal(t, zone, fz.Zone())
+
+		// closed twice
+		fz.Close()
+	})
+}
+
+func TestFileZoneMissing(t *testing.T) {
+	fz, err := NewFileZone(FileConfig{
+		Name: "example.com.",
+		Path: "missing.zone",
+	})
+	assert.Error(t, err)
+	assert.Nil(t, fz)
+}
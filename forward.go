@@ -0,0 +1,100 @@
+package newdns
+
+import (
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// FallbackPolicy defines how requests are forwarded to multiple fallback
+// servers.
+type FallbackPolicy int
+
+const (
+	// FallbackHedge queries the servers in the order of their response times
+	// and queries the next server if no response has been received after the
+	// fallback delay.
+	FallbackHedge FallbackPolicy = iota
+
+	// FallbackFailover queries the servers in the configured order and queries
+	// the next server if the previous failed. Servers that failed repeatedly
+	// are skipped until they pass a periodic health probe.
+	FallbackFailover
+)
+
+// FailurePolicy defines how requests are handled that could not be forwarded.
+type FailurePolicy int
+
+const (
+	// FailureDrop drops the request by closing the connection.
+	FailureDrop FailurePolicy = iota
+
+	// FailureServerFailure answers the request with SERVFAIL.
+	FailureServerFailure
+)
+
+// forwardDelay is the time after which the next server of a forwarder is
+// queried.
+const forwardDelay = 100 * time.Millisecond
+
+// Forwarder returns a handler that forwards requests to the servers of the
+// most specific matching domain in the provided table. Requests for domains
+// with multiple servers are forwarded using a hedged proxy. Requests that do not
+// match a domain are served by the optional fallback handler or refused. The
+// optional logger is called with events about the processing of requests.
+func Forwarder(table map[string][]string, fallback dns.Handler, logger Logger) dns.Handler {
+	// prepare mux
+	mux := dns.NewServeMux()
+
+	// register proxies
+	for domain, addrs := range table {
+		mux.Handle(domain, forwardHandler(addrs, forwardDelay, proxyOptions{logger: logger}))
+	}
+
+	// register fallback if available
+	if fallback != nil {
+		if _, ok := table["."]; !ok {
+			mux.Handle(".", fallback)
+		}
+	}
+
+	return mux
+}
+
+func forwardHandler(addrs []string, delay time.Duration, opts proxyOptions) dns.Handler {
+	// use simple proxy for single server
+	if len(addrs) == 1 {
+		return proxy(addrs[0], opts)
+	}
+
+	return hedgedProxy(addrs, delay, opts)
+}
+
+func (s *Server) proxyOptions() proxyOptions {
+	return proxyOptions{
+		tls:      s.config.FallbackTLS,
+		timeout:  s.config.FallbackTimeout,
+		retries:  s.config.FallbackRetries,
+		failure:  s.config.FailurePolicy,
+		failures: s.config.BreakerFailures,
+		cooldown: s.config.BreakerTimeout,
+		logger:   s.config.Logger,
+	}
+}
+
+func (s *Server) forwardZone(w dns.ResponseWriter, req *dns.Msg, zone *Zone) {
+	// get proxy for the zone forwarders
+	key := strings.Join(zone.Forwarders, ",")
+	proxy, ok := s.proxies.Load(key)
+	if !ok {
+		var handler = forwardHandler(zone.Forwarders, s.config.FallbackDelay, s.proxyOptions())
+		if s.config.Tracer != nil {
+			handler = traceHandler(s.config.Tracer, "newdns.Forwarder", s.context, handler)
+		}
+		proxy, _ = s.proxies.LoadOrStore(key, handler)
+	}
+
+	// forward request
+	proxy.(dns.Handler).ServeDNS(w, req)
+}
@@ -0,0 +1,128 @@
+package newdns
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForwarder(t *testing.T) {
+	upstream := func(ip string) dns.Handler {
+		return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			res := new(dns.Msg)
+			res.SetReply(req)
+			res.Answer = append(res.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.ParseIP(ip),
+			})
+			_ = w.WriteMsg(res)
+		})
+	}
+
+	corp := "127.0.0.1:53051"
+	public := "127.0.0.1:53052"
+	addr := "127.0.0.1:53053"
+	other := "127.0.0.1:53054"
+
+	serve(upstream("10.0.0.1"), corp, func() {
+		serve(upstream("1.2.3.4"), public, func() {
+			handler := Forwarder(map[string][]string{
+				"corp.internal.": {corp},
+			}, Proxy(public, nil), nil)
+
+			serve(handler, addr, func() {
+				ret, err := Query("udp", addr, "host.corp.internal.", "A", nil)
+				assert.NoError(t, err)
+				assert.Len(t, ret.Answer, 1)
+				assert.Equal(t, "10.0.0.1", ret.Answer[0].(*dns.A).A.String())
+
+				ret, err = Query("udp", addr, "example.com.", "A", nil)
+				assert.NoError(t, err)
+				assert.Len(t, ret.Answer, 1)
+				assert.Equal(t, "1.2.3.4", ret.Answer[0].(*dns.A).A.String())
+			})
+
+			handler = Forwarder(map[string][]string{
+				"corp.internal.": {corp},
+			}, nil, nil)
+
+			serve(handler, other, func() {
+				ret, err := Query("udp", other, "example.com.", "A", nil)
+				assert.NoError(t, err)
+				assert.Equal(t, dns.RcodeRefused, ret.Rcode)
+			})
+		})
+	})
+}
+
+func TestZoneForwarders(t *testing.T) {
+	upstream := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		res := new(dns.Msg)
+		res.SetReply(req)
+		res.Answer = append(res.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.ParseIP("10.0.0.1"),
+		})
+		_ = w.WriteMsg(res)
+	})
+
+	newZone := func(zone string, forwarders []string) *Zone {
+		return &Zone{
+			Name:             zone,
+			MasterNameServer: "ns1.example.com.",
+			AllNameServers:   []string{"ns1.example.com."},
+			Handler: func(ctx context.Context, name string) ([]Set, error) {
+				if name == "" {
+					return []Set{
+						{Name: zone, Type: A, Records: []Record{{Address: "1.2.3.4"}}},
+					}, nil
+				}
+				return nil, nil
+			},
+			Forwarders: forwarders,
+		}
+	}
+
+	corp := newZone("corp.example.com.", []string{"127.0.0.1:53092"})
+	public := newZone("example.com.", nil)
+
+	server := NewServer(Config{
+		Zones: []string{"example.com."},
+		Handler: func(ctx context.Context, name string) (*Zone, error) {
+			if InZone("corp.example.com.", name) {
+				return corp, nil
+			}
+			return public, nil
+		},
+	})
+
+	addr := "127.0.0.1:53093"
+
+	serve(upstream, "127.0.0.1:53092", func() {
+		run(server, addr, func() {
+			ret, err := Query("udp", addr, "corp.example.com.", "A", nil)
+			assert.NoError(t, err)
+			assert.True(t, ret.Authoritative)
+			assert.Len(t, ret.Answer, 1)
+			assert.Equal(t, "1.2.3.4", ret.Answer[0].(*dns.A).A.String())
+
+			ret, err = Query("udp", addr, "host.corp.example.com.", "A", nil)
+			assert.NoError(t, err)
+			assert.False(t, ret.Authoritative)
+			assert.Len(t, ret.Answer, 1)
+			assert.Equal(t, "10.0.0.1", ret.Answer[0].(*dns.A).A.String())
+
+			ret, err = Query("udp", addr, "corp.example.com.", "MX", nil)
+			assert.NoError(t, err)
+			assert.Equal(t, dns.RcodeSuccess, ret.Rcode)
+			assert.Len(t, ret.Answer, 0)
+
+			ret, err = Query("udp", addr, "host.example.com.", "A", nil)
+			assert.NoError(t, err)
+			assert.Equal(t, dns.RcodeNameError, ret.Rcode)
+		})
+	})
+}
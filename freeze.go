@@ -0,0 +1,88 @@
+package newdns
+
+import (
+	"errors"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Freeze returns a validated copy of the zone that is served without further
+// validation. The name servers of the copy are sorted and its lists are not
+// shared with the zone, which may therefore be modified afterwards without
+// affecting the copy. The copy itself must not be modified.
+func (z *Zone) Freeze() (*Zone, error) {
+	// copy zone
+	zone := z.clone()
+
+	// copy lists
+	zone.AllNameServers = append([]string(nil), z.AllNameServers...)
+	zone.TSIGKeys = append([]string(nil), z.TSIGKeys...)
+	if z.DefaultTypeTTL != nil {
+		zone.DefaultTypeTTL = make(map[Type]time.Duration, len(z.DefaultTypeTTL))
+		for typ, ttl := range z.DefaultTypeTTL {
+			zone.DefaultTypeTTL[typ] = ttl
+		}
+	}
+	if z.UpdatePolicy != nil {
+		zone.UpdatePolicy = append(UpdatePolicy(nil), z.UpdatePolicy...)
+	}
+
+	// sort name servers
+	sort.Strings(zone.AllNameServers)
+
+	// validate zone
+	err := zone.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return zone, nil
+}
+
+// AtomicZone holds a frozen zone that may be replaced while it is served. It
+// allows editing zones live without interfering with in-flight requests.
+type AtomicZone struct {
+	value atomic.Value
+}
+
+// NewAtomicZone creates and returns a new atomic zone that holds a frozen copy
+// of the provided zone.
+func NewAtomicZone(zone *Zone) (*AtomicZone, error) {
+	// create atomic zone
+	az := &AtomicZone{}
+
+	// store zone
+	err := az.Store(zone)
+	if err != nil {
+		return nil, err
+	}
+
+	return az, nil
+}
+
+// Load returns the current frozen zone.
+func (z *AtomicZone) Load() *Zone {
+	zone, _ := z.value.Load().(*Zone)
+	return zone
+}
+
+// Store will freeze the provided zone and replace the current zone if the
+// zone is valid.
+func (z *AtomicZone) Store(zone *Zone) error {
+	// check zone
+	if zone == nil {
+		return errors.New("missing zone")
+	}
+
+	// freeze zone
+	frozen, err := zone.Freeze()
+	if err != nil {
+		return err
+	}
+
+	// store zone
+	z.value.Store(frozen)
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package newdns
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestZoneFreeze(t *testing.T) {
+	zone := &Zone{
+		Name:             "example.com.",
+		MasterNameServer: "ns2.example.com.",
+		AllNameServers: []string{
+			"ns2.example.com.",
+			"ns1.example.com.",
+		},
+	}
+
+	frozen, err := zone.Freeze()
+	assert.NoError(t, err)
+	assert.Equal(t, zoneValid, frozen.valid)
+	assert.Equal(t, []string{"ns1.example.com.", "ns2.example.com."}, frozen.AllNameServers)
+	assert.Equal(t, []string{"ns2.example.com.", "ns1.example.com."}, zone.AllNameServers)
+	assert.Equal(t, zoneUnvalidated, zone.valid)
+	assert.NotNil(t, frozen.soa)
+
+	zone.AllNameServers[0] = "ns3.example.com."
+	assert.Equal(t, "ns2.example.com.", frozen.AllNameServers[1])
+
+	_, err = (&Zone{Name: "example.com."}).Freeze()
+	assert.Error(t, err)
+}
+
+func TestAtomicZone(t *testing.T) {
+	zone := &Zone{
+		Name:             "example.com.",
+		MasterNameServer: "ns1.example.com.",
+		AllNameServers: []string{
+			"ns1.example.com.",
+		},
+		Serial: 1,
+	}
+
+	az, err := NewAtomicZone(zone)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1), az.Load().Serial)
+
+	zone.Serial = 2
+	assert.Equal(t, uint32(1), az.Load().Serial)
+
+	err = az.Store(zone)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2), az.Load().Serial)
+
+	err = az.Store(&Zone{Name: "example.com."})
+	assert.Error(t, err)
+	assert.Equal(t, uint32(2), az.Load().Serial)
+
+	server := NewServer(Config{
+		Handler: func(ctx context.Context, name string) (*Zone, error) {
+			return az.Load(), nil
+		},
+	})
+
+	run(server, "127.0.0.1:0", func() {
+		addr := server.Addr().String()
+
+		ret, err := Query("udp", addr, "example.com.", "SOA", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, uint32(2), ret.Answer[0].(*dns.SOA).Serial)
+
+		zone.Serial = 3
+		err = az.Store(zone)
+		assert.NoError(t, err)
+
+		ret, err = Query("udp", addr, "example.com.", "SOA", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, uint32(3), ret.Answer[0].(*dns.SOA).Serial)
+	})
+}
+
+func TestZoneClone(t *testing.T) {
+	zone := &Zone{}
+
+	// set all settings
+	value := reflect.ValueOf(zone).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		if !field.CanSet() {
+			continue
+		}
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString("x")
+		case reflect.Bool:
+			field.SetBool(true)
+		case reflect.Int, reflect.Int64:
+			field.SetInt(1)
+		case reflect.Uint32:
+			field.SetUint(1)
+		case reflect.Float64:
+			field.SetFloat(1)
+		case reflect.Slice:
+			field.Set(reflect.MakeSlice(field.Type(), 1, 1))
+		case reflect.Map:
+			field.Set(reflect.MakeMap(field.Type()))
+		case reflect.Func:
+			field.Set(reflect.MakeFunc(field.Type(), func([]reflect.Value) []reflect.Value { return nil }))
+		case reflect.Ptr:
+			field.Set(reflect.New(field.Type().Elem()))
+		case reflect.Interface:
+			field.Set(reflect.ValueOf(SetProviderFunc(nil)))
+		default:
+			t.Fatalf("unhandled field: %s", value.Type().Field(i).Name)
+		}
+	}
+
+	// check copy
+	clone := reflect.ValueOf(zone.clone()).Elem()
+	for i := 0; i < clone.NumField(); i++ {
+		if value.Field(i).CanSet() {
+			assert.False(t, clone.Field(i).IsZero(), value.Type().Field(i).Name)
+		}
+	}
+}
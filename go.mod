@@ -1,8 +1,19 @@
 module github.com/256dpi/newdns
 
-go 1.12
+go 1.21
 
 require (
+	github.com/fsnotify/fsnotify v1.7.0
 	github.com/miekg/dns v1.1.58
 	github.com/stretchr/testify v1.9.0
+	golang.org/x/net v0.22.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/mod v0.14.0 // indirect
+	golang.org/x/sys v0.18.0 // indirect
+	golang.org/x/tools v0.17.0 // indirect
 )
@@ -0,0 +1,170 @@
+package newdns
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// LoadRoute53 parses a zone from the JSON listing returned by the Route53
+// "ListResourceRecordSets" API e.g. using "aws route53 list-resource-record-sets
+// --hosted-zone-id ID > zone.json" and returns a static zone that serves its
+// records. The origin is the name of the hosted zone. The records of multivalue
+// answer sets with the same name and type are merged while sets with other
+// routing policies (e.g. weighted, latency or geolocation) cause an error as
+// they cannot be served statically. Alias records are skipped and returned as
+// warnings. Records of types that are not supported cause an error. See
+// LoadZone for how the SOA and NS records are mapped.
+func LoadRoute53(r io.Reader, origin string, opts ...ZoneOption) (*Zone, []string, error) {
+	// normalize name
+	name := NormalizeDomain(origin, true, true, false)
+
+	// decode listing
+	var listing struct {
+		ResourceRecordSets []struct {
+			Name             string `json:"Name"`
+			Type             string `json:"Type"`
+			TTL              uint32 `json:"TTL"`
+			SetIdentifier    string `json:"SetIdentifier"`
+			MultiValueAnswer bool   `json:"MultiValueAnswer"`
+			ResourceRecords  []struct {
+				Value string `json:"Value"`
+			} `json:"ResourceRecords"`
+			AliasTarget *struct {
+				DNSName string `json:"DNSName"`
+			} `json:"AliasTarget"`
+		} `json:"ResourceRecordSets"`
+	}
+	err := json.NewDecoder(r).Decode(&listing)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// parse records
+	var list []dns.RR
+	var warnings []string
+	for _, set := range listing.ResourceRecordSets {
+		// skip alias records
+		if set.AliasTarget != nil {
+			warnings = append(warnings, fmt.Sprintf("skipped %s alias record %s to %s", set.Type, set.Name, set.AliasTarget.DNSName))
+			continue
+		}
+
+		// check routing policy
+		if set.SetIdentifier != "" && !set.MultiValueAnswer {
+			return nil, nil, fmt.Errorf("unsupported routing policy of %s record %s: %s", set.Type, set.Name, set.SetIdentifier)
+		}
+
+		// Route53 escapes characters in names using octal codes
+		owner := unescapeOctal(set.Name)
+
+		for _, record := range set.ResourceRecords {
+			rr, err := parseRecord(owner, set.Type, set.TTL, record.Value)
+			if err != nil {
+				return nil, nil, err
+			}
+			list = append(list, rr)
+		}
+	}
+
+	// create zone
+	zone, err := zoneFromRRs(name, list, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return zone, warnings, nil
+}
+
+// LoadCloudDNS parses a zone from the JSON listing of Google Cloud DNS record
+// sets e.g. using "gcloud dns record-sets list --zone ZONE --format json >
+// zone.json" or the "rrsets" response of the API and returns a static zone
+// that serves its records. The origin is the DNS name of the managed zone.
+// Records of types that are not supported cause an error. See LoadZone for how
+// the SOA and NS records are mapped.
+func LoadCloudDNS(r io.Reader, origin string, opts ...ZoneOption) (*Zone, error) {
+	// normalize name
+	name := NormalizeDomain(origin, true, true, false)
+
+	// read listing
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// decode listing
+	type rrset struct {
+		Name    string   `json:"name"`
+		Type    string   `json:"type"`
+		TTL     uint32   `json:"ttl"`
+		RRDatas []string `json:"rrdatas"`
+	}
+	var rrsets []rrset
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		err = json.Unmarshal(data, &rrsets)
+	} else {
+		var res struct {
+			RRSets []rrset `json:"rrsets"`
+		}
+		err = json.Unmarshal(data, &res)
+		rrsets = res.RRSets
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// parse records
+	var list []dns.RR
+	for _, set := range rrsets {
+		for _, value := range set.RRDatas {
+			rr, err := parseRecord(set.Name, set.Type, set.TTL, value)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, rr)
+		}
+	}
+
+	return zoneFromRRs(name, list, opts...)
+}
+
+func parseRecord(name, typ string, ttl uint32, value string) (dns.RR, error) {
+	// parse record
+	rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(name), ttl, typ, value))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s record %s: %w", typ, name, err)
+	} else if rr == nil {
+		return nil, fmt.Errorf("empty %s record: %s", typ, name)
+	}
+
+	return rr, nil
+}
+
+func unescapeOctal(name string) string {
+	// check escapes
+	if !strings.Contains(name, `\`) {
+		return name
+	}
+
+	// replace octal escape sequences
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] == '\\' && i+3 < len(name) {
+			code, err := strconv.ParseUint(name[i+1:i+4], 8, 8)
+			if err == nil {
+				b.WriteByte(byte(code))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(name[i])
+	}
+
+	return b.String()
+}
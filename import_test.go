@@ -0,0 +1,102 @@
+package newdns
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testRoute53 = `{
+	"ResourceRecordSets": [
+		{"Name": "example.com.", "Type": "NS", "TTL": 172800, "ResourceRecords": [{"Value": "ns-1.awsdns-01.org."}, {"Value": "ns-2.awsdns-02.com."}]},
+		{"Name": "example.com.", "Type": "SOA", "TTL": 900, "ResourceRecords": [{"Value": "ns-1.awsdns-01.org. awsdns-hostmaster.amazon.com. 1 7200 900 1209600 86400"}]},
+		{"Name": "example.com.", "Type": "MX", "TTL": 300, "ResourceRecords": [{"Value": "10 mail.example.com."}]},
+		{"Name": "example.com.", "Type": "TXT", "TTL": 300, "ResourceRecords": [{"Value": "\"v=spf1 -all\""}]},
+		{"Name": "\\052.example.com.", "Type": "A", "TTL": 60, "ResourceRecords": [{"Value": "1.2.3.4"}]},
+		{"Name": "www.example.com.", "Type": "A", "SetIdentifier": "eu", "MultiValueAnswer": true, "TTL": 60, "ResourceRecords": [{"Value": "1.2.3.5"}]},
+		{"Name": "example.com.", "Type": "A", "AliasTarget": {"DNSName": "foo.cloudfront.net."}},
+		{"Name": "www.example.com.", "Type": "A", "SetIdentifier": "us", "MultiValueAnswer": true, "TTL": 30, "ResourceRecords": [{"Value": "1.2.3.6"}]}
+	]
+}`
+
+const testCloudDNS = `[
+	{"kind": "dns#resourceRecordSet", "name": "example.com.", "rrdatas": ["ns-cloud-a1.googledomains.com.", "ns-cloud-a2.googledomains.com."], "ttl": 21600, "type": "NS"},
+	{"kind": "dns#resourceRecordSet", "name": "example.com.", "rrdatas": ["ns-cloud-a1.googledomains.com. cloud-dns-hostmaster.google.com. 3 21600 3600 259200 300"], "ttl": 21600, "type": "SOA"},
+	{"kind": "dns#resourceRecordSet", "name": "www.example.com.", "rrdatas": ["example.com."], "ttl": 300, "type": "CNAME"},
+	{"kind": "dns#resourceRecordSet", "name": "_sip._tcp.example.com.", "rrdatas": ["10 20 5060 sip.example.com."], "ttl": 300, "type": "SRV"}
+]`
+
+func TestLoadRoute53(t *testing.T) {
+	zone, warnings, err := LoadRoute53(strings.NewReader(testRoute53), "example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"skipped A alias record example.com. to foo.cloudfront.net."}, warnings)
+	assert.Equal(t, "example.com.", zone.Name)
+	assert.Equal(t, "ns-1.awsdns-01.org.", zone.MasterNameServer)
+	assert.Equal(t, []string{"ns-1.awsdns-01.org.", "ns-2.awsdns-02.com."}, zone.AllNameServers)
+	assert.Equal(t, "awsdns-hostmaster@amazon.com", zone.AdminEmail)
+	assert.Equal(t, uint32(1), zone.Serial)
+	assert.Equal(t, 48*time.Hour, zone.NSTTL)
+
+	res, exists, err := zone.Lookup(context.Background(), "foo.example.com.", A)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, []Set{
+		{Name: "foo.example.com.", Type: A, Records: []Record{{Address: "1.2.3.4"}}, TTL: time.Minute},
+	}, res)
+
+	res, exists, err = zone.Lookup(context.Background(), "www.example.com.", A)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, []Set{
+		{Name: "www.example.com.", Type: A, Records: []Record{{Address: "1.2.3.5"}, {Address: "1.2.3.6"}}, TTL: 30 * time.Second},
+	}, res)
+
+	res, exists, err = zone.Lookup(context.Background(), "example.com.", TXT)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, []string{"v=spf1 -all"}, res[0].Records[0].Data)
+
+	res, exists, err = zone.Lookup(context.Background(), "example.com.", A)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.Empty(t, res)
+
+	_, _, err = LoadRoute53(strings.NewReader(`{"ResourceRecordSets": [
+		{"Name": "www.example.com.", "Type": "A", "SetIdentifier": "eu", "Weight": 10, "TTL": 60, "ResourceRecords": [{"Value": "1.2.3.5"}]},
+		{"Name": "www.example.com.", "Type": "A", "SetIdentifier": "us", "Weight": 20, "TTL": 60, "ResourceRecords": [{"Value": "1.2.3.6"}]}
+	]}`), "example.com.")
+	assert.Error(t, err)
+	assert.Equal(t, "unsupported routing policy of A record www.example.com.: eu", err.Error())
+}
+
+func TestLoadCloudDNS(t *testing.T) {
+	zone, err := LoadCloudDNS(strings.NewReader(testCloudDNS), "example.com.")
+	assert.NoError(t, err)
+	assert.Equal(t, "ns-cloud-a1.googledomains.com.", zone.MasterNameServer)
+	assert.Equal(t, uint32(3), zone.Serial)
+	assert.Equal(t, 6*time.Hour, zone.NSTTL)
+
+	res, exists, err := zone.Lookup(context.Background(), "_sip._tcp.example.com.", SRV)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, []Set{
+		{Name: "_sip._tcp.example.com.", Type: SRV, Records: []Record{{Address: "sip.example.com.", Priority: 10, Weight: 20, Port: 5060}}, TTL: 5 * time.Minute},
+	}, res)
+
+	zone, err = LoadCloudDNS(strings.NewReader(`{"rrsets": `+testCloudDNS+`}`), "example.com.")
+	assert.NoError(t, err)
+
+	res, exists, err = zone.Lookup(context.Background(), "www.example.com.", CNAME)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, []Record{{Address: "example.com."}}, res[0].Records)
+
+	_, err = LoadCloudDNS(strings.NewReader(`[
+		{"name": "example.com.", "rrdatas": ["0 issue \"ca.example.net\""], "ttl": 300, "type": "CAA"}
+	]`), "example.com.")
+	assert.Error(t, err)
+	assert.Equal(t, "unsupported record type: CAA", err.Error())
+}
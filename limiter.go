@@ -0,0 +1,103 @@
+package newdns
+
+import (
+	"container/list"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+const limiterSize = 10000
+
+type limiterKey struct {
+	zone   string
+	client string
+}
+
+type bucket struct {
+	key    limiterKey
+	tokens float64
+	rate   float64
+	burst  float64
+	last   time.Time
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// limiter keeps the buckets of the most recently seen keys up to the size.
+// The least recently used bucket is evicted when a new key is seen and the
+// limiter is full.
+type limiter struct {
+	size    int
+	mutex   sync.Mutex
+	buckets map[limiterKey]*list.Element
+	recent  *list.List
+}
+
+func newLimiter(size int) *limiter {
+	return &limiter{
+		size:    size,
+		buckets: map[limiterKey]*list.Element{},
+		recent:  list.New(),
+	}
+}
+
+func (l *limiter) allow(key limiterKey, rate float64, burst int, now time.Time) bool {
+	// get burst
+	size := float64(burst)
+	if burst <= 0 {
+		size = math.Max(1, math.Ceil(rate))
+	}
+
+	// acquire mutex
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// get bucket
+	var b *bucket
+	if elem, ok := l.buckets[key]; ok {
+		l.recent.MoveToFront(elem)
+		b = elem.Value.(*bucket)
+	} else {
+		// evict least recently used bucket if full
+		if l.recent.Len() >= l.size {
+			last := l.recent.Back()
+			l.recent.Remove(last)
+			delete(l.buckets, last.Value.(*bucket).key)
+		}
+
+		// add bucket
+		b = &bucket{key: key, tokens: size, last: now}
+		l.buckets[key] = l.recent.PushFront(b)
+	}
+
+	// update settings and refill
+	b.rate = rate
+	b.burst = size
+	b.refill(now)
+
+	// take token
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+
+	return true
+}
+
+func clientIP(remote net.Addr) string {
+	switch addr := remote.(type) {
+	case *net.UDPAddr:
+		return addr.IP.String()
+	case *net.TCPAddr:
+		return addr.IP.String()
+	case nil:
+		return ""
+	default:
+		return remote.String()
+	}
+}
@@ -0,0 +1,38 @@
+package newdns
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(3)
+	now := time.Now()
+	key := limiterKey{zone: "example.com."}
+
+	assert.True(t, l.allow(key, 2, 0, now))
+	assert.True(t, l.allow(key, 2, 0, now))
+	assert.False(t, l.allow(key, 2, 0, now))
+
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, l.allow(key, 2, 0, now))
+	assert.False(t, l.allow(key, 2, 0, now))
+
+	other := limiterKey{zone: "example.com.", client: "1.2.3.4"}
+	assert.True(t, l.allow(other, 1, 3, now))
+	assert.True(t, l.allow(other, 1, 3, now))
+	assert.True(t, l.allow(other, 1, 3, now))
+	assert.False(t, l.allow(other, 1, 3, now))
+
+	for i := 0; i < 3; i++ {
+		assert.True(t, l.allow(limiterKey{client: strconv.Itoa(i)}, 1, 1, now))
+	}
+	assert.Len(t, l.buckets, 3)
+	assert.Equal(t, 3, l.recent.Len())
+
+	assert.True(t, l.allow(other, 1, 3, now))
+	assert.Len(t, l.buckets, 3)
+}
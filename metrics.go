@@ -0,0 +1,479 @@
+package newdns
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultLatencyBuckets are the default buckets of the latency histogram in
+// seconds.
+var DefaultLatencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+type metricsKey struct {
+	zone  string
+	typ   string
+	rcode string
+}
+
+type upstreamKey struct {
+	upstream string
+	rcode    string
+}
+
+type upstreamRTT struct {
+	sum   float64
+	count uint64
+}
+
+// Metrics collects metrics from logging events and exposes them in the
+// Prometheus text exposition format. The "collector" module provides a
+// Prometheus collector to register the metrics with an existing registry. It may be used as the server logger and
+// forwards all events to an optional logger.
+type Metrics struct {
+	next      Logger
+	buckets   []float64
+	mutex     sync.Mutex
+	queries   map[metricsKey]uint64
+	counts    []uint64
+	sum       float64
+	count     uint64
+	truncated uint64
+	fallback  uint64
+	cached    uint64
+	backend   uint64
+	network   uint64
+	exchanges map[upstreamKey]uint64
+	rtts      map[string]*upstreamRTT
+	down      map[string]uint64
+	sinks     []StatsSink
+}
+
+// NewMetrics creates and returns a new metrics collector that forwards events
+// to the optional logger. If no buckets are provided, DefaultLatencyBuckets
+// are used.
+func NewMetrics(next Logger, buckets ...float64) *Metrics {
+	// set default buckets
+	if len(buckets) == 0 {
+		buckets = DefaultLatencyBuckets
+	}
+
+	// sort buckets
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+
+	return &Metrics{
+		next:      next,
+		buckets:   buckets,
+		queries:   map[metricsKey]uint64{},
+		counts:    make([]uint64, len(buckets)),
+		exchanges: map[upstreamKey]uint64{},
+		rtts:      map[string]*upstreamRTT{},
+		down:      map[string]uint64{},
+	}
+}
+
+// Log implements the Logger interface.
+func (m *Metrics) Log(entry Entry) {
+	// forward event
+	if m.next != nil {
+		m.next.Log(entry)
+	}
+
+	// acquire mutex
+	m.mutex.Lock()
+
+	// get sinks
+	sinks := m.sinks
+
+	// prepare sink updates
+	var name string
+	var tags map[string]string
+
+	switch entry.Event {
+	case Response:
+		if entry.Msg != nil && entry.Msg.Truncated {
+			m.truncated++
+			name = "truncated_responses"
+		}
+	case Finish:
+		if entry.Info == nil {
+			break
+		}
+
+		// get rcode
+		rcode := "NONE"
+		if entry.Info.ResponseSize > 0 {
+			rcode = dns.RcodeToString[entry.Info.Rcode]
+		}
+
+		// count query
+		key := metricsKey{
+			zone:  entry.Info.Zone,
+			typ:   dns.TypeToString[entry.Info.Question.Qtype],
+			rcode: rcode,
+		}
+		m.queries[key]++
+		name = "queries"
+		tags = map[string]string{
+			"zone":  key.zone,
+			"type":  key.typ,
+			"rcode": key.rcode,
+		}
+
+		// observe latency
+		seconds := entry.Info.Elapsed.Seconds()
+		for i, bucket := range m.buckets {
+			if seconds <= bucket {
+				m.counts[i]++
+			}
+		}
+		m.sum += seconds
+		m.count++
+	case ProxyRequest:
+		m.fallback++
+		name = "fallback_requests"
+	case ProxyCacheHit:
+		m.cached++
+		name = "fallback_cache_hits"
+	case BackendError:
+		m.backend++
+		name = "backend_errors"
+	case NetworkError:
+		m.network++
+		name = "network_errors"
+	case UpstreamExchange:
+		// get upstream and rcode
+		upstream, _ := fieldValue(entry.Fields, "upstream").(string)
+		rcode := "ERROR"
+		if entry.Error == nil && entry.Msg != nil {
+			rcode = dns.RcodeToString[entry.Msg.Rcode]
+		}
+
+		// count exchange
+		m.exchanges[upstreamKey{upstream: upstream, rcode: rcode}]++
+		name = "upstream_exchanges"
+		tags = map[string]string{
+			"upstream": upstream,
+			"rcode":    rcode,
+		}
+
+		// observe RTT
+		rtt, _ := fieldValue(entry.Fields, "rtt").(time.Duration)
+		if m.rtts[upstream] == nil {
+			m.rtts[upstream] = &upstreamRTT{}
+		}
+		m.rtts[upstream].sum += rtt.Seconds()
+		m.rtts[upstream].count++
+	case UpstreamDown:
+		upstream, _ := fieldValue(entry.Fields, "upstream").(string)
+		m.down[upstream]++
+		name = "upstream_down"
+		tags = map[string]string{
+			"upstream": upstream,
+		}
+	}
+
+	// release mutex
+	m.mutex.Unlock()
+
+	// update sinks
+	if name != "" {
+		for _, sink := range sinks {
+			sink.Count(name, tags, 1)
+			if entry.Event == Finish {
+				sink.Timing("query_duration", entry.Info.Elapsed)
+			} else if entry.Event == UpstreamExchange {
+				rtt, _ := fieldValue(entry.Fields, "rtt").(time.Duration)
+				sink.Timing("upstream_rtt", rtt)
+			}
+		}
+	}
+}
+
+// AddSink will add a sink that receives all counter and timing updates.
+func (m *Metrics) AddSink(sink StatsSink) {
+	// acquire mutex
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// add sink
+	m.sinks = append(m.sinks[:len(m.sinks):len(m.sinks)], sink)
+}
+
+// MetricFamily is a snapshot of the metrics with the same name.
+type MetricFamily struct {
+	// The name e.g. "newdns_queries_total".
+	Name string
+
+	// The description of the metrics.
+	Help string
+
+	// The type of the metrics: "counter", "histogram" or "summary".
+	Type string
+
+	// The label names of the metrics.
+	Labels []string
+
+	// The metrics of the family.
+	Metrics []Metric
+}
+
+// Metric is a snapshot of a single counter, histogram or summary.
+type Metric struct {
+	// The label values in the order of the family label names.
+	Values []string
+
+	// The value of a counter.
+	Value uint64
+
+	// The number and sum of observations of a histogram or summary.
+	Count uint64
+	Sum   float64
+
+	// The cumulative bucket counts of a histogram.
+	Buckets []Bucket
+}
+
+// Bucket is a cumulative histogram bucket.
+type Bucket struct {
+	// The inclusive upper bound.
+	Bound float64
+
+	// The number of observations less or equal than the bound.
+	Count uint64
+}
+
+// Families returns a snapshot of all metric families sorted by their label
+// values. It allows exporting the metrics to other systems e.g. using a
+// Prometheus collector.
+func (m *Metrics) Families() []MetricFamily {
+	// acquire mutex
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// sort query keys
+	keys := make([]metricsKey, 0, len(m.queries))
+	for key := range m.queries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.zone != b.zone {
+			return a.zone < b.zone
+		} else if a.typ != b.typ {
+			return a.typ < b.typ
+		}
+		return a.rcode < b.rcode
+	})
+
+	// add queries
+	queries := MetricFamily{
+		Name:   "newdns_queries_total",
+		Help:   "The number of processed queries.",
+		Type:   "counter",
+		Labels: []string{"zone", "type", "rcode"},
+	}
+	for _, key := range keys {
+		queries.Metrics = append(queries.Metrics, Metric{
+			Values: []string{key.zone, key.typ, key.rcode},
+			Value:  m.queries[key],
+		})
+	}
+	families := []MetricFamily{queries}
+
+	// add latency
+	buckets := make([]Bucket, 0, len(m.buckets))
+	for i, bound := range m.buckets {
+		buckets = append(buckets, Bucket{Bound: bound, Count: m.counts[i]})
+	}
+	families = append(families, MetricFamily{
+		Name: "newdns_query_duration_seconds",
+		Help: "The duration of processed queries.",
+		Type: "histogram",
+		Metrics: []Metric{{
+			Count:   m.count,
+			Sum:     m.sum,
+			Buckets: buckets,
+		}},
+	})
+
+	// add counters
+	for _, counter := range []struct {
+		name  string
+		help  string
+		value uint64
+	}{
+		{"newdns_truncated_responses_total", "The number of truncated responses.", m.truncated},
+		{"newdns_fallback_requests_total", "The number of requests forwarded to the fallback.", m.fallback},
+		{"newdns_fallback_cache_hits_total", "The number of requests answered from the fallback cache.", m.cached},
+		{"newdns_backend_errors_total", "The number of errors returned by handlers.", m.backend},
+		{"newdns_network_errors_total", "The number of network errors.", m.network},
+	} {
+		families = append(families, MetricFamily{
+			Name:    counter.name,
+			Help:    counter.help,
+			Type:    "counter",
+			Metrics: []Metric{{Value: counter.value}},
+		})
+	}
+
+	// sort upstream keys
+	upstreamKeys := make([]upstreamKey, 0, len(m.exchanges))
+	for key := range m.exchanges {
+		upstreamKeys = append(upstreamKeys, key)
+	}
+	sort.Slice(upstreamKeys, func(i, j int) bool {
+		a, b := upstreamKeys[i], upstreamKeys[j]
+		if a.upstream != b.upstream {
+			return a.upstream < b.upstream
+		}
+		return a.rcode < b.rcode
+	})
+
+	// add upstream exchanges
+	exchanges := MetricFamily{
+		Name:   "newdns_upstream_exchanges_total",
+		Help:   "The number of exchanges with upstream servers.",
+		Type:   "counter",
+		Labels: []string{"upstream", "rcode"},
+	}
+	for _, key := range upstreamKeys {
+		exchanges.Metrics = append(exchanges.Metrics, Metric{
+			Values: []string{key.upstream, key.rcode},
+			Value:  m.exchanges[key],
+		})
+	}
+	families = append(families, exchanges)
+
+	// add upstream RTTs
+	rtts := MetricFamily{
+		Name:   "newdns_upstream_rtt_seconds",
+		Help:   "The round-trip time of exchanges with upstream servers.",
+		Type:   "summary",
+		Labels: []string{"upstream"},
+	}
+	upstreams := make([]string, 0, len(m.rtts))
+	for upstream := range m.rtts {
+		upstreams = append(upstreams, upstream)
+	}
+	sort.Strings(upstreams)
+	for _, upstream := range upstreams {
+		rtts.Metrics = append(rtts.Metrics, Metric{
+			Values: []string{upstream},
+			Count:  m.rtts[upstream].count,
+			Sum:    m.rtts[upstream].sum,
+		})
+	}
+	families = append(families, rtts)
+
+	// add upstream downs
+	downs := MetricFamily{
+		Name:   "newdns_upstream_down_total",
+		Help:   "The number of times upstream servers have been skipped due to failures.",
+		Type:   "counter",
+		Labels: []string{"upstream"},
+	}
+	upstreams = make([]string, 0, len(m.down))
+	for upstream := range m.down {
+		upstreams = append(upstreams, upstream)
+	}
+	sort.Strings(upstreams)
+	for _, upstream := range upstreams {
+		downs.Metrics = append(downs.Metrics, Metric{
+			Values: []string{upstream},
+			Value:  m.down[upstream],
+		})
+	}
+	families = append(families, downs)
+
+	return families
+}
+
+// WriteTo will write the metrics in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	// prepare writer
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+
+	// write families
+	for _, family := range m.Families() {
+		fmt.Fprintf(bw, "# HELP %s %s\n", family.Name, family.Help)
+		fmt.Fprintf(bw, "# TYPE %s %s\n", family.Name, family.Type)
+		for _, metric := range family.Metrics {
+			labels := formatLabels(family.Labels, metric.Values)
+			switch family.Type {
+			case "histogram":
+				for _, bucket := range metric.Buckets {
+					fmt.Fprintf(bw, "%s_bucket{le=\"%g\"} %d\n", family.Name, bucket.Bound, bucket.Count)
+				}
+				fmt.Fprintf(bw, "%s_bucket{le=\"+Inf\"} %d\n", family.Name, metric.Count)
+				fmt.Fprintf(bw, "%s_sum%s %g\n", family.Name, labels, metric.Sum)
+				fmt.Fprintf(bw, "%s_count%s %d\n", family.Name, labels, metric.Count)
+			case "summary":
+				fmt.Fprintf(bw, "%s_sum%s %g\n", family.Name, labels, metric.Sum)
+				fmt.Fprintf(bw, "%s_count%s %d\n", family.Name, labels, metric.Count)
+			default:
+				fmt.Fprintf(bw, "%s%s %d\n", family.Name, labels, metric.Value)
+			}
+		}
+	}
+
+	// flush writer
+	err := bw.Flush()
+
+	return cw.n, err
+}
+
+// ServeHTTP implements the http.Handler interface to allow scraping.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = m.WriteTo(w)
+}
+
+func fieldValue(fields []Field, key string) interface{} {
+	for _, field := range fields {
+		if field.Key == key {
+			return field.Value
+		}
+	}
+
+	return nil
+}
+
+func formatLabels(names, values []string) string {
+	// check labels
+	if len(names) == 0 {
+		return ""
+	}
+
+	// format labels
+	pairs := make([]string, 0, len(names))
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", name, escapeLabel(values[i])))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\"", "\\\"").Replace(value)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,88 @@
+package newdns
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	var forwarded int
+	metrics := NewMetrics(LoggerFunc(func(entry Entry) {
+		forwarded++
+	}), 0.01, 0.1)
+
+	info := &EventInfo{
+		Remote:       &net.UDPAddr{},
+		Transport:    "udp",
+		Question:     dns.Question{Name: "example.com.", Qtype: dns.TypeA},
+		Zone:         "example.com.",
+		Rcode:        dns.RcodeSuccess,
+		ResponseSize: 100,
+		Elapsed:      50 * time.Millisecond,
+	}
+
+	metrics.Log(Entry{Event: Response, Msg: &dns.Msg{MsgHdr: dns.MsgHdr{Truncated: true}}})
+	metrics.Log(Entry{Event: Finish, Info: info})
+	metrics.Log(Entry{Event: BackendError, Error: errors.New("foo")})
+	metrics.Log(Entry{Event: ProxyRequest})
+	metrics.Log(Entry{Event: UpstreamExchange, Msg: &dns.Msg{}, Fields: []Field{
+		{Key: "upstream", Value: "1.1.1.1:53"},
+		{Key: "rtt", Value: 250 * time.Millisecond},
+	}})
+	metrics.Log(Entry{Event: UpstreamExchange, Error: errors.New("foo"), Fields: []Field{
+		{Key: "upstream", Value: "1.1.1.1:53"},
+		{Key: "rtt", Value: 500 * time.Millisecond},
+	}})
+	metrics.Log(Entry{Event: UpstreamDown, Fields: []Field{
+		{Key: "upstream", Value: "1.1.1.1:53"},
+	}})
+	assert.Equal(t, 7, forwarded)
+
+	var buf bytes.Buffer
+	n, err := metrics.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(buf.Len()), n)
+	assert.Equal(t, `# HELP newdns_queries_total The number of processed queries.
+# TYPE newdns_queries_total counter
+newdns_queries_total{zone="example.com.",type="A",rcode="NOERROR"} 1
+# HELP newdns_query_duration_seconds The duration of processed queries.
+# TYPE newdns_query_duration_seconds histogram
+newdns_query_duration_seconds_bucket{le="0.01"} 0
+newdns_query_duration_seconds_bucket{le="0.1"} 1
+newdns_query_duration_seconds_bucket{le="+Inf"} 1
+newdns_query_duration_seconds_sum 0.05
+newdns_query_duration_seconds_count 1
+# HELP newdns_truncated_responses_total The number of truncated responses.
+# TYPE newdns_truncated_responses_total counter
+newdns_truncated_responses_total 1
+# HELP newdns_fallback_requests_total The number of requests forwarded to the fallback.
+# TYPE newdns_fallback_requests_total counter
+newdns_fallback_requests_total 1
+# HELP newdns_fallback_cache_hits_total The number of requests answered from the fallback cache.
+# TYPE newdns_fallback_cache_hits_total counter
+newdns_fallback_cache_hits_total 0
+# HELP newdns_backend_errors_total The number of errors returned by handlers.
+# TYPE newdns_backend_errors_total counter
+newdns_backend_errors_total 1
+# HELP newdns_network_errors_total The number of network errors.
+# TYPE newdns_network_errors_total counter
+newdns_network_errors_total 0
+# HELP newdns_upstream_exchanges_total The number of exchanges with upstream servers.
+# TYPE newdns_upstream_exchanges_total counter
+newdns_upstream_exchanges_total{upstream="1.1.1.1:53",rcode="ERROR"} 1
+newdns_upstream_exchanges_total{upstream="1.1.1.1:53",rcode="NOERROR"} 1
+# HELP newdns_upstream_rtt_seconds The round-trip time of exchanges with upstream servers.
+# TYPE newdns_upstream_rtt_seconds summary
+newdns_upstream_rtt_seconds_sum{upstream="1.1.1.1:53"} 0.75
+newdns_upstream_rtt_seconds_count{upstream="1.1.1.1:53"} 2
+# HELP newdns_upstream_down_total The number of times upstream servers have been skipped due to failures.
+# TYPE newdns_upstream_down_total counter
+newdns_upstream_down_total{upstream="1.1.1.1:53"} 1
+`, buf.String())
+}
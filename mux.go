@@ -0,0 +1,127 @@
+package newdns
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ZoneMux manages a set of zones that can be added, removed and replaced at
+// runtime. Its Handle method may be used as the server handler and returns
+// the zone with the longest matching name.
+type ZoneMux struct {
+	mutex sync.RWMutex
+	zones map[string]*Zone
+}
+
+// NewZoneMux creates and returns a new zone mux.
+func NewZoneMux() *ZoneMux {
+	return &ZoneMux{
+		zones: map[string]*Zone{},
+	}
+}
+
+// Add will validate and add the provided zone. It returns an error if the
+// zone is invalid or a zone with the same name has already been added.
+func (m *ZoneMux) Add(zone *Zone) error {
+	// validate zone
+	err := zone.validate()
+	if err != nil {
+		return err
+	}
+
+	// acquire mutex
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// check existing
+	name := strings.ToLower(zone.Name)
+	if _, ok := m.zones[name]; ok {
+		return fmt.Errorf("zone already added: %s", zone.Name)
+	}
+
+	// add zone
+	m.zones[name] = zone
+
+	return nil
+}
+
+// Replace will validate the provided zone and add it or replace the zone with
+// the same name.
+func (m *ZoneMux) Replace(zone *Zone) error {
+	// validate zone
+	err := zone.validate()
+	if err != nil {
+		return err
+	}
+
+	// acquire mutex
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// set zone
+	m.zones[strings.ToLower(zone.Name)] = zone
+
+	return nil
+}
+
+// Remove will remove the zone with the specified name. It returns whether a
+// zone has been removed.
+func (m *ZoneMux) Remove(name string) bool {
+	// acquire mutex
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// remove zone
+	name = NormalizeDomain(name, true, true, false)
+	_, ok := m.zones[name]
+	delete(m.zones, name)
+
+	return ok
+}
+
+// Zones returns the sorted names of all added zones.
+func (m *ZoneMux) Zones() []string {
+	// acquire mutex
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	// collect names
+	list := make([]string, 0, len(m.zones))
+	for name := range m.zones {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+
+	return list
+}
+
+// Zone returns the zone with the longest name that matches the provided name.
+// It implements the ZoneProvider interface.
+func (m *ZoneMux) Zone(ctx context.Context, name string) (*Zone, error) {
+	return m.Handle(ctx, name)
+}
+
+// Handle returns the zone with the longest name that matches the provided
+// name. It implements the server handler.
+func (m *ZoneMux) Handle(_ context.Context, name string) (*Zone, error) {
+	// acquire mutex
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	// find most specific zone
+	for _, suffix := range SplitDomain(strings.ToLower(name), true) {
+		if zone, ok := m.zones[suffix+"."]; ok {
+			return zone, nil
+		}
+	}
+
+	// check root zone
+	if zone, ok := m.zones["."]; ok {
+		return zone, nil
+	}
+
+	return nil, nil
+}
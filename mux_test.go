@@ -0,0 +1,60 @@
+package newdns
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestZoneMux(t *testing.T) {
+	newZone := func(name string) *Zone {
+		return &Zone{
+			Name:             name,
+			MasterNameServer: "ns1.example.com.",
+			AllNameServers:   []string{"ns1.example.com."},
+			Handler: func(ctx context.Context, name string) ([]Set, error) {
+				return nil, nil
+			},
+		}
+	}
+
+	mux := NewZoneMux()
+
+	err := mux.Add(&Zone{Name: "foo"})
+	assert.Error(t, err)
+
+	example := newZone("example.com.")
+	assert.NoError(t, mux.Add(example))
+	assert.Error(t, mux.Add(newZone("example.com.")))
+
+	sub := newZone("sub.example.com.")
+	assert.NoError(t, mux.Add(sub))
+	assert.Equal(t, []string{"example.com.", "sub.example.com."}, mux.Zones())
+
+	zone, err := mux.Handle(context.Background(), "foo.example.com.")
+	assert.NoError(t, err)
+	assert.Equal(t, example, zone)
+
+	zone, err = mux.Handle(context.Background(), "foo.SUB.example.com.")
+	assert.NoError(t, err)
+	assert.Equal(t, sub, zone)
+
+	zone, err = mux.Handle(context.Background(), "example.org.")
+	assert.NoError(t, err)
+	assert.Nil(t, zone)
+
+	replaced := newZone("sub.example.com.")
+	assert.NoError(t, mux.Replace(replaced))
+
+	zone, err = mux.Handle(context.Background(), "sub.example.com.")
+	assert.NoError(t, err)
+	assert.True(t, zone == replaced)
+
+	assert.True(t, mux.Remove("sub.example.com"))
+	assert.False(t, mux.Remove("sub.example.com"))
+
+	zone, err = mux.Handle(context.Background(), "sub.example.com.")
+	assert.NoError(t, err)
+	assert.Equal(t, example, zone)
+}
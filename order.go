@@ -0,0 +1,118 @@
+package newdns
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// Order defines the order of the records of a set in responses.
+type Order int
+
+const (
+	// OrderHandler keeps the order returned by the handler.
+	OrderHandler Order = iota
+
+	// OrderRotate rotates the records of A and AAAA sets for every response
+	// to distribute the load between the addresses.
+	OrderRotate
+
+	// OrderStable sorts the records deterministically by priority, address
+	// and data to return the same order from all servers.
+	OrderStable
+
+	// OrderShuffle shuffles the records of all sets randomly for every
+	// response.
+	OrderShuffle
+)
+
+func (s *Server) order(order Order, set Set) Set {
+	// check set
+	if order == OrderHandler || len(set.Records) < 2 {
+		return set
+	}
+
+	// handle rotation
+	if order == OrderRotate {
+		// check type
+		if set.Type != A && set.Type != AAAA {
+			return set
+		}
+
+		// get offset
+		n := len(set.Records)
+		off := int(atomic.AddUint64(&s.rotation, 1) % uint64(n))
+
+		// rotate records
+		records := make([]Record, 0, n)
+		records = append(records, set.Records[off:]...)
+		records = append(records, set.Records[:off]...)
+		set.Records = records
+
+		return set
+	}
+
+	// copy records
+	records := make([]Record, len(set.Records))
+	copy(records, set.Records)
+	set.Records = records
+
+	// shuffle records
+	if order == OrderShuffle {
+		rand.Shuffle(len(records), func(i, j int) {
+			records[i], records[j] = records[j], records[i]
+		})
+		return set
+	}
+
+	// sort records
+	sort.SliceStable(records, func(i, j int) bool {
+		return compareRecords(set.Type, records[i], records[j]) < 0
+	})
+
+	return set
+}
+
+func compareRecords(typ Type, a, b Record) int {
+	// compare priority
+	if a.Priority != b.Priority {
+		if a.Priority < b.Priority {
+			return -1
+		}
+		return 1
+	}
+
+	// compare weight (higher first)
+	if a.Weight != b.Weight {
+		if a.Weight > b.Weight {
+			return -1
+		}
+		return 1
+	}
+
+	// compare addresses numerically
+	if typ == A || typ == AAAA {
+		if c := bytes.Compare(net.ParseIP(a.Address).To16(), net.ParseIP(b.Address).To16()); c != 0 {
+			return c
+		}
+	}
+
+	// compare addresses
+	if c := strings.Compare(strings.ToLower(a.Address), strings.ToLower(b.Address)); c != 0 {
+		return c
+	}
+
+	// compare port
+	if a.Port != b.Port {
+		if a.Port < b.Port {
+			return -1
+		}
+		return 1
+	}
+
+	// compare data
+	return strings.Compare(strings.Join(a.Data, "\x00"), strings.Join(b.Data, "\x00"))
+}
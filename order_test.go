@@ -0,0 +1,56 @@
+package newdns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrder(t *testing.T) {
+	server := NewServer(Config{})
+
+	set := Set{
+		Name: "example.com.",
+		Type: A,
+		Records: []Record{
+			{Address: "10.0.0.1"},
+			{Address: "9.0.0.1"},
+			{Address: "1.2.3.4"},
+		},
+	}
+
+	assert.Equal(t, set, server.order(OrderHandler, set))
+
+	stable := server.order(OrderStable, set)
+	assert.Equal(t, []Record{
+		{Address: "1.2.3.4"},
+		{Address: "9.0.0.1"},
+		{Address: "10.0.0.1"},
+	}, stable.Records)
+	assert.Equal(t, "10.0.0.1", set.Records[0].Address)
+
+	rotated := server.order(OrderRotate, set)
+	assert.Equal(t, []Record{
+		{Address: "9.0.0.1"},
+		{Address: "1.2.3.4"},
+		{Address: "10.0.0.1"},
+	}, rotated.Records)
+
+	shuffled := server.order(OrderShuffle, set)
+	assert.ElementsMatch(t, set.Records, shuffled.Records)
+
+	mx := server.order(OrderStable, Set{
+		Name: "example.com.",
+		Type: MX,
+		Records: []Record{
+			{Address: "b.example.com.", Priority: 10},
+			{Address: "c.example.com.", Priority: 5},
+			{Address: "a.example.com.", Priority: 10},
+		},
+	})
+	assert.Equal(t, []Record{
+		{Address: "c.example.com.", Priority: 5},
+		{Address: "a.example.com.", Priority: 10},
+		{Address: "b.example.com.", Priority: 10},
+	}, mx.Records)
+}
@@ -0,0 +1,70 @@
+package newdns
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// OverloadPolicy defines how queries are handled that exceed the maximum number
+// of concurrently processed queries.
+type OverloadPolicy int
+
+const (
+	// OverloadDrop drops the query by leaving the connection hanging.
+	OverloadDrop OverloadPolicy = iota
+
+	// OverloadRefuse answers the query with REFUSED.
+	OverloadRefuse
+
+	// OverloadQueue waits for a slot until the queue timeout is reached and
+	// drops the query afterwards.
+	OverloadQueue
+)
+
+func (s *Server) admit(w dns.ResponseWriter, req *dns.Msg) bool {
+	// check limit
+	if s.slots == nil {
+		return true
+	}
+
+	// acquire slot if available
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	// handle overload
+	switch s.config.OverloadPolicy {
+	case OverloadRefuse:
+		log(s.config.Logger, Refused, nil, nil, "server overloaded")
+		res := new(dns.Msg)
+		res.SetRcode(req, dns.RcodeRefused)
+		err := w.WriteMsg(res)
+		if err != nil {
+			log(s.config.Logger, NetworkError, nil, err, "")
+			_ = w.Close()
+		}
+		return false
+	case OverloadQueue:
+		timer := time.NewTimer(s.config.QueueTimeout)
+		defer timer.Stop()
+		select {
+		case s.slots <- struct{}{}:
+			return true
+		case <-timer.C:
+		}
+	}
+
+	// drop query
+	log(s.config.Logger, Ignored, nil, nil, "server overloaded")
+
+	return false
+}
+
+func (s *Server) leave() {
+	if s.slots != nil {
+		<-s.slots
+	}
+}
@@ -0,0 +1,249 @@
+package newdns
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// pipeTimeout is the default timeout of upstream exchanges.
+const pipeTimeout = 2 * time.Second
+
+// pipeIdleTimeout is the duration after which idle upstream connections are
+// closed.
+const pipeIdleTimeout = 10 * time.Second
+
+var errPipeClosed = errors.New("upstream connection closed")
+
+type pipeKey struct {
+	network string
+	addr    string
+	tls     *tls.Config
+}
+
+var pipes = struct {
+	sync.Mutex
+	list map[pipeKey]*pipe
+}{
+	list: map[pipeKey]*pipe{},
+}
+
+type pipeQuery struct {
+	msg *dns.Msg
+	ch  chan *dns.Msg
+}
+
+// pipe is a persistent TCP or TLS connection to an upstream server that
+// pipelines queries by rewriting their IDs. UDP queries are not pipelined to
+// keep the source port of every query random. Pipes are removed once their
+// connection has been closed or could not be established.
+type pipe struct {
+	key     pipeKey
+	mutex   sync.Mutex
+	conn    *dns.Conn
+	pending map[uint16]pipeQuery
+	idle    *time.Timer
+}
+
+func getPipe(network, addr string, config *tls.Config) *pipe {
+	// acquire mutex
+	pipes.Lock()
+	defer pipes.Unlock()
+
+	// get or create pipe
+	key := pipeKey{network: network, addr: addr, tls: config}
+	p, ok := pipes.list[key]
+	if !ok {
+		p = &pipe{key: key}
+		pipes.list[key] = p
+	}
+
+	return p
+}
+
+func (p *pipe) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	// apply default timeout
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, pipeTimeout)
+		defer cancel()
+	}
+
+	// acquire mutex
+	p.mutex.Lock()
+
+	// ensure connection
+	if p.conn == nil {
+		var conn *dns.Conn
+		var err error
+		if p.key.network == "tcp-tls" {
+			conn, err = dns.DialTimeoutWithTLS(p.key.network, p.key.addr, p.key.tls, pipeTimeout)
+		} else {
+			conn, err = dns.DialTimeout(p.key.network, p.key.addr, pipeTimeout)
+		}
+		if err != nil {
+			p.evict()
+			p.mutex.Unlock()
+			return nil, err
+		}
+		p.conn = conn
+		p.pending = map[uint16]pipeQuery{}
+		go p.read(conn)
+	}
+
+	// stop idle timer
+	if p.idle != nil {
+		p.idle.Stop()
+	}
+
+	// allocate unused ID
+	msg := req.Copy()
+	for {
+		msg.Id = dns.Id()
+		if _, ok := p.pending[msg.Id]; !ok {
+			break
+		}
+	}
+
+	// register query
+	ch := make(chan *dns.Msg, 1)
+	p.pending[msg.Id] = pipeQuery{msg: msg, ch: ch}
+
+	// write query
+	conn := p.conn
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetWriteDeadline(deadline)
+	err := conn.WriteMsg(msg)
+	if err != nil {
+		p.close(conn)
+		p.mutex.Unlock()
+		return nil, err
+	}
+
+	// release mutex
+	p.mutex.Unlock()
+
+	// await response
+	var rs *dns.Msg
+	select {
+	case rs = <-ch:
+	case <-ctx.Done():
+	}
+
+	// unregister query and schedule reaping
+	p.mutex.Lock()
+	if p.pending[msg.Id].ch == ch {
+		delete(p.pending, msg.Id)
+	}
+	p.schedule()
+	p.mutex.Unlock()
+
+	// check response
+	if rs == nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, errPipeClosed
+	}
+
+	// restore ID
+	rs.Id = req.Id
+
+	return rs, nil
+}
+
+func (p *pipe) read(conn *dns.Conn) {
+	for {
+		// read response
+		rs, err := conn.ReadMsg()
+		if err != nil {
+			p.mutex.Lock()
+			p.close(conn)
+			p.mutex.Unlock()
+			return
+		}
+
+		// dispatch response
+		p.mutex.Lock()
+		if p.conn == conn {
+			query, ok := p.pending[rs.Id]
+			if ok && sameQuestion(query.msg, rs) {
+				delete(p.pending, rs.Id)
+				query.ch <- rs
+			}
+		}
+		p.mutex.Unlock()
+	}
+}
+
+func (p *pipe) close(conn *dns.Conn) {
+	// close connection
+	_ = conn.Close()
+
+	// check connection
+	if p.conn != conn {
+		return
+	}
+
+	// fail pending queries
+	for _, query := range p.pending {
+		close(query.ch)
+	}
+
+	// reset state
+	p.conn = nil
+	p.pending = nil
+
+	// remove pipe
+	p.evict()
+}
+
+func (p *pipe) evict() {
+	// acquire mutex
+	pipes.Lock()
+	defer pipes.Unlock()
+
+	// remove pipe if still registered
+	if pipes.list[p.key] == p {
+		delete(pipes.list, p.key)
+	}
+}
+
+func (p *pipe) schedule() {
+	// check connection and pending queries
+	if p.conn == nil || len(p.pending) > 0 {
+		return
+	}
+
+	// close connection when idle
+	conn := p.conn
+	p.idle = time.AfterFunc(pipeIdleTimeout, func() {
+		p.mutex.Lock()
+		if p.conn == conn && len(p.pending) == 0 {
+			p.close(conn)
+		}
+		p.mutex.Unlock()
+	})
+}
+
+func sameQuestion(a, b *dns.Msg) bool {
+	// check length
+	if len(a.Question) != len(b.Question) {
+		return false
+	}
+
+	// check questions
+	for i, q := range a.Question {
+		r := b.Question[i]
+		if !strings.EqualFold(q.Name, r.Name) || q.Qtype != r.Qtype || q.Qclass != r.Qclass {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,77 @@
+package newdns
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipe(t *testing.T) {
+	var mutex sync.Mutex
+	remotes := map[string]bool{}
+
+	upstream := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		mutex.Lock()
+		remotes[w.RemoteAddr().String()] = true
+		mutex.Unlock()
+
+		res := new(dns.Msg)
+		res.SetReply(req)
+		_ = w.WriteMsg(res)
+	})
+
+	addr := "127.0.0.1:53041"
+
+	serve(upstream, addr, func() {
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				req := new(dns.Msg)
+				req.SetQuestion("example.com.", dns.TypeA)
+
+				ret, err := getPipe("tcp", addr, nil).exchange(context.Background(), req)
+				assert.NoError(t, err)
+				assert.Equal(t, req.Id, ret.Id)
+				assert.Equal(t, req.Question, ret.Question)
+			}()
+		}
+		wg.Wait()
+
+		mutex.Lock()
+		assert.Len(t, remotes, 1)
+		remotes = map[string]bool{}
+		mutex.Unlock()
+
+		for i := 0; i < 10; i++ {
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+
+			ret, err := exchangeUDP(context.Background(), req, addr)
+			assert.NoError(t, err)
+			assert.Equal(t, req.Id, ret.Id)
+		}
+
+		mutex.Lock()
+		assert.Len(t, remotes, 10)
+		mutex.Unlock()
+	})
+}
+
+func TestPipeClosed(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	ret, err := getPipe("tcp", "127.0.0.1:53042", nil).exchange(context.Background(), req)
+	assert.Error(t, err)
+	assert.Nil(t, ret)
+
+	pipes.Lock()
+	assert.NotContains(t, pipes.list, pipeKey{network: "tcp", addr: "127.0.0.1:53042"})
+	pipes.Unlock()
+}
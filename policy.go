@@ -0,0 +1,146 @@
+package newdns
+
+import (
+	"net"
+	"strings"
+)
+
+// UpdateRule grants or denies dynamic updates similar to a BIND update-policy
+// statement. All configured conditions must match for the rule to apply.
+type UpdateRule struct {
+	// Whether matching updates are denied instead of granted.
+	Deny bool
+
+	// The names of the TSIG keys that must have signed the update. Use an
+	// empty list to match any key and unsigned updates.
+	Keys []string
+
+	// The networks in CIDR notation e.g. "10.0.0.0/8" the update must
+	// originate from. Invalid networks never match. Use an empty list to match
+	// any remote address.
+	Networks []string
+
+	// The names the update may change. Names prefixed with "*." match all
+	// subdomains of the name. Use an empty list to match any name.
+	Names []string
+
+	// Whether the changed name must equal the name of the TSIG key that signed
+	// the update. This allows tenants to only modify their own names.
+	Self bool
+
+	// The types the update may change. Deletions of whole names only match
+	// rules without types. Use an empty list to match any type.
+	Types []Type
+}
+
+// Match returns whether the rule applies to the specified update.
+func (r *UpdateRule) Match(key string, remote net.Addr, update Update) bool {
+	// normalize name and key
+	name := NormalizeDomain(update.Set.Name, true, true, false)
+	if key != "" {
+		key = NormalizeDomain(key, true, true, false)
+	}
+
+	// check keys
+	if len(r.Keys) > 0 && !matchKey(r.Keys, key) {
+		return false
+	}
+
+	// check networks
+	if len(r.Networks) > 0 && !matchNetwork(r.Networks, remote) {
+		return false
+	}
+
+	// check names
+	if len(r.Names) > 0 && !matchName(r.Names, name) {
+		return false
+	}
+
+	// check self
+	if r.Self && (key == "" || key != name) {
+		return false
+	}
+
+	// check types
+	if len(r.Types) > 0 && (update.Operation == DeleteName || !typeInList(r.Types, update.Set.Type)) {
+		return false
+	}
+
+	return true
+}
+
+// UpdatePolicy is an ordered list of update rules. The first rule that matches
+// an update decides whether it is granted. Updates that do not match any rule
+// are denied.
+type UpdatePolicy []UpdateRule
+
+// Allowed returns whether the specified update is granted by the policy.
+func (p UpdatePolicy) Allowed(key string, remote net.Addr, update Update) bool {
+	for _, rule := range p {
+		if rule.Match(key, remote, update) {
+			return !rule.Deny
+		}
+	}
+
+	return false
+}
+
+func matchKey(keys []string, key string) bool {
+	// check key
+	if key == "" {
+		return false
+	}
+
+	// find key
+	for _, item := range keys {
+		if NormalizeDomain(item, true, true, false) == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchNetwork(networks []string, remote net.Addr) bool {
+	// get IP
+	var ip net.IP
+	switch addr := remote.(type) {
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.TCPAddr:
+		ip = addr.IP
+	default:
+		return false
+	}
+
+	// find network
+	for _, item := range networks {
+		_, network, err := net.ParseCIDR(item)
+		if err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchName(names []string, name string) bool {
+	for _, item := range names {
+		// check wildcard
+		if strings.HasPrefix(item, "*.") {
+			parent := NormalizeDomain(item[2:], true, true, false)
+			if name != parent && InZone(parent, name) {
+				return true
+			}
+
+			continue
+		}
+
+		// check name
+		if NormalizeDomain(item, true, true, false) == name {
+			return true
+		}
+	}
+
+	return false
+}
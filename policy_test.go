@@ -0,0 +1,55 @@
+package newdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdatePolicy(t *testing.T) {
+	local := &net.UDPAddr{IP: net.ParseIP("10.0.0.1")}
+	remote := &net.UDPAddr{IP: net.ParseIP("1.2.3.4")}
+
+	policy := UpdatePolicy{
+		{
+			Deny:  true,
+			Names: []string{"ns1.example.com."},
+		},
+		{
+			Keys:  []string{"tenant.example.com."},
+			Self:  true,
+			Types: []Type{A, AAAA},
+		},
+		{
+			Keys:  []string{"acme.example.com."},
+			Names: []string{"*.example.com."},
+			Types: []Type{TXT},
+		},
+		{
+			Networks: []string{"10.0.0.0/8"},
+		},
+	}
+
+	add := func(name string, typ Type) Update {
+		return Update{
+			Operation: AddRecords,
+			Set:       Set{Name: name, Type: typ},
+		}
+	}
+
+	assert.True(t, policy.Allowed("tenant.example.com.", remote, add("tenant.example.com.", A)))
+	assert.False(t, policy.Allowed("tenant.example.com.", remote, add("tenant.example.com.", TXT)))
+	assert.False(t, policy.Allowed("tenant.example.com.", remote, add("other.example.com.", A)))
+	assert.False(t, policy.Allowed("tenant.example.com.", remote, Update{
+		Operation: DeleteName,
+		Set:       Set{Name: "tenant.example.com."},
+	}))
+
+	assert.True(t, policy.Allowed("acme.example.com.", remote, add("_acme-challenge.foo.example.com.", TXT)))
+	assert.False(t, policy.Allowed("acme.example.com.", remote, add("example.com.", TXT)))
+	assert.False(t, policy.Allowed("", remote, add("foo.example.com.", TXT)))
+
+	assert.True(t, policy.Allowed("", local, add("foo.example.com.", A)))
+	assert.False(t, policy.Allowed("", local, add("ns1.example.com.", A)))
+}
@@ -0,0 +1,66 @@
+package newdns
+
+import (
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+var msgPool = sync.Pool{
+	New: func() interface{} {
+		return new(dns.Msg)
+	},
+}
+
+func getMsg() *dns.Msg {
+	return msgPool.Get().(*dns.Msg)
+}
+
+func putMsg(msg *dns.Msg) {
+	// clear records
+	clearRRs(msg.Answer)
+	clearRRs(msg.Ns)
+	clearRRs(msg.Extra)
+
+	// reset message and keep sections
+	*msg = dns.Msg{
+		Question: msg.Question[:0],
+		Answer:   msg.Answer[:0],
+		Ns:       msg.Ns[:0],
+		Extra:    msg.Extra[:0],
+	}
+
+	msgPool.Put(msg)
+}
+
+func clearRRs(list []dns.RR) {
+	for i := range list {
+		list[i] = nil
+	}
+}
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 4096)
+		return &buf
+	},
+}
+
+func packMsg(msg *dns.Msg, fn func([]byte) error) error {
+	// get buffer
+	buf := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(buf)
+
+	// pack message
+	data, err := msg.PackBuffer(*buf)
+	if err != nil {
+		return err
+	}
+
+	// keep grown buffer
+	if cap(data) > cap(*buf) && cap(data) <= dns.MaxMsgSize {
+		*buf = data[:cap(data)]
+	}
+
+	return fn(data)
+}
@@ -0,0 +1,42 @@
+package newdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMsgPool(t *testing.T) {
+	msg := getMsg()
+	msg.SetQuestion("example.com.", dns.TypeA)
+	msg.Rcode = dns.RcodeNameError
+	msg.Answer = append(msg.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.ParseIP("1.2.3.4"),
+	})
+
+	answer := msg.Answer
+	putMsg(msg)
+	assert.Equal(t, dns.RcodeSuccess, msg.Rcode)
+	assert.Empty(t, msg.Question)
+	assert.Empty(t, msg.Answer)
+	assert.Nil(t, answer[0])
+}
+
+func TestPackMsg(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+
+	expected, err := msg.Pack()
+	assert.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		err = packMsg(msg, func(data []byte) error {
+			assert.Equal(t, expected, data)
+			return nil
+		})
+		assert.NoError(t, err)
+	}
+}
@@ -0,0 +1,324 @@
+package newdns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// PowerDNSConfig provides configuration for a PowerDNS remote backend.
+type PowerDNSConfig struct {
+	// The handler that returns the zone for a name. See Config.Handler.
+	Handler func(ctx context.Context, name string) (*Zone, error)
+
+	// The optional function that returns the names of all zones for the
+	// "getAllDomains" method e.g. ZoneMux.Zones.
+	Zones func() []string
+
+	// The path prefix of the URL configured in PowerDNS.
+	//
+	// Default: "/dnsapi".
+	Prefix string
+
+	// The logger called with errors returned by the handlers.
+	Logger Logger
+}
+
+// PowerDNS implements the HTTP connector of the PowerDNS remote backend. It
+// allows PowerDNS to serve zones provided by newdns handlers when configured
+// with e.g. "remote-connection-string=http:url=http://localhost:8080/dnsapi".
+// Requests using the "post_json" option are supported as well.
+//
+// The backend implements the "initialize", "lookup", "list", "getDomainInfo",
+// "getAllDomains", "getAllDomainMetadata" and "getDomainMetadata" methods.
+// Lookups return the sets of the name without following CNAME records as
+// PowerDNS resolves them itself. The SOA and NS records of the apex are
+// derived from the zone.
+type PowerDNS struct {
+	config PowerDNSConfig
+}
+
+// NewPowerDNS creates and returns a new PowerDNS remote backend.
+func NewPowerDNS(config PowerDNSConfig) *PowerDNS {
+	// set default prefix
+	if config.Prefix == "" {
+		config.Prefix = "/dnsapi"
+	}
+
+	return &PowerDNS{
+		config: config,
+	}
+}
+
+type powerDNSParams struct {
+	Qname    string `json:"qname"`
+	Qtype    string `json:"qtype"`
+	Zonename string `json:"zonename"`
+	Name     string `json:"name"`
+	Kind     string `json:"kind"`
+}
+
+type powerDNSRecord struct {
+	Qtype   string `json:"qtype"`
+	Qname   string `json:"qname"`
+	Content string `json:"content"`
+	TTL     uint32 `json:"ttl"`
+	Auth    bool   `json:"auth"`
+}
+
+type powerDNSDomain struct {
+	ID     uint32 `json:"id"`
+	Zone   string `json:"zone"`
+	Serial uint32 `json:"serial"`
+	Kind   string `json:"kind"`
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (p *PowerDNS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// parse request
+	var method string
+	var params powerDNSParams
+	if r.Method == http.MethodPost && strings.Contains(r.Header.Get("Content-Type"), "json") {
+		// decode body
+		var body struct {
+			Method     string         `json:"method"`
+			Parameters powerDNSParams `json:"parameters"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		method = body.Method
+		params = body.Parameters
+	} else {
+		// split path
+		path := strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(p.config.Prefix, "/"))
+		segments := strings.Split(strings.Trim(path, "/"), "/")
+		method = segments[0]
+
+		// get parameters
+		arg := func(i int) string {
+			if i < len(segments) {
+				return segments[i]
+			}
+			return ""
+		}
+		switch method {
+		case "lookup":
+			params.Qname, params.Qtype = arg(1), arg(2)
+		case "list":
+			params.Zonename = arg(2)
+		case "getDomainInfo", "getAllDomainMetadata":
+			params.Name = arg(1)
+		case "getDomainMetadata":
+			params.Name, params.Kind = arg(1), arg(2)
+		}
+	}
+
+	// handle method
+	result, err := p.handle(r.Context(), method, params)
+	if err != nil {
+		log(p.config.Logger, BackendError, nil, err, "")
+		result = false
+	}
+
+	// write result
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"result": result,
+	})
+}
+
+func (p *PowerDNS) handle(ctx context.Context, method string, params powerDNSParams) (interface{}, error) {
+	switch method {
+	case "initialize":
+		return true, nil
+	case "lookup":
+		return p.lookup(ctx, params.Qname, params.Qtype)
+	case "list":
+		return p.list(ctx, params.Zonename)
+	case "getDomainInfo":
+		// get zone
+		zone, err := p.zone(ctx, params.Name, true)
+		if err != nil || zone == nil {
+			return false, err
+		}
+
+		return domainInfo(zone), nil
+	case "getAllDomains":
+		// check function
+		if p.config.Zones == nil {
+			return []powerDNSDomain{}, nil
+		}
+
+		// collect domains
+		domains := make([]powerDNSDomain, 0)
+		for _, name := range p.config.Zones() {
+			zone, err := p.zone(ctx, name, true)
+			if err != nil {
+				return nil, err
+			} else if zone != nil {
+				domains = append(domains, domainInfo(zone))
+			}
+		}
+
+		return domains, nil
+	case "getAllDomainMetadata":
+		return map[string][]string{}, nil
+	case "getDomainMetadata":
+		return []string{}, nil
+	default:
+		return false, nil
+	}
+}
+
+func (p *PowerDNS) lookup(ctx context.Context, qname, qtype string) (interface{}, error) {
+	// get type
+	var typ uint16
+	if qtype != "ANY" {
+		typ = dns.StringToType[strings.ToUpper(qtype)]
+		if typ == 0 {
+			return false, nil
+		}
+	}
+
+	// check name
+	name := NormalizeDomain(qname, true, true, false)
+	if !IsDomain(name, true) {
+		return false, nil
+	}
+
+	// get zone
+	zone, err := p.zone(ctx, name, false)
+	if err != nil || zone == nil {
+		return false, err
+	}
+
+	// prepare records
+	var list []dns.RR
+
+	// add apex SOA and NS records
+	if name == zone.Name {
+		if typ == 0 || typ == dns.TypeSOA {
+			list = append(list, zone.soaRecord())
+		}
+		if typ == 0 || typ == dns.TypeNS {
+			list = append(list, zone.nsRecords(zone.Name)...)
+		}
+	}
+
+	// get sets
+	sets, err := zone.resolve(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// add sets
+	for _, set := range sets {
+		// validate set
+		err = zone.validateSet(&set)
+		if err != nil {
+			return nil, kindError(ErrValidation, fmt.Errorf("invalid set: %w", err))
+		}
+
+		// skip apex NS and other sets
+		if (set.Type == NS && name == zone.Name) || (typ != 0 && uint16(set.Type) != typ) {
+			continue
+		}
+
+		list = convertSet(list, name, zone, set)
+	}
+
+	// check records
+	if len(list) == 0 {
+		return false, nil
+	}
+
+	return powerDNSRecords(zone, list), nil
+}
+
+func (p *PowerDNS) list(ctx context.Context, zonename string) (interface{}, error) {
+	// get zone
+	zone, err := p.zone(ctx, zonename, true)
+	if err != nil || zone == nil || zone.Lister == nil {
+		return false, err
+	}
+
+	// add SOA and NS records
+	list := []dns.RR{zone.soaRecord()}
+	list = append(list, zone.nsRecords(zone.Name)...)
+
+	// list sets
+	err = zone.List(ctx, func(set Set) error {
+		list = convertSet(list, set.Name, zone, set)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return powerDNSRecords(zone, list), nil
+}
+
+func (p *PowerDNS) zone(ctx context.Context, name string, apex bool) (*Zone, error) {
+	// get zone
+	name = NormalizeDomain(name, true, true, false)
+	zone, err := p.config.Handler(ctx, name)
+	if err != nil {
+		return nil, kindError(ErrHandler, fmt.Errorf("server handler error: %w", err))
+	} else if zone == nil {
+		return nil, nil
+	}
+
+	// validate zone
+	err = zone.validate()
+	if err != nil {
+		return nil, kindError(ErrValidation, err)
+	}
+
+	// check apex
+	if apex && zone.Name != name {
+		return nil, nil
+	}
+
+	return zone.withSerial(), nil
+}
+
+func powerDNSRecords(zone *Zone, list []dns.RR) []powerDNSRecord {
+	// convert records
+	records := make([]powerDNSRecord, 0, len(list))
+	for _, rr := range list {
+		// get header
+		hdr := rr.Header()
+
+		// add record
+		records = append(records, powerDNSRecord{
+			Qtype:   dns.TypeToString[hdr.Rrtype],
+			Qname:   hdr.Name,
+			Content: strings.TrimPrefix(rr.String(), hdr.String()),
+			TTL:     hdr.Ttl,
+			Auth:    hdr.Rrtype != dns.TypeNS || hdr.Name == zone.Name,
+		})
+	}
+
+	return records
+}
+
+func domainInfo(zone *Zone) powerDNSDomain {
+	// derive a stable id
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(zone.Name))
+
+	return powerDNSDomain{
+		ID:     hash.Sum32() >> 1,
+		Zone:   zone.Name,
+		Serial: zone.Serial,
+		Kind:   "native",
+	}
+}
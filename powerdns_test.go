@@ -0,0 +1,92 @@
+package newdns
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPowerDNS(t *testing.T) {
+	zone, err := NewStaticZone("example.com.", map[string][]Set{
+		"": {
+			{Name: "example.com.", Type: NS, Records: []Record{{Address: "ns1.example.com."}, {Address: "ns2.example.com."}}},
+			{Name: "example.com.", Type: A, Records: []Record{{Address: "1.2.3.4"}}},
+		},
+		"www": {
+			{Name: "www.example.com.", Type: CNAME, Records: []Record{{Address: "example.com."}}},
+		},
+		"mail": {
+			{Name: "mail.example.com.", Type: MX, Records: []Record{{Address: "mx.example.com.", Priority: 10}}},
+			{Name: "mail.example.com.", Type: TXT, Records: []Record{{Data: []string{"foo", "bar"}}}},
+		},
+	}, func(zone *Zone) {
+		zone.Serial = 7
+		zone.NSTTL = time.Hour
+	})
+	assert.NoError(t, err)
+
+	mux := NewZoneMux()
+	assert.NoError(t, mux.Add(zone))
+
+	backend := NewPowerDNS(PowerDNSConfig{
+		Handler: mux.Handle,
+		Zones:   mux.Zones,
+	})
+
+	request := func(method, path, body string) string {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		rec := httptest.NewRecorder()
+		backend.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		return strings.TrimSpace(rec.Body.String())
+	}
+
+	res := request(http.MethodPost, "/dnsapi", `{"method": "initialize", "parameters": {}}`)
+	assert.Equal(t, `{"result":true}`, res)
+
+	res = request(http.MethodGet, "/dnsapi/lookup/www.example.com./ANY", "")
+	assert.Equal(t, `{"result":[{"qtype":"CNAME","qname":"www.example.com.","content":"example.com.","ttl":300,"auth":true}]}`, res)
+
+	res = request(http.MethodGet, "/dnsapi/lookup/mail.example.com/MX", "")
+	assert.Equal(t, `{"result":[{"qtype":"MX","qname":"mail.example.com.","content":"10 mx.example.com.","ttl":300,"auth":true}]}`, res)
+
+	res = request(http.MethodPost, "/dnsapi", `{"method": "lookup", "parameters": {"qname": "mail.example.com.", "qtype": "TXT"}}`)
+	assert.Equal(t, `{"result":[{"qtype":"TXT","qname":"mail.example.com.","content":"\"foo\" \"bar\"","ttl":300,"auth":true}]}`, res)
+
+	res = request(http.MethodGet, "/dnsapi/lookup/example.com./SOA", "")
+	assert.Equal(t, `{"result":[{"qtype":"SOA","qname":"example.com.","content":"ns1.example.com. hostmaster.example.com. 7 21600 3600 259200 300","ttl":900,"auth":true}]}`, res)
+
+	res = request(http.MethodGet, "/dnsapi/lookup/example.com./NS", "")
+	assert.Equal(t, `{"result":[{"qtype":"NS","qname":"example.com.","content":"ns1.example.com.","ttl":3600,"auth":true},{"qtype":"NS","qname":"example.com.","content":"ns2.example.com.","ttl":3600,"auth":true}]}`, res)
+
+	res = request(http.MethodGet, "/dnsapi/lookup/missing.example.com./ANY", "")
+	assert.Equal(t, `{"result":false}`, res)
+
+	res = request(http.MethodGet, "/dnsapi/lookup/example.org./ANY", "")
+	assert.Equal(t, `{"result":false}`, res)
+
+	res = request(http.MethodGet, "/dnsapi/list/-1/example.com.", "")
+	assert.Equal(t, 7, strings.Count(res, `"qtype"`))
+
+	res = request(http.MethodGet, "/dnsapi/getDomainInfo/example.com.", "")
+	assert.Contains(t, res, `"zone":"example.com.","serial":7,"kind":"native"`)
+
+	res = request(http.MethodGet, "/dnsapi/getDomainInfo/www.example.com.", "")
+	assert.Equal(t, `{"result":false}`, res)
+
+	res = request(http.MethodGet, "/dnsapi/getAllDomains", "")
+	assert.Contains(t, res, `"zone":"example.com."`)
+
+	res = request(http.MethodGet, "/dnsapi/getAllDomainMetadata/example.com.", "")
+	assert.Equal(t, `{"result":{}}`, res)
+
+	res = request(http.MethodGet, "/dnsapi/foo", "")
+	assert.Equal(t, `{"result":false}`, res)
+}
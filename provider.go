@@ -0,0 +1,34 @@
+package newdns
+
+import "context"
+
+// ZoneProvider provides the zones of a server. It may be used instead of the
+// server handler to compose, decorate and mock zone lookups more easily.
+type ZoneProvider interface {
+	// Zone returns the zone for the specified name. See Config.Handler.
+	Zone(ctx context.Context, name string) (*Zone, error)
+}
+
+// ZoneProviderFunc is a function that implements the ZoneProvider interface.
+type ZoneProviderFunc func(ctx context.Context, name string) (*Zone, error)
+
+// Zone implements the ZoneProvider interface.
+func (f ZoneProviderFunc) Zone(ctx context.Context, name string) (*Zone, error) {
+	return f(ctx, name)
+}
+
+// SetProvider provides the sets of a zone. It may be used instead of the zone
+// handler to compose, decorate and mock set lookups more easily.
+type SetProvider interface {
+	// Sets returns the sets for the specified name relative to the zone. See
+	// Zone.Handler.
+	Sets(ctx context.Context, name string) ([]Set, error)
+}
+
+// SetProviderFunc is a function that implements the SetProvider interface.
+type SetProviderFunc func(ctx context.Context, name string) ([]Set, error)
+
+// Sets implements the SetProvider interface.
+func (f SetProviderFunc) Sets(ctx context.Context, name string) ([]Set, error) {
+	return f(ctx, name)
+}
@@ -0,0 +1,66 @@
+package newdns
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+type testSetProvider map[string][]Set
+
+func (p testSetProvider) Sets(_ context.Context, name string) ([]Set, error) {
+	return p[name], nil
+}
+
+func TestProviders(t *testing.T) {
+	zone := &Zone{
+		Name:             "example.com.",
+		MasterNameServer: "ns1.example.com.",
+		AllNameServers: []string{
+			"ns1.example.com.",
+		},
+		Provider: testSetProvider{
+			"foo": {
+				{Name: "foo.example.com.", Type: A, Records: []Record{{Address: "1.2.3.4"}}},
+			},
+		},
+	}
+
+	mux := NewZoneMux()
+	assert.NoError(t, mux.Add(zone))
+
+	var mp ZoneProvider = mux
+
+	var calls int32
+	provider := ZoneProviderFunc(func(ctx context.Context, name string) (*Zone, error) {
+		atomic.AddInt32(&calls, 1)
+		return mp.Zone(ctx, name)
+	})
+
+	server := NewServer(Config{
+		Zones:    []string{"example.com."},
+		Provider: provider,
+	})
+
+	run(server, "127.0.0.1:0", func() {
+		addr := server.Addr().String()
+
+		ret, err := Query("udp", addr, "foo.example.com.", "A", nil)
+		assert.NoError(t, err)
+		assert.Len(t, ret.Answer, 1)
+		assert.Equal(t, "1.2.3.4", ret.Answer[0].(*dns.A).A.String())
+
+		ret, err = Query("udp", addr, "bar.example.com.", "A", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, dns.RcodeNameError, ret.Rcode)
+	})
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	sets, err := SetProviderFunc(zone.Handler).Sets(context.Background(), "foo")
+	assert.NoError(t, err)
+	assert.Len(t, sets, 1)
+}
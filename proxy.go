@@ -1,38 +1,344 @@
 package newdns
 
-import "github.com/miekg/dns"
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
 
-// Proxy returns a handler that proxies requests to the provided DNS server. The
-// optional logger is called with events about the processing of requests.
+	"github.com/miekg/dns"
+)
+
+// Proxy returns a handler that proxies requests to the provided DNS server.
+// The case of questions sent over UDP is randomized and responses that do not
+// echo the case or are truncated are retried over TCP. Responses to UDP clients
+// are truncated to the requested buffer size. Addresses of the form
+// "tls://host:port" and "https://host/path" use DNS-over-TLS and
+// DNS-over-HTTPS. The TLS server name may be overridden using an URL fragment
+// e.g. "tls://1.1.1.1:853#cloudflare-dns.com". The optional logger is called
+// with events about the processing of requests.
 func Proxy(addr string, logger Logger) dns.Handler {
+	return proxy(addr, proxyOptions{logger: logger})
+}
+
+type proxyOptions struct {
+	tls      *tls.Config
+	timeout  time.Duration
+	retries  int
+	failure  FailurePolicy
+	failures int
+	cooldown time.Duration
+	logger   Logger
+}
+
+func proxy(addr string, opts proxyOptions) dns.Handler {
+	// prepare breaker
+	breaker := newBreakers(opts.failures, opts.cooldown).get(addr)
+
+	return proxyHandler(opts, func(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+		return forward(ctx, req, addr, breaker, opts.tls, opts.logger)
+	})
+}
+
+func proxyHandler(opts proxyOptions, fn func(context.Context, *dns.Msg) (*dns.Msg, error)) dns.Handler {
 	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
 		// log request
-		if logger != nil {
-			logger(ProxyRequest, req, nil, "")
+		log(opts.logger, ProxyRequest, req, nil, "")
+
+		// forward request and retry on errors
+		var rs *dns.Msg
+		var err error
+		for i := 0; i <= opts.retries; i++ {
+			ctx, cancel := context.Background(), context.CancelFunc(func() {})
+			if opts.timeout > 0 {
+				ctx, cancel = context.WithTimeout(ctx, opts.timeout)
+			}
+			rs, err = fn(ctx, req)
+			cancel()
+			if err == nil {
+				break
+			}
 		}
 
-		// forward request to fallback
-		rs, err := dns.Exchange(req, addr)
+		// handle error
 		if err != nil {
-			if logger != nil {
-				logger(ProxyError, nil, err, "")
+			log(opts.logger, ProxyError, nil, err, "")
+			if opts.failure == FailureServerFailure {
+				rs = new(dns.Msg)
+				rs.SetRcode(req, dns.RcodeServerFailure)
+				err = w.WriteMsg(rs)
+				if err != nil {
+					log(opts.logger, NetworkError, nil, err, "")
+					_ = w.Close()
+				}
+				return
 			}
 			_ = w.Close()
 			return
 		}
 
 		// log response
-		if logger != nil {
-			logger(ProxyResponse, rs, nil, "")
+		log(opts.logger, ProxyResponse, rs, nil, "")
+
+		// limit responses to UDP clients to the requested buffer size as they
+		// may have been retried over TCP
+		if w.RemoteAddr().Network() == "udp" {
+			size := dns.MinMsgSize
+			if opt := req.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+				size = int(opt.UDPSize())
+			}
+			rs.Truncate(size)
 		}
 
 		// write response
 		err = w.WriteMsg(rs)
 		if err != nil {
-			if logger != nil {
-				logger(NetworkError, nil, err, "")
-			}
+			log(opts.logger, NetworkError, nil, err, "")
 			_ = w.Close()
 		}
 	})
 }
+
+func exchange(ctx context.Context, req *dns.Msg, addr string, config *tls.Config) (*dns.Msg, error) {
+	// exchange message over TLS
+	if strings.HasPrefix(addr, "tls://") {
+		addr, config, err := tlsUpstream(addr, config)
+		if err != nil {
+			return nil, err
+		}
+		return getPipe("tcp-tls", addr, config).exchange(ctx, req)
+	}
+
+	// exchange message over HTTPS
+	if strings.HasPrefix(addr, "https://") {
+		return exchangeHTTPS(ctx, req, addr, config)
+	}
+
+	// randomize question case
+	msg := req
+	if len(req.Question) == 1 {
+		msg = req.Copy()
+		msg.Question[0].Name = randomizeCase(req.Question[0].Name)
+	}
+
+	// exchange message over UDP
+	rs, err := exchangeUDP(ctx, msg, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// retry over TCP if truncated or the question case has not been echoed
+	if rs.Truncated || !sameCase(msg, rs) {
+		return getPipe("tcp", addr, nil).exchange(ctx, req)
+	}
+
+	// restore question case
+	if msg != req {
+		restoreCase(rs, req.Question[0].Name)
+	}
+
+	return rs, nil
+}
+
+// exchangeUDP exchanges the message using a new socket to randomize the
+// source port of every query.
+func exchangeUDP(ctx context.Context, req *dns.Msg, addr string) (*dns.Msg, error) {
+	// apply default timeout
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, pipeTimeout)
+		defer cancel()
+	}
+
+	// exchange message
+	client := dns.Client{Net: "udp", UDPSize: dns.MaxMsgSize}
+	rs, _, err := client.ExchangeContext(ctx, req, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return rs, nil
+}
+
+func randomizeCase(name string) string {
+	// get random bits
+	bits := make([]byte, len(name))
+	_, err := rand.Read(bits)
+	if err != nil {
+		return name
+	}
+
+	// toggle case of letters
+	buf := []byte(name)
+	for i, c := range buf {
+		if bits[i]&1 == 1 && (c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			buf[i] = c ^ 0x20
+		}
+	}
+
+	return string(buf)
+}
+
+func sameCase(req, rs *dns.Msg) bool {
+	return len(req.Question) != 1 || len(rs.Question) == 1 && rs.Question[0].Name == req.Question[0].Name
+}
+
+func restoreCase(rs *dns.Msg, name string) {
+	// restore question
+	rs.Question[0].Name = name
+
+	// restore owner names matching the question
+	for _, section := range [][]dns.RR{rs.Answer, rs.Ns, rs.Extra} {
+		for _, rr := range section {
+			if strings.EqualFold(rr.Header().Name, name) {
+				rr.Header().Name = name
+			}
+		}
+	}
+}
+
+type upstream struct {
+	addr    string
+	rtt     int64
+	breaker *breaker
+}
+
+// HedgedProxy returns a handler that proxies requests to the provided DNS
+// servers. Servers are queried in the order of their observed response times.
+// The next server is queried if no response has been received after the delay
+// or the previous server failed. The first successful response is returned,
+// which improves tail latencies if a server is degraded. Truncated responses
+// are retried over TCP and addresses may use DNS-over-TLS and DNS-over-HTTPS
+// like with Proxy. The optional logger is called with events about the
+// processing of requests.
+func HedgedProxy(addrs []string, delay time.Duration, logger Logger) dns.Handler {
+	return hedgedProxy(addrs, delay, proxyOptions{logger: logger})
+}
+
+func hedgedProxy(addrs []string, delay time.Duration, opts proxyOptions) dns.Handler {
+	// prepare upstreams
+	breakers := newBreakers(opts.failures, opts.cooldown)
+	upstreams := make([]*upstream, 0, len(addrs))
+	for _, addr := range addrs {
+		upstreams = append(upstreams, &upstream{addr: addr, breaker: breakers.get(addr)})
+	}
+
+	return proxyHandler(opts, func(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+		// order upstreams by response time
+		order := make([]*upstream, len(upstreams))
+		copy(order, upstreams)
+		sort.SliceStable(order, func(i, j int) bool {
+			return atomic.LoadInt64(&order[i].rtt) < atomic.LoadInt64(&order[j].rtt)
+		})
+
+		return hedge(ctx, order, delay, req, opts)
+	})
+}
+
+type hedgeResult struct {
+	msg *dns.Msg
+	err error
+}
+
+func hedge(ctx context.Context, upstreams []*upstream, delay time.Duration, req *dns.Msg, opts proxyOptions) (*dns.Msg, error) {
+	// check upstreams
+	if len(upstreams) == 0 {
+		return nil, errors.New("no upstream servers")
+	}
+
+	// prepare context
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// prepare results
+	results := make(chan hedgeResult, len(upstreams))
+
+	// prepare launcher
+	var launched int
+	launch := func() {
+		up := upstreams[launched]
+		launched++
+		go func() {
+			// exchange message
+			start := time.Now()
+			rs, err := forward(ctx, req.Copy(), up.addr, up.breaker, opts.tls, opts.logger)
+
+			// update response time, failures and cancelled exchanges count
+			// as slow responses
+			rtt := int64(time.Since(start))
+			if err != nil || !validResponse(rs) {
+				rtt += int64(delay) * 2
+			}
+			old := atomic.LoadInt64(&up.rtt)
+			if old == 0 {
+				atomic.StoreInt64(&up.rtt, rtt)
+			} else {
+				atomic.StoreInt64(&up.rtt, (old*7+rtt)/8)
+			}
+
+			results <- hedgeResult{msg: rs, err: err}
+		}()
+	}
+
+	// launch first exchange
+	launch()
+
+	// prepare timer
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	// await results
+	var fallback *dns.Msg
+	var lastErr error
+	for received := 0; received < len(upstreams); {
+		select {
+		case res := <-results:
+			received++
+
+			// return valid response
+			if res.err == nil && validResponse(res.msg) {
+				return res.msg, nil
+			}
+
+			// remember failure
+			if res.err == nil && fallback == nil {
+				fallback = res.msg
+			} else if res.err != nil {
+				lastErr = res.err
+			}
+
+			// launch next exchange immediately
+			if launched < len(upstreams) {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				launch()
+				timer.Reset(delay)
+			}
+		case <-timer.C:
+			// launch next exchange
+			if launched < len(upstreams) {
+				launch()
+				timer.Reset(delay)
+			}
+		}
+	}
+
+	// return failed response if available
+	if fallback != nil {
+		return fallback, nil
+	}
+
+	return nil, lastErr
+}
+
+func validResponse(msg *dns.Msg) bool {
+	return msg != nil && msg.Rcode != dns.RcodeServerFailure && msg.Rcode != dns.RcodeRefused
+}
@@ -0,0 +1,164 @@
+package newdns
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHedgedProxy(t *testing.T) {
+	answer := func(delay time.Duration, rcode int) dns.Handler {
+		return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			time.Sleep(delay)
+			res := new(dns.Msg)
+			res.SetRcode(req, rcode)
+			if rcode == dns.RcodeSuccess {
+				res.Answer = append(res.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+					A:   net.ParseIP("1.2.3.4"),
+				})
+			}
+			_ = w.WriteMsg(res)
+		})
+	}
+
+	slow := "127.0.0.1:53011"
+	failing := "127.0.0.1:53012"
+	fast := "127.0.0.1:53013"
+	proxy := "127.0.0.1:53014"
+
+	serve(answer(300*time.Millisecond, dns.RcodeSuccess), slow, func() {
+		serve(answer(0, dns.RcodeServerFailure), failing, func() {
+			serve(answer(0, dns.RcodeSuccess), fast, func() {
+				serve(HedgedProxy([]string{slow, failing, fast}, 20*time.Millisecond, nil), proxy, func() {
+					for i := 0; i < 3; i++ {
+						start := time.Now()
+						ret, err := Query("udp", proxy, "example.com.", "A", nil)
+						assert.NoError(t, err)
+						assert.Equal(t, dns.RcodeSuccess, ret.Rcode)
+						assert.Len(t, ret.Answer, 1)
+						assert.True(t, time.Since(start) < 200*time.Millisecond)
+					}
+				})
+			})
+		})
+	})
+}
+
+func TestProxyTruncated(t *testing.T) {
+	upstream := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		res := new(dns.Msg)
+		res.SetReply(req)
+		if w.LocalAddr().Network() == "udp" {
+			res.Truncated = true
+		} else {
+			n := 1
+			if req.Question[0].Name == "big.example.com." {
+				n = 50
+			}
+			for i := 0; i < n; i++ {
+				res.Answer = append(res.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+					A:   net.IPv4(1, 2, 3, byte(i)),
+				})
+			}
+		}
+		_ = w.WriteMsg(res)
+	})
+
+	addr := "127.0.0.1:53021"
+	proxy := "127.0.0.1:53022"
+	hedged := "127.0.0.1:53023"
+
+	serve(upstream, addr, func() {
+		serve(Proxy(addr, nil), proxy, func() {
+			serve(HedgedProxy([]string{addr}, 20*time.Millisecond, nil), hedged, func() {
+				for _, server := range []string{proxy, hedged} {
+					ret, err := Query("udp", server, "example.com.", "A", nil)
+					assert.NoError(t, err)
+					assert.False(t, ret.Truncated)
+					assert.Len(t, ret.Answer, 1)
+
+					ret, err = Query("udp", server, "big.example.com.", "A", nil)
+					assert.NoError(t, err)
+					assert.True(t, ret.Truncated)
+					ret.Compress = true
+					assert.True(t, ret.Len() <= dns.MinMsgSize)
+
+					ret, err = Query("udp", server, "big.example.com.", "A", func(msg *dns.Msg) {
+						msg.SetEdns0(4096, false)
+					})
+					assert.NoError(t, err)
+					assert.False(t, ret.Truncated)
+					assert.Len(t, ret.Answer, 50)
+
+					ret, err = Query("tcp", server, "big.example.com.", "A", nil)
+					assert.NoError(t, err)
+					assert.False(t, ret.Truncated)
+					assert.Len(t, ret.Answer, 50)
+				}
+			})
+		})
+	})
+}
+
+func TestProxyRandomizeCase(t *testing.T) {
+	var mutex sync.Mutex
+	var names []string
+	var tcp int
+
+	upstream := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		mutex.Lock()
+		names = append(names, req.Question[0].Name)
+		if w.LocalAddr().Network() == "tcp" {
+			tcp++
+		}
+		mutex.Unlock()
+
+		res := new(dns.Msg)
+		res.SetReply(req)
+		if strings.HasPrefix(strings.ToLower(req.Question[0].Name), "lower") {
+			res.Question[0].Name = strings.ToLower(req.Question[0].Name)
+		}
+		res.Answer = append(res.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.ParseIP("1.2.3.4"),
+		})
+		_ = w.WriteMsg(res)
+	})
+
+	addr := "127.0.0.1:53091"
+	name := "abcdefghijklmnopqrstuvwxyz.example.com."
+
+	serve(upstream, addr, func() {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+
+		ret, err := exchange(context.Background(), req, addr, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, name, ret.Question[0].Name)
+		assert.Equal(t, name, ret.Answer[0].Header().Name)
+
+		mutex.Lock()
+		assert.Len(t, names, 1)
+		assert.NotEqual(t, name, names[0])
+		assert.Equal(t, name, strings.ToLower(names[0]))
+		assert.Equal(t, 0, tcp)
+		mutex.Unlock()
+
+		req.SetQuestion("lower"+name, dns.TypeA)
+		ret, err = exchange(context.Background(), req, addr, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "lower"+name, ret.Question[0].Name)
+
+		mutex.Lock()
+		assert.Equal(t, 1, tcp)
+		mutex.Unlock()
+	})
+}
@@ -0,0 +1,125 @@
+package newdns
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// QueryLogEntry is a single entry in the query log.
+type QueryLogEntry struct {
+	Time         time.Time     `json:"time"`
+	Remote       string        `json:"remote"`
+	Transport    string        `json:"transport"`
+	Zone         string        `json:"zone"`
+	Name         string        `json:"name"`
+	Type         string        `json:"type"`
+	Rcode        string        `json:"rcode"`
+	Truncated    bool          `json:"truncated"`
+	RequestSize  int           `json:"request_size"`
+	ResponseSize int           `json:"response_size"`
+	Elapsed      time.Duration `json:"elapsed"`
+	Answer       []string      `json:"answer,omitempty"`
+}
+
+// QueryLog keeps the most recent responses in a ring buffer. It may be used as
+// the server logger and forwards all events to an optional logger.
+type QueryLog struct {
+	next    Logger
+	mutex   sync.Mutex
+	entries []QueryLogEntry
+	offset  int
+	full    bool
+}
+
+// NewQueryLog creates and returns a new query log that keeps the specified
+// number of entries.
+func NewQueryLog(size int, next Logger) *QueryLog {
+	// check size
+	if size <= 0 {
+		size = 1
+	}
+
+	return &QueryLog{
+		next:    next,
+		entries: make([]QueryLogEntry, size),
+	}
+}
+
+// Log implements the Logger interface.
+func (l *QueryLog) Log(entry Entry) {
+	// forward event
+	if l.next != nil {
+		l.next.Log(entry)
+	}
+
+	// check event
+	if entry.Event != Response || entry.Msg == nil || entry.Info == nil {
+		return
+	}
+
+	// prepare entry
+	item := QueryLogEntry{
+		Time:         time.Now().Add(-entry.Info.Elapsed),
+		Transport:    entry.Info.Transport,
+		Zone:         entry.Info.Zone,
+		Name:         entry.Info.Question.Name,
+		Type:         dns.TypeToString[entry.Info.Question.Qtype],
+		Rcode:        dns.RcodeToString[entry.Msg.Rcode],
+		Truncated:    entry.Msg.Truncated,
+		RequestSize:  entry.Info.RequestSize,
+		ResponseSize: entry.Info.ResponseSize,
+		Elapsed:      entry.Info.Elapsed,
+	}
+	if entry.Info.Remote != nil {
+		item.Remote = entry.Info.Remote.String()
+	}
+	for _, rr := range entry.Msg.Answer {
+		item.Answer = append(item.Answer, rr.String())
+	}
+
+	// acquire mutex
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// add entry
+	l.entries[l.offset] = item
+	l.offset++
+	if l.offset == len(l.entries) {
+		l.offset = 0
+		l.full = true
+	}
+}
+
+// Entries returns the logged entries from oldest to newest.
+func (l *QueryLog) Entries() []QueryLogEntry {
+	// acquire mutex
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// copy entries
+	var list []QueryLogEntry
+	if l.full {
+		list = append(list, l.entries[l.offset:]...)
+	}
+	list = append(list, l.entries[:l.offset]...)
+
+	return list
+}
+
+// ServeHTTP implements the http.Handler interface and responds with the
+// logged entries encoded as JSON.
+func (l *QueryLog) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	// get entries
+	entries := l.Entries()
+	if entries == nil {
+		entries = []QueryLogEntry{}
+	}
+
+	// write entries
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(entries)
+}
@@ -0,0 +1,48 @@
+package newdns
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryLog(t *testing.T) {
+	zone := testZone(nil)
+
+	server := NewServer(Config{
+		Handler:      testHandler(zone),
+		QueryLogSize: 2,
+	})
+
+	run(server, "127.0.0.1:0", func() {
+		addr := server.Addr().String()
+
+		for _, name := range []string{"a", "b", "c"} {
+			_, err := Query("udp", addr, name+".example.com.", "A", nil)
+			assert.NoError(t, err)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+
+		entries := server.QueryLog().Entries()
+		assert.Len(t, entries, 2)
+		assert.Equal(t, "b.example.com.", entries[0].Name)
+		assert.Equal(t, "c.example.com.", entries[1].Name)
+		assert.Equal(t, "example.com.", entries[1].Zone)
+		assert.Equal(t, "A", entries[1].Type)
+		assert.Equal(t, "NXDOMAIN", entries[1].Rcode)
+		assert.Equal(t, "udp", entries[1].Transport)
+
+		rec := httptest.NewRecorder()
+		server.QueryLog().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/queries", nil))
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+		var list []QueryLogEntry
+		err := json.Unmarshal(rec.Body.Bytes(), &list)
+		assert.NoError(t, err)
+		assert.Len(t, list, 2)
+	})
+}
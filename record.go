@@ -2,17 +2,24 @@ package newdns
 
 import (
 	"fmt"
+	"math"
 	"net"
 )
 
 // Record holds a single DNS record.
 type Record struct {
-	// The target address for A, AAAA, CNAME and MX records.
+	// The target address for A, AAAA, CNAME, MX, NS, PTR and SRV records.
 	Address string
 
-	// The priority for MX records.
+	// The priority for MX and SRV records.
 	Priority int
 
+	// The weight for SRV records.
+	Weight int
+
+	// The port for SRV records.
+	Port int
+
 	// The data for TXT records.
 	Data []string
 }
@@ -62,5 +69,25 @@ func (r *Record) Validate(typ Type) error {
 		}
 	}
 
+	// validate PTR addresses
+	if typ == PTR {
+		if !IsDomain(r.Address, true) {
+			return fmt.Errorf("invalid ptr name: %s", r.Address)
+		}
+	}
+
+	// validate SRV addresses, priorities, weights and ports
+	if typ == SRV {
+		if !IsDomain(r.Address, true) {
+			return fmt.Errorf("invalid srv target: %s", r.Address)
+		} else if r.Priority < 0 || r.Priority > math.MaxUint16 {
+			return fmt.Errorf("invalid srv priority: %d", r.Priority)
+		} else if r.Weight < 0 || r.Weight > math.MaxUint16 {
+			return fmt.Errorf("invalid srv weight: %d", r.Weight)
+		} else if r.Port < 0 || r.Port > math.MaxUint16 {
+			return fmt.Errorf("invalid srv port: %d", r.Port)
+		}
+	}
+
 	return nil
 }
@@ -81,6 +81,20 @@ func TestRecordValidate(t *testing.T) {
 			typ: NS,
 			rec: Record{Address: "foo.com."},
 		},
+		{
+			typ: SRV,
+			rec: Record{Address: "foo.com", Port: 80},
+			err: "invalid srv target: foo.com",
+		},
+		{
+			typ: SRV,
+			rec: Record{Address: "foo.com.", Port: 70000},
+			err: "invalid srv port: 70000",
+		},
+		{
+			typ: SRV,
+			rec: Record{Address: "foo.com.", Priority: 10, Weight: 5, Port: 80},
+		},
 	}
 
 	for i, item := range table {
@@ -1,7 +1,10 @@
 package newdns
 
 import (
+	"context"
+	"errors"
 	"net"
+	"strings"
 
 	"github.com/miekg/dns"
 )
@@ -35,8 +38,15 @@ func (w *responseWriter) WriteMsg(msg *dns.Msg) error {
 	return nil
 }
 
-func (w *responseWriter) Write([]byte) (int, error) {
-	panic("not implemented")
+func (w *responseWriter) Write(data []byte) (int, error) {
+	// unpack message
+	msg := new(dns.Msg)
+	err := msg.Unpack(data)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(data), w.WriteMsg(msg)
 }
 
 func (w *responseWriter) Close() error {
@@ -44,20 +54,67 @@ func (w *responseWriter) Close() error {
 }
 
 func (w *responseWriter) TsigStatus() error {
-	panic("not implemented")
+	return dns.ErrSecret
 }
 
-func (w *responseWriter) TsigTimersOnly(bool) {
-	panic("not implemented")
-}
+func (w *responseWriter) TsigTimersOnly(bool) {}
 
 func (w *responseWriter) Hijack() {
 	panic("not implemented")
 }
 
+// ResolverLimits defines the limits of a resolver per client query.
+type ResolverLimits struct {
+	// The maximum number of followed referrals.
+	//
+	// Default: 8.
+	MaxReferrals int
+
+	// The maximum number of chased CNAME records.
+	//
+	// Default: 8.
+	MaxCNAMEs int
+
+	// The maximum number of issued queries.
+	//
+	// Default: 32.
+	MaxQueries int
+}
+
+var errResolverLimit = errors.New("resolver limit exceeded")
+
 // Resolver returns a very primitive recursive resolver that uses the provided
 // handler to resolve all names.
 func Resolver(handler dns.Handler) dns.Handler {
+	return LimitedResolver(handler, ResolverLimits{})
+}
+
+// LimitedResolver returns a very primitive recursive resolver that uses the
+// provided handler to resolve all names. Referrals returned by the handler are
+// followed using the provided glue addresses. Queries that exceed the limits
+// are answered with SERVFAIL and an extended error.
+func LimitedResolver(handler dns.Handler, limits ResolverLimits) dns.Handler {
+	return CachingResolver(handler, limits, nil)
+}
+
+// CachingResolver returns a resolver like LimitedResolver that stores the
+// responses in the provided cache.
+func CachingResolver(handler dns.Handler, limits ResolverLimits, cache *ResolverCache) dns.Handler {
+	// set default max referrals
+	if limits.MaxReferrals == 0 {
+		limits.MaxReferrals = 8
+	}
+
+	// set default max CNAMEs
+	if limits.MaxCNAMEs == 0 {
+		limits.MaxCNAMEs = maxCNAMEChain
+	}
+
+	// set default max queries
+	if limits.MaxQueries == 0 {
+		limits.MaxQueries = 32
+	}
+
 	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
 		// forward query if no recursion is desired
 		if !req.RecursionDesired {
@@ -70,51 +127,259 @@ func Resolver(handler dns.Handler) dns.Handler {
 		res.SetReply(req)
 		res.RecursionAvailable = true
 
-		// query handler
-		var wr responseWriter
-		handler.ServeDNS(&wr, req)
+		// get cached response
+		key, cacheable := resolverKeyOf(req)
+		var cached *dns.Msg
+		var fresh, prefetch bool
+		if cacheable {
+			cached, fresh, prefetch = cache.get(key)
+		}
 
-		// check response
-		if wr.msg == nil {
-			_ = w.WriteMsg(res)
-			return
+		// refresh popular response in the background
+		if prefetch {
+			go func(req *dns.Msg) {
+				msg, err := resolveQuery(handler, limits, req)
+				if err == nil && !failedResponse(msg) {
+					cache.put(key, msg)
+				} else {
+					cache.release(key)
+				}
+			}(req.Copy())
 		}
 
-		// add resolved answers
-		res.Answer = append(res.Answer, resolve(handler, wr.msg.Answer)...)
+		// resolve query if not cached
+		msg := cached
+		var err error
+		if !fresh {
+			msg, err = resolveQuery(handler, limits, req)
+			if err == nil && !failedResponse(msg) && cacheable {
+				cache.put(key, msg)
+			}
+		}
+
+		// serve stale response on failures
+		var stale bool
+		if !fresh && cached != nil && (err != nil || failedResponse(msg)) {
+			msg, err, stale = cached, nil, true
+		}
+
+		// handle errors
+		if err != nil {
+			res.Rcode = dns.RcodeServerFailure
+			if err == errResolverLimit {
+				addExtendedError(res, req, dns.ExtendedErrorCodeOther, err.Error())
+			}
+		} else if msg != nil {
+			res.Rcode = msg.Rcode
+			res.Answer = msg.Answer
+			res.Ns = msg.Ns
+		}
+
+		// mark stale response
+		if stale {
+			addExtendedError(res, req, dns.ExtendedErrorCodeStaleAnswer, "")
+		}
 
 		// write response
-		err := w.WriteMsg(res)
+		err = w.WriteMsg(res)
 		if err != nil {
 			_ = w.Close()
 		}
 	})
 }
 
-func resolve(handler dns.Handler, records []dns.RR) []dns.RR {
+func resolveQuery(handler dns.Handler, limits ResolverLimits, req *dns.Msg) (*dns.Msg, error) {
+	// prepare resolution
+	rn := &resolution{
+		handler: handler,
+		limits:  limits,
+	}
+
+	// query handler
+	msg, err := rn.query(req)
+	if err != nil || msg == nil {
+		return nil, err
+	}
+
+	// resolve answers
+	answer, err := rn.resolve(req.Question[0].Qtype, msg.Answer)
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare result
+	res := new(dns.Msg)
+	res.Rcode = msg.Rcode
+	res.Answer = answer
+	if len(answer) == 0 {
+		res.Ns = msg.Ns
+	}
+
+	return res, nil
+}
+
+func failedResponse(msg *dns.Msg) bool {
+	return msg == nil || msg.Rcode == dns.RcodeServerFailure || msg.Rcode == dns.RcodeRefused
+}
+
+func addExtendedError(res, req *dns.Msg, code uint16, text string) {
+	// check EDNS
+	opt := req.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	// ensure OPT record
+	if res.IsEdns0() == nil {
+		res.SetEdns0(opt.UDPSize(), false)
+	}
+
+	// add option
+	ro := res.IsEdns0()
+	ro.Option = append(ro.Option, &dns.EDNS0_EDE{
+		InfoCode:  code,
+		ExtraText: text,
+	})
+}
+
+type resolution struct {
+	handler   dns.Handler
+	limits    ResolverLimits
+	queries   int
+	referrals int
+}
+
+func (r *resolution) query(req *dns.Msg) (*dns.Msg, error) {
+	// check queries
+	r.queries++
+	if r.queries > r.limits.MaxQueries {
+		return nil, errResolverLimit
+	}
+
+	// query handler
+	var wr responseWriter
+	r.handler.ServeDNS(&wr, req)
+	msg := wr.msg
+
+	// follow referrals
+	for msg != nil {
+		// get referral address
+		addr := referral(msg)
+		if addr == "" {
+			break
+		}
+
+		// check referrals and queries
+		r.referrals++
+		r.queries++
+		if r.referrals > r.limits.MaxReferrals || r.queries > r.limits.MaxQueries {
+			return nil, errResolverLimit
+		}
+
+		// query delegated server
+		var err error
+		msg, err = exchange(context.Background(), req.Copy(), addr, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return msg, nil
+}
+
+func (r *resolution) resolve(qtype uint16, records []dns.RR) ([]dns.RR, error) {
 	// prepare result
 	var res []dns.RR
 	res = append(res, records...)
 
-	// handle records
-	for _, record := range records {
-		if cname, ok := record.(*dns.CNAME); ok {
-			// query handler
-			var wr responseWriter
-			handler.ServeDNS(&wr, &dns.Msg{
-				Question: []dns.Question{
-					{
-						Name:   cname.Target,
-						Qtype:  dns.TypeA,
-						Qclass: dns.ClassINET,
-					},
+	// CNAME records are not chased for CNAME queries
+	if qtype == dns.TypeCNAME {
+		return res, nil
+	}
+
+	// prepare visited names
+	visited := map[string]bool{}
+
+	for {
+		// find CNAME target without records
+		var target string
+		for _, record := range res {
+			if cname, ok := record.(*dns.CNAME); ok && !hasOwner(res, cname.Target) {
+				target = strings.ToLower(cname.Target)
+			}
+		}
+
+		// stop if resolved or looping
+		if target == "" || visited[target] {
+			break
+		}
+		visited[target] = true
+
+		// check CNAMEs
+		if len(visited) > r.limits.MaxCNAMEs {
+			return nil, errResolverLimit
+		}
+
+		// query handler
+		msg, err := r.query(&dns.Msg{
+			Question: []dns.Question{
+				{
+					Name:   target,
+					Qtype:  qtype,
+					Qclass: dns.ClassINET,
 				},
-			})
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// stop if no answer
+		if msg == nil || len(msg.Answer) == 0 {
+			break
+		}
+
+		// add resolved answers
+		res = append(res, msg.Answer...)
+	}
 
-			// add resolved answers
-			res = append(res, resolve(handler, wr.msg.Answer)...)
+	return res, nil
+}
+
+func referral(msg *dns.Msg) string {
+	// check message
+	if msg.Rcode != dns.RcodeSuccess || msg.Authoritative || len(msg.Answer) > 0 {
+		return ""
+	}
+
+	// find glue address of a name server
+	for _, record := range msg.Ns {
+		ns, ok := record.(*dns.NS)
+		if !ok {
+			continue
+		}
+		for _, extra := range msg.Extra {
+			if !strings.EqualFold(extra.Header().Name, ns.Ns) {
+				continue
+			}
+			switch extra := extra.(type) {
+			case *dns.A:
+				return net.JoinHostPort(extra.A.String(), "53")
+			case *dns.AAAA:
+				return net.JoinHostPort(extra.AAAA.String(), "53")
+			}
+		}
+	}
+
+	return ""
+}
+
+func hasOwner(records []dns.RR, name string) bool {
+	for _, record := range records {
+		if strings.EqualFold(record.Header().Name, name) {
+			return true
 		}
 	}
 
-	return res
+	return false
 }
@@ -1,7 +1,11 @@
 package newdns
 
 import (
+	"fmt"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
@@ -90,3 +94,210 @@ func TestResolver(t *testing.T) {
 		}, ret)
 	})
 }
+
+func TestResolverChaseTypes(t *testing.T) {
+	records := map[string]string{
+		"a.example.com.": "a.example.com. 300 IN CNAME b.example.com.",
+		"b.example.com.": "b.example.com. 300 IN CNAME c.example.com.",
+		"c.example.com.": "c.example.com. 300 IN AAAA 1:2:3:4::",
+		"x.example.com.": "x.example.com. 300 IN CNAME y.example.com.",
+		"y.example.com.": "y.example.com. 300 IN CNAME x.example.com.",
+	}
+
+	var queries []uint16
+	handler := Resolver(dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		queries = append(queries, req.Question[0].Qtype)
+
+		res := new(dns.Msg)
+		res.SetReply(req)
+		if str, ok := records[req.Question[0].Name]; ok {
+			rr, err := dns.NewRR(str)
+			assert.NoError(t, err)
+			res.Answer = append(res.Answer, rr)
+		}
+
+		_ = w.WriteMsg(res)
+	}))
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeAAAA)
+	req.RecursionDesired = true
+
+	var wr responseWriter
+	handler.ServeDNS(&wr, req)
+	assert.Len(t, wr.msg.Answer, 3)
+	assert.Equal(t, dns.TypeAAAA, wr.msg.Answer[2].Header().Rrtype)
+	assert.Equal(t, []uint16{dns.TypeAAAA, dns.TypeAAAA, dns.TypeAAAA}, queries)
+
+	req.SetQuestion("x.example.com.", dns.TypeMX)
+	wr = responseWriter{}
+	handler.ServeDNS(&wr, req)
+	assert.Len(t, wr.msg.Answer, 2)
+}
+
+func TestResolverLimits(t *testing.T) {
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		res := new(dns.Msg)
+		res.SetReply(req)
+
+		name := req.Question[0].Name
+		if strings.HasPrefix(name, "ref.") {
+			ns, _ := dns.NewRR("ref.example.com. 300 IN NS ns.ref.example.com.")
+			glue, _ := dns.NewRR("ns.ref.example.com. 300 IN A 127.0.0.1")
+			res.Ns = append(res.Ns, ns)
+			res.Extra = append(res.Extra, glue)
+		} else {
+			var n int
+			_, _ = fmt.Sscanf(name, "a%d.", &n)
+			rr, _ := dns.NewRR(fmt.Sprintf("%s 300 IN CNAME a%d.example.com.", name, n+1))
+			res.Authoritative = true
+			res.Answer = append(res.Answer, rr)
+		}
+
+		_ = w.WriteMsg(res)
+	})
+
+	query := func(handler dns.Handler, name string) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		req.SetEdns0(1232, false)
+		req.RecursionDesired = true
+
+		var wr responseWriter
+		handler.ServeDNS(&wr, req)
+
+		return wr.msg
+	}
+
+	ede := []dns.EDNS0{
+		&dns.EDNS0_EDE{
+			InfoCode:  dns.ExtendedErrorCodeOther,
+			ExtraText: "resolver limit exceeded",
+		},
+	}
+
+	ret := query(LimitedResolver(handler, ResolverLimits{MaxCNAMEs: 3}), "a0.example.com.")
+	assert.Equal(t, dns.RcodeServerFailure, ret.Rcode)
+	assert.Empty(t, ret.Answer)
+	assert.Equal(t, ede, ret.IsEdns0().Option)
+
+	ret = query(LimitedResolver(handler, ResolverLimits{MaxQueries: 2}), "a0.example.com.")
+	assert.Equal(t, dns.RcodeServerFailure, ret.Rcode)
+	assert.Equal(t, ede, ret.IsEdns0().Option)
+
+	ret = query(LimitedResolver(handler, ResolverLimits{MaxQueries: 1}), "ref.example.com.")
+	assert.Equal(t, dns.RcodeServerFailure, ret.Rcode)
+	assert.Equal(t, ede, ret.IsEdns0().Option)
+
+	ret = query(LimitedResolver(handler, ResolverLimits{MaxCNAMEs: 10, MaxQueries: 20}), "a0.example.com.")
+	assert.Equal(t, dns.RcodeServerFailure, ret.Rcode)
+}
+
+func TestResolverServeStale(t *testing.T) {
+	var queries int
+	var fail bool
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		queries++
+
+		res := new(dns.Msg)
+		res.SetReply(req)
+		if fail {
+			res.Rcode = dns.RcodeServerFailure
+		} else {
+			rr, _ := dns.NewRR(req.Question[0].Name + " 1 IN A 1.2.3.4")
+			res.Answer = append(res.Answer, rr)
+		}
+
+		_ = w.WriteMsg(res)
+	})
+
+	query := func(handler dns.Handler) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		req.SetEdns0(1232, false)
+		req.RecursionDesired = true
+
+		var wr responseWriter
+		handler.ServeDNS(&wr, req)
+
+		return wr.msg
+	}
+
+	cache := NewResolverCache(10)
+	cache.SetServeStale(time.Minute)
+	resolver := CachingResolver(handler, ResolverLimits{}, cache)
+
+	ret := query(resolver)
+	assert.Equal(t, dns.RcodeSuccess, ret.Rcode)
+	assert.Len(t, ret.Answer, 1)
+	assert.Equal(t, 1, queries)
+
+	ret = query(resolver)
+	assert.Equal(t, dns.RcodeSuccess, ret.Rcode)
+	assert.Len(t, ret.Answer, 1)
+	assert.Equal(t, 1, queries)
+
+	time.Sleep(1100 * time.Millisecond)
+	fail = true
+
+	ret = query(resolver)
+	assert.Equal(t, dns.RcodeSuccess, ret.Rcode)
+	assert.Len(t, ret.Answer, 1)
+	assert.Equal(t, uint32(30), ret.Answer[0].Header().Ttl)
+	assert.Equal(t, []dns.EDNS0{
+		&dns.EDNS0_EDE{
+			InfoCode: dns.ExtendedErrorCodeStaleAnswer,
+		},
+	}, ret.IsEdns0().Option)
+	assert.Equal(t, 2, queries)
+
+	cache.SetServeStale(0)
+
+	ret = query(resolver)
+	assert.Equal(t, dns.RcodeServerFailure, ret.Rcode)
+	assert.Empty(t, ret.Answer)
+	assert.Equal(t, 3, queries)
+}
+
+func TestResolverPrefetch(t *testing.T) {
+	var queries int32
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+
+		res := new(dns.Msg)
+		res.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 2 IN A 1.2.3.4")
+		res.Answer = append(res.Answer, rr)
+
+		_ = w.WriteMsg(res)
+	})
+
+	cache := NewResolverCache(10)
+	cache.SetPrefetch(0.9, 1)
+	resolver := CachingResolver(handler, ResolverLimits{}, cache)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.RecursionDesired = true
+
+	for i := 0; i < 2; i++ {
+		var wr responseWriter
+		resolver.ServeDNS(&wr, req)
+		assert.Len(t, wr.msg.Answer, 1)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&queries))
+
+	time.Sleep(300 * time.Millisecond)
+
+	var wr responseWriter
+	resolver.ServeDNS(&wr, req)
+	assert.Len(t, wr.msg.Answer, 1)
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&queries))
+
+	wr = responseWriter{}
+	resolver.ServeDNS(&wr, req)
+	assert.Equal(t, uint32(2), wr.msg.Answer[0].Header().Ttl)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&queries))
+}
@@ -0,0 +1,245 @@
+package newdns
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// staleTTL is the TTL of records in stale responses.
+const staleTTL = 30
+
+type resolverKey struct {
+	name  string
+	qtype uint16
+}
+
+type resolverEntry struct {
+	msg        *dns.Msg
+	ttl        time.Duration
+	stored     time.Time
+	expires    time.Time
+	hits       int
+	refreshing bool
+}
+
+// ResolverCache stores the responses of a resolver until the lowest TTL of the
+// contained records expires. Negative responses are stored for the minimum
+// TTL of the included SOA record. Expired responses may optionally be served
+// if the resolution fails and popular responses may optionally be refreshed
+// before they expire.
+type ResolverCache struct {
+	size      int
+	maxStale  time.Duration
+	threshold float64
+	minHits   int
+	mutex     sync.Mutex
+	entries   map[resolverKey]*resolverEntry
+}
+
+// NewResolverCache creates and returns a new resolver cache that stores up to
+// the specified number of responses.
+func NewResolverCache(size int) *ResolverCache {
+	// check size
+	if size <= 0 {
+		size = 1
+	}
+
+	return &ResolverCache{
+		size:    size,
+		entries: map[resolverKey]*resolverEntry{},
+	}
+}
+
+// SetServeStale enables serving expired responses if the resolution fails
+// (RFC 8767). Responses are served up to the specified duration after their
+// expiry and are marked with an extended error.
+func (c *ResolverCache) SetServeStale(maxStale time.Duration) {
+	// acquire mutex
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// set config
+	c.maxStale = maxStale
+}
+
+// SetPrefetch enables the refreshing of popular responses before they expire.
+// A response is refreshed in the background when it is requested within the
+// specified fraction of its TTL before the expiry, e.g. 0.1 for the last ten
+// percent, and has been requested at least the specified number of times since
+// it has been cached. Clients are served the cached response meanwhile.
+func (c *ResolverCache) SetPrefetch(threshold float64, hits int) {
+	// acquire mutex
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// set config
+	c.threshold = threshold
+	c.minHits = hits
+}
+
+func resolverKeyOf(req *dns.Msg) (resolverKey, bool) {
+	// check message
+	if req.Opcode != dns.OpcodeQuery || len(req.Question) != 1 || req.Question[0].Qclass != dns.ClassINET {
+		return resolverKey{}, false
+	}
+
+	return resolverKey{
+		name:  strings.ToLower(req.Question[0].Name),
+		qtype: req.Question[0].Qtype,
+	}, true
+}
+
+func (c *ResolverCache) get(key resolverKey) (*dns.Msg, bool, bool) {
+	// check cache
+	if c == nil {
+		return nil, false, false
+	}
+
+	// get time
+	now := time.Now()
+
+	// acquire mutex
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// get entry
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false, false
+	}
+
+	// return fresh response
+	if now.Before(entry.expires) {
+		// count hit
+		entry.hits++
+
+		// check prefetch
+		var prefetch bool
+		if c.threshold > 0 && !entry.refreshing && entry.hits >= c.minHits {
+			window := time.Duration(float64(entry.ttl) * c.threshold)
+			if entry.expires.Sub(now) <= window {
+				entry.refreshing = true
+				prefetch = true
+			}
+		}
+
+		// copy response
+		elapsed := uint32(now.Sub(entry.stored) / time.Second)
+		return copyResponse(entry.msg, func(ttl uint32) uint32 {
+			if ttl > elapsed {
+				return ttl - elapsed
+			}
+			return 0
+		}), true, prefetch
+	}
+
+	// check staleness
+	if now.Sub(entry.expires) >= c.maxStale {
+		delete(c.entries, key)
+		return nil, false, false
+	}
+
+	// return stale response
+	return copyResponse(entry.msg, func(uint32) uint32 {
+		return staleTTL
+	}), false, false
+}
+
+func (c *ResolverCache) put(key resolverKey, msg *dns.Msg) {
+	// check cache
+	if c == nil {
+		return
+	}
+
+	// get lowest TTL
+	ttl, ok := responseTTL(msg)
+	if !ok || ttl == 0 {
+		return
+	}
+
+	// get time
+	now := time.Now()
+
+	// acquire mutex
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// remove expired entries if full
+	if len(c.entries) >= c.size {
+		for k, entry := range c.entries {
+			if now.Sub(entry.expires) >= c.maxStale {
+				delete(c.entries, k)
+			}
+		}
+	}
+
+	// remove arbitrary entries if still full
+	for k := range c.entries {
+		if len(c.entries) < c.size {
+			break
+		}
+		delete(c.entries, k)
+	}
+
+	// add entry
+	c.entries[key] = &resolverEntry{
+		msg:     msg.Copy(),
+		ttl:     time.Duration(ttl) * time.Second,
+		stored:  now,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+func (c *ResolverCache) release(key resolverKey) {
+	// acquire mutex
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// reset refreshing flag
+	entry, ok := c.entries[key]
+	if ok {
+		entry.refreshing = false
+	}
+}
+
+func responseTTL(msg *dns.Msg) (uint32, bool) {
+	// use lowest answer TTL
+	if len(msg.Answer) > 0 {
+		ttl := msg.Answer[0].Header().Ttl
+		for _, rr := range msg.Answer[1:] {
+			if rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+		return ttl, true
+	}
+
+	// use SOA minimum for negative responses
+	for _, rr := range msg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			if soa.Minttl < soa.Hdr.Ttl {
+				return soa.Minttl, true
+			}
+			return soa.Hdr.Ttl, true
+		}
+	}
+
+	return 0, false
+}
+
+func copyResponse(msg *dns.Msg, ttl func(uint32) uint32) *dns.Msg {
+	// copy message
+	res := msg.Copy()
+
+	// update TTLs
+	for _, section := range [][]dns.RR{res.Answer, res.Ns} {
+		for _, rr := range section {
+			rr.Header().Ttl = ttl(rr.Header().Ttl)
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,327 @@
+package newdns
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type responseKey struct {
+	name   string
+	qtype  uint16
+	tcp    bool
+	edns   bool
+	buffer uint16
+}
+
+type responseEntry struct {
+	zone    string
+	data    []byte
+	ttls    []int
+	sets    []int
+	jitter  float64
+	minTTL  uint32
+	stored  time.Time
+	expires time.Time
+}
+
+type responseCache struct {
+	size    int
+	mutex   sync.Mutex
+	entries map[responseKey]*responseEntry
+}
+
+func newResponseCache(size int) *responseCache {
+	return &responseCache{
+		size:    size,
+		entries: map[responseKey]*responseEntry{},
+	}
+}
+
+func responseKeyOf(req *dns.Msg, transport string) (responseKey, bool) {
+	// check message
+	if req.Opcode != dns.OpcodeQuery || len(req.Question) != 1 || req.IsTsig() != nil {
+		return responseKey{}, false
+	}
+
+	// prepare key
+	key := responseKey{
+		name:  req.Question[0].Name,
+		qtype: req.Question[0].Qtype,
+		tcp:   transport != "udp",
+	}
+
+	// check EDNS
+	if opt := req.IsEdns0(); opt != nil {
+		// requests with options may yield individual responses
+		if opt.Version() != 0 || len(opt.Option) > 0 {
+			return responseKey{}, false
+		}
+
+		// set EDNS and buffer size
+		key.edns = true
+		if !key.tcp {
+			key.buffer = opt.UDPSize()
+		}
+	}
+
+	return key, true
+}
+
+func (c *responseCache) get(key responseKey, req *dns.Msg) ([]byte, string, bool) {
+	// get time
+	now := time.Now()
+
+	// acquire mutex
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// get entry
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, "", false
+	}
+
+	// check expiry
+	if !now.Before(entry.expires) {
+		delete(c.entries, key)
+		return nil, "", false
+	}
+
+	// copy data
+	data := make([]byte, len(entry.data))
+	copy(data, entry.data)
+
+	// set ID and copied flags
+	binary.BigEndian.PutUint16(data, req.Id)
+	data[2] &^= 0x01
+	if req.RecursionDesired {
+		data[2] |= 0x01
+	}
+	data[3] &^= 0x10
+	if req.CheckingDisabled {
+		data[3] |= 0x10
+	}
+
+	// decrement TTLs
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	for _, off := range entry.ttls {
+		ttl := binary.BigEndian.Uint32(data[off:])
+		if ttl > elapsed {
+			ttl -= elapsed
+		} else {
+			ttl = 0
+		}
+		binary.BigEndian.PutUint32(data[off:], ttl)
+	}
+
+	// jitter answer TTLs
+	if entry.jitter > 0 {
+		var i int
+		for _, n := range entry.sets {
+			ttl := jitteredTTL(binary.BigEndian.Uint32(data[entry.ttls[i]:]), entry.jitter, entry.minTTL)
+			for _, off := range entry.ttls[i : i+n] {
+				binary.BigEndian.PutUint32(data[off:], ttl)
+			}
+			i += n
+		}
+	}
+
+	return data, entry.zone, true
+}
+
+func (c *responseCache) put(key responseKey, zone string, msg *dns.Msg, jitter float64, minTTL uint32) {
+	// responses with options or signatures are individual
+	if opt := msg.IsEdns0(); (opt != nil && len(opt.Option) > 0) || msg.IsTsig() != nil {
+		return
+	}
+
+	// pack message
+	data, err := msg.Pack()
+	if err != nil {
+		return
+	}
+
+	// find TTLs
+	ttls, min, ok := packedTTLs(data)
+	if !ok || len(ttls) == 0 || min == 0 {
+		return
+	}
+
+	// get time
+	now := time.Now()
+
+	// acquire mutex
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// remove expired entries if full
+	if len(c.entries) >= c.size {
+		for k, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+
+	// remove arbitrary entries if still full
+	for k := range c.entries {
+		if len(c.entries) < c.size {
+			break
+		}
+		delete(c.entries, k)
+	}
+
+	// add entry
+	c.entries[key] = &responseEntry{
+		zone:    zone,
+		data:    data,
+		ttls:    ttls,
+		sets:    setSizes(msg.Answer),
+		jitter:  jitter,
+		minTTL:  minTTL,
+		stored:  now,
+		expires: now.Add(time.Duration(min) * time.Second),
+	}
+}
+
+func (c *responseCache) purge(zone string) {
+	// acquire mutex
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// remove entries
+	for key, entry := range c.entries {
+		if zone == "" || entry.zone == zone {
+			delete(c.entries, key)
+		}
+	}
+}
+
+type cacheWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *cacheWriter) WriteMsg(msg *dns.Msg) error {
+	w.msg = msg
+	return w.ResponseWriter.WriteMsg(msg)
+}
+
+func (s *Server) cacheHandler(cache *responseCache, next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		// get key
+		key, ok := responseKeyOf(req, w.RemoteAddr().Network())
+		if !ok {
+			next.ServeDNS(w, req)
+			return
+		}
+
+		// write cached response
+		data, _, ok := cache.get(key, req)
+		if ok {
+			log(s.logger(w), ProxyCacheHit, req, nil, "")
+			var err error
+			if s.direct(w) {
+				err = writeRaw(w, s.config.Capture, data)
+			} else {
+				rs := new(dns.Msg)
+				err = rs.Unpack(data)
+				if err == nil {
+					err = w.WriteMsg(rs)
+				}
+			}
+			if err != nil {
+				log(s.logger(w), NetworkError, nil, err, "")
+				_ = w.Close()
+			}
+			return
+		}
+
+		// serve request
+		cw := &cacheWriter{ResponseWriter: w}
+		next.ServeDNS(cw, req)
+
+		// cache successful and negative responses
+		rs := cw.msg
+		if rs != nil && !rs.Truncated && (rs.Rcode == dns.RcodeSuccess || rs.Rcode == dns.RcodeNameError) {
+			cache.put(key, "", rs, 0, 0)
+		}
+	})
+}
+
+func packedTTLs(data []byte) ([]int, uint32, bool) {
+	// check header
+	if len(data) < 12 {
+		return nil, 0, false
+	}
+
+	// get counts
+	qd := int(binary.BigEndian.Uint16(data[4:]))
+	rr := int(binary.BigEndian.Uint16(data[6:])) + int(binary.BigEndian.Uint16(data[8:])) + int(binary.BigEndian.Uint16(data[10:]))
+
+	// skip questions
+	off := 12
+	for i := 0; i < qd; i++ {
+		off = skipPackedName(data, off)
+		if off < 0 || off+4 > len(data) {
+			return nil, 0, false
+		}
+		off += 4
+	}
+
+	// find TTLs
+	var ttls []int
+	var min uint32
+	for i := 0; i < rr; i++ {
+		// skip name
+		off = skipPackedName(data, off)
+		if off < 0 || off+10 > len(data) {
+			return nil, 0, false
+		}
+
+		// get type and TTL
+		typ := binary.BigEndian.Uint16(data[off:])
+		ttl := binary.BigEndian.Uint32(data[off+4:])
+
+		// add TTL unless pseudo record
+		if typ != dns.TypeOPT && typ != dns.TypeTSIG {
+			if len(ttls) == 0 || ttl < min {
+				min = ttl
+			}
+			ttls = append(ttls, off+4)
+		}
+
+		// skip data
+		off += 10 + int(binary.BigEndian.Uint16(data[off+8:]))
+		if off > len(data) {
+			return nil, 0, false
+		}
+	}
+
+	return ttls, min, true
+}
+
+func skipPackedName(data []byte, off int) int {
+	for {
+		// check offset
+		if off >= len(data) {
+			return -1
+		}
+
+		// handle label
+		c := data[off]
+		switch {
+		case c == 0:
+			return off + 1
+		case c&0xc0 == 0xc0:
+			return off + 2
+		case c&0xc0 != 0:
+			return -1
+		default:
+			off += 1 + int(c)
+		}
+	}
+}
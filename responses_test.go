@@ -0,0 +1,77 @@
+package newdns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResponseCache(t *testing.T) {
+	cache := newResponseCache(10)
+
+	req := new(dns.Msg)
+	req.SetQuestion("foo.example.com.", dns.TypeA)
+	req.SetEdns0(1232, false)
+
+	key, ok := responseKeyOf(req, "udp")
+	assert.True(t, ok)
+	assert.Equal(t, responseKey{
+		name:   "foo.example.com.",
+		qtype:  dns.TypeA,
+		edns:   true,
+		buffer: 1232,
+	}, key)
+
+	res := new(dns.Msg)
+	res.SetReply(req)
+	res.Compress = true
+	res.SetEdns0(4096, false)
+	res.Answer = append(res.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "foo.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.ParseIP("1.2.3.4"),
+	})
+	res.Ns = append(res.Ns, &dns.NS{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60},
+		Ns:  "ns1.example.com.",
+	})
+
+	cache.put(key, "example.com.", res, 0, 0)
+	assert.Len(t, cache.entries, 1)
+	cache.entries[key].stored = cache.entries[key].stored.Add(-10 * time.Second)
+
+	req.Id = 42
+	req.RecursionDesired = false
+	data, zone, ok := cache.get(key, req)
+	assert.True(t, ok)
+	assert.Equal(t, "example.com.", zone)
+
+	ret := new(dns.Msg)
+	err := ret.Unpack(data)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(42), ret.Id)
+	assert.False(t, ret.RecursionDesired)
+	assert.Equal(t, uint32(290), ret.Answer[0].Header().Ttl)
+	assert.Equal(t, uint32(50), ret.Ns[0].Header().Ttl)
+	assert.NotNil(t, ret.IsEdns0())
+
+	cache.entries[key].stored = cache.entries[key].stored.Add(-time.Minute)
+	cache.entries[key].expires = cache.entries[key].expires.Add(-time.Minute)
+	_, _, ok = cache.get(key, req)
+	assert.False(t, ok)
+	assert.Len(t, cache.entries, 0)
+
+	cache.put(key, "example.com.", res, 0, 0)
+	cache.purge("example.org.")
+	assert.Len(t, cache.entries, 1)
+	cache.purge("example.com.")
+	assert.Len(t, cache.entries, 0)
+
+	req.Extra = nil
+	req.SetEdns0(1232, false)
+	req.IsEdns0().Option = append(req.IsEdns0().Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+	_, ok = responseKeyOf(req, "udp")
+	assert.False(t, ok)
+}
@@ -2,28 +2,59 @@ package newdns
 
 import (
 	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 )
 
+// RejectPolicy defines how unsupported messages are handled.
+type RejectPolicy int
+
+const (
+	// RejectIgnore ignores unsupported messages silently.
+	RejectIgnore RejectPolicy = iota
+
+	// RejectAnswer answers messages with an unsupported opcode with NOTIMP,
+	// messages without exactly one question with FORMERR and queries for an
+	// unsupported class with REFUSED. Responses are always ignored.
+	RejectAnswer
+)
+
 // Accept will return a dns.MsgAcceptFunc that only accepts normal queries.
 func Accept(logger Logger) dns.MsgAcceptFunc {
+	return accept(logger, RejectIgnore, dns.OpcodeQuery)
+}
+
+func accept(logger Logger, policy RejectPolicy, opcodes ...int) dns.MsgAcceptFunc {
 	return func(dh dns.Header) dns.MsgAcceptAction {
 		// check if request
 		if dh.Bits&(1<<15) != 0 {
-			log(logger, Ignored, nil, nil, fmt.Sprintf("not a request"))
+			log(logger, Ignored, nil, nil, "not a request")
 			return dns.MsgIgnore
 		}
 
 		// check opcode
-		if int(dh.Bits>>11)&0xF != dns.OpcodeQuery {
-			log(logger, Ignored, nil, nil, fmt.Sprintf("not a query"))
+		if !intInList(opcodes, int(dh.Bits>>11)&0xF) {
+			if policy == RejectAnswer {
+				log(logger, Refused, nil, nil, "not a query", Field{"opcode", int(dh.Bits>>11) & 0xF})
+				return dns.MsgRejectNotImplemented
+			}
+			log(logger, Ignored, nil, nil, "not a query", Field{"opcode", int(dh.Bits>>11) & 0xF})
 			return dns.MsgIgnore
 		}
 
 		// check question count
 		if dh.Qdcount != 1 {
-			log(logger, Ignored, nil, nil, fmt.Sprintf("invalid question count: %d", dh.Qdcount))
+			if policy == RejectAnswer {
+				log(logger, Refused, nil, nil, "invalid question count", Field{"count", dh.Qdcount})
+				return dns.MsgReject
+			}
+			log(logger, Ignored, nil, nil, "invalid question count", Field{"count", dh.Qdcount})
 			return dns.MsgIgnore
 		}
 
@@ -35,22 +66,176 @@ func Accept(logger Logger) dns.MsgAcceptFunc {
 // specified accept function until the provided close channel is closed. It will
 // return the first error of a listener.
 func Run(addr string, handler dns.Handler, accept dns.MsgAcceptFunc, close <-chan struct{}) error {
-	// prepare servers
-	udp := &dns.Server{Addr: addr, Net: "udp", Handler: handler, MsgAcceptFunc: accept}
-	tcp := &dns.Server{Addr: addr, Net: "tcp", Handler: handler, MsgAcceptFunc: accept}
+	return RunAll([]string{addr}, handler, accept, close)
+}
+
+// RunAll will start a UDP and TCP listener on every specified address to serve
+// the specified handler with the specified accept function until the provided
+// close channel is closed. Addresses of the form "unix:/path/to/socket" will
+// start a stream listener on a unix domain socket that uses the TCP message
+// framing. It will return the first error of a listener and shutdown all other
+// listeners.
+func RunAll(addrs []string, handler dns.Handler, accept dns.MsgAcceptFunc, close <-chan struct{}) error {
+	return listenAndServe(addrs, handler, accept, close, listenOptions{})
+}
+
+type listenOptions struct {
+	tcpIdleTimeout    time.Duration
+	maxTCPConnections int
+	maxTCPQueries     int
+	udpReadBuffer     int
+	udpWriteBuffer    int
+	udpBatchSize      int
+	tsigKeys          map[string]string
+	capture           CaptureFunc
+	ready             func([]net.Addr)
+}
+
+func (o listenOptions) server(net string, handler dns.Handler, accept dns.MsgAcceptFunc) *dns.Server {
+	// prepare server
+	server := &dns.Server{
+		Net:           net,
+		Handler:       handler,
+		MsgAcceptFunc: accept,
+		MaxTCPQueries: o.maxTCPQueries,
+		TsigProvider:  tsigProvider(o.tsigKeys),
+	}
+
+	// set idle timeout
+	if o.tcpIdleTimeout > 0 {
+		server.IdleTimeout = func() time.Duration {
+			return o.tcpIdleTimeout
+		}
+	}
+
+	// set capture decorators
+	if o.capture != nil {
+		server.DecorateReader = func(r dns.Reader) dns.Reader {
+			return &captureReader{Reader: r, fn: o.capture}
+		}
+		server.DecorateWriter = func(w dns.Writer) dns.Writer {
+			return &captureWriter{Writer: w, fn: o.capture}
+		}
+	}
+
+	return server
+}
+
+func (o listenOptions) listener(listener net.Listener) net.Listener {
+	// limit connections
+	if o.maxTCPConnections > 0 {
+		listener = newLimitListener(listener, o.maxTCPConnections)
+	}
+
+	return listener
+}
+
+func (o listenOptions) packetConn(conn net.PacketConn) (net.PacketConn, error) {
+	// set buffer sizes
+	if udp, ok := conn.(*net.UDPConn); ok {
+		if o.udpReadBuffer > 0 {
+			err := udp.SetReadBuffer(o.udpReadBuffer)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if o.udpWriteBuffer > 0 {
+			err := udp.SetWriteBuffer(o.udpWriteBuffer)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// enable batching
+	if o.udpBatchSize > 1 {
+		conn = newBatchConn(conn, o.udpBatchSize)
+	}
+
+	return conn, nil
+}
+
+func listenAndServe(addrs []string, handler dns.Handler, accept dns.MsgAcceptFunc, close <-chan struct{}, opts listenOptions) error {
+	// check addresses
+	if len(addrs) == 0 {
+		return fmt.Errorf("missing addresses")
+	}
+
+	// prepare servers and bound addresses
+	var servers []*dns.Server
+	var bound []net.Addr
+
+	// prepare cleanup
+	cleanup := func() {
+		for _, server := range servers {
+			if server.Listener != nil {
+				_ = server.Listener.Close()
+			}
+			if server.PacketConn != nil {
+				_ = server.PacketConn.Close()
+			}
+		}
+	}
+
+	// bind listeners
+	for _, addr := range addrs {
+		// handle unix sockets
+		if strings.HasPrefix(addr, "unix:") {
+			// create listener
+			listener, err := listenUnix(strings.TrimPrefix(addr, "unix:"))
+			if err != nil {
+				cleanup()
+				return err
+			}
+
+			// add server
+			server := opts.server("tcp", handler, accept)
+			server.Listener = opts.listener(listener)
+			servers = append(servers, server)
+			bound = append(bound, listener.Addr())
+
+			continue
+		}
+
+		// create listener and packet conn
+		listener, conn, err := listenNet(addr)
+		if err != nil {
+			cleanup()
+			return err
+		}
+
+		// configure packet conn
+		pc, err := opts.packetConn(conn)
+		if err != nil {
+			_ = listener.Close()
+			_ = conn.Close()
+			cleanup()
+			return err
+		}
+
+		// add servers
+		udp := opts.server("udp", handler, accept)
+		udp.PacketConn = pc
+		tcp := opts.server("tcp", handler, accept)
+		tcp.Listener = opts.listener(listener)
+		servers = append(servers, udp, tcp)
+		bound = append(bound, listener.Addr())
+	}
 
 	// prepare errors
-	errs := make(chan error, 2)
+	errs := make(chan error, len(servers))
 
-	// run udp server
-	go func() {
-		errs <- udp.ListenAndServe()
-	}()
+	// run servers
+	for _, server := range servers {
+		go func(server *dns.Server) {
+			errs <- server.ActivateAndServe()
+		}(server)
+	}
 
-	// run tcp server
-	go func() {
-		errs <- tcp.ListenAndServe()
-	}()
+	// signal readiness
+	if opts.ready != nil {
+		opts.ready(bound)
+	}
 
 	// await first error
 	var err error
@@ -60,8 +245,100 @@ func Run(addr string, handler dns.Handler, accept dns.MsgAcceptFunc, close <-cha
 	}
 
 	// shutdown servers
-	_ = udp.Shutdown()
-	_ = tcp.Shutdown()
+	for _, server := range servers {
+		_ = server.Shutdown()
+	}
 
 	return err
 }
+
+func listenNet(addr string) (net.Listener, net.PacketConn, error) {
+	// create listener
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// use the same port for UDP if a random port has been requested
+	host, port, err := net.SplitHostPort(addr)
+	if err == nil && port == "0" {
+		addr = net.JoinHostPort(host, strconv.Itoa(listener.Addr().(*net.TCPAddr).Port))
+	}
+
+	// create packet conn
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		_ = listener.Close()
+		return nil, nil, err
+	}
+
+	return listener, conn, nil
+}
+
+func listenUnix(path string) (net.Listener, error) {
+	// remove stale socket
+	info, err := os.Lstat(path)
+	if err == nil && info.Mode()&os.ModeSocket != 0 {
+		err = os.Remove(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// create listener
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+type limitListener struct {
+	net.Listener
+	sem  chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+func newLimitListener(listener net.Listener, n int) *limitListener {
+	return &limitListener{
+		Listener: listener,
+		sem:      make(chan struct{}, n),
+		done:     make(chan struct{}),
+	}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	// acquire slot
+	select {
+	case l.sem <- struct{}{}:
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+
+	// accept connection
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
+	}
+
+	return &limitConn{Conn: conn, release: func() { <-l.sem }}, nil
+}
+
+func (l *limitListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
@@ -0,0 +1,98 @@
+package newdns
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// SamplerConfig configures a sampler.
+type SamplerConfig struct {
+	// The rates between 0 and 1 at which events are forwarded. Events without
+	// a rate are always forwarded.
+	Events map[Event]float64
+
+	// The rates between 0 and 1 at which Response and Finish events are
+	// forwarded depending on the response code. Rcode rates take precedence
+	// over event rates. For example, use {dns.RcodeServerFailure: 1,
+	// dns.RcodeSuccess: 0.01} to always log failures and sample one percent of
+	// successful responses.
+	Rcodes map[int]float64
+}
+
+// Sampler forwards a sample of the logging events to the next logger to
+// reduce the logging volume on busy servers. Events of the same request are
+// sampled consistently, a request that is sampled at a rate has all its events
+// with an equal or higher rate forwarded.
+type Sampler struct {
+	next   Logger
+	config SamplerConfig
+	mutex  sync.Mutex
+	rand   *rand.Rand
+}
+
+// NewSampler creates and returns a new sampler that forwards a sample of the
+// events to the provided logger.
+func NewSampler(next Logger, config SamplerConfig) *Sampler {
+	return &Sampler{
+		next:   next,
+		config: config,
+		rand:   rand.New(rand.NewSource(rand.Int63())),
+	}
+}
+
+// Log implements the Logger interface.
+func (s *Sampler) Log(entry Entry) {
+	// get rate
+	rate, ok := s.rate(entry)
+	if !ok || rate >= 1 {
+		s.next.Log(entry)
+		return
+	} else if rate <= 0 {
+		return
+	}
+
+	// get value
+	var value float64
+	if entry.RequestID != 0 {
+		value = sampleValue(entry.RequestID)
+	} else {
+		s.mutex.Lock()
+		value = s.rand.Float64()
+		s.mutex.Unlock()
+	}
+
+	// check value
+	if value < rate {
+		s.next.Log(entry)
+	}
+}
+
+func (s *Sampler) rate(entry Entry) (float64, bool) {
+	// check rcode rates
+	if len(s.config.Rcodes) > 0 {
+		var rcode = -1
+		if entry.Event == Response && entry.Msg != nil {
+			rcode = entry.Msg.Rcode
+		} else if entry.Event == Finish && entry.Info != nil && entry.Info.ResponseSize > 0 {
+			rcode = entry.Info.Rcode
+		}
+		if rate, ok := s.config.Rcodes[rcode]; ok && rcode >= 0 {
+			return rate, true
+		}
+	}
+
+	// check event rates
+	rate, ok := s.config.Events[entry.Event]
+
+	return rate, ok
+}
+
+func sampleValue(id uint64) float64 {
+	// mix bits (splitmix64)
+	id += 0x9e3779b97f4a7c15
+	id = (id ^ (id >> 30)) * 0xbf58476d1ce4e5b9
+	id = (id ^ (id >> 27)) * 0x94d049bb133111eb
+	id ^= id >> 31
+
+	return float64(id>>11) / (1 << 53)
+}
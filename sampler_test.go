@@ -0,0 +1,65 @@
+package newdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSampler(t *testing.T) {
+	var entries []Entry
+	sampler := NewSampler(LoggerFunc(func(entry Entry) {
+		entries = append(entries, entry)
+	}), SamplerConfig{
+		Events: map[Event]float64{
+			Request:  0.1,
+			Response: 0.1,
+			Ignored:  0,
+		},
+		Rcodes: map[int]float64{
+			dns.RcodeServerFailure: 1,
+		},
+	})
+
+	for i := uint64(1); i <= 1000; i++ {
+		success := new(dns.Msg)
+		failure := new(dns.Msg)
+		failure.Rcode = dns.RcodeServerFailure
+
+		sampler.Log(Entry{Event: Request, RequestID: i})
+		sampler.Log(Entry{Event: Response, Msg: success, RequestID: i})
+		sampler.Log(Entry{Event: Response, Msg: failure, RequestID: i})
+		sampler.Log(Entry{Event: Ignored, RequestID: i})
+		sampler.Log(Entry{Event: BackendError, RequestID: i})
+	}
+
+	counts := map[Event]int{}
+	failures := 0
+	requests := map[uint64]bool{}
+	for _, entry := range entries {
+		counts[entry.Event]++
+		if entry.Event == Request {
+			requests[entry.RequestID] = true
+		}
+		if entry.Event == Response && entry.Msg.Rcode == dns.RcodeServerFailure {
+			failures++
+		} else if entry.Event == Response {
+			assert.True(t, requests[entry.RequestID])
+		}
+	}
+
+	assert.Equal(t, 0, counts[Ignored])
+	assert.Equal(t, 1000, counts[BackendError])
+	assert.Equal(t, 1000, failures)
+	assert.True(t, counts[Request] > 50 && counts[Request] < 150)
+	assert.Equal(t, counts[Request], counts[Response]-failures)
+}
+
+func TestSampleValue(t *testing.T) {
+	for i := uint64(0); i < 1000; i++ {
+		value := sampleValue(i)
+		assert.True(t, value >= 0 && value < 1)
+		assert.Equal(t, value, sampleValue(i))
+	}
+}
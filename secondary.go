@@ -0,0 +1,433 @@
+package newdns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// SecondaryConfig provides configuration for a secondary zone.
+type SecondaryConfig struct {
+	// The FQDN of the zone e.g. "example.com.".
+	Name string
+
+	// The address of the primary server e.g. "ns1.example.com:53".
+	Primary string
+
+	// The interval used to retry the initial transfer. Afterwards the
+	// intervals announced by the primary in the SOA record are used.
+	//
+	// Default: 1m.
+	Retry time.Duration
+
+	// The timeout for SOA queries and zone transfers.
+	//
+	// Default: 10s.
+	Timeout time.Duration
+
+	// The optional callback that decides whether a zone transfer of the
+	// secondary zone to the specified remote address is allowed.
+	AllowTransfer func(remote net.Addr) bool
+
+	// The optional TSIG key name and base64 encoded secret used to sign SOA
+	// queries and zone transfers. NOTIFY messages for the zone must be signed
+	// with the same key if configured.
+	TSIGKey    string
+	TSIGSecret string
+
+	// The TSIG algorithm.
+	//
+	// Default: dns.HmacSHA256.
+	TSIGAlgorithm string
+
+	// The logger called with errors encountered while refreshing the zone.
+	Logger Logger
+}
+
+// SecondaryZone maintains a local copy of a zone by transferring it from a
+// primary server. The zone is refreshed using the refresh, retry and expire
+// intervals announced by the primary in its SOA record.
+type SecondaryZone struct {
+	config  SecondaryConfig
+	mutex   sync.RWMutex
+	zone    *Zone
+	checked time.Time
+	refresh chan struct{}
+	close   chan struct{}
+}
+
+// NewSecondaryZone creates and returns a new secondary zone.
+func NewSecondaryZone(config SecondaryConfig) *SecondaryZone {
+	// set default retry
+	if config.Retry <= 0 {
+		config.Retry = time.Minute
+	}
+
+	// set default timeout
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+
+	// normalize TSIG key
+	if config.TSIGKey != "" {
+		config.TSIGKey = NormalizeDomain(config.TSIGKey, true, true, false)
+	}
+
+	// set default TSIG algorithm
+	if config.TSIGAlgorithm == "" {
+		config.TSIGAlgorithm = dns.HmacSHA256
+	}
+
+	return &SecondaryZone{
+		config:  config,
+		refresh: make(chan struct{}, 1),
+		close:   make(chan struct{}),
+	}
+}
+
+// Zone returns the current copy of the zone. It returns nil if the zone has
+// not yet been transferred or if the zone has expired.
+func (z *SecondaryZone) Zone() *Zone {
+	// acquire lock
+	z.mutex.RLock()
+	defer z.mutex.RUnlock()
+
+	// check zone
+	if z.zone == nil {
+		return nil
+	}
+
+	// check expiry
+	if time.Since(z.checked) > z.zone.Expire {
+		return nil
+	}
+
+	return z.zone
+}
+
+// Refresh will trigger an immediate refresh of the zone. It may be called when
+// a NOTIFY message for the zone has been received.
+func (z *SecondaryZone) Refresh() {
+	select {
+	case z.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// Run will transfer the zone and keep it up-to-date until the secondary zone
+// is closed.
+func (z *SecondaryZone) Run() error {
+	// prepare wait
+	var wait time.Duration
+
+	for {
+		// await next check
+		select {
+		case <-time.After(wait):
+		case <-z.refresh:
+		case <-z.close:
+			return nil
+		}
+
+		// update zone
+		err := z.update()
+		if err != nil {
+			log(z.config.Logger, NetworkError, nil, err, "")
+		}
+
+		// get current zone
+		z.mutex.RLock()
+		zone := z.zone
+		z.mutex.RUnlock()
+
+		// determine next wait
+		switch {
+		case zone == nil:
+			wait = z.config.Retry
+		case err != nil:
+			wait = zone.Retry
+		default:
+			wait = zone.Refresh
+		}
+	}
+}
+
+// Close will stop refreshing the zone.
+func (z *SecondaryZone) Close() {
+	defer func() { recover() }()
+	close(z.close)
+}
+
+func (z *SecondaryZone) update() error {
+	// get current zone
+	z.mutex.RLock()
+	current := z.zone
+	z.mutex.RUnlock()
+
+	// check serial if available
+	if current != nil {
+		// query SOA
+		serial, err := z.querySerial()
+		if err != nil {
+			return err
+		}
+
+		// mark checked and return if not changed
+		if !serialLess(current.Serial, serial) {
+			z.mutex.Lock()
+			z.checked = time.Now()
+			z.mutex.Unlock()
+
+			return nil
+		}
+	}
+
+	// transfer zone
+	zone, err := z.transfer()
+	if err != nil {
+		return err
+	}
+
+	// set zone
+	z.mutex.Lock()
+	z.zone = zone
+	z.checked = time.Now()
+	z.mutex.Unlock()
+
+	return nil
+}
+
+func (z *SecondaryZone) querySerial() (uint32, error) {
+	// prepare client
+	client := dns.Client{
+		Net:     "tcp",
+		Timeout: z.config.Timeout,
+	}
+
+	// prepare request
+	req := new(dns.Msg)
+	req.SetQuestion(z.config.Name, dns.TypeSOA)
+
+	// sign request
+	if z.config.TSIGKey != "" {
+		client.TsigSecret = map[string]string{z.config.TSIGKey: z.config.TSIGSecret}
+		req.SetTsig(z.config.TSIGKey, z.config.TSIGAlgorithm, 300, time.Now().Unix())
+	}
+
+	// send request
+	res, _, err := client.Exchange(req, z.config.Primary)
+	if err != nil {
+		return 0, err
+	}
+
+	// find SOA record
+	for _, rr := range res.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial, nil
+		}
+	}
+
+	return 0, fmt.Errorf("missing SOA record for secondary zone: %s", z.config.Name)
+}
+
+func (z *SecondaryZone) transfer() (*Zone, error) {
+	// prepare transfer
+	tr := &dns.Transfer{
+		DialTimeout:  z.config.Timeout,
+		ReadTimeout:  z.config.Timeout,
+		WriteTimeout: z.config.Timeout,
+	}
+
+	// prepare request
+	req := new(dns.Msg)
+	req.SetAxfr(z.config.Name)
+
+	// sign request
+	if z.config.TSIGKey != "" {
+		tr.TsigSecret = map[string]string{z.config.TSIGKey: z.config.TSIGSecret}
+		req.SetTsig(z.config.TSIGKey, z.config.TSIGAlgorithm, 300, time.Now().Unix())
+	}
+
+	// perform transfer
+	envs, err := tr.In(req, z.config.Primary)
+	if err != nil {
+		return nil, err
+	}
+
+	// collect records
+	var rrs []dns.RR
+	for env := range envs {
+		if env.Error != nil {
+			return nil, env.Error
+		}
+		rrs = append(rrs, env.RR...)
+	}
+
+	// build zone
+	zone, err := buildZone(z.config.Name, rrs, z.config.AllowTransfer)
+	if err != nil {
+		return nil, err
+	}
+
+	// refresh on notify
+	zone.Notify = func(net.Addr) {
+		z.Refresh()
+	}
+
+	// require TSIG key for notify
+	if z.config.TSIGKey != "" {
+		zone.TSIGKeys = []string{z.config.TSIGKey}
+	}
+
+	return zone, nil
+}
+
+func buildZone(name string, rrs []dns.RR, allowTransfer func(net.Addr) bool) (*Zone, error) {
+	// normalize name
+	name = NormalizeDomain(name, true, true, false)
+
+	// prepare zone
+	zone := &Zone{
+		Name:          name,
+		AllowTransfer: allowTransfer,
+	}
+
+	// prepare sets
+	var order []string
+	sets := map[string]*Set{}
+
+	// handle records
+	for _, rr := range rrs {
+		// get header
+		hdr := rr.Header()
+		owner := NormalizeDomain(hdr.Name, true, false, false)
+		ttl := time.Duration(hdr.Ttl) * time.Second
+
+		// handle SOA record
+		if soa, ok := rr.(*dns.SOA); ok {
+			if owner == name {
+				zone.MasterNameServer = NormalizeDomain(soa.Ns, true, false, false)
+				zone.AdminEmail = domainToEmail(soa.Mbox)
+				zone.Serial = soa.Serial
+				zone.Refresh = time.Duration(soa.Refresh) * time.Second
+				zone.Retry = time.Duration(soa.Retry) * time.Second
+				zone.Expire = time.Duration(soa.Expire) * time.Second
+				zone.MinTTL = time.Duration(soa.Minttl) * time.Second
+				zone.SOATTL = ttl
+			}
+			continue
+		}
+
+		// handle apex NS records
+		if ns, ok := rr.(*dns.NS); ok && owner == name {
+			zone.AllNameServers = append(zone.AllNameServers, NormalizeDomain(ns.Ns, true, false, false))
+			zone.NSTTL = ttl
+			continue
+		}
+
+		// convert record
+		typ, record, ok := fromRR(rr)
+		if !ok {
+			continue
+		}
+
+		// get set
+		key := fmt.Sprintf("%s/%d", owner, typ)
+		set, ok := sets[key]
+		if !ok {
+			set = &Set{
+				Name: owner,
+				Type: typ,
+				TTL:  ttl,
+			}
+			sets[key] = set
+			order = append(order, key)
+		}
+
+		// add record
+		set.Records = append(set.Records, record)
+
+		// use lowest TTL
+		if ttl < set.TTL {
+			set.TTL = ttl
+		}
+	}
+
+	// check SOA
+	if zone.MasterNameServer == "" {
+		return nil, fmt.Errorf("missing SOA record for zone: %s", name)
+	}
+
+	// use the first name server as master if the primary is hidden
+	if len(zone.AllNameServers) > 0 && !stringInList(zone.AllNameServers, zone.MasterNameServer) {
+		zone.MasterNameServer = zone.AllNameServers[0]
+	}
+
+	// index sets by name
+	index := map[string][]Set{}
+	var list []Set
+	for _, key := range order {
+		set := *sets[key]
+		index[set.Name] = append(index[set.Name], set)
+		list = append(list, set)
+	}
+
+	// set handler
+	zone.Handler = func(ctx context.Context, sub string) ([]Set, error) {
+		// get full name
+		full := name
+		if sub != "" {
+			full = sub + "." + name
+		}
+
+		return index[strings.ToLower(full)], nil
+	}
+
+	// set lister
+	zone.Lister = func(ctx context.Context, fn func(Set) error) error {
+		for _, set := range list {
+			err := fn(set)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	// validate zone
+	err := zone.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return zone, nil
+}
+
+func fromRR(rr dns.RR) (Type, Record, bool) {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return A, Record{Address: rr.A.String()}, true
+	case *dns.AAAA:
+		return AAAA, Record{Address: rr.AAAA.String()}, true
+	case *dns.CNAME:
+		return CNAME, Record{Address: NormalizeDomain(rr.Target, true, false, false)}, true
+	case *dns.MX:
+		return MX, Record{Address: NormalizeDomain(rr.Mx, true, false, false), Priority: int(rr.Preference)}, true
+	case *dns.TXT:
+		return TXT, Record{Data: rr.Txt}, true
+	case *dns.NS:
+		return NS, Record{Address: NormalizeDomain(rr.Ns, true, false, false)}, true
+	case *dns.PTR:
+		return PTR, Record{Address: NormalizeDomain(rr.Ptr, true, false, false)}, true
+	case *dns.SRV:
+		return SRV, Record{Address: NormalizeDomain(rr.Target, true, false, false), Priority: int(rr.Priority), Weight: int(rr.Weight), Port: int(rr.Port)}, true
+	default:
+		return 0, Record{}, false
+	}
+}
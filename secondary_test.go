@@ -0,0 +1,113 @@
+package newdns
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecondaryZone(t *testing.T) {
+	sets := []Set{
+		{
+			Name: "example.com.",
+			Type: A,
+			Records: []Record{
+				{Address: "1.2.3.4"},
+			},
+		},
+		{
+			Name: "foo.example.com.",
+			Type: CNAME,
+			Records: []Record{
+				{Address: "example.com."},
+			},
+		},
+		{
+			Name: "mail.example.com.",
+			Type: MX,
+			Records: []Record{
+				{Address: "mx1.example.com.", Priority: 10},
+				{Address: "mx2.example.com.", Priority: 20},
+			},
+		},
+	}
+
+	primary := &Zone{
+		Name:             "example.com.",
+		MasterNameServer: "ns1.example.com.",
+		AllNameServers: []string{
+			"ns1.example.com.",
+			"ns2.example.com.",
+		},
+		Serial:  7,
+		Refresh: time.Hour,
+		Retry:   time.Minute,
+		Handler: func(ctx context.Context, name string) ([]Set, error) {
+			return nil, nil
+		},
+		Lister: func(ctx context.Context, fn func(Set) error) error {
+			for _, set := range sets {
+				err := fn(set)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+		AllowTransfer: func(remote net.Addr) bool {
+			return true
+		},
+	}
+
+	server := NewServer(Config{
+		Handler: testHandler(primary),
+	})
+
+	run(server, "127.0.0.1:0", func() {
+		secondary := NewSecondaryZone(SecondaryConfig{
+			Name:    "example.com.",
+			Primary: server.Addr().String(),
+		})
+		defer secondary.Close()
+
+		assert.Nil(t, secondary.Zone())
+
+		go func() {
+			_ = secondary.Run()
+		}()
+
+		assert.Eventually(t, func() bool {
+			return secondary.Zone() != nil
+		}, time.Second, 10*time.Millisecond)
+
+		zone := secondary.Zone()
+		assert.Equal(t, "example.com.", zone.Name)
+		assert.Equal(t, "ns1.example.com.", zone.MasterNameServer)
+		assert.Equal(t, []string{"ns1.example.com.", "ns2.example.com."}, zone.AllNameServers)
+		assert.Equal(t, uint32(7), zone.Serial)
+		assert.Equal(t, time.Hour, zone.Refresh)
+
+		res, exists, err := zone.Lookup(context.Background(), "foo.example.com.", A)
+		assert.NoError(t, err)
+		assert.False(t, exists)
+		assert.Len(t, res, 2)
+
+		res, _, err = zone.Lookup(context.Background(), "mail.example.com.", MX)
+		assert.NoError(t, err)
+		assert.Equal(t, []Set{
+			{
+				Name: "mail.example.com.",
+				Type: MX,
+				Records: []Record{
+					{Address: "mx1.example.com.", Priority: 10},
+					{Address: "mx2.example.com.", Priority: 20},
+				},
+				TTL: 5 * time.Minute,
+			},
+		}, res)
+	})
+}
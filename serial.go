@@ -0,0 +1,26 @@
+package newdns
+
+import "time"
+
+// UnixSerial returns a serial for the provided time using the number of
+// seconds since the unix epoch.
+func UnixSerial(t time.Time) uint32 {
+	return uint32(t.Unix())
+}
+
+// DateSerial returns the next serial in the "YYYYMMDDnn" format for the
+// provided time. The counter is incremented if the previous serial has already
+// been issued on the same day. If the counter is exhausted or the previous
+// serial is ahead, the previous serial is incremented instead.
+func DateSerial(t time.Time, previous uint32) uint32 {
+	// get date serial
+	year, month, day := t.UTC().Date()
+	serial := uint32(year)*1000000 + uint32(month)*10000 + uint32(day)*100
+
+	// increment previous if not behind
+	if !serialLess(previous, serial) {
+		return previous + 1
+	}
+
+	return serial
+}
@@ -0,0 +1,22 @@
+package newdns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnixSerial(t *testing.T) {
+	assert.Equal(t, uint32(1600000000), UnixSerial(time.Unix(1600000000, 0)))
+}
+
+func TestDateSerial(t *testing.T) {
+	now := time.Date(2020, 9, 13, 12, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, uint32(2020091300), DateSerial(now, 0))
+	assert.Equal(t, uint32(2020091300), DateSerial(now, 2020091200))
+	assert.Equal(t, uint32(2020091301), DateSerial(now, 2020091300))
+	assert.Equal(t, uint32(2020091400), DateSerial(now, 2020091399))
+	assert.Equal(t, uint32(2020091502), DateSerial(now, 2020091501))
+}
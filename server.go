@@ -1,8 +1,19 @@
 package newdns
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/hex"
 	"fmt"
+	"math/rand"
 	"net"
+	"net/http"
+	"reflect"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/miekg/dns"
 )
@@ -14,43 +25,332 @@ type Config struct {
 	// Default: 1220.
 	BufferSize int
 
+	// The maximum size of UDP responses. The buffer size announced by clients
+	// is clamped to this value to avoid IP fragmentation. Zones may override
+	// the value.
+	//
+	// Default: 1232.
+	MaxUDPSize int
+
+	// The server identifier that is returned to clients that request it using
+	// the EDNS NSID option (RFC 5001) e.g. the name of an anycast instance.
+	ServerID string
+
 	// The list of zones handled by this server.
 	//
 	// Default: ["."].
 	Zones []string
 
 	// Handler is the callback that returns a zone for the specified name.
-	// The returned zone must not be altered going forward.
-	Handler func(name string) (*Zone, error)
+	// The returned zone must not be altered going forward. The provided context
+	// is derived from the context the server has been run with and may be used
+	// with GetRequestInfo, RequestOptions and AddResponseOption. It is
+	// cancelled once the request has been processed or the handler timeout has
+	// been exceeded.
+	Handler func(ctx context.Context, name string) (*Zone, error)
+
+	// The provider that is used as the handler if no handler is set.
+	Provider ZoneProvider
+
+	// The maximum duration of a request after which the context passed to the
+	// server and zone handlers is cancelled. Handlers should return with an
+	// error once the context has been cancelled, which answers the request
+	// with SERVFAIL.
+	//
+	// Default: 0 (no timeout).
+	HandlerTimeout time.Duration
+
+	// The policy for messages with an unsupported opcode, class or question
+	// count.
+	//
+	// Default: RejectIgnore.
+	RejectPolicy RejectPolicy
+
+	// The policy for queries of the ANY type.
+	//
+	// Default: AnyNotImplemented.
+	AnyPolicy AnyPolicy
+
+	// Whether CNAME targets in other zones served by this server are resolved
+	// using the handler and their records are included in the answer.
+	ChaseCNAMEs bool
+
+	// The fallback DNS servers to be used if the zones is not matched. Exact
+	// zones must be provided above for this to work. Requests are forwarded
+	// to multiple servers according to the fallback policy.
+	Fallback []string
+
+	// The time after which the next fallback server is queried.
+	//
+	// Default: 100ms.
+	FallbackDelay time.Duration
+
+	// The TLS configuration used for fallback and forwarder servers that are
+	// addressed using DNS-over-TLS ("tls://host:port") or DNS-over-HTTPS
+	// ("https://host/path"). The server name is set from the address if
+	// missing.
+	FallbackTLS *tls.Config
+
+	// The timeout of a single exchange with the fallback servers.
+	//
+	// Default: 2s.
+	FallbackTimeout time.Duration
+
+	// The number of times a failed exchange with the fallback servers is
+	// retried.
+	//
+	// Default: 0.
+	FallbackRetries int
+
+	// The policy used to handle requests that could not be forwarded to the
+	// fallback servers.
+	//
+	// Default: FailureDrop.
+	FailurePolicy FailurePolicy
+
+	// The policy used to forward requests to multiple fallback servers.
+	//
+	// Default: FallbackHedge.
+	FallbackPolicy FallbackPolicy
 
-	// The fallback DNS server to be used if the zones is not matched. Exact
-	// zones must be provided above for this to work.
-	Fallback string
+	// The number of consecutive transport errors after which the circuit of a
+	// fallback or forwarder server is opened and the server is skipped.
+	// Error responses are not counted as failures.
+	//
+	// Default: 5.
+	BreakerFailures int
+
+	// The duration after which a single request is forwarded again to a
+	// server with an open circuit. With the failover policy, servers are
+	// instead used again once they pass a health probe.
+	//
+	// Default: 10s.
+	BreakerTimeout time.Duration
+
+	// The servers to which requests for names in the domains are forwarded.
+	// The most specific domain is used and requests for domains with multiple
+	// servers are forwarded using a hedged proxy. Exact zones must be provided
+	// above for this to work.
+	Forwarders map[string][]string
+
+	// The middleware that is applied around the handling of all requests
+	// including the fallback. The first middleware is the outermost. Wrapped
+	// writers receive all responses using WriteMsg. The messages are reused
+	// and must not be retained.
+	Middleware []func(next dns.Handler) dns.Handler
+
+	// The optional tracer used to create a span for every query with child
+	// spans for handler calls. Requests forwarded to the fallback are traced
+	// using separate spans.
+	Tracer Tracer
+
+	// The time after which idle TCP connections are closed.
+	//
+	// Default: 8s.
+	TCPIdleTimeout time.Duration
 
-	// Reporter is the callback called with request errors.
+	// The maximum number of concurrent TCP connections. Further connections
+	// are not accepted until other connections have been closed.
+	//
+	// Default: 0 (unlimited).
+	MaxTCPConnections int
+
+	// The maximum number of queries served on a single TCP connection before
+	// it is closed. Use -1 for unlimited queries.
+	//
+	// Default: 128.
+	MaxTCPQueries int
+
+	// The maximum number of queries that are processed concurrently. Queries
+	// exceeding the limit are handled according to the overload policy.
+	//
+	// Default: 0 (unlimited).
+	MaxConcurrentQueries int
+
+	// The policy for queries that exceed the maximum number of concurrently
+	// processed queries.
+	//
+	// Default: OverloadDrop.
+	OverloadPolicy OverloadPolicy
+
+	// The maximum time queries wait for processing with OverloadQueue.
+	//
+	// Default: 1s.
+	QueueTimeout time.Duration
+
+	// The size of the operating system receive buffer for UDP sockets in
+	// bytes. Increasing the buffer helps to avoid dropped packets under load.
+	//
+	// Default: 0 (system default).
+	UDPReadBuffer int
+
+	// The size of the operating system send buffer for UDP sockets in bytes.
+	//
+	// Default: 0 (system default).
+	UDPWriteBuffer int
+
+	// The number of UDP messages that are read and written using a single
+	// system call. Batching is only available on Linux and uses the generic
+	// packet path, therefore listeners should be bound to specific addresses
+	// on multi-homed hosts.
+	//
+	// Default: 0 (disabled).
+	UDPBatchSize int
+
+	// The TSIG keys used to verify and sign messages. The map is keyed by the
+	// key name and contains the base64 encoded secrets. Key names are matched
+	// case-insensitively. Signed requests with unknown keys or invalid
+	// signatures are always rejected. Zones must list the keys they accept.
+	TSIGKeys map[string]string
+
+	// The number of recent responses kept in the in-memory query log.
+	//
+	// Default: 0 (disabled).
+	QueryLogSize int
+
+	// The number of packed responses kept in the response cache. Cached
+	// responses are served without calling the handlers until the lowest TTL
+	// of the contained records expires. The TTLs are decremented when served.
+	// The cache should only be enabled if responses solely depend on the
+	// question. Requests with EDNS options or TSIG signatures are not cached.
+	//
+	// Default: 0 (disabled).
+	ResponseCacheSize int
+
+	// The number of packed responses kept in the fallback cache. Cached
+	// successful and negative responses of the fallback servers are served
+	// without forwarding until the lowest TTL of the contained records
+	// expires. Requests with EDNS options or TSIG signatures are not cached.
+	//
+	// Default: 0 (disabled).
+	FallbackCacheSize int
+
+	// The optional address of a debug HTTP listener that serves the query log
+	// as JSON at "/debug/queries".
+	DebugAddr string
+
+	// The optional callback that receives the raw messages received from and
+	// sent to clients for protocol debugging.
+	Capture CaptureFunc
+
+	// The optional callback that is called with panics recovered from handlers
+	// and the stack trace of the panic. Requests that caused a panic are
+	// answered with SERVFAIL.
+	Reporter func(err error, stack []byte)
+
+	// The maximum time to wait for in-flight queries to finish when the server
+	// is shutdown gracefully.
+	//
+	// Default: 5s.
+	DrainTimeout time.Duration
+
+	// The logger called with events about the processing of requests.
 	Logger Logger
 }
 
 // Server is a DNS server.
 type Server struct {
-	config Config
-	close  chan struct{}
+	requests  uint64
+	rotation  uint64
+	config    Config
+	queryLog  *QueryLog
+	responses *responseCache
+	fallbacks *responseCache
+	proxies   sync.Map
+	slots     chan struct{}
+	limits    *limiter
+	counters  counters
+	base      atomic.Value
+	raw       atomic.Value
+	mutex     sync.Mutex
+	pending   int
+	draining  bool
+	drained   chan struct{}
+	addrs     []net.Addr
+	ready     chan struct{}
+	close     chan struct{}
 }
 
 // NewServer creates and returns a new DNS server.
 func NewServer(config Config) *Server {
+	// use provider as handler
+	if config.Handler == nil && config.Provider != nil {
+		config.Handler = config.Provider.Zone
+	}
+
 	// set default buffer size
 	if config.BufferSize <= 0 {
 		config.BufferSize = 1220
 	}
 
+	// set default max UDP size
+	if config.MaxUDPSize <= 0 {
+		config.MaxUDPSize = 1232
+	}
+
+	// set default TCP idle timeout
+	if config.TCPIdleTimeout <= 0 {
+		config.TCPIdleTimeout = 8 * time.Second
+	}
+
+	// set default max TCP queries
+	if config.MaxTCPQueries == 0 {
+		config.MaxTCPQueries = 128
+	}
+
+	// set default queue timeout
+	if config.QueueTimeout <= 0 {
+		config.QueueTimeout = time.Second
+	}
+
+	// set default fallback delay
+	if config.FallbackDelay <= 0 {
+		config.FallbackDelay = 100 * time.Millisecond
+	}
+
+	// set default fallback timeout
+	if config.FallbackTimeout <= 0 {
+		config.FallbackTimeout = 2 * time.Second
+	}
+
+	// set default breaker failures
+	if config.BreakerFailures <= 0 {
+		config.BreakerFailures = breakerFailures
+	}
+
+	// set default breaker timeout
+	if config.BreakerTimeout <= 0 {
+		config.BreakerTimeout = breakerTimeout
+	}
+
+	// set default drain timeout
+	if config.DrainTimeout <= 0 {
+		config.DrainTimeout = 5 * time.Second
+	}
+
+	// normalize TSIG keys
+	if config.TSIGKeys != nil {
+		keys := make(map[string]string, len(config.TSIGKeys))
+		for name, secret := range config.TSIGKeys {
+			keys[NormalizeDomain(name, true, true, false)] = secret
+		}
+		config.TSIGKeys = keys
+	}
+
 	// set default zone
 	if len(config.Zones) == 0 {
 		config.Zones = []string{"."}
 	}
 
+	// check zones if forwarders
+	for _, zone := range config.Zones {
+		if _, ok := config.Forwarders[zone]; ok {
+			panic(fmt.Sprintf("forwarder conflicts with zone: %s", zone))
+		}
+	}
+
 	// check zones if fallback
-	if config.Fallback != "" {
+	if len(config.Fallback) > 0 {
 		for _, zone := range config.Zones {
 			if zone == "." {
 				panic(`fallback conflicts with the match all pattern "." (default)`)
@@ -58,15 +358,81 @@ func NewServer(config Config) *Server {
 		}
 	}
 
+	// create query log
+	var queryLog *QueryLog
+	if config.QueryLogSize > 0 {
+		queryLog = NewQueryLog(config.QueryLogSize, config.Logger)
+		config.Logger = queryLog
+	}
+
+	// create response cache
+	var responses *responseCache
+	if config.ResponseCacheSize > 0 {
+		responses = newResponseCache(config.ResponseCacheSize)
+	}
+
+	// create fallback cache
+	var fallbacks *responseCache
+	if config.FallbackCacheSize > 0 {
+		fallbacks = newResponseCache(config.FallbackCacheSize)
+	}
+
+	// create slots
+	var slots chan struct{}
+	if config.MaxConcurrentQueries > 0 {
+		slots = make(chan struct{}, config.MaxConcurrentQueries)
+	}
+
 	return &Server{
-		config: config,
-		close:  make(chan struct{}),
+		config:    config,
+		queryLog:  queryLog,
+		responses: responses,
+		fallbacks: fallbacks,
+		limits:    newLimiter(limiterSize),
+		slots:     slots,
+		drained:   make(chan struct{}),
+		ready:     make(chan struct{}),
+		close:     make(chan struct{}),
 	}
 }
 
-// Run will run a UDP and TCP server on the specified address. It will return
-// on the first accept error and close all servers.
-func (s *Server) Run(addr string) error {
+// Run will run a UDP and TCP server on each of the specified addresses. All
+// addresses share the same zones and configuration. It will return on the
+// first accept error and close all servers.
+func (s *Server) Run(addrs ...string) error {
+	return s.RunContext(context.Background(), addrs...)
+}
+
+// RunContext will run the server like Run until the provided context is
+// cancelled and the server has been shutdown gracefully. The values of the
+// context are available to the contexts passed to the handlers. The handler
+// contexts are only cancelled after the server has been drained and closed.
+func (s *Server) RunContext(ctx context.Context, addrs ...string) error {
+	// set base context before the listeners start
+	base, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+	s.base.Store(baseContext{base})
+
+	// close server when the context is cancelled
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = s.Shutdown()
+		case <-done:
+		}
+	}()
+
+	// run debug listener if configured
+	if s.config.DebugAddr != "" {
+		debug, err := s.serveDebug()
+		if err != nil {
+			return err
+		}
+		defer debug.Close()
+	}
+
 	// prepare mux
 	mux := dns.NewServeMux()
 
@@ -75,13 +441,99 @@ func (s *Server) Run(addr string) error {
 		mux.Handle(zone, s)
 	}
 
+	// prepare proxy options
+	opts := s.proxyOptions()
+
+	// add forwarders
+	for domain, addrs := range s.config.Forwarders {
+		var proxy = forwardHandler(addrs, s.config.FallbackDelay, opts)
+		if s.config.Tracer != nil {
+			proxy = traceHandler(s.config.Tracer, "newdns.Forwarder", s.context, proxy)
+		}
+		mux.Handle(domain, proxy)
+	}
+
 	// add fallback if available
-	if s.config.Fallback != "" {
-		mux.Handle(".", Proxy(s.config.Fallback, s.config.Logger))
+	if len(s.config.Fallback) > 0 {
+		addrs := s.config.Fallback
+		var proxy = forwardHandler(addrs, s.config.FallbackDelay, opts)
+		if s.config.FallbackPolicy == FallbackFailover && len(addrs) > 1 {
+			upstreams := make([]Upstream, 0, len(addrs))
+			for _, addr := range addrs {
+				upstreams = append(upstreams, Upstream{Addr: addr})
+			}
+			pool := newPool(PoolConfig{
+				Upstreams:   upstreams,
+				Failover:    true,
+				MaxFailures: s.config.BreakerFailures,
+				TLSConfig:   s.config.FallbackTLS,
+				Logger:      s.config.Logger,
+			})
+			go pool.prober(done)
+			proxy = proxyHandler(opts, pool.exchange)
+		}
+		if s.fallbacks != nil {
+			proxy = s.cacheHandler(s.fallbacks, proxy)
+		}
+		if s.config.Tracer != nil {
+			proxy = traceHandler(s.config.Tracer, "newdns.Fallback", s.context, proxy)
+		}
+		mux.Handle(".", proxy)
 	}
 
+	// apply middleware
+	var next dns.Handler = mux
+	for i := len(s.config.Middleware) - 1; i >= 0; i-- {
+		next = s.config.Middleware[i](next)
+	}
+
+	// track queries
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		// remember the type of the listener writer
+		if s.raw.Load() == nil {
+			s.raw.Store(reflect.TypeOf(w))
+		}
+
+		// check if draining
+		if !s.acquire() {
+			log(s.config.Logger, Ignored, nil, nil, "server shutting down")
+			return
+		}
+
+		// release query
+		defer s.release()
+
+		// check concurrency
+		if !s.admit(w, req) {
+			return
+		}
+		defer s.leave()
+
+		// serve query
+		next.ServeDNS(w, req)
+	})
+
 	// run server
-	err := Run(addr, mux, Accept(s.config.Logger), s.close)
+	err := listenAndServe(addrs, handler, accept(s.config.Logger, s.config.RejectPolicy, dns.OpcodeQuery, dns.OpcodeNotify, dns.OpcodeUpdate), s.close, listenOptions{
+		tcpIdleTimeout:    s.config.TCPIdleTimeout,
+		maxTCPConnections: s.config.MaxTCPConnections,
+		maxTCPQueries:     s.config.MaxTCPQueries,
+		udpReadBuffer:     s.config.UDPReadBuffer,
+		udpWriteBuffer:    s.config.UDPWriteBuffer,
+		udpBatchSize:      s.config.UDPBatchSize,
+		tsigKeys:          s.config.TSIGKeys,
+		capture:           s.config.Capture,
+		ready: func(bound []net.Addr) {
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			s.addrs = bound
+			select {
+			case <-s.ready:
+			default:
+				close(s.ready)
+			}
+		},
+	})
 	if err != nil {
 		return err
 	}
@@ -89,6 +541,91 @@ func (s *Server) Run(addr string) error {
 	return nil
 }
 
+func (s *Server) recover(w dns.ResponseWriter, req *dns.Msg, state *requestState, v interface{}) {
+	// prepare error
+	err := kindError(ErrHandler, fmt.Errorf("handler panic: %v", v))
+
+	// report panic
+	if s.config.Reporter != nil {
+		s.config.Reporter(err, debug.Stack())
+	}
+
+	// log error
+	log(s.logger(w), BackendError, nil, err, "")
+
+	// check if a response has already been written
+	state.info.mutex.Lock()
+	responded := state.info.ResponseSize > 0
+	state.info.mutex.Unlock()
+	if responded {
+		_ = w.Close()
+		return
+	}
+
+	// write error
+	res := new(dns.Msg)
+	res.SetRcode(req, dns.RcodeServerFailure)
+	s.writeMessage(w, req, res)
+}
+
+func (s *Server) logger(w dns.ResponseWriter) Logger {
+	// get state
+	state := requestStateOf(w)
+	if state == nil || state.logger == nil {
+		return s.config.Logger
+	}
+
+	return state.logger
+}
+
+// Counters returns the numbers of queries processed since the server has been
+// created.
+func (s *Server) Counters() Counters {
+	return s.counters.snapshot()
+}
+
+// PurgeResponses will remove all cached responses of the specified zone from
+// the response cache. All responses are removed if the zone is empty.
+func (s *Server) PurgeResponses(zone string) {
+	if s.responses != nil {
+		s.responses.purge(zone)
+	}
+}
+
+// PurgeFallback will remove all cached responses from the fallback cache.
+func (s *Server) PurgeFallback() {
+	if s.fallbacks != nil {
+		s.fallbacks.purge("")
+	}
+}
+
+// QueryLog returns the query log if enabled.
+func (s *Server) QueryLog() *QueryLog {
+	return s.queryLog
+}
+
+func (s *Server) serveDebug() (*http.Server, error) {
+	// listen
+	listener, err := net.Listen("tcp", s.config.DebugAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare mux
+	mux := http.NewServeMux()
+	if s.queryLog != nil {
+		mux.Handle("/debug/queries", s.queryLog)
+	}
+
+	// serve
+	server := &http.Server{Handler: mux}
+	go func() {
+		_ = server.Serve(listener)
+	}()
+
+	return server, nil
+}
+
 // ServeDNS implements the dns.Handler interface.
 func (s *Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	// get question
@@ -96,16 +633,77 @@ func (s *Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 
 	// check class
 	if question.Qclass != dns.ClassINET {
-		log(s.config.Logger, Ignored, nil, nil, fmt.Sprintf("unsupported class: %s", dns.ClassToString[question.Qclass]))
+		if s.config.RejectPolicy == RejectAnswer {
+			log(s.logger(w), Refused, nil, nil, "unsupported class", Field{"class", dns.ClassToString[question.Qclass]})
+			res := new(dns.Msg)
+			res.SetRcode(req, dns.RcodeRefused)
+			err := w.WriteMsg(res)
+			if err != nil {
+				log(s.logger(w), NetworkError, nil, err, "")
+				_ = w.Close()
+			}
+			return
+		}
+		log(s.logger(w), Ignored, nil, nil, "unsupported class", Field{"class", dns.ClassToString[question.Qclass]})
 		return
 	}
 
+	// prepare context
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if s.config.HandlerTimeout > 0 {
+		ctx, cancel = context.WithTimeout(s.context(), s.config.HandlerTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(s.context())
+	}
+	defer cancel()
+
+	// attach request state
+	ctx, state := withRequestState(ctx, req)
+	state.id = atomic.AddUint64(&s.requests, 1)
+	state.info = newRequestInfo(w, req)
+	if cs, ok := w.(dns.ConnectionStater); ok && cs.ConnectionState() != nil {
+		state.tls = true
+	}
+	state.udpLimit = s.config.MaxUDPSize
+	if s.config.Logger != nil {
+		state.logger = &requestLogger{next: s.config.Logger, id: state.id}
+	}
+	w = &requestWriter{ResponseWriter: w, state: state}
+
+	// start span
+	var span Span = noopSpan{}
+	if s.config.Tracer != nil {
+		ctx = withTracer(ctx, s.config.Tracer)
+		ctx, span = startSpan(ctx, "newdns.Query")
+		span.SetAttribute("dns.qname", question.Name)
+		span.SetAttribute("dns.qtype", dns.TypeToString[question.Qtype])
+	}
+	state.ctx = ctx
+
 	// log request and finish
-	log(s.config.Logger, Request, req, nil, "")
-	defer log(s.config.Logger, Finish, nil, nil, "")
+	logInfo(s.logger(w), Request, req, state.info)
+	defer func() {
+		s.counters.count(state.info)
+		logInfo(s.logger(w), Finish, nil, state.info)
+		if state.info.ResponseSize > 0 {
+			span.SetAttribute("dns.rcode", dns.RcodeToString[state.info.Rcode])
+		}
+		span.End()
+	}()
 
-	// prepare response
-	res := new(dns.Msg)
+	// recover panics
+	defer func() {
+		if v := recover(); v != nil {
+			s.recover(w, req, state, v)
+		}
+	}()
+
+	// prepare response and recycle it if not retained by a logger
+	res := getMsg()
+	if s.config.Logger == nil {
+		defer putMsg(res)
+	}
 	res.SetReply(req)
 
 	// always compress responses
@@ -121,47 +719,133 @@ func (s *Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 
 		// check version
 		if req.IsEdns0().Version() != 0 {
-			log(s.config.Logger, Refused, nil, nil, fmt.Sprintf("unsupported EDNS version: %d", req.IsEdns0().Version()))
+			log(s.logger(w), Refused, nil, nil, "unsupported EDNS version", Field{"version", req.IsEdns0().Version()})
 			s.writeError(w, req, res, nil, dns.RcodeBadVers)
 			return
 		}
+
+		// add server identifier if requested
+		if s.config.ServerID != "" && hasOption(req.IsEdns0(), dns.EDNS0NSID) {
+			opt := res.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_NSID{
+				Code: dns.EDNS0NSID,
+				Nsid: hex.EncodeToString([]byte(s.config.ServerID)),
+			})
+		}
+	}
+
+	// check TSIG
+	if code := tsigError(w, req); code != dns.RcodeSuccess {
+		log(s.logger(w), Refused, nil, nil, "invalid TSIG", Field{"error", dns.RcodeToString[int(code)]})
+		s.writeTSIGError(w, req, res, code)
+		return
 	}
 
 	// check any type
-	if question.Qtype == dns.TypeANY {
-		log(s.config.Logger, Refused, nil, nil, "unsupported type: ANY")
+	if question.Qtype == dns.TypeANY && s.config.AnyPolicy == AnyNotImplemented {
+		log(s.logger(w), Refused, nil, nil, "unsupported type: ANY")
 		s.writeError(w, req, res, nil, dns.RcodeNotImplemented)
 		return
 	}
 
+	// serve cached response
+	var cacheKey responseKey
+	var cacheable bool
+	if s.responses != nil {
+		cacheKey, cacheable = responseKeyOf(req, state.info.Transport)
+		if cacheable && s.writeCached(w, req, state, cacheKey) {
+			return
+		}
+	}
+
 	// get name
 	name := NormalizeDomain(question.Name, true, false, false)
 
 	// get zone
-	zone, err := s.config.Handler(name)
+	hctx, hspan := startSpan(ctx, "newdns.Handler")
+	hstart := time.Now()
+	zone, err := s.config.Handler(hctx, name)
+	state.info.handler(time.Since(hstart))
+	if err != nil {
+		hspan.RecordError(err)
+	}
+	hspan.End()
 	if err != nil {
 		err = fmt.Errorf("server handler error: %w", err)
-		log(s.config.Logger, BackendError, nil, err, "")
+		log(s.logger(w), BackendError, nil, err, "")
 		s.writeError(w, req, res, nil, dns.RcodeServerFailure)
 		return
 	}
 
 	// check zone
 	if zone == nil {
-		log(s.config.Logger, Refused, nil, nil, "no zone")
+		log(s.logger(w), Refused, nil, nil, "no zone")
 		res.Authoritative = false
 		s.writeError(w, req, res, nil, dns.RcodeRefused)
 		return
 	}
 
-	// validate zone
-	err = zone.Validate()
+	// validate zone once
+	err = zone.validate()
 	if err != nil {
-		log(s.config.Logger, BackendError, nil, err, "")
+		log(s.logger(w), BackendError, nil, kindError(ErrValidation, err), "")
 		s.writeError(w, req, res, nil, dns.RcodeServerFailure)
 		return
 	}
 
+	// set zone
+	state.info.zone(zone.Name)
+
+	// get current serial
+	zone = zone.withSerial()
+
+	// use zone max UDP size
+	if zone.MaxUDPSize > 0 {
+		state.udpLimit = zone.MaxUDPSize
+	}
+
+	// check query rate
+	if !s.allow(w, zone) {
+		log(s.logger(w), Refused, nil, nil, "query rate exceeded")
+		AddResponseOption(ctx, &dns.EDNS0_EDE{
+			InfoCode:  dns.ExtendedErrorCodeOther,
+			ExtraText: "query rate exceeded",
+		})
+		s.writeError(w, req, res, nil, dns.RcodeRefused)
+		return
+	}
+
+	// handle notify
+	if req.Opcode == dns.OpcodeNotify {
+		s.handleNotify(w, req, res, zone, name)
+		return
+	}
+
+	// handle update
+	if req.Opcode == dns.OpcodeUpdate {
+		s.handleUpdate(ctx, w, req, res, zone, name)
+		return
+	}
+
+	// check TSIG
+	if zone.RequireTSIG && !verifyTSIG(w, req, zone.TSIGKeys) {
+		log(s.logger(w), Refused, nil, nil, "missing or invalid TSIG")
+		s.writeError(w, req, res, nil, dns.RcodeNotAuth)
+		return
+	}
+
+	// handle zone transfers
+	if question.Qtype == dns.TypeAXFR || question.Qtype == dns.TypeIXFR {
+		s.writeTransfer(ctx, w, req, res, zone, name)
+		return
+	}
+
+	// allow caching of the response unless records are reordered
+	if cacheable && zone.Order != OrderRotate && zone.Order != OrderShuffle {
+		state.cacheKey = &cacheKey
+		state.cacheZone = zone.Name
+	}
+
 	// answer SOA directly
 	if question.Qtype == dns.TypeSOA && name == zone.Name {
 		s.writeSOAResponse(w, req, res, zone)
@@ -170,7 +854,26 @@ func (s *Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 
 	// answer NS directly
 	if question.Qtype == dns.TypeNS && name == zone.Name {
-		s.writeNSResponse(w, req, res, zone)
+		s.writeNSResponse(ctx, w, req, res, zone)
+		return
+	}
+
+	// check delegation, DS records are served by the parent side of the cut
+	if zone.Delegations {
+		cut, err := zone.delegation(ctx, name)
+		if err != nil {
+			log(s.logger(w), BackendError, nil, err, "")
+			s.writeError(w, req, res, nil, dns.RcodeServerFailure)
+			return
+		} else if cut != nil && (question.Qtype != dns.TypeDS || cut.Name != name) {
+			s.writeReferral(ctx, w, req, res, zone, *cut)
+			return
+		}
+	}
+
+	// handle any type
+	if question.Qtype == dns.TypeANY {
+		s.handleANY(ctx, w, req, res, zone, name)
 		return
 	}
 
@@ -178,9 +881,9 @@ func (s *Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	typ := Type(question.Qtype)
 
 	// lookup main answer
-	answer, exists, err := zone.Lookup(name, typ)
+	answer, exists, err := zone.Lookup(ctx, name, typ)
 	if err != nil {
-		log(s.config.Logger, BackendError, nil, err, "")
+		log(s.logger(w), BackendError, nil, err, "")
 		s.writeError(w, req, res, nil, dns.RcodeServerFailure)
 		return
 	}
@@ -190,6 +893,9 @@ func (s *Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		if exists {
 			// we have a record, but not of the requested type
 			s.writeError(w, req, res, zone, dns.RcodeSuccess)
+		} else if len(zone.Forwarders) > 0 {
+			// forward queries for unknown names
+			s.forwardZone(w, req, zone)
 		} else {
 			// we have no record at all for this name
 			s.writeError(w, req, res, zone, dns.RcodeNameError)
@@ -197,21 +903,51 @@ func (s *Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		return
 	}
 
+	// chase CNAME targets in other zones
+	if s.config.ChaseCNAMEs && typ != CNAME {
+		answer, err = s.chase(ctx, zone, answer, typ)
+		if err != nil {
+			log(s.logger(w), BackendError, nil, err, "")
+			s.writeError(w, req, res, nil, dns.RcodeServerFailure)
+			return
+		}
+	}
+
 	// prepare extra set
 	var extra []Set
 
-	// TODO: Lookup glue records for NS records?
+	// prime internal MX and SRV targets
+	if zone.BatchHandler != nil {
+		var targets []string
+		for _, set := range answer {
+			if set.Type == MX || set.Type == SRV {
+				for _, record := range set.Records {
+					if InZone(zone.Name, record.Address) {
+						targets = append(targets, NormalizeDomain(record.Address, true, false, false))
+					}
+				}
+			}
+		}
+		if len(targets) > 1 {
+			_, err = zone.load(ctx, targets)
+			if err != nil {
+				log(s.logger(w), BackendError, nil, err, "")
+				s.writeError(w, req, res, nil, dns.RcodeServerFailure)
+				return
+			}
+		}
+	}
 
 	// lookup extra sets
 	for _, set := range answer {
 		for _, record := range set.Records {
 			switch set.Type {
-			case MX:
-				// lookup internal MX target A and AAAA records
+			case MX, SRV:
+				// lookup internal MX and SRV target A and AAAA records
 				if InZone(zone.Name, record.Address) {
-					ret, _, err := zone.Lookup(record.Address, A, AAAA)
+					ret, _, err := zone.Lookup(ctx, record.Address, A, AAAA)
 					if err != nil {
-						log(s.config.Logger, BackendError, nil, err, "")
+						log(s.logger(w), BackendError, nil, err, "")
 						s.writeError(w, req, res, nil, dns.RcodeServerFailure)
 						return
 					}
@@ -225,26 +961,24 @@ func (s *Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 
 	// set answer
 	for _, set := range answer {
-		res.Answer = append(res.Answer, s.convert(question.Name, zone, set)...)
+		set = s.order(zone.Order, set)
+		res.Answer = convertSet(res.Answer, question.Name, zone, set)
+	}
+
+	// jitter answer TTLs once the response has been cached
+	if zone.TTLJitter > 0 && state != nil {
+		state.jitter = zone.TTLJitter
+		state.minTTL = toSeconds(zone.MinTTL)
 	}
 
 	// set extra
 	for _, set := range extra {
-		res.Extra = append(res.Extra, s.convert(question.Name, zone, set)...)
+		set = s.order(zone.Order, set)
+		res.Extra = convertSet(res.Extra, question.Name, zone, set)
 	}
 
 	// add ns records
-	for _, ns := range zone.AllNameServers {
-		res.Ns = append(res.Ns, &dns.NS{
-			Hdr: dns.RR_Header{
-				Name:   TransferCase(question.Name, zone.Name),
-				Rrtype: dns.TypeNS,
-				Class:  dns.ClassINET,
-				Ttl:    toSeconds(zone.NSTTL),
-			},
-			Ns: ns,
-		})
-	}
+	res.Ns = append(res.Ns, zone.nsRecords(TransferCase(question.Name, zone.Name))...)
 
 	// check if NS query
 	if typ == NS {
@@ -256,63 +990,301 @@ func (s *Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		res.Authoritative = false
 	}
 
+	// add handler supplied sets
+	authority, additional := state.sections()
+	for i, list := range [][]Set{authority, additional} {
+		for _, set := range list {
+			// validate set
+			err = zone.validateSet(&set)
+			if err != nil {
+				log(s.logger(w), BackendError, nil, kindError(ErrValidation, fmt.Errorf("invalid set: %w", err)), "")
+				s.writeError(w, req, res, nil, dns.RcodeServerFailure)
+				return
+			}
+
+			// check relationship
+			if !InZone(zone.Name, set.Name) {
+				log(s.logger(w), BackendError, nil, kindError(ErrValidation, fmt.Errorf("set does not belong to zone: %s", set.Name)), "")
+				s.writeError(w, req, res, nil, dns.RcodeServerFailure)
+				return
+			}
+
+			// add set
+			if i == 0 {
+				res.Ns = convertSet(res.Ns, set.Name, zone, set)
+			} else {
+				res.Extra = convertSet(res.Extra, set.Name, zone, set)
+			}
+		}
+	}
+
 	// write message
 	s.writeMessage(w, req, res)
 }
 
-// Close will close the server.
+// Ready returns a channel that is closed once the UDP and TCP listeners of the
+// server have been bound.
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Addr returns the bound address of the first listener. It returns nil if the
+// server is not yet ready.
+func (s *Server) Addr() net.Addr {
+	// get addresses
+	addrs := s.Addrs()
+	if len(addrs) == 0 {
+		return nil
+	}
+
+	return addrs[0]
+}
+
+// Addrs returns the bound addresses of all listeners in the order they have
+// been specified. UDP listeners use the same address as the TCP listeners.
+func (s *Server) Addrs() []net.Addr {
+	// acquire lock
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.addrs
+}
+
+func (s *Server) context() context.Context {
+	// get base context
+	if base, ok := s.base.Load().(baseContext); ok {
+		return base.ctx
+	}
+
+	return context.Background()
+}
+
+// Shutdown will gracefully shutdown the server. New queries are dropped while
+// in-flight queries are given up to the configured drain timeout to finish. The
+// server is closed afterwards in any case.
+func (s *Server) Shutdown() error {
+	// begin draining
+	s.mutex.Lock()
+	if !s.draining {
+		s.draining = true
+		if s.pending == 0 {
+			close(s.drained)
+		}
+	}
+	s.mutex.Unlock()
+
+	// ensure close
+	defer s.Close()
+
+	// await drain
+	select {
+	case <-s.drained:
+		return nil
+	case <-time.After(s.config.DrainTimeout):
+		return fmt.Errorf("drain timeout exceeded")
+	}
+}
+
+// Close will close the server immediately.
 func (s *Server) Close() {
 	defer func() { recover() }()
 	close(s.close)
 }
 
+func (s *Server) acquire() bool {
+	// acquire lock
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// check draining
+	if s.draining {
+		return false
+	}
+
+	// increment
+	s.pending++
+
+	return true
+}
+
+func (s *Server) release() {
+	// acquire lock
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// decrement
+	s.pending--
+
+	// signal drain
+	if s.draining && s.pending == 0 {
+		close(s.drained)
+	}
+}
+
 func (s *Server) writeSOAResponse(w dns.ResponseWriter, rq, rs *dns.Msg, zone *Zone) {
 	// add soa record
-	rs.Answer = append(rs.Answer, &dns.SOA{
-		Hdr: dns.RR_Header{
-			Name:   zone.Name,
-			Rrtype: dns.TypeSOA,
-			Class:  dns.ClassINET,
-			Ttl:    toSeconds(zone.SOATTL),
-		},
-		Ns:      zone.MasterNameServer,
-		Mbox:    emailToDomain(zone.AdminEmail),
-		Serial:  1,
-		Refresh: toSeconds(zone.Refresh),
-		Retry:   toSeconds(zone.Retry),
-		Expire:  toSeconds(zone.Expire),
-		Minttl:  toSeconds(zone.MinTTL),
-	})
+	rs.Answer = append(rs.Answer, zone.soaRecord())
 
 	// add ns records
-	for _, ns := range zone.AllNameServers {
-		rs.Ns = append(rs.Ns, &dns.NS{
-			Hdr: dns.RR_Header{
-				Name:   zone.Name,
-				Rrtype: dns.TypeNS,
-				Class:  dns.ClassINET,
-				Ttl:    toSeconds(zone.NSTTL),
-			},
-			Ns: ns,
-		})
-	}
+	rs.Ns = append(rs.Ns, zone.nsRecords(zone.Name)...)
 
 	// write message
 	s.writeMessage(w, rq, rs)
 }
 
-func (s *Server) writeNSResponse(w dns.ResponseWriter, rq, rs *dns.Msg, zone *Zone) {
+func (s *Server) writeNSResponse(ctx context.Context, w dns.ResponseWriter, rq, rs *dns.Msg, zone *Zone) {
 	// add ns records
-	for _, ns := range zone.AllNameServers {
-		rs.Answer = append(rs.Answer, &dns.NS{
-			Hdr: dns.RR_Header{
-				Name:   zone.Name,
-				Rrtype: dns.TypeNS,
-				Class:  dns.ClassINET,
-				Ttl:    toSeconds(zone.NSTTL),
-			},
-			Ns: ns,
-		})
+	rs.Answer = append(rs.Answer, zone.nsRecords(zone.Name)...)
+
+	// lookup glue records
+	glue, err := zone.glue(ctx, zone.AllNameServers)
+	if err != nil {
+		log(s.logger(w), BackendError, nil, err, "")
+		s.writeError(w, rq, rs, nil, dns.RcodeServerFailure)
+		return
+	}
+
+	// add glue records
+	for _, set := range glue {
+		rs.Extra = convertSet(rs.Extra, set.Name, zone, set)
+	}
+
+	// write message
+	s.writeMessage(w, rq, rs)
+}
+
+// jitterTTLs reduces the TTLs of the records of every set by the same random
+// fraction of up to the specified jitter without going below the minimum TTL.
+func jitterTTLs(list []dns.RR, jitter float64, min uint32) {
+	var off int
+	for _, n := range setSizes(list) {
+		ttl := jitteredTTL(list[off].Header().Ttl, jitter, min)
+		for _, rr := range list[off : off+n] {
+			rr.Header().Ttl = ttl
+		}
+		off += n
+	}
+}
+
+// jitteredTTL reduces the TTL by a random fraction of up to the specified
+// jitter. TTLs above the minimum TTL are not reduced below it.
+func jitteredTTL(ttl uint32, jitter float64, min uint32) uint32 {
+	// get reduced TTL
+	reduced := ttl - uint32(float64(ttl)*jitter*rand.Float64())
+
+	// clamp to minimum
+	if reduced < min {
+		if ttl < min {
+			return ttl
+		}
+		return min
+	}
+
+	return reduced
+}
+
+// setSizes returns the number of records of the consecutive sets in the list.
+func setSizes(list []dns.RR) []int {
+	var sizes []int
+	for i, rr := range list {
+		if i > 0 && rr.Header().Rrtype == list[i-1].Header().Rrtype && rr.Header().Name == list[i-1].Header().Name {
+			sizes[len(sizes)-1]++
+		} else {
+			sizes = append(sizes, 1)
+		}
+	}
+
+	return sizes
+}
+
+// maxCNAMEChain is the maximum number of CNAME sets in a chased answer.
+const maxCNAMEChain = 8
+
+func (s *Server) chase(ctx context.Context, zone *Zone, answer []Set, typ Type) ([]Set, error) {
+	// prepare visited names
+	visited := map[string]bool{}
+
+	for {
+		// get last set
+		last := answer[len(answer)-1]
+		if last.Type != CNAME || len(answer) > maxCNAMEChain {
+			return answer, nil
+		}
+
+		// get target
+		target := NormalizeDomain(last.Records[0].Address, true, false, false)
+		if InZone(zone.Name, target) || visited[target] || !s.serves(target) {
+			return answer, nil
+		}
+		visited[target] = true
+
+		// get zone
+		other, err := s.config.Handler(ctx, target)
+		if err != nil {
+			return nil, fmt.Errorf("server handler error: %w", err)
+		} else if other == nil {
+			return answer, nil
+		}
+
+		// validate zone once
+		err = other.validate()
+		if err != nil {
+			return nil, kindError(ErrValidation, err)
+		}
+
+		// lookup target
+		ret, _, err := other.Lookup(ctx, target, typ)
+		if err != nil {
+			return nil, err
+		} else if len(ret) == 0 {
+			return answer, nil
+		}
+
+		// responses with records from other zones are not cached
+		if state := getRequestState(ctx); state != nil {
+			state.cacheKey = nil
+		}
+
+		// add sets
+		answer = append(answer, ret...)
+		zone = other
+	}
+}
+
+func (s *Server) serves(name string) bool {
+	for _, pattern := range s.config.Zones {
+		if dns.IsSubDomain(pattern, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Server) writeReferral(ctx context.Context, w dns.ResponseWriter, rq, rs *dns.Msg, zone *Zone, cut Set) {
+	// referrals are not authoritative
+	rs.Authoritative = false
+
+	// add delegation
+	rs.Ns = convertSet(rs.Ns, rq.Question[0].Name, zone, cut)
+
+	// get name servers
+	targets := make([]string, 0, len(cut.Records))
+	for _, record := range cut.Records {
+		targets = append(targets, record.Address)
+	}
+
+	// lookup glue records
+	glue, err := zone.glue(ctx, targets)
+	if err != nil {
+		log(s.logger(w), BackendError, nil, err, "")
+		s.writeError(w, rq, rs, nil, dns.RcodeServerFailure)
+		return
+	}
+
+	// add glue records
+	for _, set := range glue {
+		rs.Extra = convertSet(rs.Extra, set.Name, zone, set)
 	}
 
 	// write message
@@ -325,23 +1297,70 @@ func (s *Server) writeError(w dns.ResponseWriter, rq, rs *dns.Msg, zone *Zone, c
 
 	// add soa record
 	if zone != nil {
-		rs.Ns = append(rs.Ns, &dns.SOA{
-			Hdr: dns.RR_Header{
-				Name:   zone.Name,
-				Rrtype: dns.TypeSOA,
-				Class:  dns.ClassINET,
-				Ttl:    toSeconds(zone.SOATTL),
-			},
-			Ns:      zone.MasterNameServer,
-			Mbox:    emailToDomain(zone.AdminEmail),
-			Serial:  1,
-			Refresh: toSeconds(zone.Refresh),
-			Retry:   toSeconds(zone.Retry),
-			Expire:  toSeconds(zone.Expire),
-			Minttl:  toSeconds(zone.MinTTL),
-		})
+		rs.Ns = append(rs.Ns, zone.soaRecord())
+	}
+
+	// write message
+	s.writeMessage(w, rq, rs)
+}
+
+func (s *Server) writeTSIGError(w dns.ResponseWriter, rq, rs *dns.Msg, code uint16) {
+	// set code
+	rs.Rcode = dns.RcodeNotAuth
+	rs.Authoritative = false
+
+	// add TSIG record with error, the response is only signed for BADTIME
+	// errors (RFC 8945 5.2)
+	tsig := rq.IsTsig()
+	rs.Extra = append(rs.Extra, &dns.TSIG{
+		Hdr:       dns.RR_Header{Name: tsig.Hdr.Name, Rrtype: dns.TypeTSIG, Class: dns.ClassANY},
+		Algorithm: tsig.Algorithm,
+		Fudge:     tsig.Fudge,
+		OrigId:    rq.Id,
+		Error:     code,
+	})
+
+	// write message
+	s.writeMessage(w, rq, rs)
+}
+
+func (s *Server) allow(w dns.ResponseWriter, zone *Zone) bool {
+	// get time
+	now := time.Now()
+
+	// check client rate
+	if zone.ClientQueryRate > 0 {
+		key := limiterKey{zone: zone.Name, client: clientIP(w.RemoteAddr())}
+		if !s.limits.allow(key, zone.ClientQueryRate, zone.ClientQueryBurst, now) {
+			return false
+		}
+	}
+
+	// check zone rate
+	if zone.QueryRate > 0 && !s.limits.allow(limiterKey{zone: zone.Name}, zone.QueryRate, zone.QueryBurst, now) {
+		return false
+	}
+
+	return true
+}
+
+func (s *Server) handleNotify(w dns.ResponseWriter, rq, rs *dns.Msg, zone *Zone, name string) {
+	// check support
+	if zone.Notify == nil || name != zone.Name {
+		log(s.logger(w), Ignored, nil, nil, "unsupported notify")
+		return
+	}
+
+	// check TSIG
+	if len(zone.TSIGKeys) > 0 && !verifyTSIG(w, rq, zone.TSIGKeys) {
+		log(s.logger(w), Refused, nil, nil, "missing or invalid TSIG")
+		s.writeError(w, rq, rs, nil, dns.RcodeNotAuth)
+		return
 	}
 
+	// call handler
+	zone.Notify(w.RemoteAddr())
+
 	// write message
 	s.writeMessage(w, rq, rs)
 }
@@ -349,85 +1368,302 @@ func (s *Server) writeError(w dns.ResponseWriter, rq, rs *dns.Msg, zone *Zone, c
 func (s *Server) writeMessage(w dns.ResponseWriter, rq, rs *dns.Msg) {
 	// get buffer size
 	var buffer = 512
-	if rq.IsEdns0() != nil {
+	if rq.IsEdns0() != nil && int(rq.IsEdns0().UDPSize()) > buffer {
 		buffer = int(rq.IsEdns0().UDPSize())
 	}
 
+	// get state
+	state := requestStateOf(w)
+
+	// clamp buffer size
+	if state != nil && state.udpLimit >= 512 && buffer > state.udpLimit {
+		buffer = state.udpLimit
+	}
+
 	// determine if client is using UDP
 	isUDP := w.RemoteAddr().Network() == "udp"
 
-	// truncate message if client is using UDP and message is too long
-	if isUDP && rs.Len() > buffer {
-		rs.Truncated = true
-		rs.Answer = nil
-		rs.Ns = nil
-		rs.Extra = nil
+	// truncate message if client is using UDP and message is too long while
+	// leaving space for the signature
+	if isUDP {
+		truncateMsg(rs, buffer-tsigLen(w, rq))
+	}
+
+	// cache response before jitter is applied
+	if state != nil && state.cacheKey != nil && !rs.Truncated {
+		s.responses.put(*state.cacheKey, state.cacheZone, rs, state.jitter, state.minTTL)
+	}
+
+	// jitter answer TTLs
+	if state != nil && state.jitter > 0 {
+		jitterTTLs(rs.Answer, state.jitter, state.minTTL)
 	}
 
+	// sign message
+	signTSIG(w, rq, rs)
+
 	// write message
-	err := w.WriteMsg(rs)
+	err := s.write(w, state, rs)
+	if err != nil {
+		log(s.logger(w), NetworkError, nil, err, "")
+		_ = w.Close()
+		return
+	}
+
+	// log response
+	s.logResponse(w, rs)
+}
+
+// truncateMsg removes additional, authority and trailing answer sets until the
+// message fits the size. The message is marked as truncated if answers, the
+// authority records of responses without answers or the glue records of
+// referrals have been removed.
+func truncateMsg(msg *dns.Msg, size int) {
+	// get length
+	length := msg.Len()
+	if length <= size {
+		return
+	}
+
+	// prepare removal, the length is reduced by the uncompressed length of
+	// the record and only computed again once the message may fit
+	single := &dns.Msg{Answer: make([]dns.RR, 1)}
+	remove := func(rr dns.RR) {
+		single.Answer[0] = rr
+		length -= single.Len() - 12
+	}
+	fits := func() bool {
+		if length <= size {
+			length = msg.Len()
+		}
+		return length <= size
+	}
+
+	// check referral
+	referral := len(msg.Answer) == 0 && len(msg.Ns) > 0 && msg.Ns[0].Header().Rrtype == dns.TypeNS
+
+	// remove additional records but keep the OPT record
+	for i := len(msg.Extra) - 1; i >= 0 && !fits(); i-- {
+		if rr := msg.Extra[i]; rr.Header().Rrtype != dns.TypeOPT {
+			msg.Extra = append(msg.Extra[:i], msg.Extra[i+1:]...)
+			msg.Truncated = msg.Truncated || referral
+			remove(rr)
+		}
+	}
+
+	// remove authority records
+	for len(msg.Ns) > 0 && !fits() {
+		remove(msg.Ns[len(msg.Ns)-1])
+		msg.Ns = msg.Ns[:len(msg.Ns)-1]
+		msg.Truncated = msg.Truncated || len(msg.Answer) == 0
+	}
+
+	// remove trailing answer sets as a whole
+	for len(msg.Answer) > 0 && !fits() {
+		last := msg.Answer[len(msg.Answer)-1].Header()
+		for len(msg.Answer) > 0 {
+			rr := msg.Answer[len(msg.Answer)-1]
+			hdr := rr.Header()
+			if hdr.Rrtype != last.Rrtype || !strings.EqualFold(hdr.Name, last.Name) {
+				break
+			}
+			remove(rr)
+			msg.Answer = msg.Answer[:len(msg.Answer)-1]
+		}
+		msg.Truncated = true
+	}
+}
+
+func (s *Server) write(w dns.ResponseWriter, state *requestState, rs *dns.Msg) error {
+	// signed messages are packed and signed by the underlying writer and
+	// wrapped writers must see the message
+	if state == nil || rs.IsTsig() != nil || !s.direct(w) {
+		return w.WriteMsg(rs)
+	}
+
+	// add response options
+	if opt := rs.IsEdns0(); opt != nil {
+		opt.Option = append(opt.Option, state.take()...)
+	}
+
+	// pack and write message using a pooled buffer
+	return packMsg(rs, func(data []byte) error {
+		return writeRaw(w, s.config.Capture, data)
+	})
+}
+
+func (s *Server) writeCached(w dns.ResponseWriter, req *dns.Msg, state *requestState, key responseKey) bool {
+	// get response
+	data, zone, ok := s.responses.get(key, req)
+	if !ok {
+		return false
+	}
+
+	// set zone
+	state.info.zone(zone)
+
+	// write unpacked response to wrapped writers
+	if !s.direct(w) {
+		rs := new(dns.Msg)
+		err := rs.Unpack(data)
+		if err == nil {
+			err = w.WriteMsg(rs)
+		}
+		if err != nil {
+			log(s.logger(w), NetworkError, nil, err, "")
+			_ = w.Close()
+			return true
+		}
+		s.logResponse(w, rs)
+		return true
+	}
+
+	// write response
+	err := writeRaw(w, s.config.Capture, data)
 	if err != nil {
-		log(s.config.Logger, NetworkError, nil, err, "")
+		log(s.logger(w), NetworkError, nil, err, "")
 		_ = w.Close()
+		return true
+	}
+
+	// update info without unpacking if not logged
+	logger := s.logger(w)
+	if logger == nil {
+		state.info.written(int(data[3]&0x0f), len(data))
+		return true
+	}
+
+	// unpack and log response
+	rs := new(dns.Msg)
+	err = rs.Unpack(data)
+	if err == nil {
+		s.logResponse(w, rs)
+	}
+
+	return true
+}
+
+// direct returns whether the request writer wraps the writer of the server
+// listeners. Raw messages are only written to these writers as wrapped writers
+// e.g. from middleware may rely on WriteMsg.
+func (s *Server) direct(w dns.ResponseWriter) bool {
+	// get request writer
+	rw, ok := w.(*requestWriter)
+	if !ok {
+		return false
+	}
+
+	// compare types
+	typ, _ := s.raw.Load().(reflect.Type)
+
+	return typ != nil && reflect.TypeOf(rw.ResponseWriter) == typ
+}
+
+func (s *Server) logResponse(w dns.ResponseWriter, rs *dns.Msg) {
+	// get state
+	state := requestStateOf(w)
+	if state == nil || state.info == nil {
+		log(s.logger(w), Response, rs, nil, "")
 		return
 	}
 
+	// update info
+	state.info.response(rs)
+
 	// log response
-	log(s.config.Logger, Response, rs, nil, "")
+	logInfo(s.logger(w), Response, rs, state.info)
 }
 
-func (s *Server) convert(query string, zone *Zone, set Set) []dns.RR {
+// convertSet appends the records of the set to the list using the owner name
+// casing of the query and the TTL limits of the zone.
+func convertSet(list []dns.RR, query string, zone *Zone, set Set) []dns.RR {
+	// get TTL
+	ttl := set.TTL
+	if ttl == 0 {
+		ttl = zone.defaultTTL(set.Type)
+	}
+
 	// prepare header
 	header := dns.RR_Header{
 		Name:   TransferCase(query, set.Name),
 		Rrtype: uint16(set.Type),
 		Class:  dns.ClassINET,
-		Ttl:    toSeconds(set.TTL),
+		Ttl:    toSeconds(ttl),
 	}
 
-	// ensure zone min TTL
-	if set.TTL < zone.MinTTL {
+	// ensure zone min and max TTL
+	if ttl < zone.MinTTL {
 		header.Ttl = toSeconds(zone.MinTTL)
+	} else if zone.MaxTTL > 0 && ttl > zone.MaxTTL {
+		header.Ttl = toSeconds(zone.MaxTTL)
 	}
 
-	// prepare list
-	var list []dns.RR
+	// copy raw records
+	for _, rr := range set.Raw {
+		rr = dns.Copy(rr)
+		*rr.Header() = dns.RR_Header{
+			Name:   header.Name,
+			Rrtype: header.Rrtype,
+			Class:  header.Class,
+			Ttl:    header.Ttl,
+		}
+		list = append(list, rr)
+	}
 
-	// add records
-	for _, record := range set.Records {
-		// construct record
-		switch set.Type {
-		case A:
-			list = append(list, &dns.A{
-				Hdr: header,
-				A:   net.ParseIP(record.Address),
-			})
-		case AAAA:
-			list = append(list, &dns.AAAA{
-				Hdr:  header,
-				AAAA: net.ParseIP(record.Address),
-			})
-		case CNAME:
-			list = append(list, &dns.CNAME{
-				Hdr:    header,
-				Target: dns.Fqdn(record.Address),
-			})
-		case MX:
-			list = append(list, &dns.MX{
-				Hdr:        header,
-				Preference: uint16(record.Priority),
-				Mx:         dns.Fqdn(record.Address),
-			})
-		case TXT:
-			list = append(list, &dns.TXT{
-				Hdr: header,
-				Txt: record.Data,
-			})
-		case NS:
-			list = append(list, &dns.NS{
-				Hdr: header,
-				Ns:  dns.Fqdn(record.Address),
-			})
+	// allocate records in batches to reduce allocations
+	switch set.Type {
+	case A:
+		batch := make([]dns.A, len(set.Records))
+		ips := make([]byte, 4*len(set.Records))
+		for i, record := range set.Records {
+			ip := net.IP(ips[i*4 : i*4+4 : i*4+4])
+			if !parseIPv4(ip, record.Address) {
+				ip = net.ParseIP(record.Address)
+			}
+			batch[i] = dns.A{Hdr: header, A: ip}
+			list = append(list, &batch[i])
+		}
+	case AAAA:
+		batch := make([]dns.AAAA, len(set.Records))
+		for i, record := range set.Records {
+			batch[i] = dns.AAAA{Hdr: header, AAAA: net.ParseIP(record.Address)}
+			list = append(list, &batch[i])
+		}
+	case CNAME:
+		batch := make([]dns.CNAME, len(set.Records))
+		for i, record := range set.Records {
+			batch[i] = dns.CNAME{Hdr: header, Target: dns.Fqdn(record.Address)}
+			list = append(list, &batch[i])
+		}
+	case MX:
+		batch := make([]dns.MX, len(set.Records))
+		for i, record := range set.Records {
+			batch[i] = dns.MX{Hdr: header, Preference: uint16(record.Priority), Mx: dns.Fqdn(record.Address)}
+			list = append(list, &batch[i])
+		}
+	case TXT:
+		batch := make([]dns.TXT, len(set.Records))
+		for i, record := range set.Records {
+			batch[i] = dns.TXT{Hdr: header, Txt: record.Data}
+			list = append(list, &batch[i])
+		}
+	case NS:
+		batch := make([]dns.NS, len(set.Records))
+		for i, record := range set.Records {
+			batch[i] = dns.NS{Hdr: header, Ns: dns.Fqdn(record.Address)}
+			list = append(list, &batch[i])
+		}
+	case PTR:
+		batch := make([]dns.PTR, len(set.Records))
+		for i, record := range set.Records {
+			batch[i] = dns.PTR{Hdr: header, Ptr: dns.Fqdn(record.Address)}
+			list = append(list, &batch[i])
+		}
+	case SRV:
+		batch := make([]dns.SRV, len(set.Records))
+		for i, record := range set.Records {
+			batch[i] = dns.SRV{Hdr: header, Priority: uint16(record.Priority), Weight: uint16(record.Weight), Port: uint16(record.Port), Target: dns.Fqdn(record.Address)}
+			list = append(list, &batch[i])
 		}
 	}
 
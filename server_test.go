@@ -1,9 +1,17 @@
 package newdns
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"net"
+	"os"
+	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -144,7 +152,7 @@ func TestServer(t *testing.T) {
 		SOATTL:     15 * time.Minute,
 		NSTTL:      48 * time.Hour,
 		MinTTL:     5 * time.Minute,
-		Handler: func(name string) ([]Set, error) {
+		Handler: func(ctx context.Context, name string) ([]Set, error) {
 			// handle apex records
 			if name == "" {
 				return []Set{
@@ -355,18 +363,18 @@ func TestServer(t *testing.T) {
 
 	server := NewServer(Config{
 		BufferSize: 4096,
-		Handler: func(name string) (*Zone, error) {
+		Handler: func(ctx context.Context, name string) (*Zone, error) {
 			if InZone("newdns.256dpi.com.", name) {
 				return zone, nil
 			}
 
 			return nil, nil
 		},
-		Logger: func(e Event, msg *dns.Msg, err error, reason string) {
-			if e == NetworkError {
-				panic(err.Error())
+		Logger: LoggerFunc(func(entry Entry) {
+			if entry.Event == NetworkError {
+				panic(entry.Error.Error())
 			}
-		},
+		}),
 	})
 
 	addr := "0.0.0.0:53001"
@@ -389,41 +397,13 @@ func TestServer(t *testing.T) {
 }
 
 func TestServerFallback(t *testing.T) {
-	zone := &Zone{
-		Name:             "example.com.",
-		MasterNameServer: "ns1.example.com.",
-		AllNameServers: []string{
-			"ns1.example.com.",
-			"ns2.example.com.",
-		},
-		Handler: func(name string) ([]Set, error) {
-			// handle apex
-			if name == "" {
-				return []Set{
-					{
-						Name: "example.com.",
-						Type: A,
-						Records: []Record{
-							{Address: "1.2.3.4"},
-						},
-					},
-				}, nil
-			}
-
-			return nil, nil
-		},
-	}
+	zone := testZone(apexHandler)
+	zone.AllNameServers = append(zone.AllNameServers, "ns2.example.com.")
 
 	server := NewServer(Config{
-		Zones: []string{"example.com."},
-		Handler: func(name string) (*Zone, error) {
-			if InZone("example.com.", name) {
-				return zone, nil
-			}
-
-			return nil, nil
-		},
-		Fallback: "1.1.1.1:53",
+		Zones:    []string{"example.com."},
+		Handler:  testHandler(zone),
+		Fallback: []string{"1.1.1.1:53"},
 	})
 
 	addr := "0.0.0.0:53002"
@@ -511,185 +491,2165 @@ func TestServerFallback(t *testing.T) {
 	})
 }
 
-func conformanceTests(t *testing.T, proto, addr string, local bool) {
-	t.Run("ApexA", func(t *testing.T) {
-		ret, err := Query(proto, addr, "newdns.256dpi.com.", "A", nil)
+func TestServerMultipleAddresses(t *testing.T) {
+	zone := testZone(apexHandler)
+
+	server := NewServer(Config{
+		Handler: testHandler(zone),
+	})
+
+	addr1 := "0.0.0.0:53003"
+	addr2 := "0.0.0.0:53004"
+
+	defer server.Close()
+
+	go func() {
+		err := server.Run(addr1, addr2)
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	<-server.Ready()
+
+	for _, addr := range []string{addr1, addr2} {
+		for _, proto := range []string{"udp", "tcp"} {
+			ret, err := Query(proto, addr, "example.com.", "A", nil)
+			assert.NoError(t, err)
+			assert.Len(t, ret.Answer, 1)
+			assert.Equal(t, "1.2.3.4", ret.Answer[0].(*dns.A).A.String())
+		}
+	}
+}
+
+func TestServerUnixSocket(t *testing.T) {
+	zone := testZone(apexHandler)
+
+	server := NewServer(Config{
+		Handler: testHandler(zone),
+	})
+
+	path := filepath.Join(os.TempDir(), "newdns-test.sock")
+
+	run(server, "unix:"+path, func() {
+		ret, err := Query("unix", path, "example.com.", "A", nil)
 		assert.NoError(t, err)
-		equalJSON(t, &dns.Msg{
-			MsgHdr: dns.MsgHdr{
-				Response:      true,
-				Authoritative: true,
-			},
-			Question: []dns.Question{
-				{Name: "newdns.256dpi.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
-			},
-			Answer: []dns.RR{
-				&dns.A{
-					Hdr: dns.RR_Header{
-						Name:     "newdns.256dpi.com.",
-						Rrtype:   dns.TypeA,
-						Class:    dns.ClassINET,
-						Ttl:      300,
-						Rdlength: 4,
-					},
-					A: net.ParseIP("1.2.3.4"),
-				},
-			},
-			Ns: nsRRs,
-		}, ret)
+		assert.Len(t, ret.Answer, 1)
+		assert.Equal(t, "1.2.3.4", ret.Answer[0].(*dns.A).A.String())
 	})
+}
 
-	t.Run("ApexAAAA", func(t *testing.T) {
-		ret, err := Query(proto, addr, "newdns.256dpi.com.", "AAAA", nil)
+func TestServerRunContext(t *testing.T) {
+	type key struct{}
+
+	var mutex sync.Mutex
+	var values []interface{}
+	server := NewServer(Config{
+		Handler: func(ctx context.Context, name string) (*Zone, error) {
+			mutex.Lock()
+			values = append(values, ctx.Value(key{}))
+			mutex.Unlock()
+			return nil, nil
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), key{}, "foo"))
+
+	done := make(chan error)
+	go func() {
+		done <- server.RunContext(ctx, "0.0.0.0:53005")
+	}()
+
+	<-server.Ready()
+
+	ret, err := Query("udp", "0.0.0.0:53005", "example.com.", "A", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeRefused, ret.Rcode)
+
+	mutex.Lock()
+	assert.Equal(t, []interface{}{"foo"}, values)
+	mutex.Unlock()
+
+	cancel()
+
+	select {
+	case err := <-done:
 		assert.NoError(t, err)
-		equalJSON(t, &dns.Msg{
-			MsgHdr: dns.MsgHdr{
-				Response:      true,
-				Authoritative: true,
-			},
-			Question: []dns.Question{
-				{Name: "newdns.256dpi.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET},
-			},
-			Answer: []dns.RR{
-				&dns.AAAA{
-					Hdr: dns.RR_Header{
-						Name:     "newdns.256dpi.com.",
-						Rrtype:   dns.TypeAAAA,
-						Class:    dns.ClassINET,
-						Ttl:      300,
-						Rdlength: 16,
-					},
-					AAAA: net.ParseIP("1:2:3:4::"),
-				},
-			},
-			Ns: nsRRs,
-		}, ret)
+	case <-time.After(time.Second):
+		t.Fatal("server did not stop")
+	}
+}
+
+func TestServerRunContextDrain(t *testing.T) {
+	var mutex sync.Mutex
+	var errs []error
+	server := NewServer(Config{
+		Handler: func(ctx context.Context, name string) (*Zone, error) {
+			time.Sleep(100 * time.Millisecond)
+			mutex.Lock()
+			errs = append(errs, ctx.Err())
+			mutex.Unlock()
+			return nil, nil
+		},
 	})
 
-	t.Run("ApexCNAME", func(t *testing.T) {
-		ret, err := Query(proto, addr, "newdns.256dpi.com.", "CNAME", nil)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error)
+	go func() {
+		done <- server.RunContext(ctx, "127.0.0.1:0")
+	}()
+
+	<-server.Ready()
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+
+	ret, err := Query("udp", server.Addr().String(), "example.com.", "A", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeRefused, ret.Rcode)
+
+	select {
+	case err := <-done:
 		assert.NoError(t, err)
-		equalJSON(t, &dns.Msg{
-			MsgHdr: dns.MsgHdr{
-				Response:      true,
-				Authoritative: true,
-				Rcode:         dns.RcodeSuccess,
+	case <-time.After(time.Second):
+		t.Fatal("server did not stop")
+	}
+
+	mutex.Lock()
+	assert.Equal(t, []error{nil}, errs)
+	mutex.Unlock()
+}
+
+func TestServerAddr(t *testing.T) {
+	server := NewServer(Config{
+		Handler: testHandler(),
+	})
+
+	assert.Nil(t, server.Addr())
+
+	run(server, "127.0.0.1:0", func() {
+		addr := server.Addr()
+		assert.NotNil(t, addr)
+		assert.NotEqual(t, 0, addr.(*net.TCPAddr).Port)
+
+		for _, proto := range []string{"udp", "tcp"} {
+			ret, err := Query(proto, addr.String(), "example.com.", "A", nil)
+			assert.NoError(t, err)
+			assert.Equal(t, dns.RcodeRefused, ret.Rcode)
+		}
+	})
+}
+
+func TestServerMaxTCPConnections(t *testing.T) {
+	server := NewServer(Config{
+		MaxTCPConnections: 1,
+		Handler:           testHandler(),
+	})
+
+	run(server, "127.0.0.1:0", func() {
+		addr := server.Addr().String()
+
+		conn, err := net.Dial("tcp", addr)
+		assert.NoError(t, err)
+
+		_, err = Query("tcp", addr, "example.com.", "A", nil)
+		assert.True(t, isIOError(err), err)
+
+		_ = conn.Close()
+
+		ret, err := Query("tcp", addr, "example.com.", "A", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, dns.RcodeRefused, ret.Rcode)
+	})
+}
+
+func TestServerUDPBatching(t *testing.T) {
+	server := NewServer(Config{
+		UDPReadBuffer:  1 << 20,
+		UDPWriteBuffer: 1 << 20,
+		UDPBatchSize:   16,
+		Handler:        testHandler(),
+	})
+
+	run(server, "127.0.0.1:0", func() {
+		addr := server.Addr().String()
+
+		for i := 0; i < 10; i++ {
+			ret, err := Query("udp", addr, "example.com.", "A", nil)
+			assert.NoError(t, err)
+			assert.Equal(t, dns.RcodeRefused, ret.Rcode)
+		}
+	})
+}
+
+func TestServerTransfer(t *testing.T) {
+	sets := []Set{
+		{
+			Name: "example.com.",
+			Type: A,
+			Records: []Record{
+				{Address: "1.2.3.4"},
 			},
-			Question: []dns.Question{
-				{Name: "newdns.256dpi.com.", Qtype: dns.TypeCNAME, Qclass: dns.ClassINET},
+		},
+		{
+			Name: "foo.example.com.",
+			Type: CNAME,
+			Records: []Record{
+				{Address: "example.com."},
 			},
-			Ns: []dns.RR{
-				&dns.SOA{
-					Hdr: dns.RR_Header{
-						Name:     "newdns.256dpi.com.",
-						Rrtype:   dns.TypeSOA,
-						Class:    dns.ClassINET,
-						Ttl:      900,
-						Rdlength: 66,
-					},
-					Ns:      awsPrimaryNS,
-					Mbox:    "awsdns-hostmaster.amazon.com.",
-					Serial:  1,
-					Refresh: 7200,
-					Retry:   900,
-					Expire:  1209600,
-					Minttl:  300,
-				},
+		},
+		{
+			Name: "bar.example.com.",
+			Type: TXT,
+			Records: []Record{
+				{Data: []string{"bar"}},
 			},
-		}, ret)
+		},
+	}
+
+	zone := &Zone{
+		Name:             "example.com.",
+		MasterNameServer: "ns1.example.com.",
+		AllNameServers: []string{
+			"ns1.example.com.",
+			"ns2.example.com.",
+		},
+		Handler: func(ctx context.Context, name string) ([]Set, error) {
+			return nil, nil
+		},
+		Lister: func(ctx context.Context, fn func(Set) error) error {
+			for _, set := range sets {
+				err := fn(set)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+		AllowTransfer: func(remote net.Addr) bool {
+			return true
+		},
+	}
+
+	server := NewServer(Config{
+		Handler: testHandler(zone),
 	})
 
-	t.Run("ApexSOA", func(t *testing.T) {
-		ret, err := Query(proto, addr, "newdns.256dpi.com.", "SOA", nil)
+	run(server, "127.0.0.1:0", func() {
+		addr := server.Addr().String()
+
+		tr := new(dns.Transfer)
+		msg := new(dns.Msg)
+		msg.SetAxfr("example.com.")
+
+		ch, err := tr.In(msg, addr)
 		assert.NoError(t, err)
-		equalJSON(t, &dns.Msg{
-			MsgHdr: dns.MsgHdr{
-				Response:      true,
-				Authoritative: true,
-			},
-			Question: []dns.Question{
-				{Name: "newdns.256dpi.com.", Qtype: dns.TypeSOA, Qclass: dns.ClassINET},
-			},
-			Answer: []dns.RR{
-				&dns.SOA{
-					Hdr: dns.RR_Header{
-						Name:     "newdns.256dpi.com.",
-						Rrtype:   dns.TypeSOA,
-						Class:    dns.ClassINET,
-						Ttl:      900,
-						Rdlength: 66,
+
+		var rrs []dns.RR
+		for env := range ch {
+			assert.NoError(t, env.Error)
+			rrs = append(rrs, env.RR...)
+		}
+
+		assert.Len(t, rrs, 7)
+		assert.Equal(t, dns.TypeSOA, rrs[0].Header().Rrtype)
+		assert.Equal(t, dns.TypeNS, rrs[1].Header().Rrtype)
+		assert.Equal(t, dns.TypeNS, rrs[2].Header().Rrtype)
+		assert.Equal(t, dns.TypeA, rrs[3].Header().Rrtype)
+		assert.Equal(t, dns.TypeCNAME, rrs[4].Header().Rrtype)
+		assert.Equal(t, dns.TypeTXT, rrs[5].Header().Rrtype)
+		assert.Equal(t, dns.TypeSOA, rrs[6].Header().Rrtype)
+
+		ret, err := Query("udp", addr, "example.com.", "AXFR", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, dns.RcodeRefused, ret.Rcode)
+	})
+}
+
+func TestServerIncrementalTransfer(t *testing.T) {
+	zone := &Zone{
+		Name:             "example.com.",
+		MasterNameServer: "ns1.example.com.",
+		AllNameServers: []string{
+			"ns1.example.com.",
+			"ns2.example.com.",
+		},
+		Serial: 3,
+		Handler: func(ctx context.Context, name string) ([]Set, error) {
+			return nil, nil
+		},
+		Journal: func(ctx context.Context, serial uint32) ([]Change, error) {
+			if serial != 1 {
+				return nil, nil
+			}
+
+			return []Change{
+				{
+					From: 1,
+					To:   2,
+					Added: []Set{
+						{Name: "foo.example.com.", Type: A, Records: []Record{{Address: "1.2.3.4"}}},
 					},
-					Ns:      awsPrimaryNS,
-					Mbox:    "awsdns-hostmaster.amazon.com.",
-					Serial:  1,
-					Refresh: 7200,
-					Retry:   900,
-					Expire:  1209600,
-					Minttl:  300,
 				},
-			},
-			Ns: []dns.RR{
-				&dns.NS{
-					Hdr: dns.RR_Header{
-						Name:     "newdns.256dpi.com.",
-						Rrtype:   dns.TypeNS,
+				{
+					From: 2,
+					To:   3,
+					Removed: []Set{
+						{Name: "foo.example.com.", Type: A, Records: []Record{{Address: "1.2.3.4"}}},
+					},
+					Added: []Set{
+						{Name: "foo.example.com.", Type: A, Records: []Record{{Address: "5.6.7.8"}}},
+					},
+				},
+			}, nil
+		},
+		AllowTransfer: func(remote net.Addr) bool {
+			return true
+		},
+	}
+
+	server := NewServer(Config{
+		Handler: testHandler(zone),
+	})
+
+	run(server, "127.0.0.1:0", func() {
+		addr := server.Addr().String()
+
+		tr := new(dns.Transfer)
+		msg := new(dns.Msg)
+		msg.SetIxfr("example.com.", 1, "ns1.example.com.", "hostmaster.example.com.")
+
+		ch, err := tr.In(msg, addr)
+		assert.NoError(t, err)
+
+		var rrs []dns.RR
+		for env := range ch {
+			assert.NoError(t, env.Error)
+			rrs = append(rrs, env.RR...)
+		}
+
+		var serials []uint32
+		for _, rr := range rrs {
+			if soa, ok := rr.(*dns.SOA); ok {
+				serials = append(serials, soa.Serial)
+			}
+		}
+
+		assert.Len(t, rrs, 9)
+		assert.Equal(t, []uint32{3, 1, 2, 2, 3, 3}, serials)
+
+		ret, err := Query("udp", addr, "example.com.", "IXFR", func(msg *dns.Msg) {
+			msg.SetIxfr("example.com.", 3, "ns1.example.com.", "hostmaster.example.com.")
+		})
+		assert.NoError(t, err)
+		assert.Len(t, ret.Answer, 1)
+		assert.Equal(t, uint32(3), ret.Answer[0].(*dns.SOA).Serial)
+	})
+}
+
+func TestServerTSIG(t *testing.T) {
+	secret := "c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0"
+
+	zone := testZone(func(ctx context.Context, name string) ([]Set, error) {
+		if name == "big" {
+			set := Set{Name: "big.example.com.", Type: TXT}
+			for i := 0; i < 10; i++ {
+				set.Records = append(set.Records, Record{Data: []string{strings.Repeat(strconv.Itoa(i), 100)}})
+			}
+			return []Set{set}, nil
+		}
+		return nil, nil
+	})
+	zone.Lister = func(ctx context.Context, fn func(Set) error) error {
+		return fn(Set{
+			Name: "example.com.",
+			Type: A,
+			Records: []Record{
+				{Address: "1.2.3.4"},
+			},
+		})
+	}
+	zone.TSIGKeys = []string{"key.example.com."}
+	zone.RequireTSIG = true
+
+	server := NewServer(Config{
+		Handler: testHandler(zone),
+		TSIGKeys: map[string]string{
+			"key.example.com.": secret,
+		},
+	})
+
+	run(server, "127.0.0.1:0", func() {
+		addr := server.Addr().String()
+
+		/* signed transfer */
+
+		tr := &dns.Transfer{
+			TsigSecret: map[string]string{"key.example.com.": secret},
+		}
+		msg := new(dns.Msg)
+		msg.SetAxfr("example.com.")
+		msg.SetTsig("key.example.com.", dns.HmacSHA256, 300, time.Now().Unix())
+
+		ch, err := tr.In(msg, addr)
+		assert.NoError(t, err)
+
+		var rrs []dns.RR
+		for env := range ch {
+			assert.NoError(t, env.Error)
+			rrs = append(rrs, env.RR...)
+		}
+		assert.Len(t, rrs, 4)
+
+		/* unsigned transfer */
+
+		tr = new(dns.Transfer)
+		msg = new(dns.Msg)
+		msg.SetAxfr("example.com.")
+
+		ch, err = tr.In(msg, addr)
+		assert.NoError(t, err)
+
+		env := <-ch
+		assert.Error(t, env.Error)
+
+		/* signed query */
+
+		client := dns.Client{
+			TsigSecret: map[string]string{"key.example.com.": secret},
+		}
+		msg = new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeSOA)
+		msg.SetTsig("key.example.com.", dns.HmacSHA256, 300, time.Now().Unix())
+
+		ret, _, err := client.Exchange(msg, addr)
+		assert.NoError(t, err)
+		assert.Equal(t, dns.RcodeSuccess, ret.Rcode)
+		assert.NotNil(t, ret.IsTsig())
+
+		/* signed truncated query */
+
+		msg = new(dns.Msg)
+		msg.SetQuestion("big.example.com.", dns.TypeTXT)
+		msg.SetTsig("key.example.com.", dns.HmacSHA256, 300, time.Now().Unix())
+
+		ret, _, err = client.Exchange(msg, addr)
+		assert.NoError(t, err)
+		assert.Equal(t, dns.RcodeSuccess, ret.Rcode)
+		assert.True(t, ret.Truncated)
+		assert.NotNil(t, ret.IsTsig())
+
+		/* unsigned query */
+
+		ret, err = Query("udp", addr, "example.com.", "SOA", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, dns.RcodeNotAuth, ret.Rcode)
+	})
+}
+
+func TestServerTSIGErrors(t *testing.T) {
+	secret := "c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0"
+
+	zone := testZone(nil)
+
+	server := NewServer(Config{
+		Handler: testHandler(zone),
+		TSIGKeys: map[string]string{
+			"Key.Example.com": secret,
+		},
+	})
+
+	run(server, "127.0.0.1:0", func() {
+		addr := server.Addr().String()
+
+		exchange := func(key, secret string) *dns.Msg {
+			client := dns.Client{
+				TsigSecret: map[string]string{key: secret},
+			}
+			msg := new(dns.Msg)
+			msg.SetQuestion("example.com.", dns.TypeSOA)
+			msg.SetTsig(key, dns.HmacSHA256, 300, time.Now().Unix())
+			ret, _, _ := client.Exchange(msg, addr)
+			return ret
+		}
+
+		/* known key */
+
+		ret := exchange("KEY.example.com.", secret)
+		assert.Equal(t, dns.RcodeSuccess, ret.Rcode)
+		assert.NotNil(t, ret.IsTsig())
+		assert.NotEmpty(t, ret.IsTsig().MAC)
+
+		/* unknown key */
+
+		ret = exchange("other.example.com.", secret)
+		assert.Equal(t, dns.RcodeNotAuth, ret.Rcode)
+		assert.Equal(t, uint16(dns.RcodeBadKey), ret.IsTsig().Error)
+		assert.Empty(t, ret.IsTsig().MAC)
+		assert.Empty(t, ret.Answer)
+
+		/* bad signature */
+
+		ret = exchange("key.example.com.", "b3RoZXJvdGhlcm90aGVyb3RoZXI=")
+		assert.Equal(t, dns.RcodeNotAuth, ret.Rcode)
+		assert.Equal(t, uint16(dns.RcodeBadSig), ret.IsTsig().Error)
+		assert.Empty(t, ret.IsTsig().MAC)
+	})
+}
+
+func TestServerUpdate(t *testing.T) {
+	var mutex sync.Mutex
+	sets := map[string][]Set{}
+
+	zone := testZone(func(ctx context.Context, name string) ([]Set, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return sets[name], nil
+	})
+	zone.UpdateHandler = func(ctx context.Context, updates []Update) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		for _, update := range updates {
+			name := TrimZone("example.com.", update.Set.Name)
+			switch update.Operation {
+			case AddRecords:
+				sets[name] = append(sets[name], update.Set)
+			case DeleteName, DeleteSet:
+				delete(sets, name)
+			}
+		}
+
+		return nil
+	}
+	zone.UpdatePolicy = UpdatePolicy{
+		{Deny: true, Names: []string{"*.secret.example.com."}},
+		{},
+	}
+
+	unauthenticated := &Zone{
+		Name:             "example.net.",
+		MasterNameServer: "ns1.example.net.",
+		AllNameServers: []string{
+			"ns1.example.net.",
+		},
+		Handler: func(ctx context.Context, name string) ([]Set, error) {
+			return nil, nil
+		},
+		UpdateHandler: func(ctx context.Context, updates []Update) error {
+			panic("unexpected update")
+		},
+	}
+
+	server := NewServer(Config{
+		Handler: func(ctx context.Context, name string) (*Zone, error) {
+			if InZone("example.com.", name) {
+				return zone, nil
+			} else if InZone("example.net.", name) {
+				return unauthenticated, nil
+			}
+
+			return nil, nil
+		},
+	})
+
+	run(server, "127.0.0.1:0", func() {
+		addr := server.Addr().String()
+
+		rr, err := dns.NewRR("foo.example.com. 300 IN A 1.2.3.4")
+		assert.NoError(t, err)
+
+		/* add record */
+
+		msg := new(dns.Msg)
+		msg.SetUpdate("example.com.")
+		msg.NameNotUsed([]dns.RR{rr})
+		msg.Insert([]dns.RR{rr})
+
+		ret, err := dns.Exchange(msg, addr)
+		assert.NoError(t, err)
+		assert.Equal(t, dns.RcodeSuccess, ret.Rcode)
+
+		ret, err = Query("udp", addr, "foo.example.com.", "A", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, dns.RcodeSuccess, ret.Rcode)
+		assert.Len(t, ret.Answer, 1)
+
+		/* conflicting CNAME record */
+
+		cname, err := dns.NewRR("foo.example.com. 300 IN CNAME example.com.")
+		assert.NoError(t, err)
+
+		msg = new(dns.Msg)
+		msg.SetUpdate("example.com.")
+		msg.Insert([]dns.RR{cname})
+
+		ret, err = dns.Exchange(msg, addr)
+		assert.NoError(t, err)
+		assert.Equal(t, dns.RcodeSuccess, ret.Rcode)
+
+		ret, err = Query("udp", addr, "foo.example.com.", "CNAME", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, dns.RcodeSuccess, ret.Rcode)
+		assert.Empty(t, ret.Answer)
+
+		/* failed prerequisite */
+
+		msg = new(dns.Msg)
+		msg.SetUpdate("example.com.")
+		msg.NameNotUsed([]dns.RR{rr})
+		msg.Insert([]dns.RR{rr})
+
+		ret, err = dns.Exchange(msg, addr)
+		assert.NoError(t, err)
+		assert.Equal(t, dns.RcodeYXDomain, ret.Rcode)
+
+		/* remove name */
+
+		msg = new(dns.Msg)
+		msg.SetUpdate("example.com.")
+		msg.Used([]dns.RR{rr})
+		msg.RemoveName([]dns.RR{rr})
+
+		ret, err = dns.Exchange(msg, addr)
+		assert.NoError(t, err)
+		assert.Equal(t, dns.RcodeSuccess, ret.Rcode)
+
+		ret, err = Query("udp", addr, "foo.example.com.", "A", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, dns.RcodeNameError, ret.Rcode)
+
+		/* other zone */
+
+		other, err := dns.NewRR("foo.example.org. 300 IN A 1.2.3.4")
+		assert.NoError(t, err)
+
+		msg = new(dns.Msg)
+		msg.SetUpdate("example.com.")
+		msg.Insert([]dns.RR{other})
+
+		ret, err = dns.Exchange(msg, addr)
+		assert.NoError(t, err)
+		assert.Equal(t, dns.RcodeNotZone, ret.Rcode)
+
+		/* denied update */
+
+		secret, err := dns.NewRR("foo.secret.example.com. 300 IN A 1.2.3.4")
+		assert.NoError(t, err)
+
+		msg = new(dns.Msg)
+		msg.SetUpdate("example.com.")
+		msg.Used([]dns.RR{secret})
+		msg.Insert([]dns.RR{secret})
+
+		ret, err = dns.Exchange(msg, addr)
+		assert.NoError(t, err)
+		assert.Equal(t, dns.RcodeRefused, ret.Rcode)
+
+		/* unauthenticated update */
+
+		rr, err = dns.NewRR("foo.example.net. 300 IN A 1.2.3.4")
+		assert.NoError(t, err)
+
+		msg = new(dns.Msg)
+		msg.SetUpdate("example.net.")
+		msg.Insert([]dns.RR{rr})
+
+		ret, err = dns.Exchange(msg, addr)
+		assert.NoError(t, err)
+		assert.Equal(t, dns.RcodeRefused, ret.Rcode)
+	})
+}
+
+func TestServerNSID(t *testing.T) {
+	zone := testZone(nil)
+
+	server := NewServer(Config{
+		Handler:  testHandler(zone),
+		ServerID: "fra1",
+	})
+
+	run(server, "127.0.0.1:0", func() {
+		addr := server.Addr().String()
+
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeSOA)
+		msg.SetEdns0(1232, false)
+		opt := msg.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+
+		ret, err := dns.Exchange(msg, addr)
+		assert.NoError(t, err)
+		assert.NotNil(t, ret.IsEdns0())
+		assert.Len(t, ret.IsEdns0().Option, 1)
+		assert.Equal(t, "66726131", ret.IsEdns0().Option[0].(*dns.EDNS0_NSID).Nsid)
+
+		msg = new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeSOA)
+		msg.SetEdns0(1232, false)
+
+		ret, err = dns.Exchange(msg, addr)
+		assert.NoError(t, err)
+		assert.NotNil(t, ret.IsEdns0())
+		assert.Empty(t, ret.IsEdns0().Option)
+	})
+}
+
+func TestServerOptions(t *testing.T) {
+	zone := testZone(func(ctx context.Context, name string) ([]Set, error) {
+		for _, option := range RequestOptions(ctx) {
+			if local, ok := option.(*dns.EDNS0_LOCAL); ok {
+				AddResponseOption(ctx, &dns.EDNS0_LOCAL{
+					Code: local.Code,
+					Data: append([]byte("re:"), local.Data...),
+				})
+			}
+		}
+
+		return []Set{
+			{
+				Name: "example.com.",
+				Type: A,
+				Records: []Record{
+					{Address: "1.2.3.4"},
+				},
+			},
+		}, nil
+	})
+
+	server := NewServer(Config{
+		Handler: testHandler(zone),
+	})
+
+	run(server, "127.0.0.1:0", func() {
+		addr := server.Addr().String()
+
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		msg.SetEdns0(1232, false)
+		opt := msg.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: 65001, Data: []byte("foo")})
+
+		ret, err := dns.Exchange(msg, addr)
+		assert.NoError(t, err)
+		assert.Len(t, ret.Answer, 1)
+		assert.NotNil(t, ret.IsEdns0())
+		assert.Equal(t, []dns.EDNS0{
+			&dns.EDNS0_LOCAL{Code: 65001, Data: []byte("re:foo")},
+		}, ret.IsEdns0().Option)
+	})
+}
+
+func TestServerMaxUDPSize(t *testing.T) {
+	var records []Record
+	for i := 0; i < 10; i++ {
+		records = append(records, Record{Data: []string{strings.Repeat(strconv.Itoa(i), 200)}})
+	}
+
+	zone := testZone(func(ctx context.Context, name string) ([]Set, error) {
+		return []Set{
+			{
+				Name:    "example.com.",
+				Type:    TXT,
+				Records: records,
+			},
+		}, nil
+	})
+
+	other := *zone
+	other.Name = "example.org."
+	other.MaxUDPSize = 4096
+	other.Handler = func(ctx context.Context, name string) ([]Set, error) {
+		return []Set{
+			{
+				Name:    "example.org.",
+				Type:    TXT,
+				Records: records,
+			},
+		}, nil
+	}
+
+	server := NewServer(Config{
+		Handler: func(ctx context.Context, name string) (*Zone, error) {
+			if InZone("example.org.", name) {
+				return &other, nil
+			}
+
+			return zone, nil
+		},
+	})
+
+	run(server, "127.0.0.1:0", func() {
+		addr := server.Addr().String()
+
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeTXT)
+		msg.SetEdns0(4096, false)
+
+		ret, err := dns.Exchange(msg, addr)
+		assert.NoError(t, err)
+		assert.True(t, ret.Truncated)
+		assert.Empty(t, ret.Answer)
+
+		msg = new(dns.Msg)
+		msg.SetQuestion("example.org.", dns.TypeTXT)
+		msg.SetEdns0(4096, false)
+
+		ret, err = dns.Exchange(msg, addr)
+		assert.NoError(t, err)
+		assert.False(t, ret.Truncated)
+		assert.Len(t, ret.Answer, 10)
+	})
+}
+
+func TestServerMiddleware(t *testing.T) {
+	zone := testZone(nil)
+
+	var mutex sync.Mutex
+	var order []string
+
+	server := NewServer(Config{
+		Handler: testHandler(zone),
+		Middleware: []func(dns.Handler) dns.Handler{
+			func(next dns.Handler) dns.Handler {
+				return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+					mutex.Lock()
+					order = append(order, "first")
+					mutex.Unlock()
+					next.ServeDNS(w, req)
+				})
+			},
+			func(next dns.Handler) dns.Handler {
+				return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+					mutex.Lock()
+					order = append(order, "second")
+					mutex.Unlock()
+
+					if req.Question[0].Name == "blocked.example.com." {
+						res := new(dns.Msg)
+						res.SetRcode(req, dns.RcodeRefused)
+						_ = w.WriteMsg(res)
+						return
+					}
+
+					next.ServeDNS(w, req)
+				})
+			},
+		},
+	})
+
+	run(server, "127.0.0.1:0", func() {
+		addr := server.Addr().String()
+
+		ret, err := Query("udp", addr, "example.com.", "SOA", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, dns.RcodeSuccess, ret.Rcode)
+
+		ret, err = Query("udp", addr, "blocked.example.com.", "A", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, dns.RcodeRefused, ret.Rcode)
+
+		mutex.Lock()
+		assert.Equal(t, []string{"first", "second", "first", "second"}, order)
+		mutex.Unlock()
+	})
+}
+
+type testMsgLog struct {
+	mutex   sync.Mutex
+	answers []int
+}
+
+func (l *testMsgLog) get() []int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]int(nil), l.answers...)
+}
+
+type testMsgWriter struct {
+	dns.ResponseWriter
+	log *testMsgLog
+}
+
+func (w *testMsgWriter) WriteMsg(msg *dns.Msg) error {
+	w.log.mutex.Lock()
+	w.log.answers = append(w.log.answers, len(msg.Answer))
+	w.log.mutex.Unlock()
+	return w.ResponseWriter.WriteMsg(msg)
+}
+
+func TestServerMiddlewareWriter(t *testing.T) {
+	zone := testZone(apexHandler)
+
+	var msgs testMsgLog
+
+	server := NewServer(Config{
+		Handler:           testHandler(zone),
+		ResponseCacheSize: 10,
+		Middleware: []func(dns.Handler) dns.Handler{
+			func(next dns.Handler) dns.Handler {
+				return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+					next.ServeDNS(&testMsgWriter{ResponseWriter: w, log: &msgs}, req)
+				})
+			},
+		},
+	})
+
+	run(server, "127.0.0.1:0", func() {
+		addr := server.Addr().String()
+
+		for i := 0; i < 2; i++ {
+			ret, err := Query("udp", addr, "example.com.", "A", nil)
+			assert.NoError(t, err)
+			assert.Len(t, ret.Answer, 1)
+		}
+
+		assert.Equal(t, []int{1, 1}, msgs.get())
+	})
+}
+
+func TestServerEventInfo(t *testing.T) {
+	zone := testZone(func(ctx context.Context, name string) ([]Set, error) {
+		time.Sleep(time.Millisecond)
+		return nil, nil
+	})
+
+	var mutex sync.Mutex
+	var entries []Entry
+
+	server := NewServer(Config{
+		Handler: testHandler(zone),
+		Logger: LoggerFunc(func(entry Entry) {
+			if entry.Info != nil {
+				mutex.Lock()
+				entries = append(entries, entry)
+				mutex.Unlock()
+			}
+		}),
+	})
+
+	run(server, "127.0.0.1:0", func() {
+		addr := server.Addr().String()
+
+		ret, err := Query("udp", addr, "missing.example.com.", "A", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, dns.RcodeNameError, ret.Rcode)
+
+		time.Sleep(10 * time.Millisecond)
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		assert.Len(t, entries, 3)
+		assert.Equal(t, Request, entries[0].Event)
+		assert.Equal(t, Response, entries[1].Event)
+		assert.Equal(t, Finish, entries[2].Event)
+
+		info := entries[2].Info
+		assert.Equal(t, "udp", info.Transport)
+		assert.NotNil(t, info.Remote)
+		assert.Equal(t, "missing.example.com.", info.Question.Name)
+		assert.Equal(t, dns.RcodeNameError, info.Rcode)
+		assert.True(t, info.RequestSize > 0)
+		assert.True(t, info.ResponseSize > 0)
+		assert.True(t, info.HandlerDuration >= time.Millisecond)
+		assert.True(t, info.Elapsed >= info.HandlerDuration)
+	})
+}
+
+type testTracer struct {
+	mutex sync.Mutex
+	spans []*testSpan
+}
+
+func (t *testTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	parent, _ := ctx.Value(testSpanKey{}).(*testSpan)
+	span := &testSpan{name: name, parent: parent, attrs: map[string]interface{}{}, done: make(chan struct{})}
+	t.spans = append(t.spans, span)
+
+	return context.WithValue(ctx, testSpanKey{}, span), span
+}
+
+func (t *testTracer) list() []*testSpan {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]*testSpan(nil), t.spans...)
+}
+
+type testSpanKey struct{}
+
+type testSpan struct {
+	name   string
+	parent *testSpan
+	mutex  sync.Mutex
+	attrs  map[string]interface{}
+	done   chan struct{}
+}
+
+func (s *testSpan) SetAttribute(key string, value interface{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.attrs[key] = value
+}
+
+func (s *testSpan) RecordError(error) {}
+
+func (s *testSpan) End() {
+	close(s.done)
+}
+
+func (s *testSpan) attributes() map[string]interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	attrs := map[string]interface{}{}
+	for key, value := range s.attrs {
+		attrs[key] = value
+	}
+	return attrs
+}
+
+func (s *testSpan) wait() bool {
+	select {
+	case <-s.done:
+		return true
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+func TestServerTracer(t *testing.T) {
+	zone := testZone(nil)
+
+	tracer := &testTracer{}
+
+	server := NewServer(Config{
+		Handler: testHandler(zone),
+		Tracer:  tracer,
+	})
+
+	run(server, "127.0.0.1:0", func() {
+		addr := server.Addr().String()
+
+		ret, err := Query("udp", addr, "foo.example.com.", "A", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, dns.RcodeNameError, ret.Rcode)
+
+		spans := tracer.list()
+		for _, span := range spans {
+			assert.True(t, span.wait())
+		}
+
+		assert.Len(t, spans, 3)
+		assert.Equal(t, "newdns.Query", spans[0].name)
+		assert.Equal(t, "newdns.Handler", spans[1].name)
+		assert.Equal(t, "newdns.ZoneHandler", spans[2].name)
+		assert.Equal(t, map[string]interface{}{
+			"dns.qname": "foo.example.com.",
+			"dns.qtype": "A",
+			"dns.rcode": "NXDOMAIN",
+		}, spans[0].attributes())
+	})
+}
+
+func TestServerTracerForwarder(t *testing.T) {
+	upstream := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		res := new(dns.Msg)
+		res.SetRcode(req, dns.RcodeNameError)
+		_ = w.WriteMsg(res)
+	})
+
+	zone := testZone(nil)
+	zone.Forwarders = []string{"127.0.0.1:53111"}
+
+	tracer := &testTracer{}
+
+	server := NewServer(Config{
+		Handler: testHandler(zone),
+		Tracer:  tracer,
+	})
+
+	serve(upstream, "127.0.0.1:53111", func() {
+		run(server, "127.0.0.1:0", func() {
+			addr := server.Addr().String()
+
+			ret, err := Query("udp", addr, "foo.example.com.", "A", nil)
+			assert.NoError(t, err)
+			assert.Equal(t, dns.RcodeNameError, ret.Rcode)
+
+			var forwarder *testSpan
+			for _, span := range tracer.list() {
+				if span.name == "newdns.Forwarder" {
+					forwarder = span
+				}
+			}
+			if assert.NotNil(t, forwarder) {
+				assert.True(t, forwarder.wait())
+				assert.Equal(t, "newdns.Query", forwarder.parent.name)
+				assert.Equal(t, "NXDOMAIN", forwarder.attributes()["dns.rcode"])
+			}
+		})
+	})
+}
+
+func TestServerPanic(t *testing.T) {
+	zone := testZone(func(ctx context.Context, name string) ([]Set, error) {
+		panic("foo")
+	})
+
+	var mutex sync.Mutex
+	var reported error
+	var stack []byte
+
+	server := NewServer(Config{
+		Handler: testHandler(zone),
+		Reporter: func(err error, s []byte) {
+			mutex.Lock()
+			reported = err
+			stack = s
+			mutex.Unlock()
+		},
+	})
+
+	run(server, "127.0.0.1:0", func() {
+		addr := server.Addr().String()
+
+		ret, err := Query("udp", addr, "foo.example.com.", "A", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, dns.RcodeServerFailure, ret.Rcode)
+
+		mutex.Lock()
+		assert.EqualError(t, reported, "handler panic: foo")
+		assert.NotEmpty(t, stack)
+		mutex.Unlock()
+	})
+}
+
+func TestServerCapture(t *testing.T) {
+	zone := testZone(nil)
+
+	var mutex sync.Mutex
+	var inbound, outbound [][]byte
+
+	server := NewServer(Config{
+		Handler:           testHandler(zone),
+		ResponseCacheSize: 10,
+		Capture: func(in bool, remote net.Addr, data []byte) {
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			assert.NotNil(t, remote)
+			if in {
+				inbound = append(inbound, data)
+			} else {
+				outbound = append(outbound, data)
+			}
+		},
+	})
+
+	run(server, "127.0.0.1:0", func() {
+		addr := server.Addr().String()
+
+		for _, proto := range []string{"udp", "tcp", "udp", "tcp"} {
+			ret, err := Query(proto, addr, "example.com.", "SOA", nil)
+			assert.NoError(t, err)
+			assert.Equal(t, dns.RcodeSuccess, ret.Rcode)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		assert.Len(t, inbound, 4)
+		assert.Len(t, outbound, 4)
+
+		for _, data := range inbound {
+			var msg dns.Msg
+			assert.NoError(t, msg.Unpack(data))
+			assert.False(t, msg.Response)
+		}
+
+		for _, data := range outbound {
+			var msg dns.Msg
+			assert.NoError(t, msg.Unpack(data))
+			assert.True(t, msg.Response)
+		}
+	})
+}
+
+func TestServerShutdown(t *testing.T) {
+	zone := &Zone{
+		Name:             "example.com.",
+		MasterNameServer: "ns1.example.com.",
+		AllNameServers: []string{
+			"ns1.example.com.",
+			"ns2.example.com.",
+		},
+		Handler: func(ctx context.Context, name string) ([]Set, error) {
+			if name == "slow" {
+				time.Sleep(200 * time.Millisecond)
+			}
+
+			return []Set{
+				{
+					Name: name + ".example.com.",
+					Type: A,
+					Records: []Record{
+						{Address: "1.2.3.4"},
+					},
+				},
+			}, nil
+		},
+	}
+
+	server := NewServer(Config{
+		Handler: testHandler(zone),
+	})
+
+	addr := "0.0.0.0:53006"
+
+	go func() {
+		err := server.Run(addr)
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	<-server.Ready()
+
+	slow := make(chan *dns.Msg)
+	go func() {
+		ret, err := Query("udp", addr, "slow.example.com.", "A", nil)
+		assert.NoError(t, err)
+		slow <- ret
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan error)
+	go func() {
+		done <- server.Shutdown()
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	_, err := Query("udp", addr, "fast.example.com.", "A", nil)
+	assert.True(t, isIOError(err), err)
+
+	ret := <-slow
+	assert.Len(t, ret.Answer, 1)
+	assert.NoError(t, <-done)
+}
+
+func conformanceTests(t *testing.T, proto, addr string, local bool) {
+	t.Run("ApexA", func(t *testing.T) {
+		ret, err := Query(proto, addr, "newdns.256dpi.com.", "A", nil)
+		assert.NoError(t, err)
+		equalJSON(t, &dns.Msg{
+			MsgHdr: dns.MsgHdr{
+				Response:      true,
+				Authoritative: true,
+			},
+			Question: []dns.Question{
+				{Name: "newdns.256dpi.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+			},
+			Answer: []dns.RR{
+				&dns.A{
+					Hdr: dns.RR_Header{
+						Name:     "newdns.256dpi.com.",
+						Rrtype:   dns.TypeA,
+						Class:    dns.ClassINET,
+						Ttl:      300,
+						Rdlength: 4,
+					},
+					A: net.ParseIP("1.2.3.4"),
+				},
+			},
+			Ns: nsRRs,
+		}, ret)
+	})
+
+	t.Run("ApexAAAA", func(t *testing.T) {
+		ret, err := Query(proto, addr, "newdns.256dpi.com.", "AAAA", nil)
+		assert.NoError(t, err)
+		equalJSON(t, &dns.Msg{
+			MsgHdr: dns.MsgHdr{
+				Response:      true,
+				Authoritative: true,
+			},
+			Question: []dns.Question{
+				{Name: "newdns.256dpi.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET},
+			},
+			Answer: []dns.RR{
+				&dns.AAAA{
+					Hdr: dns.RR_Header{
+						Name:     "newdns.256dpi.com.",
+						Rrtype:   dns.TypeAAAA,
+						Class:    dns.ClassINET,
+						Ttl:      300,
+						Rdlength: 16,
+					},
+					AAAA: net.ParseIP("1:2:3:4::"),
+				},
+			},
+			Ns: nsRRs,
+		}, ret)
+	})
+
+	t.Run("ApexCNAME", func(t *testing.T) {
+		ret, err := Query(proto, addr, "newdns.256dpi.com.", "CNAME", nil)
+		assert.NoError(t, err)
+		equalJSON(t, &dns.Msg{
+			MsgHdr: dns.MsgHdr{
+				Response:      true,
+				Authoritative: true,
+				Rcode:         dns.RcodeSuccess,
+			},
+			Question: []dns.Question{
+				{Name: "newdns.256dpi.com.", Qtype: dns.TypeCNAME, Qclass: dns.ClassINET},
+			},
+			Ns: []dns.RR{
+				&dns.SOA{
+					Hdr: dns.RR_Header{
+						Name:     "newdns.256dpi.com.",
+						Rrtype:   dns.TypeSOA,
+						Class:    dns.ClassINET,
+						Ttl:      900,
+						Rdlength: 66,
+					},
+					Ns:      awsPrimaryNS,
+					Mbox:    "awsdns-hostmaster.amazon.com.",
+					Serial:  1,
+					Refresh: 7200,
+					Retry:   900,
+					Expire:  1209600,
+					Minttl:  300,
+				},
+			},
+		}, ret)
+	})
+
+	t.Run("ApexSOA", func(t *testing.T) {
+		ret, err := Query(proto, addr, "newdns.256dpi.com.", "SOA", nil)
+		assert.NoError(t, err)
+		equalJSON(t, &dns.Msg{
+			MsgHdr: dns.MsgHdr{
+				Response:      true,
+				Authoritative: true,
+			},
+			Question: []dns.Question{
+				{Name: "newdns.256dpi.com.", Qtype: dns.TypeSOA, Qclass: dns.ClassINET},
+			},
+			Answer: []dns.RR{
+				&dns.SOA{
+					Hdr: dns.RR_Header{
+						Name:     "newdns.256dpi.com.",
+						Rrtype:   dns.TypeSOA,
+						Class:    dns.ClassINET,
+						Ttl:      900,
+						Rdlength: 66,
+					},
+					Ns:      awsPrimaryNS,
+					Mbox:    "awsdns-hostmaster.amazon.com.",
+					Serial:  1,
+					Refresh: 7200,
+					Retry:   900,
+					Expire:  1209600,
+					Minttl:  300,
+				},
+			},
+			Ns: []dns.RR{
+				&dns.NS{
+					Hdr: dns.RR_Header{
+						Name:     "newdns.256dpi.com.",
+						Rrtype:   dns.TypeNS,
+						Class:    dns.ClassINET,
+						Ttl:      172800,
+						Rdlength: 23,
+					},
+					Ns: awsNS[0],
+				},
+				&dns.NS{
+					Hdr: dns.RR_Header{
+						Name:     "newdns.256dpi.com.",
+						Rrtype:   dns.TypeNS,
+						Class:    dns.ClassINET,
+						Ttl:      172800,
+						Rdlength: 2,
+					},
+					Ns: awsNS[1],
+				},
+				&dns.NS{
+					Hdr: dns.RR_Header{
+						Name:     "newdns.256dpi.com.",
+						Rrtype:   dns.TypeNS,
+						Class:    dns.ClassINET,
+						Ttl:      172800,
+						Rdlength: 25,
+					},
+					Ns: awsNS[2],
+				},
+				&dns.NS{
+					Hdr: dns.RR_Header{
+						Name:     "newdns.256dpi.com.",
+						Rrtype:   dns.TypeNS,
+						Class:    dns.ClassINET,
+						Ttl:      172800,
+						Rdlength: 22,
+					},
+					Ns: awsNS[3],
+				},
+			},
+		}, ret)
+	})
+
+	t.Run("ApexNS", func(t *testing.T) {
+		ret, err := Query(proto, addr, "newdns.256dpi.com.", "NS", nil)
+		assert.NoError(t, err)
+		equalJSON(t, &dns.Msg{
+			MsgHdr: dns.MsgHdr{
+				Response:      true,
+				Authoritative: true,
+			},
+			Question: []dns.Question{
+				{Name: "newdns.256dpi.com.", Qtype: dns.TypeNS, Qclass: dns.ClassINET},
+			},
+			Answer: nsRRs,
+		}, ret)
+	})
+
+	t.Run("ApexTXT", func(t *testing.T) {
+		ret, err := Query(proto, addr, "newdns.256dpi.com.", "TXT", nil)
+		assert.NoError(t, err)
+		equalJSON(t, &dns.Msg{
+			MsgHdr: dns.MsgHdr{
+				Response:      true,
+				Authoritative: true,
+			},
+			Question: []dns.Question{
+				{Name: "newdns.256dpi.com.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET},
+			},
+			Answer: []dns.RR{
+				&dns.TXT{
+					Hdr: dns.RR_Header{
+						Name:     "newdns.256dpi.com.",
+						Rrtype:   dns.TypeTXT,
+						Class:    dns.ClassINET,
+						Ttl:      300,
+						Rdlength: 4,
+					},
+					Txt: []string{"baz"},
+				},
+				&dns.TXT{
+					Hdr: dns.RR_Header{
+						Name:     "newdns.256dpi.com.",
+						Rrtype:   dns.TypeTXT,
+						Class:    dns.ClassINET,
+						Ttl:      300,
+						Rdlength: 8,
+					},
+					Txt: []string{"foo", "bar"},
+				},
+			},
+			Ns: nsRRs,
+		}, ret)
+	})
+
+	t.Run("SubA", func(t *testing.T) {
+		ret, err := Query(proto, addr, "ip4.newdns.256dpi.com.", "A", nil)
+		assert.NoError(t, err)
+		equalJSON(t, &dns.Msg{
+			MsgHdr: dns.MsgHdr{
+				Response:      true,
+				Authoritative: true,
+			},
+			Question: []dns.Question{
+				{Name: "ip4.newdns.256dpi.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+			},
+			Answer: []dns.RR{
+				&dns.A{
+					Hdr: dns.RR_Header{
+						Name:     "ip4.newdns.256dpi.com.",
+						Rrtype:   dns.TypeA,
+						Class:    dns.ClassINET,
+						Ttl:      300,
+						Rdlength: 4,
+					},
+					A: net.ParseIP("1.2.3.4"),
+				},
+			},
+			Ns: nsRRs,
+		}, ret)
+	})
+
+	t.Run("SubAAAA", func(t *testing.T) {
+		ret, err := Query(proto, addr, "ip6.newdns.256dpi.com.", "AAAA", nil)
+		assert.NoError(t, err)
+		equalJSON(t, &dns.Msg{
+			MsgHdr: dns.MsgHdr{
+				Response:      true,
+				Authoritative: true,
+			},
+			Question: []dns.Question{
+				{Name: "ip6.newdns.256dpi.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET},
+			},
+			Answer: []dns.RR{
+				&dns.AAAA{
+					Hdr: dns.RR_Header{
+						Name:     "ip6.newdns.256dpi.com.",
+						Rrtype:   dns.TypeAAAA,
+						Class:    dns.ClassINET,
+						Ttl:      300,
+						Rdlength: 16,
+					},
+					AAAA: net.ParseIP("1:2:3:4::"),
+				},
+			},
+			Ns: nsRRs,
+		}, ret)
+	})
+
+	t.Run("SubCNAME", func(t *testing.T) {
+		ret, err := Query(proto, addr, "example.newdns.256dpi.com.", "CNAME", nil)
+		assert.NoError(t, err)
+		equalJSON(t, &dns.Msg{
+			MsgHdr: dns.MsgHdr{
+				Response:      true,
+				Authoritative: true,
+			},
+			Question: []dns.Question{
+				{Name: "example.newdns.256dpi.com.", Qtype: dns.TypeCNAME, Qclass: dns.ClassINET},
+			},
+			Answer: []dns.RR{
+				&dns.CNAME{
+					Hdr: dns.RR_Header{
+						Name:     "example.newdns.256dpi.com.",
+						Rrtype:   dns.TypeCNAME,
+						Class:    dns.ClassINET,
+						Ttl:      300,
+						Rdlength: 10,
+					},
+					Target: "example.com.",
+				},
+			},
+			Ns: nsRRs,
+		}, ret)
+	})
+
+	t.Run("SubMX", func(t *testing.T) {
+		ret, err := Query(proto, addr, "mail.newdns.256dpi.com.", "MX", nil)
+		assert.NoError(t, err)
+		equalJSON(t, &dns.Msg{
+			MsgHdr: dns.MsgHdr{
+				Response:      true,
+				Authoritative: true,
+			},
+			Question: []dns.Question{
+				{Name: "mail.newdns.256dpi.com.", Qtype: dns.TypeMX, Qclass: dns.ClassINET},
+			},
+			Answer: []dns.RR{
+				&dns.MX{
+					Hdr: dns.RR_Header{
+						Name:     "mail.newdns.256dpi.com.",
+						Rrtype:   dns.TypeMX,
+						Class:    dns.ClassINET,
+						Ttl:      300,
+						Rdlength: 17,
+					},
+					Mx:         "mail.example.com.",
+					Preference: 7,
+				},
+			},
+			Ns: nsRRs,
+		}, ret)
+	})
+
+	t.Run("SubMultiMX", func(t *testing.T) {
+		ret, err := Query(proto, addr, "multimail.newdns.256dpi.com.", "MX", nil)
+		assert.NoError(t, err)
+		equalJSON(t, &dns.Msg{
+			MsgHdr: dns.MsgHdr{
+				Response:      true,
+				Authoritative: true,
+			},
+			Question: []dns.Question{
+				{Name: "multimail.newdns.256dpi.com.", Qtype: dns.TypeMX, Qclass: dns.ClassINET},
+			},
+			Answer: []dns.RR{
+				&dns.MX{
+					Hdr: dns.RR_Header{
+						Name:     "multimail.newdns.256dpi.com.",
+						Rrtype:   dns.TypeMX,
+						Class:    dns.ClassINET,
+						Ttl:      300,
+						Rdlength: 18,
+					},
+					Mx:         "mail1.example.com.",
+					Preference: 1,
+				},
+				&dns.MX{
+					Hdr: dns.RR_Header{
+						Name:     "multimail.newdns.256dpi.com.",
+						Rrtype:   dns.TypeMX,
+						Class:    dns.ClassINET,
+						Ttl:      300,
+						Rdlength: 10,
+					},
+					Mx:         "mail2.example.com.",
+					Preference: 10,
+				},
+				&dns.MX{
+					Hdr: dns.RR_Header{
+						Name:     "multimail.newdns.256dpi.com.",
+						Rrtype:   dns.TypeMX,
+						Class:    dns.ClassINET,
+						Ttl:      300,
+						Rdlength: 10,
+					},
+					Mx:         "mail3.example.com.",
+					Preference: 10,
+				},
+			},
+			Ns: nsRRs,
+		}, ret)
+	})
+
+	t.Run("SubTXT", func(t *testing.T) {
+		ret, err := Query(proto, addr, "text.newdns.256dpi.com.", "TXT", nil)
+		assert.NoError(t, err)
+		equalJSON(t, &dns.Msg{
+			MsgHdr: dns.MsgHdr{
+				Response:      true,
+				Authoritative: true,
+			},
+			Question: []dns.Question{
+				{Name: "text.newdns.256dpi.com.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET},
+			},
+			Answer: []dns.RR{
+				&dns.TXT{
+					Hdr: dns.RR_Header{
+						Name:     "text.newdns.256dpi.com.",
+						Rrtype:   dns.TypeTXT,
+						Class:    dns.ClassINET,
+						Ttl:      300,
+						Rdlength: 8,
+					},
+					Txt: []string{"foo", "bar"},
+				},
+			},
+			Ns: nsRRs,
+		}, ret)
+	})
+
+	t.Run("SubCNAMEForA", func(t *testing.T) {
+		ret, err := Query(proto, addr, "example.newdns.256dpi.com.", "A", nil)
+		assert.NoError(t, err)
+		equalJSON(t, &dns.Msg{
+			MsgHdr: dns.MsgHdr{
+				Response:      true,
+				Authoritative: true,
+			},
+			Question: []dns.Question{
+				{Name: "example.newdns.256dpi.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+			},
+			Answer: []dns.RR{
+				&dns.CNAME{
+					Hdr: dns.RR_Header{
+						Name:     "example.newdns.256dpi.com.",
+						Rrtype:   dns.TypeCNAME,
+						Class:    dns.ClassINET,
+						Ttl:      300,
+						Rdlength: 10,
+					},
+					Target: "example.com.",
+				},
+			},
+			Ns: nsRRs,
+		}, ret)
+	})
+
+	t.Run("SubCNAMEForAAAA", func(t *testing.T) {
+		ret, err := Query(proto, addr, "example.newdns.256dpi.com.", "AAAA", nil)
+		assert.NoError(t, err)
+		equalJSON(t, &dns.Msg{
+			MsgHdr: dns.MsgHdr{
+				Response:      true,
+				Authoritative: true,
+			},
+			Question: []dns.Question{
+				{Name: "example.newdns.256dpi.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET},
+			},
+			Answer: []dns.RR{
+				&dns.CNAME{
+					Hdr: dns.RR_Header{
+						Name:     "example.newdns.256dpi.com.",
+						Rrtype:   dns.TypeCNAME,
+						Class:    dns.ClassINET,
+						Ttl:      300,
+						Rdlength: 10,
+					},
+					Target: "example.com.",
+				},
+			},
+			Ns: nsRRs,
+		}, ret)
+	})
+
+	t.Run("SubCNAMEForAWithA", func(t *testing.T) {
+		ret, err := Query(proto, addr, "ref4.newdns.256dpi.com.", "A", nil)
+		assert.NoError(t, err)
+		equalJSON(t, &dns.Msg{
+			MsgHdr: dns.MsgHdr{
+				Response:      true,
+				Authoritative: true,
+			},
+			Question: []dns.Question{
+				{Name: "ref4.newdns.256dpi.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+			},
+			Answer: []dns.RR{
+				&dns.CNAME{
+					Hdr: dns.RR_Header{
+						Name:     "ref4.newdns.256dpi.com.",
+						Rrtype:   dns.TypeCNAME,
+						Class:    dns.ClassINET,
+						Ttl:      300,
+						Rdlength: 6,
+					},
+					Target: "ip4.newdns.256dpi.com.",
+				},
+				&dns.A{
+					Hdr: dns.RR_Header{
+						Name:     "ip4.newdns.256dpi.com.",
+						Rrtype:   dns.TypeA,
+						Class:    dns.ClassINET,
+						Ttl:      300,
+						Rdlength: 4,
+					},
+					A: net.ParseIP("1.2.3.4"),
+				},
+			},
+			Ns: nsRRs,
+		}, ret)
+	})
+
+	t.Run("SubCNAMEForAAAAWithAAAA", func(t *testing.T) {
+		ret, err := Query(proto, addr, "ref6.newdns.256dpi.com.", "AAAA", nil)
+		assert.NoError(t, err)
+		equalJSON(t, &dns.Msg{
+			MsgHdr: dns.MsgHdr{
+				Response:      true,
+				Authoritative: true,
+			},
+			Question: []dns.Question{
+				{Name: "ref6.newdns.256dpi.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET},
+			},
+			Answer: []dns.RR{
+				&dns.CNAME{
+					Hdr: dns.RR_Header{
+						Name:     "ref6.newdns.256dpi.com.",
+						Rrtype:   dns.TypeCNAME,
+						Class:    dns.ClassINET,
+						Ttl:      300,
+						Rdlength: 6,
+					},
+					Target: "ip6.newdns.256dpi.com.",
+				},
+				&dns.AAAA{
+					Hdr: dns.RR_Header{
+						Name:     "ip6.newdns.256dpi.com.",
+						Rrtype:   dns.TypeAAAA,
+						Class:    dns.ClassINET,
+						Ttl:      300,
+						Rdlength: 16,
+					},
+					AAAA: net.ParseIP("1:2:3:4::"),
+				},
+			},
+			Ns: nsRRs,
+		}, ret)
+	})
+
+	t.Run("SubCNAMEWithoutA", func(t *testing.T) {
+		ret, err := Query(proto, addr, "ref4.newdns.256dpi.com.", "CNAME", nil)
+		assert.NoError(t, err)
+		equalJSON(t, &dns.Msg{
+			MsgHdr: dns.MsgHdr{
+				Response:      true,
+				Authoritative: true,
+			},
+			Question: []dns.Question{
+				{Name: "ref4.newdns.256dpi.com.", Qtype: dns.TypeCNAME, Qclass: dns.ClassINET},
+			},
+			Answer: []dns.RR{
+				&dns.CNAME{
+					Hdr: dns.RR_Header{
+						Name:     "ref4.newdns.256dpi.com.",
+						Rrtype:   dns.TypeCNAME,
+						Class:    dns.ClassINET,
+						Ttl:      300,
+						Rdlength: 6,
+					},
+					Target: "ip4.newdns.256dpi.com.",
+				},
+			},
+			Ns: nsRRs,
+		}, ret)
+	})
+
+	t.Run("SubCNAMEWithoutAAAA", func(t *testing.T) {
+		ret, err := Query(proto, addr, "ref6.newdns.256dpi.com.", "CNAME", nil)
+		assert.NoError(t, err)
+		equalJSON(t, &dns.Msg{
+			MsgHdr: dns.MsgHdr{
+				Response:      true,
+				Authoritative: true,
+			},
+			Question: []dns.Question{
+				{Name: "ref6.newdns.256dpi.com.", Qtype: dns.TypeCNAME, Qclass: dns.ClassINET},
+			},
+			Answer: []dns.RR{
+				&dns.CNAME{
+					Hdr: dns.RR_Header{
+						Name:     "ref6.newdns.256dpi.com.",
+						Rrtype:   dns.TypeCNAME,
+						Class:    dns.ClassINET,
+						Ttl:      300,
+						Rdlength: 6,
+					},
+					Target: "ip6.newdns.256dpi.com.",
+				},
+			},
+			Ns: nsRRs,
+		}, ret)
+	})
+
+	t.Run("SubCNAMEForCNAMEForAWithA", func(t *testing.T) {
+		ret, err := Query(proto, addr, "refref.newdns.256dpi.com.", "A", nil)
+		assert.NoError(t, err)
+		equalJSON(t, &dns.Msg{
+			MsgHdr: dns.MsgHdr{
+				Response:      true,
+				Authoritative: true,
+			},
+			Question: []dns.Question{
+				{Name: "refref.newdns.256dpi.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+			},
+			Answer: []dns.RR{
+				&dns.CNAME{
+					Hdr: dns.RR_Header{
+						Name:     "refref.newdns.256dpi.com.",
+						Rrtype:   dns.TypeCNAME,
+						Class:    dns.ClassINET,
+						Ttl:      300,
+						Rdlength: 7,
+					},
+					Target: "ref4.newdns.256dpi.com.",
+				},
+				&dns.CNAME{
+					Hdr: dns.RR_Header{
+						Name:     "ref4.newdns.256dpi.com.",
+						Rrtype:   dns.TypeCNAME,
+						Class:    dns.ClassINET,
+						Ttl:      300,
+						Rdlength: 6,
+					},
+					Target: "ip4.newdns.256dpi.com.",
+				},
+				&dns.A{
+					Hdr: dns.RR_Header{
+						Name:     "ip4.newdns.256dpi.com.",
+						Rrtype:   dns.TypeA,
+						Class:    dns.ClassINET,
+						Ttl:      300,
+						Rdlength: 4,
+					},
+					A: net.ParseIP("1.2.3.4"),
+				},
+			},
+			Ns: nsRRs,
+		}, ret)
+	})
+
+	t.Run("SubAAAAForCNAMEToA", func(t *testing.T) {
+		ret, err := Query(proto, addr, "ref4.newdns.256dpi.com.", "AAAA", nil)
+		assert.NoError(t, err)
+		equalJSON(t, &dns.Msg{
+			MsgHdr: dns.MsgHdr{
+				Response:      true,
+				Authoritative: true,
+			},
+			Question: []dns.Question{
+				{Name: "ref4.newdns.256dpi.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET},
+			},
+			Answer: []dns.RR{
+				&dns.CNAME{
+					Hdr: dns.RR_Header{
+						Name:     "ref4.newdns.256dpi.com.",
+						Rrtype:   dns.TypeCNAME,
+						Class:    dns.ClassINET,
+						Ttl:      300,
+						Rdlength: 6,
+					},
+					Target: "ip4.newdns.256dpi.com.",
+				},
+			},
+			Ns: nsRRs,
+		}, ret)
+	})
+
+	t.Run("SubAForCNAMEToAAAA", func(t *testing.T) {
+		ret, err := Query(proto, addr, "ref6.newdns.256dpi.com.", "A", nil)
+		assert.NoError(t, err)
+		equalJSON(t, &dns.Msg{
+			MsgHdr: dns.MsgHdr{
+				Response:      true,
+				Authoritative: true,
+			},
+			Question: []dns.Question{
+				{Name: "ref6.newdns.256dpi.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+			},
+			Answer: []dns.RR{
+				&dns.CNAME{
+					Hdr: dns.RR_Header{
+						Name:     "ref6.newdns.256dpi.com.",
+						Rrtype:   dns.TypeCNAME,
+						Class:    dns.ClassINET,
+						Ttl:      300,
+						Rdlength: 6,
+					},
+					Target: "ip6.newdns.256dpi.com.",
+				},
+			},
+			Ns: nsRRs,
+		}, ret)
+	})
+
+	t.Run("SubSRVForCNAME", func(t *testing.T) {
+		ret, err := Query(proto, addr, "ref4.newdns.256dpi.com.", "SRV", nil)
+		assert.NoError(t, err)
+		equalJSON(t, &dns.Msg{
+			MsgHdr: dns.MsgHdr{
+				Response:      true,
+				Authoritative: true,
+			},
+			Question: []dns.Question{
+				{Name: "ref4.newdns.256dpi.com.", Qtype: dns.TypeSRV, Qclass: dns.ClassINET},
+			},
+			Answer: []dns.RR{
+				&dns.CNAME{
+					Hdr: dns.RR_Header{
+						Name:     "ref4.newdns.256dpi.com.",
+						Rrtype:   dns.TypeCNAME,
 						Class:    dns.ClassINET,
-						Ttl:      172800,
-						Rdlength: 23,
+						Ttl:      300,
+						Rdlength: 6,
 					},
-					Ns: awsNS[0],
+					Target: "ip4.newdns.256dpi.com.",
 				},
-				&dns.NS{
+			},
+			Ns: nsRRs,
+		}, ret)
+	})
+
+	t.Run("SubMXWithExtraA", func(t *testing.T) {
+		ret, err := Query(proto, addr, "ref4m.newdns.256dpi.com.", "MX", nil)
+		assert.NoError(t, err)
+		equalJSON(t, &dns.Msg{
+			MsgHdr: dns.MsgHdr{
+				Response:      true,
+				Authoritative: true,
+			},
+			Question: []dns.Question{
+				{Name: "ref4m.newdns.256dpi.com.", Qtype: dns.TypeMX, Qclass: dns.ClassINET},
+			},
+			Answer: []dns.RR{
+				&dns.MX{
 					Hdr: dns.RR_Header{
-						Name:     "newdns.256dpi.com.",
-						Rrtype:   dns.TypeNS,
+						Name:     "ref4m.newdns.256dpi.com.",
+						Rrtype:   dns.TypeMX,
 						Class:    dns.ClassINET,
-						Ttl:      172800,
-						Rdlength: 2,
+						Ttl:      300,
+						Rdlength: 8,
 					},
-					Ns: awsNS[1],
+					Preference: 7,
+					Mx:         "ip4.newdns.256dpi.com.",
 				},
-				&dns.NS{
+			},
+			Extra: []dns.RR{
+				&dns.A{
 					Hdr: dns.RR_Header{
-						Name:     "newdns.256dpi.com.",
-						Rrtype:   dns.TypeNS,
+						Name:     "ip4.newdns.256dpi.com.",
+						Rrtype:   dns.TypeA,
 						Class:    dns.ClassINET,
-						Ttl:      172800,
-						Rdlength: 25,
+						Ttl:      300,
+						Rdlength: 4,
 					},
-					Ns: awsNS[2],
+					A: net.ParseIP("1.2.3.4"),
 				},
-				&dns.NS{
+			},
+			Ns: nsRRs,
+		}, ret)
+	})
+
+	t.Run("SubMXWithExtraAAAA", func(t *testing.T) {
+		ret, err := Query(proto, addr, "ref6m.newdns.256dpi.com.", "MX", nil)
+		assert.NoError(t, err)
+		equalJSON(t, &dns.Msg{
+			MsgHdr: dns.MsgHdr{
+				Response:      true,
+				Authoritative: true,
+			},
+			Question: []dns.Question{
+				{Name: "ref6m.newdns.256dpi.com.", Qtype: dns.TypeMX, Qclass: dns.ClassINET},
+			},
+			Answer: []dns.RR{
+				&dns.MX{
 					Hdr: dns.RR_Header{
-						Name:     "newdns.256dpi.com.",
-						Rrtype:   dns.TypeNS,
+						Name:     "ref6m.newdns.256dpi.com.",
+						Rrtype:   dns.TypeMX,
 						Class:    dns.ClassINET,
-						Ttl:      172800,
-						Rdlength: 22,
+						Ttl:      300,
+						Rdlength: 8,
 					},
-					Ns: awsNS[3],
+					Preference: 7,
+					Mx:         "ip6.newdns.256dpi.com.",
+				},
+			},
+			Extra: []dns.RR{
+				&dns.AAAA{
+					Hdr: dns.RR_Header{
+						Name:     "ip6.newdns.256dpi.com.",
+						Rrtype:   dns.TypeAAAA,
+						Class:    dns.ClassINET,
+						Ttl:      300,
+						Rdlength: 16,
+					},
+					AAAA: net.ParseIP("1:2:3:4::"),
 				},
 			},
+			Ns: nsRRs,
 		}, ret)
 	})
 
-	t.Run("ApexNS", func(t *testing.T) {
-		ret, err := Query(proto, addr, "newdns.256dpi.com.", "NS", nil)
+	t.Run("SubNS", func(t *testing.T) {
+		ret, err := Query(proto, addr, "other.newdns.256dpi.com.", "NS", nil)
 		assert.NoError(t, err)
+		order(ret.Ns)
 		equalJSON(t, &dns.Msg{
 			MsgHdr: dns.MsgHdr{
 				Response:      true,
-				Authoritative: true,
+				Authoritative: false,
 			},
 			Question: []dns.Question{
-				{Name: "newdns.256dpi.com.", Qtype: dns.TypeNS, Qclass: dns.ClassINET},
+				{Name: "other.newdns.256dpi.com.", Qtype: dns.TypeNS, Qclass: dns.ClassINET},
 			},
-			Answer: nsRRs,
+			Ns: order(otherNSRRs),
 		}, ret)
 	})
 
-	t.Run("ApexTXT", func(t *testing.T) {
-		ret, err := Query(proto, addr, "newdns.256dpi.com.", "TXT", nil)
+	t.Run("NoExactRecord", func(t *testing.T) {
+		assertMissing(t, proto, addr, "ip4.newdns.256dpi.com.", "CNAME", dns.RcodeSuccess)
+		assertMissing(t, proto, addr, "ip6.newdns.256dpi.com.", "CNAME", dns.RcodeSuccess)
+		assertMissing(t, proto, addr, "ip4.newdns.256dpi.com.", "AAAA", dns.RcodeSuccess)
+		assertMissing(t, proto, addr, "ip6.newdns.256dpi.com.", "A", dns.RcodeSuccess)
+		assertMissing(t, proto, addr, "mail.newdns.256dpi.com.", "A", dns.RcodeSuccess)
+		assertMissing(t, proto, addr, "text.newdns.256dpi.com.", "A", dns.RcodeSuccess)
+		assertMissing(t, proto, addr, "ip4.newdns.256dpi.com.", "NS", dns.RcodeSuccess)
+		// unsupported types
+		assertMissing(t, proto, addr, "ip4.newdns.256dpi.com.", "SRV", dns.RcodeSuccess)
+		assertMissing(t, proto, addr, "ip6.newdns.256dpi.com.", "SRV", dns.RcodeSuccess)
+		assertMissing(t, proto, addr, "ip4.newdns.256dpi.com.", "PTR", dns.RcodeSuccess)
+		assertMissing(t, proto, addr, "ip6.newdns.256dpi.com.", "PTR", dns.RcodeSuccess)
+	})
+
+	t.Run("NoExistingRecord", func(t *testing.T) {
+		assertMissing(t, proto, addr, "missing.newdns.256dpi.com.", "A", dns.RcodeNameError)
+		assertMissing(t, proto, addr, "missing.newdns.256dpi.com.", "AAAA", dns.RcodeNameError)
+		assertMissing(t, proto, addr, "missing.newdns.256dpi.com.", "CNAME", dns.RcodeNameError)
+		assertMissing(t, proto, addr, "missing.newdns.256dpi.com.", "MX", dns.RcodeNameError)
+		assertMissing(t, proto, addr, "missing.newdns.256dpi.com.", "TXT", dns.RcodeNameError)
+		assertMissing(t, proto, addr, "missing.newdns.256dpi.com.", "NS", dns.RcodeNameError)
+		// unsupported types
+		assertMissing(t, proto, addr, "missing.newdns.256dpi.com.", "SRV", dns.RcodeNameError)
+		assertMissing(t, proto, addr, "missing.newdns.256dpi.com.", "PTR", dns.RcodeNameError)
+	})
+
+	t.Run("TruncatedResponse", func(t *testing.T) {
+		ret, err := Query(proto, addr, "long.newdns.256dpi.com.", "TXT", nil)
+		assert.NoError(t, err)
+
+		if proto == "udp" {
+			equalJSON(t, &dns.Msg{
+				MsgHdr: dns.MsgHdr{
+					Response:      true,
+					Authoritative: true,
+					Truncated:     true,
+				},
+				Question: []dns.Question{
+					{Name: "long.newdns.256dpi.com.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET},
+				},
+			}, ret)
+		} else {
+			equalJSON(t, &dns.Msg{
+				MsgHdr: dns.MsgHdr{
+					Response:      true,
+					Authoritative: true,
+				},
+				Question: []dns.Question{
+					{Name: "long.newdns.256dpi.com.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET},
+				},
+				Answer: []dns.RR{
+					&dns.TXT{
+						Hdr: dns.RR_Header{
+							Name:     "long.newdns.256dpi.com.",
+							Rrtype:   dns.TypeTXT,
+							Class:    dns.ClassINET,
+							Ttl:      300,
+							Rdlength: 256,
+						},
+						Txt: []string{
+							"gyK4oL9X8Zn3b6TwmUIYAgQx43rBOWMqJWR3wGMGNaZgajnhd2u9JaIbGwNo6gzZunyKYRxID3mKLmYUCcIrNYuo8R4UkijZeshwqEAM2EWnjNsB1hJHOlu6VyRKW13rsFUJedOSqc7YjjUoxm9c3mF28tEXmc3GVsC476wJ2ciSbp7ujDjQ032SQRD6kpayzFX8GncS5KXP8mLK2ZIqK2U4fUmYEpTPQMmp7w24GKkfGJzE4JfMBxSybDUScLq",
+						},
+					},
+					&dns.TXT{
+						Hdr: dns.RR_Header{
+							Name:     "long.newdns.256dpi.com.",
+							Rrtype:   dns.TypeTXT,
+							Class:    dns.ClassINET,
+							Ttl:      300,
+							Rdlength: 256,
+						},
+						Txt: []string{
+							"upNh05zi9flqN2puI9eIGgAgl3gwc65l3WjFdnE3u55dhyUyIoKbOlc1mQJPULPkn1V5TTG9rLBB8AzNfeL8jvwO8h0mzmJhPH8n6dkgI546jB8Z0g0MRJxN5VNSixjFjdR8vtUp6EWlVi7QSe9SYInghV0M17zZ8mXSHwTfYZaPH54ng22mSWzVbRX2tlUPLTNRB5CHrEtxliyhhQlRey98P5G0eo35FUXdqzOSJ3HGqDssBWQAxK3I9feOjbE",
+						},
+					},
+					&dns.TXT{
+						Hdr: dns.RR_Header{
+							Name:     "long.newdns.256dpi.com.",
+							Rrtype:   dns.TypeTXT,
+							Class:    dns.ClassINET,
+							Ttl:      300,
+							Rdlength: 256,
+						},
+						Txt: []string{
+							"z4e6ycRMp6MP3WvWQMxIAOXglxANbj3oB0xD8BffktO4eo3VCR0s6TyGHKixvarOFJU0fqNkXeFOeI7sTXH5X0iXZukfLgnGTxLXNC7KkVFwtVFsh1P0IUNXtNBlOVWrVbxkS62ezbLpENNkiBwbkCvcTjwF2kyI0curAt9JhhJFb3AAq0q1iHWlJLn1KSrev9PIsY3alndDKjYTPxAojxzGKdK3A7rWLJ8Uzb3Z5OhLwP7jTKqbWVUocJRFLYp",
+						},
+					},
+				},
+				Ns: nsRRs,
+			}, ret)
+		}
+	})
+
+	t.Run("CaseTransfer", func(t *testing.T) {
+		ret, err := Query(proto, addr, "Ip4.NeWDnS.256dpi.com.", "A", nil)
 		assert.NoError(t, err)
 		equalJSON(t, &dns.Msg{
 			MsgHdr: dns.MsgHdr{
@@ -697,36 +2657,73 @@ func conformanceTests(t *testing.T, proto, addr string, local bool) {
 				Authoritative: true,
 			},
 			Question: []dns.Question{
-				{Name: "newdns.256dpi.com.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET},
+				{Name: "Ip4.NeWDnS.256dpi.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
 			},
 			Answer: []dns.RR{
-				&dns.TXT{
+				&dns.A{
 					Hdr: dns.RR_Header{
-						Name:     "newdns.256dpi.com.",
-						Rrtype:   dns.TypeTXT,
+						Name:     "Ip4.NeWDnS.256dpi.com.",
+						Rrtype:   dns.TypeA,
 						Class:    dns.ClassINET,
 						Ttl:      300,
 						Rdlength: 4,
 					},
-					Txt: []string{"baz"},
+					A: net.ParseIP("1.2.3.4"),
+				},
+			},
+			Ns: []dns.RR{
+				&dns.NS{
+					Hdr: dns.RR_Header{
+						Name:     "NeWDnS.256dpi.com.",
+						Rrtype:   dns.TypeNS,
+						Class:    dns.ClassINET,
+						Ttl:      172800,
+						Rdlength: 23,
+					},
+					Ns: awsNS[0],
+				},
+				&dns.NS{
+					Hdr: dns.RR_Header{
+						Name:     "NeWDnS.256dpi.com.",
+						Rrtype:   dns.TypeNS,
+						Class:    dns.ClassINET,
+						Ttl:      172800,
+						Rdlength: 19,
+					},
+					Ns: awsNS[1],
+				},
+				&dns.NS{
+					Hdr: dns.RR_Header{
+						Name:     "NeWDnS.256dpi.com.",
+						Rrtype:   dns.TypeNS,
+						Class:    dns.ClassINET,
+						Ttl:      172800,
+						Rdlength: 25,
+					},
+					Ns: awsNS[2],
 				},
-				&dns.TXT{
+				&dns.NS{
 					Hdr: dns.RR_Header{
-						Name:     "newdns.256dpi.com.",
-						Rrtype:   dns.TypeTXT,
+						Name:     "NeWDnS.256dpi.com.",
+						Rrtype:   dns.TypeNS,
 						Class:    dns.ClassINET,
-						Ttl:      300,
-						Rdlength: 8,
+						Ttl:      172800,
+						Rdlength: 22,
 					},
-					Txt: []string{"foo", "bar"},
+					Ns: awsNS[3],
 				},
 			},
-			Ns: nsRRs,
 		}, ret)
 	})
 
-	t.Run("SubA", func(t *testing.T) {
-		ret, err := Query(proto, addr, "ip4.newdns.256dpi.com.", "A", nil)
+	t.Run("DomainWithSpace", func(t *testing.T) {
+		assertMissing(t, proto, addr, "\\ ip4.newdns.256dpi.com.", "NULL", dns.RcodeNameError)
+	})
+
+	t.Run("EDNSSuccess", func(t *testing.T) {
+		ret, err := Query(proto, addr, "newdns.256dpi.com.", "A", func(msg *dns.Msg) {
+			msg.SetEdns0(1337, false)
+		})
 		assert.NoError(t, err)
 		equalJSON(t, &dns.Msg{
 			MsgHdr: dns.MsgHdr{
@@ -734,12 +2731,12 @@ func conformanceTests(t *testing.T, proto, addr string, local bool) {
 				Authoritative: true,
 			},
 			Question: []dns.Question{
-				{Name: "ip4.newdns.256dpi.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+				{Name: "newdns.256dpi.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
 			},
 			Answer: []dns.RR{
 				&dns.A{
 					Hdr: dns.RR_Header{
-						Name:     "ip4.newdns.256dpi.com.",
+						Name:     "newdns.256dpi.com.",
 						Rrtype:   dns.TypeA,
 						Class:    dns.ClassINET,
 						Ttl:      300,
@@ -749,93 +2746,107 @@ func conformanceTests(t *testing.T, proto, addr string, local bool) {
 				},
 			},
 			Ns: nsRRs,
-		}, ret)
-	})
-
-	t.Run("SubAAAA", func(t *testing.T) {
-		ret, err := Query(proto, addr, "ip6.newdns.256dpi.com.", "AAAA", nil)
-		assert.NoError(t, err)
-		equalJSON(t, &dns.Msg{
-			MsgHdr: dns.MsgHdr{
-				Response:      true,
-				Authoritative: true,
-			},
-			Question: []dns.Question{
-				{Name: "ip6.newdns.256dpi.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET},
-			},
-			Answer: []dns.RR{
-				&dns.AAAA{
+			Extra: []dns.RR{
+				&dns.OPT{
 					Hdr: dns.RR_Header{
-						Name:     "ip6.newdns.256dpi.com.",
-						Rrtype:   dns.TypeAAAA,
-						Class:    dns.ClassINET,
-						Ttl:      300,
-						Rdlength: 16,
+						Name:     ".",
+						Rrtype:   dns.TypeOPT,
+						Class:    4096,
+						Ttl:      0,
+						Rdlength: 0,
 					},
-					AAAA: net.ParseIP("1:2:3:4::"),
 				},
 			},
-			Ns: nsRRs,
 		}, ret)
 	})
 
-	t.Run("SubCNAME", func(t *testing.T) {
-		ret, err := Query(proto, addr, "example.newdns.256dpi.com.", "CNAME", nil)
+	t.Run("EDNSError", func(t *testing.T) {
+		ret, err := Query(proto, addr, "missing.newdns.256dpi.com.", "A", func(msg *dns.Msg) {
+			msg.SetEdns0(1337, false)
+		})
 		assert.NoError(t, err)
 		equalJSON(t, &dns.Msg{
 			MsgHdr: dns.MsgHdr{
 				Response:      true,
 				Authoritative: true,
+				Rcode:         dns.RcodeNameError,
 			},
 			Question: []dns.Question{
-				{Name: "example.newdns.256dpi.com.", Qtype: dns.TypeCNAME, Qclass: dns.ClassINET},
+				{Name: "missing.newdns.256dpi.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
 			},
-			Answer: []dns.RR{
-				&dns.CNAME{
+			Ns: []dns.RR{
+				&dns.SOA{
 					Hdr: dns.RR_Header{
-						Name:     "example.newdns.256dpi.com.",
-						Rrtype:   dns.TypeCNAME,
+						Name:     "newdns.256dpi.com.",
+						Rrtype:   dns.TypeSOA,
 						Class:    dns.ClassINET,
-						Ttl:      300,
-						Rdlength: 10,
+						Ttl:      900,
+						Rdlength: 66,
+					},
+					Ns:      awsPrimaryNS,
+					Mbox:    "awsdns-hostmaster.amazon.com.",
+					Serial:  1,
+					Refresh: 7200,
+					Retry:   900,
+					Expire:  1209600,
+					Minttl:  300,
+				},
+			},
+			Extra: []dns.RR{
+				&dns.OPT{
+					Hdr: dns.RR_Header{
+						Name:     ".",
+						Rrtype:   dns.TypeOPT,
+						Class:    4096,
+						Ttl:      0,
+						Rdlength: 0,
 					},
-					Target: "example.com.",
 				},
 			},
-			Ns: nsRRs,
 		}, ret)
 	})
 
-	t.Run("SubMX", func(t *testing.T) {
-		ret, err := Query(proto, addr, "mail.newdns.256dpi.com.", "MX", nil)
+	t.Run("EDNSBadVersion", func(t *testing.T) {
+		ret, err := Query(proto, addr, "newdns.256dpi.com.", "A", func(msg *dns.Msg) {
+			msg.SetEdns0(1337, false)
+			msg.Extra[0].(*dns.OPT).SetVersion(2)
+		})
 		assert.NoError(t, err)
 		equalJSON(t, &dns.Msg{
 			MsgHdr: dns.MsgHdr{
 				Response:      true,
 				Authoritative: true,
+				Rcode:         dns.RcodeBadVers,
 			},
 			Question: []dns.Question{
-				{Name: "mail.newdns.256dpi.com.", Qtype: dns.TypeMX, Qclass: dns.ClassINET},
+				{Name: "newdns.256dpi.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
 			},
-			Answer: []dns.RR{
-				&dns.MX{
+			Extra: []dns.RR{
+				&dns.OPT{
 					Hdr: dns.RR_Header{
-						Name:     "mail.newdns.256dpi.com.",
-						Rrtype:   dns.TypeMX,
-						Class:    dns.ClassINET,
-						Ttl:      300,
-						Rdlength: 17,
+						Name:     ".",
+						Rrtype:   dns.TypeOPT,
+						Class:    4096,
+						Ttl:      ret.Extra[0].Header().Ttl, // see below
+						Rdlength: 0,
 					},
-					Mx:         "mail.example.com.",
-					Preference: 7,
 				},
 			},
-			Ns: nsRRs,
 		}, ret)
+
+		// the AWS servers sometimes return a bit-flipped TTL value
+		ttl := ret.Extra[0].Header().Ttl
+		if !local {
+			assert.True(t, ttl == 0x1008000 || ttl == 0x1000000, ttl)
+		} else {
+			assert.Equal(t, uint32(dns.RcodeBadVers<<20), ttl)
+		}
 	})
 
-	t.Run("SubMultiMX", func(t *testing.T) {
-		ret, err := Query(proto, addr, "multimail.newdns.256dpi.com.", "MX", nil)
+	t.Run("EDNSLongResponse", func(t *testing.T) {
+		ret, err := Query(proto, addr, "long.newdns.256dpi.com.", "TXT", func(msg *dns.Msg) {
+			msg.SetEdns0(1337, false)
+		})
 		assert.NoError(t, err)
 		equalJSON(t, &dns.Msg{
 			MsgHdr: dns.MsgHdr{
@@ -843,153 +2854,79 @@ func conformanceTests(t *testing.T, proto, addr string, local bool) {
 				Authoritative: true,
 			},
 			Question: []dns.Question{
-				{Name: "multimail.newdns.256dpi.com.", Qtype: dns.TypeMX, Qclass: dns.ClassINET},
+				{Name: "long.newdns.256dpi.com.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET},
 			},
 			Answer: []dns.RR{
-				&dns.MX{
+				&dns.TXT{
 					Hdr: dns.RR_Header{
-						Name:     "multimail.newdns.256dpi.com.",
-						Rrtype:   dns.TypeMX,
+						Name:     "long.newdns.256dpi.com.",
+						Rrtype:   dns.TypeTXT,
 						Class:    dns.ClassINET,
 						Ttl:      300,
-						Rdlength: 18,
+						Rdlength: 256,
 					},
-					Mx:         "mail1.example.com.",
-					Preference: 1,
-				},
-				&dns.MX{
-					Hdr: dns.RR_Header{
-						Name:     "multimail.newdns.256dpi.com.",
-						Rrtype:   dns.TypeMX,
-						Class:    dns.ClassINET,
-						Ttl:      300,
-						Rdlength: 10,
+					Txt: []string{
+						"gyK4oL9X8Zn3b6TwmUIYAgQx43rBOWMqJWR3wGMGNaZgajnhd2u9JaIbGwNo6gzZunyKYRxID3mKLmYUCcIrNYuo8R4UkijZeshwqEAM2EWnjNsB1hJHOlu6VyRKW13rsFUJedOSqc7YjjUoxm9c3mF28tEXmc3GVsC476wJ2ciSbp7ujDjQ032SQRD6kpayzFX8GncS5KXP8mLK2ZIqK2U4fUmYEpTPQMmp7w24GKkfGJzE4JfMBxSybDUScLq",
 					},
-					Mx:         "mail2.example.com.",
-					Preference: 10,
 				},
-				&dns.MX{
+				&dns.TXT{
 					Hdr: dns.RR_Header{
-						Name:     "multimail.newdns.256dpi.com.",
-						Rrtype:   dns.TypeMX,
+						Name:     "long.newdns.256dpi.com.",
+						Rrtype:   dns.TypeTXT,
 						Class:    dns.ClassINET,
 						Ttl:      300,
-						Rdlength: 10,
+						Rdlength: 256,
+					},
+					Txt: []string{
+						"upNh05zi9flqN2puI9eIGgAgl3gwc65l3WjFdnE3u55dhyUyIoKbOlc1mQJPULPkn1V5TTG9rLBB8AzNfeL8jvwO8h0mzmJhPH8n6dkgI546jB8Z0g0MRJxN5VNSixjFjdR8vtUp6EWlVi7QSe9SYInghV0M17zZ8mXSHwTfYZaPH54ng22mSWzVbRX2tlUPLTNRB5CHrEtxliyhhQlRey98P5G0eo35FUXdqzOSJ3HGqDssBWQAxK3I9feOjbE",
 					},
-					Mx:         "mail3.example.com.",
-					Preference: 10,
 				},
-			},
-			Ns: nsRRs,
-		}, ret)
-	})
-
-	t.Run("SubTXT", func(t *testing.T) {
-		ret, err := Query(proto, addr, "text.newdns.256dpi.com.", "TXT", nil)
-		assert.NoError(t, err)
-		equalJSON(t, &dns.Msg{
-			MsgHdr: dns.MsgHdr{
-				Response:      true,
-				Authoritative: true,
-			},
-			Question: []dns.Question{
-				{Name: "text.newdns.256dpi.com.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET},
-			},
-			Answer: []dns.RR{
 				&dns.TXT{
 					Hdr: dns.RR_Header{
-						Name:     "text.newdns.256dpi.com.",
+						Name:     "long.newdns.256dpi.com.",
 						Rrtype:   dns.TypeTXT,
 						Class:    dns.ClassINET,
 						Ttl:      300,
-						Rdlength: 8,
+						Rdlength: 256,
 					},
-					Txt: []string{"foo", "bar"},
-				},
-			},
-			Ns: nsRRs,
-		}, ret)
-	})
-
-	t.Run("SubCNAMEForA", func(t *testing.T) {
-		ret, err := Query(proto, addr, "example.newdns.256dpi.com.", "A", nil)
-		assert.NoError(t, err)
-		equalJSON(t, &dns.Msg{
-			MsgHdr: dns.MsgHdr{
-				Response:      true,
-				Authoritative: true,
-			},
-			Question: []dns.Question{
-				{Name: "example.newdns.256dpi.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
-			},
-			Answer: []dns.RR{
-				&dns.CNAME{
-					Hdr: dns.RR_Header{
-						Name:     "example.newdns.256dpi.com.",
-						Rrtype:   dns.TypeCNAME,
-						Class:    dns.ClassINET,
-						Ttl:      300,
-						Rdlength: 10,
+					Txt: []string{
+						"z4e6ycRMp6MP3WvWQMxIAOXglxANbj3oB0xD8BffktO4eo3VCR0s6TyGHKixvarOFJU0fqNkXeFOeI7sTXH5X0iXZukfLgnGTxLXNC7KkVFwtVFsh1P0IUNXtNBlOVWrVbxkS62ezbLpENNkiBwbkCvcTjwF2kyI0curAt9JhhJFb3AAq0q1iHWlJLn1KSrev9PIsY3alndDKjYTPxAojxzGKdK3A7rWLJ8Uzb3Z5OhLwP7jTKqbWVUocJRFLYp",
 					},
-					Target: "example.com.",
 				},
 			},
 			Ns: nsRRs,
-		}, ret)
-	})
-
-	t.Run("SubCNAMEForAAAA", func(t *testing.T) {
-		ret, err := Query(proto, addr, "example.newdns.256dpi.com.", "AAAA", nil)
-		assert.NoError(t, err)
-		equalJSON(t, &dns.Msg{
-			MsgHdr: dns.MsgHdr{
-				Response:      true,
-				Authoritative: true,
-			},
-			Question: []dns.Question{
-				{Name: "example.newdns.256dpi.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET},
-			},
-			Answer: []dns.RR{
-				&dns.CNAME{
+			Extra: []dns.RR{
+				&dns.OPT{
 					Hdr: dns.RR_Header{
-						Name:     "example.newdns.256dpi.com.",
-						Rrtype:   dns.TypeCNAME,
-						Class:    dns.ClassINET,
-						Ttl:      300,
-						Rdlength: 10,
+						Name:     ".",
+						Rrtype:   dns.TypeOPT,
+						Class:    4096,
+						Ttl:      0,
+						Rdlength: 0,
 					},
-					Target: "example.com.",
 				},
 			},
-			Ns: nsRRs,
 		}, ret)
 	})
 
-	t.Run("SubCNAMEForAWithA", func(t *testing.T) {
-		ret, err := Query(proto, addr, "ref4.newdns.256dpi.com.", "A", nil)
+	t.Run("RecursionDesired", func(t *testing.T) {
+		ret, err := Query(proto, addr, "newdns.256dpi.com.", "A", func(msg *dns.Msg) {
+			msg.RecursionDesired = true
+		})
 		assert.NoError(t, err)
 		equalJSON(t, &dns.Msg{
 			MsgHdr: dns.MsgHdr{
-				Response:      true,
-				Authoritative: true,
+				Response:         true,
+				Authoritative:    true,
+				RecursionDesired: true,
 			},
 			Question: []dns.Question{
-				{Name: "ref4.newdns.256dpi.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+				{Name: "newdns.256dpi.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
 			},
 			Answer: []dns.RR{
-				&dns.CNAME{
-					Hdr: dns.RR_Header{
-						Name:     "ref4.newdns.256dpi.com.",
-						Rrtype:   dns.TypeCNAME,
-						Class:    dns.ClassINET,
-						Ttl:      300,
-						Rdlength: 6,
-					},
-					Target: "ip4.newdns.256dpi.com.",
-				},
 				&dns.A{
 					Hdr: dns.RR_Header{
-						Name:     "ip4.newdns.256dpi.com.",
+						Name:     "newdns.256dpi.com.",
 						Rrtype:   dns.TypeA,
 						Class:    dns.ClassINET,
 						Ttl:      300,
@@ -1002,45 +2939,67 @@ func conformanceTests(t *testing.T, proto, addr string, local bool) {
 		}, ret)
 	})
 
-	t.Run("SubCNAMEForAAAAWithAAAA", func(t *testing.T) {
-		ret, err := Query(proto, addr, "ref6.newdns.256dpi.com.", "AAAA", nil)
-		assert.NoError(t, err)
-		equalJSON(t, &dns.Msg{
-			MsgHdr: dns.MsgHdr{
-				Response:      true,
-				Authoritative: true,
-			},
-			Question: []dns.Question{
-				{Name: "ref6.newdns.256dpi.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET},
-			},
-			Answer: []dns.RR{
-				&dns.CNAME{
+	t.Run("UnsupportedMessage", func(t *testing.T) {
+		_, err := Query(proto, addr, "newdns.256dpi.com.", "A", func(msg *dns.Msg) {
+			msg.Response = true
+		})
+		assert.True(t, isIOError(err), err)
+	})
+
+	t.Run("UnsupportedOpcode", func(t *testing.T) {
+		_, err := Query(proto, addr, "newdns.256dpi.com.", "A", func(msg *dns.Msg) {
+			msg.Opcode = dns.OpcodeNotify
+		})
+		assert.True(t, isIOError(err), err)
+	})
+
+	t.Run("UnsupportedClass", func(t *testing.T) {
+		_, err := Query(proto, addr, "newdns.256dpi.com.", "A", func(msg *dns.Msg) {
+			msg.Question[0].Qclass = dns.ClassANY
+		})
+		assert.True(t, isIOError(err), err)
+	})
+
+	t.Run("IgnorePayload", func(t *testing.T) {
+		ret, err := Query(proto, addr, "newdns.256dpi.com.", "A", func(msg *dns.Msg) {
+			msg.Answer = []dns.RR{
+				&dns.A{
 					Hdr: dns.RR_Header{
-						Name:     "ref6.newdns.256dpi.com.",
-						Rrtype:   dns.TypeCNAME,
+						Name:     "newdns.256dpi.com.",
+						Rrtype:   dns.TypeA,
 						Class:    dns.ClassINET,
 						Ttl:      300,
-						Rdlength: 6,
+						Rdlength: 4,
 					},
-					Target: "ip6.newdns.256dpi.com.",
+					A: net.ParseIP("1.2.3.4"),
 				},
 				&dns.AAAA{
 					Hdr: dns.RR_Header{
-						Name:     "ip6.newdns.256dpi.com.",
+						Name:     "newdns.256dpi.com.",
 						Rrtype:   dns.TypeAAAA,
 						Class:    dns.ClassINET,
 						Ttl:      300,
-						Rdlength: 16,
+						Rdlength: 4,
 					},
 					AAAA: net.ParseIP("1:2:3:4::"),
 				},
-			},
-			Ns: nsRRs,
-		}, ret)
-	})
-
-	t.Run("SubCNAMEWithoutA", func(t *testing.T) {
-		ret, err := Query(proto, addr, "ref4.newdns.256dpi.com.", "CNAME", nil)
+			}
+			msg.Ns = []dns.RR{
+				nsRRs[0],
+			}
+			msg.Extra = []dns.RR{
+				&dns.TXT{
+					Hdr: dns.RR_Header{
+						Name:     "newdns.256dpi.com.",
+						Rrtype:   dns.TypeTXT,
+						Class:    dns.ClassINET,
+						Ttl:      300,
+						Rdlength: 4,
+					},
+					Txt: []string{"baz"},
+				},
+			}
+		})
 		assert.NoError(t, err)
 		equalJSON(t, &dns.Msg{
 			MsgHdr: dns.MsgHdr{
@@ -1048,871 +3007,1333 @@ func conformanceTests(t *testing.T, proto, addr string, local bool) {
 				Authoritative: true,
 			},
 			Question: []dns.Question{
-				{Name: "ref4.newdns.256dpi.com.", Qtype: dns.TypeCNAME, Qclass: dns.ClassINET},
+				{Name: "newdns.256dpi.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
 			},
 			Answer: []dns.RR{
-				&dns.CNAME{
+				&dns.A{
 					Hdr: dns.RR_Header{
-						Name:     "ref4.newdns.256dpi.com.",
-						Rrtype:   dns.TypeCNAME,
+						Name:     "newdns.256dpi.com.",
+						Rrtype:   dns.TypeA,
 						Class:    dns.ClassINET,
 						Ttl:      300,
-						Rdlength: 6,
+						Rdlength: 4,
 					},
-					Target: "ip4.newdns.256dpi.com.",
+					A: net.ParseIP("1.2.3.4"),
 				},
 			},
 			Ns: nsRRs,
 		}, ret)
 	})
 
-	t.Run("SubCNAMEWithoutAAAA", func(t *testing.T) {
-		ret, err := Query(proto, addr, "ref6.newdns.256dpi.com.", "CNAME", nil)
+	t.Run("MultipleQuestions", func(t *testing.T) {
+		_, err := Query(proto, addr, "newdns.256dpi.com.", "A", func(msg *dns.Msg) {
+			msg.Question = append(msg.Question, dns.Question{
+				Name:   "newdns.256dpi.com.",
+				Qtype:  dns.TypeA,
+				Qclass: dns.ClassINET,
+			})
+		})
+		assert.True(t, isIOError(err), err)
+	})
+
+	t.Run("UnsupportedType", func(t *testing.T) {
+		assertMissing(t, proto, addr, "missing.newdns.256dpi.com.", "NULL", dns.RcodeNameError)
+	})
+
+	t.Run("NonAuthoritativeZone", func(t *testing.T) {
+		ret, err := Query(proto, addr, "foo.256dpi.com.", "A", nil)
 		assert.NoError(t, err)
 		equalJSON(t, &dns.Msg{
 			MsgHdr: dns.MsgHdr{
 				Response:      true,
-				Authoritative: true,
+				Authoritative: false,
+				Rcode:         dns.RcodeRefused,
 			},
 			Question: []dns.Question{
-				{Name: "ref6.newdns.256dpi.com.", Qtype: dns.TypeCNAME, Qclass: dns.ClassINET},
-			},
-			Answer: []dns.RR{
-				&dns.CNAME{
-					Hdr: dns.RR_Header{
-						Name:     "ref6.newdns.256dpi.com.",
-						Rrtype:   dns.TypeCNAME,
-						Class:    dns.ClassINET,
-						Ttl:      300,
-						Rdlength: 6,
-					},
-					Target: "ip6.newdns.256dpi.com.",
-				},
+				{Name: "foo.256dpi.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
 			},
-			Ns: nsRRs,
 		}, ret)
 	})
+}
 
-	t.Run("SubCNAMEForCNAMEForAWithA", func(t *testing.T) {
-		ret, err := Query(proto, addr, "refref.newdns.256dpi.com.", "A", nil)
+func additionalTests(t *testing.T, proto, addr string) {
+	t.Run("UnsupportedAny", func(t *testing.T) {
+		ret, err := Query(proto, addr, "newdns.256dpi.com.", "ANY", nil)
 		assert.NoError(t, err)
 		equalJSON(t, &dns.Msg{
 			MsgHdr: dns.MsgHdr{
 				Response:      true,
 				Authoritative: true,
+				Rcode:         dns.RcodeNotImplemented,
 			},
 			Question: []dns.Question{
-				{Name: "refref.newdns.256dpi.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+				{Name: "newdns.256dpi.com.", Qtype: dns.TypeANY, Qclass: dns.ClassINET},
 			},
-			Answer: []dns.RR{
-				&dns.CNAME{
-					Hdr: dns.RR_Header{
-						Name:     "refref.newdns.256dpi.com.",
-						Rrtype:   dns.TypeCNAME,
-						Class:    dns.ClassINET,
-						Ttl:      300,
-						Rdlength: 7,
-					},
-					Target: "ref4.newdns.256dpi.com.",
-				},
-				&dns.CNAME{
-					Hdr: dns.RR_Header{
-						Name:     "ref4.newdns.256dpi.com.",
-						Rrtype:   dns.TypeCNAME,
-						Class:    dns.ClassINET,
-						Ttl:      300,
-						Rdlength: 6,
-					},
-					Target: "ip4.newdns.256dpi.com.",
-				},
-				&dns.A{
-					Hdr: dns.RR_Header{
-						Name:     "ip4.newdns.256dpi.com.",
-						Rrtype:   dns.TypeA,
-						Class:    dns.ClassINET,
-						Ttl:      300,
-						Rdlength: 4,
-					},
-					A: net.ParseIP("1.2.3.4"),
+		}, ret)
+	})
+}
+
+func assertMissing(t *testing.T, proto, addr, name, typ string, code int) {
+	qt := dns.StringToType[typ]
+
+	ret, err := Query(proto, addr, name, typ, nil)
+	assert.NoError(t, err)
+	equalJSON(t, &dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Response:      true,
+			Authoritative: true,
+			Rcode:         code,
+		},
+		Question: []dns.Question{
+			{Name: name, Qtype: qt, Qclass: dns.ClassINET},
+		},
+		Ns: []dns.RR{
+			&dns.SOA{
+				Hdr: dns.RR_Header{
+					Name:     "newdns.256dpi.com.",
+					Rrtype:   dns.TypeSOA,
+					Class:    dns.ClassINET,
+					Ttl:      900,
+					Rdlength: 66,
 				},
+				Ns:      awsPrimaryNS,
+				Mbox:    "awsdns-hostmaster.amazon.com.",
+				Serial:  1,
+				Refresh: 7200,
+				Retry:   900,
+				Expire:  1209600,
+				Minttl:  300,
 			},
-			Ns: nsRRs,
-		}, ret)
+		},
+	}, ret)
+}
+
+func resolverTests(t *testing.T, fallback string) {
+	var dialer net.Dialer
+
+	resolver := net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (conn net.Conn, err error) {
+			return dialer.DialContext(ctx, network, fallback)
+		},
+	}
+
+	ctx := context.Background()
+
+	t.Run("LookupHost", func(t *testing.T) {
+		addrs, err := resolver.LookupHost(ctx, "newdns.256dpi.com")
+		assert.NoError(t, err)
+		sort.Strings(addrs)
+		assert.Equal(t, []string{"1.2.3.4", "1:2:3:4::"}, addrs)
+	})
+
+	t.Run("LookupCNAME", func(t *testing.T) {
+		cname, err := resolver.LookupCNAME(ctx, "ref4.newdns.256dpi.com")
+		assert.NoError(t, err)
+		assert.Equal(t, "ip4.newdns.256dpi.com.", cname)
+	})
+
+	t.Run("LookupTXT", func(t *testing.T) {
+		txt, err := resolver.LookupTXT(ctx, "newdns.256dpi.com")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"baz", "foobar"}, txt)
 	})
 
-	t.Run("SubAAAAForCNAMEToA", func(t *testing.T) {
-		ret, err := Query(proto, addr, "ref4.newdns.256dpi.com.", "AAAA", nil)
+	t.Run("LookupMX", func(t *testing.T) {
+		mx, err := resolver.LookupMX(ctx, "ref4m.newdns.256dpi.com")
 		assert.NoError(t, err)
-		equalJSON(t, &dns.Msg{
-			MsgHdr: dns.MsgHdr{
-				Response:      true,
-				Authoritative: true,
-			},
-			Question: []dns.Question{
-				{Name: "ref4.newdns.256dpi.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET},
-			},
-			Answer: []dns.RR{
-				&dns.CNAME{
-					Hdr: dns.RR_Header{
-						Name:     "ref4.newdns.256dpi.com.",
-						Rrtype:   dns.TypeCNAME,
-						Class:    dns.ClassINET,
-						Ttl:      300,
-						Rdlength: 6,
-					},
-					Target: "ip4.newdns.256dpi.com.",
-				},
-			},
-			Ns: nsRRs,
-		}, ret)
+		assert.Equal(t, []*net.MX{
+			{Host: "ip4.newdns.256dpi.com.", Pref: 7},
+		}, mx)
 	})
 
-	t.Run("SubAForCNAMEToAAAA", func(t *testing.T) {
-		ret, err := Query(proto, addr, "ref6.newdns.256dpi.com.", "A", nil)
-		assert.NoError(t, err)
-		equalJSON(t, &dns.Msg{
-			MsgHdr: dns.MsgHdr{
-				Response:      true,
-				Authoritative: true,
-			},
-			Question: []dns.Question{
-				{Name: "ref6.newdns.256dpi.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
-			},
-			Answer: []dns.RR{
-				&dns.CNAME{
-					Hdr: dns.RR_Header{
-						Name:     "ref6.newdns.256dpi.com.",
-						Rrtype:   dns.TypeCNAME,
-						Class:    dns.ClassINET,
-						Ttl:      300,
-						Rdlength: 6,
-					},
-					Target: "ip6.newdns.256dpi.com.",
-				},
-			},
-			Ns: nsRRs,
-		}, ret)
+	t.Run("LookupNS", func(t *testing.T) {
+		ns, err := resolver.LookupNS(ctx, "other.newdns.256dpi.com")
+		assert.Error(t, err) // zone is not served by server
+		assert.Nil(t, ns)
 	})
+}
 
-	t.Run("SubSRVForCNAME", func(t *testing.T) {
-		ret, err := Query(proto, addr, "ref4.newdns.256dpi.com.", "SRV", nil)
+func TestServerRequestID(t *testing.T) {
+	var mutex sync.Mutex
+	var handlerIDs []uint64
+	var entries []Entry
+
+	zone := testZone(func(ctx context.Context, name string) ([]Set, error) {
+		mutex.Lock()
+		handlerIDs = append(handlerIDs, RequestID(ctx))
+		mutex.Unlock()
+		return nil, nil
+	})
+
+	server := NewServer(Config{
+		Handler: testHandler(zone),
+		Logger: LoggerFunc(func(entry Entry) {
+			mutex.Lock()
+			entries = append(entries, entry)
+			mutex.Unlock()
+		}),
+	})
+
+	run(server, "127.0.0.1:0", func() {
+		addr := server.Addr().String()
+
+		_, err := Query("udp", addr, "foo.example.com.", "A", nil)
 		assert.NoError(t, err)
-		equalJSON(t, &dns.Msg{
-			MsgHdr: dns.MsgHdr{
-				Response:      true,
-				Authoritative: true,
-			},
-			Question: []dns.Question{
-				{Name: "ref4.newdns.256dpi.com.", Qtype: dns.TypeSRV, Qclass: dns.ClassINET},
-			},
-			Answer: []dns.RR{
-				&dns.CNAME{
-					Hdr: dns.RR_Header{
-						Name:     "ref4.newdns.256dpi.com.",
-						Rrtype:   dns.TypeCNAME,
-						Class:    dns.ClassINET,
-						Ttl:      300,
-						Rdlength: 6,
+
+		_, err = Query("udp", addr, "bar.example.com.", "A", nil)
+		assert.NoError(t, err)
+
+		time.Sleep(10 * time.Millisecond)
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		assert.Len(t, handlerIDs, 2)
+		assert.NotZero(t, handlerIDs[0])
+		assert.NotZero(t, handlerIDs[1])
+		assert.NotEqual(t, handlerIDs[0], handlerIDs[1])
+
+		counts := map[uint64]int{}
+		for _, entry := range entries {
+			assert.NotZero(t, entry.RequestID)
+			counts[entry.RequestID]++
+		}
+		assert.Equal(t, 3, counts[handlerIDs[0]])
+		assert.Equal(t, 3, counts[handlerIDs[1]])
+	})
+
+	assert.Zero(t, RequestID(context.Background()))
+}
+
+func TestServerCounters(t *testing.T) {
+	zone := testZone(func(ctx context.Context, name string) ([]Set, error) {
+		if name == "foo" {
+			return []Set{
+				{
+					Name: "foo.example.com.",
+					Type: A,
+					Records: []Record{
+						{Address: "1.2.3.4"},
 					},
-					Target: "ip4.newdns.256dpi.com.",
 				},
-			},
-			Ns: nsRRs,
-		}, ret)
+			}, nil
+		}
+
+		return nil, nil
 	})
 
-	t.Run("SubMXWithExtraA", func(t *testing.T) {
-		ret, err := Query(proto, addr, "ref4m.newdns.256dpi.com.", "MX", nil)
+	server := NewServer(Config{
+		Handler: testHandler(zone),
+	})
+
+	run(server, "127.0.0.1:0", func() {
+		addr := server.Addr().String()
+
+		_, err := Query("udp", addr, "foo.example.com.", "A", nil)
 		assert.NoError(t, err)
-		equalJSON(t, &dns.Msg{
-			MsgHdr: dns.MsgHdr{
-				Response:      true,
-				Authoritative: true,
+
+		_, err = Query("udp", addr, "foo.example.com.", "AAAA", nil)
+		assert.NoError(t, err)
+
+		_, err = Query("udp", addr, "bar.example.com.", "A", nil)
+		assert.NoError(t, err)
+
+		time.Sleep(10 * time.Millisecond)
+
+		assert.Equal(t, Counters{
+			Queries: 3,
+			Rcodes: map[string]uint64{
+				"NOERROR":  2,
+				"NXDOMAIN": 1,
 			},
-			Question: []dns.Question{
-				{Name: "ref4m.newdns.256dpi.com.", Qtype: dns.TypeMX, Qclass: dns.ClassINET},
+			Types: map[string]uint64{
+				"A":    2,
+				"AAAA": 1,
 			},
-			Answer: []dns.RR{
-				&dns.MX{
-					Hdr: dns.RR_Header{
-						Name:     "ref4m.newdns.256dpi.com.",
-						Rrtype:   dns.TypeMX,
-						Class:    dns.ClassINET,
-						Ttl:      300,
-						Rdlength: 8,
-					},
-					Preference: 7,
-					Mx:         "ip4.newdns.256dpi.com.",
+		}, server.Counters())
+	})
+}
+
+func TestServerErrorKinds(t *testing.T) {
+	backendErr := errors.New("backend")
+
+	zone := testZone(func(ctx context.Context, name string) ([]Set, error) {
+		if name == "invalid" {
+			return []Set{
+				{
+					Name: "invalid.example.com.",
+					Type: A,
 				},
-			},
-			Extra: []dns.RR{
-				&dns.A{
-					Hdr: dns.RR_Header{
-						Name:     "ip4.newdns.256dpi.com.",
-						Rrtype:   dns.TypeA,
-						Class:    dns.ClassINET,
-						Ttl:      300,
-						Rdlength: 4,
+			}, nil
+		}
+
+		return nil, backendErr
+	})
+
+	var mutex sync.Mutex
+	var errs []error
+
+	server := NewServer(Config{
+		Handler: testHandler(zone),
+		Logger: LoggerFunc(func(entry Entry) {
+			if entry.Error != nil {
+				mutex.Lock()
+				errs = append(errs, entry.Error)
+				mutex.Unlock()
+			}
+		}),
+	})
+
+	run(server, "127.0.0.1:0", func() {
+		addr := server.Addr().String()
+
+		for _, name := range []string{"foo.example.com.", "invalid.example.com.", "foo.example.net."} {
+			_, err := Query("udp", addr, name, "A", nil)
+			assert.NoError(t, err)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		assert.Len(t, errs, 3)
+
+		assert.True(t, errors.Is(errs[0], ErrHandler))
+		assert.True(t, errors.Is(errs[0], backendErr))
+		assert.False(t, errors.Is(errs[0], ErrValidation))
+
+		assert.True(t, errors.Is(errs[1], ErrValidation))
+		assert.False(t, errors.Is(errs[1], ErrHandler))
+
+		assert.True(t, errors.Is(errs[2], ErrRefused))
+		assert.Equal(t, "no zone", errs[2].Error())
+	})
+}
+
+func TestServerResponseCache(t *testing.T) {
+	var mutex sync.Mutex
+	var calls int
+
+	zone := testZone(func(ctx context.Context, name string) ([]Set, error) {
+		mutex.Lock()
+		calls++
+		mutex.Unlock()
+
+		if name == "foo" {
+			return []Set{
+				{
+					Name: "foo.example.com.",
+					Type: A,
+					Records: []Record{
+						{Address: "1.2.3.4"},
 					},
-					A: net.ParseIP("1.2.3.4"),
 				},
-			},
-			Ns: nsRRs,
-		}, ret)
+			}, nil
+		}
+
+		return nil, nil
 	})
 
-	t.Run("SubMXWithExtraAAAA", func(t *testing.T) {
-		ret, err := Query(proto, addr, "ref6m.newdns.256dpi.com.", "MX", nil)
+	server := NewServer(Config{
+		Handler:           testHandler(zone),
+		ResponseCacheSize: 10,
+	})
+
+	run(server, "127.0.0.1:0", func() {
+		addr := server.Addr().String()
+
+		var rets []*dns.Msg
+		for i := 0; i < 3; i++ {
+			ret, err := Query("udp", addr, "foo.example.com.", "A", nil)
+			assert.NoError(t, err)
+			rets = append(rets, ret)
+
+			ret, err = Query("udp", addr, "bar.example.com.", "A", nil)
+			assert.NoError(t, err)
+			assert.Equal(t, dns.RcodeNameError, ret.Rcode)
+		}
+
+		assert.Equal(t, rets[0].Answer, rets[2].Answer)
+		assert.Equal(t, rets[0].Ns, rets[2].Ns)
+
+		time.Sleep(10 * time.Millisecond)
+
+		mutex.Lock()
+		assert.Equal(t, 2, calls)
+		mutex.Unlock()
+
+		counters := server.Counters()
+		assert.Equal(t, uint64(6), counters.Queries)
+		assert.Equal(t, uint64(3), counters.Rcodes["NOERROR"])
+		assert.Equal(t, uint64(3), counters.Rcodes["NXDOMAIN"])
+
+		server.PurgeResponses("example.com.")
+
+		_, err := Query("udp", addr, "foo.example.com.", "A", nil)
 		assert.NoError(t, err)
-		equalJSON(t, &dns.Msg{
-			MsgHdr: dns.MsgHdr{
-				Response:      true,
-				Authoritative: true,
-			},
-			Question: []dns.Question{
-				{Name: "ref6m.newdns.256dpi.com.", Qtype: dns.TypeMX, Qclass: dns.ClassINET},
-			},
-			Answer: []dns.RR{
-				&dns.MX{
-					Hdr: dns.RR_Header{
-						Name:     "ref6m.newdns.256dpi.com.",
-						Rrtype:   dns.TypeMX,
-						Class:    dns.ClassINET,
-						Ttl:      300,
-						Rdlength: 8,
-					},
-					Preference: 7,
-					Mx:         "ip6.newdns.256dpi.com.",
-				},
+
+		mutex.Lock()
+		assert.Equal(t, 3, calls)
+		mutex.Unlock()
+	})
+}
+
+func TestServerOverload(t *testing.T) {
+	for _, policy := range []OverloadPolicy{OverloadRefuse, OverloadQueue} {
+		block := make(chan struct{})
+
+		zone := testZone(func(ctx context.Context, name string) ([]Set, error) {
+			if name == "slow" {
+				<-block
+			}
+			return nil, nil
+		})
+
+		server := NewServer(Config{
+			Handler:              testHandler(zone),
+			MaxConcurrentQueries: 1,
+			OverloadPolicy:       policy,
+		})
+
+		run(server, "127.0.0.1:0", func() {
+			addr := server.Addr().String()
+
+			done := make(chan struct{})
+			go func() {
+				ret, err := Query("udp", addr, "slow.example.com.", "A", nil)
+				assert.NoError(t, err)
+				assert.Equal(t, dns.RcodeNameError, ret.Rcode)
+				close(done)
+			}()
+
+			time.Sleep(10 * time.Millisecond)
+
+			if policy == OverloadQueue {
+				time.AfterFunc(50*time.Millisecond, func() {
+					close(block)
+				})
+			}
+
+			ret, err := Query("udp", addr, "fast.example.com.", "A", nil)
+			assert.NoError(t, err)
+			if policy == OverloadRefuse {
+				assert.Equal(t, dns.RcodeRefused, ret.Rcode)
+				close(block)
+			} else {
+				assert.Equal(t, dns.RcodeNameError, ret.Rcode)
+			}
+
+			<-done
+		})
+	}
+}
+
+func TestServerBatchHandler(t *testing.T) {
+	var mutex sync.Mutex
+	var calls [][]string
+
+	zone := &Zone{
+		Name:             "example.com.",
+		MasterNameServer: "ns1.example.com.",
+		AllNameServers: []string{
+			"ns1.example.com.",
+		},
+		BatchHandler: func(ctx context.Context, names []string) ([][]Set, error) {
+			mutex.Lock()
+			calls = append(calls, names)
+			mutex.Unlock()
+
+			list := make([][]Set, len(names))
+			for i, name := range names {
+				switch name {
+				case "":
+					list[i] = []Set{
+						{
+							Name: "example.com.",
+							Type: MX,
+							Records: []Record{
+								{Address: "mx1.example.com.", Priority: 1},
+								{Address: "mx2.example.com.", Priority: 2},
+							},
+						},
+					}
+				case "mx1", "mx2":
+					list[i] = []Set{
+						{
+							Name: name + ".example.com.",
+							Type: A,
+							Records: []Record{
+								{Address: "1.2.3.4"},
+							},
+						},
+					}
+				}
+			}
+
+			return list, nil
+		},
+	}
+
+	server := NewServer(Config{
+		Handler: testHandler(zone),
+	})
+
+	run(server, "127.0.0.1:0", func() {
+		addr := server.Addr().String()
+
+		ret, err := Query("udp", addr, "example.com.", "MX", nil)
+		assert.NoError(t, err)
+		assert.Len(t, ret.Answer, 2)
+		assert.Len(t, ret.Extra, 2)
+
+		mutex.Lock()
+		assert.Equal(t, [][]string{
+			{""},
+			{"mx1", "mx2"},
+		}, calls)
+		mutex.Unlock()
+	})
+}
+
+func TestServerQueryRate(t *testing.T) {
+	zone := testZone(nil)
+	zone.ClientQueryRate = 0.001
+	zone.ClientQueryBurst = 2
+
+	server := NewServer(Config{
+		Handler: testHandler(zone),
+	})
+
+	run(server, "127.0.0.1:0", func() {
+		addr := server.Addr().String()
+
+		for i := 0; i < 2; i++ {
+			ret, err := Query("udp", addr, "foo.example.com.", "A", nil)
+			assert.NoError(t, err)
+			assert.Equal(t, dns.RcodeNameError, ret.Rcode)
+		}
+
+		ret, err := Query("udp", addr, "foo.example.com.", "A", func(msg *dns.Msg) {
+			msg.SetEdns0(1232, false)
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, dns.RcodeRefused, ret.Rcode)
+		assert.Equal(t, []dns.EDNS0{
+			&dns.EDNS0_EDE{
+				InfoCode:  dns.ExtendedErrorCodeOther,
+				ExtraText: "query rate exceeded",
 			},
-			Extra: []dns.RR{
-				&dns.AAAA{
-					Hdr: dns.RR_Header{
-						Name:     "ip6.newdns.256dpi.com.",
-						Rrtype:   dns.TypeAAAA,
-						Class:    dns.ClassINET,
-						Ttl:      300,
-						Rdlength: 16,
+		}, ret.IsEdns0().Option)
+	})
+}
+
+func TestServerDelegation(t *testing.T) {
+	zone := testZone(func(ctx context.Context, name string) ([]Set, error) {
+		switch name {
+		case "sub":
+			return []Set{
+				{
+					Name: "sub.example.com.",
+					Type: NS,
+					Records: []Record{
+						{Address: "ns1.sub.example.com."},
+						{Address: "ns.other.com."},
 					},
-					AAAA: net.ParseIP("1:2:3:4::"),
 				},
-			},
-			Ns: nsRRs,
-		}, ret)
+			}, nil
+		case "ns1.sub":
+			return []Set{
+				{Name: "ns1.sub.example.com.", Type: A, Records: []Record{{Address: "1.2.3.4"}}},
+				{Name: "ns1.sub.example.com.", Type: AAAA, Records: []Record{{Address: "1:2:3:4::"}}},
+			}, nil
+		case "foo.sub":
+			return []Set{
+				{Name: "foo.sub.example.com.", Type: A, Records: []Record{{Address: "1.2.3.4"}}},
+			}, nil
+		}
+
+		return nil, nil
 	})
 
-	t.Run("SubNS", func(t *testing.T) {
-		ret, err := Query(proto, addr, "other.newdns.256dpi.com.", "NS", nil)
+	zone.Delegations = true
+
+	server := NewServer(Config{
+		Handler: testHandler(zone),
+	})
+
+	run(server, "127.0.0.1:0", func() {
+		addr := server.Addr().String()
+
+		for _, name := range []string{"sub.example.com.", "foo.sub.example.com.", "bar.foo.sub.example.com."} {
+			ret, err := Query("udp", addr, name, "A", nil)
+			assert.NoError(t, err)
+			assert.Equal(t, dns.RcodeSuccess, ret.Rcode, name)
+			assert.False(t, ret.Authoritative, name)
+			assert.Empty(t, ret.Answer, name)
+			assert.Len(t, ret.Ns, 2, name)
+			assert.Equal(t, dns.TypeNS, ret.Ns[0].Header().Rrtype, name)
+			assert.Equal(t, "sub.example.com.", ret.Ns[0].Header().Name, name)
+			assert.Len(t, ret.Extra, 2, name)
+			assert.Equal(t, dns.TypeA, ret.Extra[0].Header().Rrtype, name)
+			assert.Equal(t, dns.TypeAAAA, ret.Extra[1].Header().Rrtype, name)
+		}
+
+		ret, err := Query("udp", addr, "sub.example.com.", "DS", nil)
 		assert.NoError(t, err)
-		order(ret.Ns)
-		equalJSON(t, &dns.Msg{
-			MsgHdr: dns.MsgHdr{
-				Response:      true,
-				Authoritative: false,
-			},
-			Question: []dns.Question{
-				{Name: "other.newdns.256dpi.com.", Qtype: dns.TypeNS, Qclass: dns.ClassINET},
-			},
-			Ns: order(otherNSRRs),
-		}, ret)
+		assert.Equal(t, dns.RcodeSuccess, ret.Rcode)
+		assert.True(t, ret.Authoritative)
+		assert.Empty(t, ret.Answer)
+		assert.Equal(t, dns.TypeSOA, ret.Ns[0].Header().Rrtype)
+
+		ret, err = Query("udp", addr, "bar.example.com.", "A", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, dns.RcodeNameError, ret.Rcode)
+		assert.True(t, ret.Authoritative)
 	})
 
-	t.Run("NoExactRecord", func(t *testing.T) {
-		assertMissing(t, proto, addr, "ip4.newdns.256dpi.com.", "CNAME", dns.RcodeSuccess)
-		assertMissing(t, proto, addr, "ip6.newdns.256dpi.com.", "CNAME", dns.RcodeSuccess)
-		assertMissing(t, proto, addr, "ip4.newdns.256dpi.com.", "AAAA", dns.RcodeSuccess)
-		assertMissing(t, proto, addr, "ip6.newdns.256dpi.com.", "A", dns.RcodeSuccess)
-		assertMissing(t, proto, addr, "mail.newdns.256dpi.com.", "A", dns.RcodeSuccess)
-		assertMissing(t, proto, addr, "text.newdns.256dpi.com.", "A", dns.RcodeSuccess)
-		assertMissing(t, proto, addr, "ip4.newdns.256dpi.com.", "NS", dns.RcodeSuccess)
-		// unsupported types
-		assertMissing(t, proto, addr, "ip4.newdns.256dpi.com.", "SRV", dns.RcodeSuccess)
-		assertMissing(t, proto, addr, "ip6.newdns.256dpi.com.", "SRV", dns.RcodeSuccess)
-		assertMissing(t, proto, addr, "ip4.newdns.256dpi.com.", "PTR", dns.RcodeSuccess)
-		assertMissing(t, proto, addr, "ip6.newdns.256dpi.com.", "PTR", dns.RcodeSuccess)
+	plain := testZone(zone.Handler)
+
+	server = NewServer(Config{
+		Handler: testHandler(plain),
 	})
 
-	t.Run("NoExistingRecord", func(t *testing.T) {
-		assertMissing(t, proto, addr, "missing.newdns.256dpi.com.", "A", dns.RcodeNameError)
-		assertMissing(t, proto, addr, "missing.newdns.256dpi.com.", "AAAA", dns.RcodeNameError)
-		assertMissing(t, proto, addr, "missing.newdns.256dpi.com.", "CNAME", dns.RcodeNameError)
-		assertMissing(t, proto, addr, "missing.newdns.256dpi.com.", "MX", dns.RcodeNameError)
-		assertMissing(t, proto, addr, "missing.newdns.256dpi.com.", "TXT", dns.RcodeNameError)
-		assertMissing(t, proto, addr, "missing.newdns.256dpi.com.", "NS", dns.RcodeNameError)
-		// unsupported types
-		assertMissing(t, proto, addr, "missing.newdns.256dpi.com.", "SRV", dns.RcodeNameError)
-		assertMissing(t, proto, addr, "missing.newdns.256dpi.com.", "PTR", dns.RcodeNameError)
+	run(server, "127.0.0.1:0", func() {
+		addr := server.Addr().String()
+
+		ret, err := Query("udp", addr, "sub.example.com.", "NS", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, dns.RcodeSuccess, ret.Rcode)
+		assert.False(t, ret.Authoritative)
+		assert.Empty(t, ret.Answer)
+		assert.Len(t, ret.Ns, 2)
+		assert.Equal(t, "sub.example.com.", ret.Ns[0].Header().Name)
+
+		ret, err = Query("udp", addr, "foo.sub.example.com.", "A", nil)
+		assert.NoError(t, err)
+		assert.True(t, ret.Authoritative)
+		assert.Len(t, ret.Answer, 1)
+	})
+}
+
+func TestServerChaseCNAMEs(t *testing.T) {
+	com := testZone(func(ctx context.Context, name string) ([]Set, error) {
+		switch name {
+		case "foo":
+			return []Set{
+				{Name: "foo.example.com.", Type: CNAME, Records: []Record{{Address: "bar.example.org."}}},
+			}, nil
+		case "loop":
+			return []Set{
+				{Name: "loop.example.com.", Type: CNAME, Records: []Record{{Address: "loop.example.org."}}},
+			}, nil
+		}
+
+		return nil, nil
 	})
 
-	t.Run("TruncatedResponse", func(t *testing.T) {
-		ret, err := Query(proto, addr, "long.newdns.256dpi.com.", "TXT", nil)
+	org := &Zone{
+		Name:             "example.org.",
+		MasterNameServer: "ns1.example.org.",
+		AllNameServers: []string{
+			"ns1.example.org.",
+		},
+		Handler: func(ctx context.Context, name string) ([]Set, error) {
+			switch name {
+			case "bar":
+				return []Set{
+					{Name: "bar.example.org.", Type: A, Records: []Record{{Address: "1.2.3.4"}}},
+				}, nil
+			case "loop":
+				return []Set{
+					{Name: "loop.example.org.", Type: CNAME, Records: []Record{{Address: "loop.example.com."}}},
+				}, nil
+			}
+
+			return nil, nil
+		},
+	}
+
+	server := NewServer(Config{
+		ChaseCNAMEs: true,
+		Handler: func(ctx context.Context, name string) (*Zone, error) {
+			if InZone("example.com.", name) {
+				return com, nil
+			} else if InZone("example.org.", name) {
+				return org, nil
+			}
+
+			return nil, nil
+		},
+	})
+
+	run(server, "127.0.0.1:0", func() {
+		addr := server.Addr().String()
+
+		ret, err := Query("udp", addr, "foo.example.com.", "A", nil)
 		assert.NoError(t, err)
+		assert.Equal(t, dns.RcodeSuccess, ret.Rcode)
+		assert.Len(t, ret.Answer, 2)
+		assert.Equal(t, "bar.example.org.", ret.Answer[1].Header().Name)
+		assert.Equal(t, dns.TypeA, ret.Answer[1].Header().Rrtype)
 
-		if proto == "udp" {
-			equalJSON(t, &dns.Msg{
-				MsgHdr: dns.MsgHdr{
-					Response:      true,
-					Authoritative: true,
-					Truncated:     true,
-				},
-				Question: []dns.Question{
-					{Name: "long.newdns.256dpi.com.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET},
-				},
-			}, ret)
-		} else {
-			equalJSON(t, &dns.Msg{
-				MsgHdr: dns.MsgHdr{
-					Response:      true,
-					Authoritative: true,
-				},
-				Question: []dns.Question{
-					{Name: "long.newdns.256dpi.com.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET},
-				},
-				Answer: []dns.RR{
-					&dns.TXT{
-						Hdr: dns.RR_Header{
-							Name:     "long.newdns.256dpi.com.",
-							Rrtype:   dns.TypeTXT,
-							Class:    dns.ClassINET,
-							Ttl:      300,
-							Rdlength: 256,
-						},
-						Txt: []string{
-							"gyK4oL9X8Zn3b6TwmUIYAgQx43rBOWMqJWR3wGMGNaZgajnhd2u9JaIbGwNo6gzZunyKYRxID3mKLmYUCcIrNYuo8R4UkijZeshwqEAM2EWnjNsB1hJHOlu6VyRKW13rsFUJedOSqc7YjjUoxm9c3mF28tEXmc3GVsC476wJ2ciSbp7ujDjQ032SQRD6kpayzFX8GncS5KXP8mLK2ZIqK2U4fUmYEpTPQMmp7w24GKkfGJzE4JfMBxSybDUScLq",
-						},
-					},
-					&dns.TXT{
-						Hdr: dns.RR_Header{
-							Name:     "long.newdns.256dpi.com.",
-							Rrtype:   dns.TypeTXT,
-							Class:    dns.ClassINET,
-							Ttl:      300,
-							Rdlength: 256,
-						},
-						Txt: []string{
-							"upNh05zi9flqN2puI9eIGgAgl3gwc65l3WjFdnE3u55dhyUyIoKbOlc1mQJPULPkn1V5TTG9rLBB8AzNfeL8jvwO8h0mzmJhPH8n6dkgI546jB8Z0g0MRJxN5VNSixjFjdR8vtUp6EWlVi7QSe9SYInghV0M17zZ8mXSHwTfYZaPH54ng22mSWzVbRX2tlUPLTNRB5CHrEtxliyhhQlRey98P5G0eo35FUXdqzOSJ3HGqDssBWQAxK3I9feOjbE",
-						},
-					},
-					&dns.TXT{
-						Hdr: dns.RR_Header{
-							Name:     "long.newdns.256dpi.com.",
-							Rrtype:   dns.TypeTXT,
-							Class:    dns.ClassINET,
-							Ttl:      300,
-							Rdlength: 256,
-						},
-						Txt: []string{
-							"z4e6ycRMp6MP3WvWQMxIAOXglxANbj3oB0xD8BffktO4eo3VCR0s6TyGHKixvarOFJU0fqNkXeFOeI7sTXH5X0iXZukfLgnGTxLXNC7KkVFwtVFsh1P0IUNXtNBlOVWrVbxkS62ezbLpENNkiBwbkCvcTjwF2kyI0curAt9JhhJFb3AAq0q1iHWlJLn1KSrev9PIsY3alndDKjYTPxAojxzGKdK3A7rWLJ8Uzb3Z5OhLwP7jTKqbWVUocJRFLYp",
-						},
-					},
-				},
-				Ns: nsRRs,
-			}, ret)
+		ret, err = Query("udp", addr, "loop.example.com.", "A", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, dns.RcodeSuccess, ret.Rcode)
+		assert.Len(t, ret.Answer, 3)
+	})
+}
+
+func TestTruncateMsg(t *testing.T) {
+	build := func() *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		for _, str := range []string{
+			"example.com. 300 IN CNAME foo.example.com.",
+			"foo.example.com. 300 IN TXT \"" + strings.Repeat("x", 200) + "\"",
+			"foo.example.com. 300 IN TXT \"" + strings.Repeat("y", 200) + "\"",
+		} {
+			rr, err := dns.NewRR(str)
+			assert.NoError(t, err)
+			msg.Answer = append(msg.Answer, rr)
 		}
+		ns, err := dns.NewRR("example.com. 300 IN NS ns1.example.com.")
+		assert.NoError(t, err)
+		msg.Ns = append(msg.Ns, ns)
+		extra, err := dns.NewRR("ns1.example.com. 300 IN A 1.2.3.4")
+		assert.NoError(t, err)
+		msg.Extra = append(msg.Extra, extra)
+		msg.SetEdns0(1232, false)
+		return msg
+	}
+
+	msg := build()
+	truncateMsg(msg, msg.Len()-1)
+	assert.False(t, msg.Truncated)
+	assert.Len(t, msg.Answer, 3)
+	assert.Len(t, msg.Ns, 1)
+	assert.Len(t, msg.Extra, 1)
+	assert.NotNil(t, msg.IsEdns0())
+
+	msg = build()
+	truncateMsg(msg, 200)
+	assert.True(t, msg.Truncated)
+	assert.Len(t, msg.Answer, 1)
+	assert.Empty(t, msg.Ns)
+	assert.Len(t, msg.Extra, 1)
+	assert.NotNil(t, msg.IsEdns0())
+	assert.True(t, msg.Len() <= 200)
+
+	msg = build()
+	msg.Answer = msg.Answer[:1]
+	truncateMsg(msg, msg.Len()-1)
+	assert.False(t, msg.Truncated)
+	assert.Len(t, msg.Answer, 1)
+	assert.Len(t, msg.Ns, 1)
+	assert.Len(t, msg.Extra, 1)
+
+	msg = build()
+	msg.Answer = nil
+	truncateMsg(msg, msg.Len()-1)
+	assert.True(t, msg.Truncated)
+	assert.Len(t, msg.Ns, 1)
+	assert.Len(t, msg.Extra, 1)
+
+	msg = build()
+	msg.Answer = nil
+	msg.Extra = msg.Extra[1:]
+	truncateMsg(msg, msg.Len()-1)
+	assert.True(t, msg.Truncated)
+	assert.Empty(t, msg.Ns)
+}
+
+func TestServerNSGlue(t *testing.T) {
+	zone := &Zone{
+		Name:             "example.com.",
+		MasterNameServer: "ns1.example.com.",
+		AllNameServers: []string{
+			"ns1.example.com.",
+			"ns2.example.net.",
+		},
+		Handler: func(ctx context.Context, name string) ([]Set, error) {
+			if name == "ns1" {
+				return []Set{
+					{Name: "ns1.example.com.", Type: A, Records: []Record{{Address: "1.2.3.4"}}},
+					{Name: "ns1.example.com.", Type: AAAA, Records: []Record{{Address: "1:2:3:4::"}}},
+				}, nil
+			}
+
+			return nil, nil
+		},
+	}
+
+	server := NewServer(Config{
+		Handler: testHandler(zone),
 	})
 
-	t.Run("CaseTransfer", func(t *testing.T) {
-		ret, err := Query(proto, addr, "Ip4.NeWDnS.256dpi.com.", "A", nil)
+	run(server, "127.0.0.1:0", func() {
+		addr := server.Addr().String()
+
+		ret, err := Query("udp", addr, "example.com.", "NS", nil)
 		assert.NoError(t, err)
-		equalJSON(t, &dns.Msg{
-			MsgHdr: dns.MsgHdr{
-				Response:      true,
-				Authoritative: true,
-			},
-			Question: []dns.Question{
-				{Name: "Ip4.NeWDnS.256dpi.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
-			},
-			Answer: []dns.RR{
-				&dns.A{
-					Hdr: dns.RR_Header{
-						Name:     "Ip4.NeWDnS.256dpi.com.",
-						Rrtype:   dns.TypeA,
-						Class:    dns.ClassINET,
-						Ttl:      300,
-						Rdlength: 4,
-					},
-					A: net.ParseIP("1.2.3.4"),
-				},
-			},
-			Ns: []dns.RR{
-				&dns.NS{
-					Hdr: dns.RR_Header{
-						Name:     "NeWDnS.256dpi.com.",
-						Rrtype:   dns.TypeNS,
-						Class:    dns.ClassINET,
-						Ttl:      172800,
-						Rdlength: 23,
-					},
-					Ns: awsNS[0],
-				},
-				&dns.NS{
-					Hdr: dns.RR_Header{
-						Name:     "NeWDnS.256dpi.com.",
-						Rrtype:   dns.TypeNS,
-						Class:    dns.ClassINET,
-						Ttl:      172800,
-						Rdlength: 19,
-					},
-					Ns: awsNS[1],
-				},
-				&dns.NS{
-					Hdr: dns.RR_Header{
-						Name:     "NeWDnS.256dpi.com.",
-						Rrtype:   dns.TypeNS,
-						Class:    dns.ClassINET,
-						Ttl:      172800,
-						Rdlength: 25,
-					},
-					Ns: awsNS[2],
-				},
-				&dns.NS{
-					Hdr: dns.RR_Header{
-						Name:     "NeWDnS.256dpi.com.",
-						Rrtype:   dns.TypeNS,
-						Class:    dns.ClassINET,
-						Ttl:      172800,
-						Rdlength: 22,
-					},
-					Ns: awsNS[3],
+		assert.True(t, ret.Authoritative)
+		assert.Len(t, ret.Answer, 2)
+		assert.Len(t, ret.Extra, 2)
+		assert.Equal(t, "ns1.example.com.", ret.Extra[0].Header().Name)
+		assert.Equal(t, dns.TypeA, ret.Extra[0].Header().Rrtype)
+		assert.Equal(t, dns.TypeAAAA, ret.Extra[1].Header().Rrtype)
+	})
+}
+
+func TestServerRotate(t *testing.T) {
+	zone := testZone(func(ctx context.Context, name string) ([]Set, error) {
+		return []Set{
+			{
+				Name: "foo.example.com.",
+				Type: A,
+				Records: []Record{
+					{Address: "1.1.1.1"},
+					{Address: "2.2.2.2"},
+					{Address: "3.3.3.3"},
 				},
 			},
-		}, ret)
+		}, nil
+	})
+	zone.Order = OrderRotate
+
+	server := NewServer(Config{
+		ResponseCacheSize: 10,
+		Handler:           testHandler(zone),
 	})
 
-	t.Run("DomainWithSpace", func(t *testing.T) {
-		assertMissing(t, proto, addr, "\\ ip4.newdns.256dpi.com.", "NULL", dns.RcodeNameError)
+	run(server, "127.0.0.1:0", func() {
+		addr := server.Addr().String()
+
+		first := map[string]bool{}
+		for i := 0; i < 3; i++ {
+			ret, err := Query("udp", addr, "foo.example.com.", "A", nil)
+			assert.NoError(t, err)
+			assert.Len(t, ret.Answer, 3)
+			first[ret.Answer[0].(*dns.A).A.String()] = true
+		}
+
+		assert.Len(t, first, 3)
 	})
+}
 
-	t.Run("EDNSSuccess", func(t *testing.T) {
-		ret, err := Query(proto, addr, "newdns.256dpi.com.", "A", func(msg *dns.Msg) {
-			msg.SetEdns0(1337, false)
-		})
-		assert.NoError(t, err)
-		equalJSON(t, &dns.Msg{
-			MsgHdr: dns.MsgHdr{
-				Response:      true,
-				Authoritative: true,
-			},
-			Question: []dns.Question{
-				{Name: "newdns.256dpi.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
-			},
-			Answer: []dns.RR{
-				&dns.A{
-					Hdr: dns.RR_Header{
-						Name:     "newdns.256dpi.com.",
-						Rrtype:   dns.TypeA,
-						Class:    dns.ClassINET,
-						Ttl:      300,
-						Rdlength: 4,
-					},
-					A: net.ParseIP("1.2.3.4"),
-				},
-			},
-			Ns: nsRRs,
-			Extra: []dns.RR{
-				&dns.OPT{
-					Hdr: dns.RR_Header{
-						Name:     ".",
-						Rrtype:   dns.TypeOPT,
-						Class:    4096,
-						Ttl:      0,
-						Rdlength: 0,
-					},
-				},
-			},
-		}, ret)
+func TestServerRejectPolicy(t *testing.T) {
+	server := NewServer(Config{
+		RejectPolicy: RejectAnswer,
+		Handler:      testHandler(),
 	})
 
-	t.Run("EDNSError", func(t *testing.T) {
-		ret, err := Query(proto, addr, "missing.newdns.256dpi.com.", "A", func(msg *dns.Msg) {
-			msg.SetEdns0(1337, false)
-		})
+	run(server, "127.0.0.1:0", func() {
+		addr := server.Addr().String()
+
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		msg.Question[0].Qclass = dns.ClassCHAOS
+		ret, err := dns.Exchange(msg, addr)
 		assert.NoError(t, err)
-		equalJSON(t, &dns.Msg{
-			MsgHdr: dns.MsgHdr{
-				Response:      true,
-				Authoritative: true,
-				Rcode:         dns.RcodeNameError,
-			},
-			Question: []dns.Question{
-				{Name: "missing.newdns.256dpi.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
-			},
-			Ns: []dns.RR{
-				&dns.SOA{
-					Hdr: dns.RR_Header{
-						Name:     "newdns.256dpi.com.",
-						Rrtype:   dns.TypeSOA,
-						Class:    dns.ClassINET,
-						Ttl:      900,
-						Rdlength: 66,
-					},
-					Ns:      awsPrimaryNS,
-					Mbox:    "awsdns-hostmaster.amazon.com.",
-					Serial:  1,
-					Refresh: 7200,
-					Retry:   900,
-					Expire:  1209600,
-					Minttl:  300,
-				},
-			},
-			Extra: []dns.RR{
-				&dns.OPT{
-					Hdr: dns.RR_Header{
-						Name:     ".",
-						Rrtype:   dns.TypeOPT,
-						Class:    4096,
-						Ttl:      0,
-						Rdlength: 0,
-					},
-				},
-			},
-		}, ret)
+		assert.Equal(t, dns.RcodeRefused, ret.Rcode)
+
+		msg = new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		msg.Opcode = dns.OpcodeStatus
+		ret, err = dns.Exchange(msg, addr)
+		assert.NoError(t, err)
+		assert.Equal(t, dns.RcodeNotImplemented, ret.Rcode)
+
+		msg = new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		msg.Question = append(msg.Question, msg.Question[0])
+		ret, err = dns.Exchange(msg, addr)
+		assert.NoError(t, err)
+		assert.Equal(t, dns.RcodeFormatError, ret.Rcode)
+	})
+}
+
+func TestServerUnderscoreNames(t *testing.T) {
+	zone := testZone(func(ctx context.Context, name string) ([]Set, error) {
+		if name == "_dmarc" {
+			return []Set{
+				{Name: "_dmarc.example.com.", Type: TXT, Records: []Record{{Data: []string{"v=DMARC1; p=none"}}}},
+			}, nil
+		}
+
+		return nil, nil
 	})
 
-	t.Run("EDNSBadVersion", func(t *testing.T) {
-		ret, err := Query(proto, addr, "newdns.256dpi.com.", "A", func(msg *dns.Msg) {
-			msg.SetEdns0(1337, false)
-			msg.Extra[0].(*dns.OPT).SetVersion(2)
-		})
+	server := NewServer(Config{
+		Handler: testHandler(zone),
+	})
+
+	run(server, "127.0.0.1:0", func() {
+		addr := server.Addr().String()
+
+		ret, err := Query("udp", addr, "_DMARC.example.com.", "TXT", nil)
 		assert.NoError(t, err)
-		equalJSON(t, &dns.Msg{
-			MsgHdr: dns.MsgHdr{
-				Response:      true,
-				Authoritative: true,
-				Rcode:         dns.RcodeBadVers,
-			},
-			Question: []dns.Question{
-				{Name: "newdns.256dpi.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
-			},
-			Extra: []dns.RR{
-				&dns.OPT{
-					Hdr: dns.RR_Header{
-						Name:     ".",
-						Rrtype:   dns.TypeOPT,
-						Class:    4096,
-						Ttl:      ret.Extra[0].Header().Ttl, // see below
-						Rdlength: 0,
-					},
-				},
-			},
-		}, ret)
+		assert.Equal(t, dns.RcodeSuccess, ret.Rcode)
+		assert.Len(t, ret.Answer, 1)
+		assert.Equal(t, "_DMARC.example.com.", ret.Answer[0].Header().Name)
+	})
+}
 
-		// the AWS servers sometimes return a bit-flipped TTL value
-		ttl := ret.Extra[0].Header().Ttl
-		if !local {
-			assert.True(t, ttl == 0x1008000 || ttl == 0x1000000, ttl)
-		} else {
-			assert.Equal(t, uint32(dns.RcodeBadVers<<20), ttl)
+func TestServerUnsupportedTypes(t *testing.T) {
+	zone := testZone(func(ctx context.Context, name string) ([]Set, error) {
+		if name == "foo" {
+			return []Set{
+				{Name: "foo.example.com.", Type: A, Records: []Record{{Address: "1.2.3.4"}}},
+			}, nil
 		}
+
+		return nil, nil
 	})
 
-	t.Run("EDNSLongResponse", func(t *testing.T) {
-		ret, err := Query(proto, addr, "long.newdns.256dpi.com.", "TXT", func(msg *dns.Msg) {
-			msg.SetEdns0(1337, false)
-		})
+	server := NewServer(Config{
+		Handler: testHandler(zone),
+	})
+
+	run(server, "127.0.0.1:0", func() {
+		addr := server.Addr().String()
+
+		for _, name := range []string{"foo.example.com.", "example.com."} {
+			for _, typ := range []string{"CAA", "DNSKEY", "SRV", "A"} {
+				if name == "foo.example.com." && typ == "A" {
+					continue
+				}
+
+				ret, err := Query("udp", addr, name, typ, nil)
+				assert.NoError(t, err)
+				assert.Equal(t, dns.RcodeSuccess, ret.Rcode, name+" "+typ)
+				assert.Empty(t, ret.Answer, name+" "+typ)
+				assert.Len(t, ret.Ns, 1, name+" "+typ)
+				assert.Equal(t, dns.TypeSOA, ret.Ns[0].Header().Rrtype, name+" "+typ)
+			}
+		}
+
+		ret, err := Query("udp", addr, "bar.example.com.", "CAA", nil)
 		assert.NoError(t, err)
-		equalJSON(t, &dns.Msg{
-			MsgHdr: dns.MsgHdr{
-				Response:      true,
-				Authoritative: true,
-			},
-			Question: []dns.Question{
-				{Name: "long.newdns.256dpi.com.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET},
-			},
-			Answer: []dns.RR{
-				&dns.TXT{
-					Hdr: dns.RR_Header{
-						Name:     "long.newdns.256dpi.com.",
-						Rrtype:   dns.TypeTXT,
-						Class:    dns.ClassINET,
-						Ttl:      300,
-						Rdlength: 256,
-					},
-					Txt: []string{
-						"gyK4oL9X8Zn3b6TwmUIYAgQx43rBOWMqJWR3wGMGNaZgajnhd2u9JaIbGwNo6gzZunyKYRxID3mKLmYUCcIrNYuo8R4UkijZeshwqEAM2EWnjNsB1hJHOlu6VyRKW13rsFUJedOSqc7YjjUoxm9c3mF28tEXmc3GVsC476wJ2ciSbp7ujDjQ032SQRD6kpayzFX8GncS5KXP8mLK2ZIqK2U4fUmYEpTPQMmp7w24GKkfGJzE4JfMBxSybDUScLq",
-					},
-				},
-				&dns.TXT{
-					Hdr: dns.RR_Header{
-						Name:     "long.newdns.256dpi.com.",
-						Rrtype:   dns.TypeTXT,
-						Class:    dns.ClassINET,
-						Ttl:      300,
-						Rdlength: 256,
-					},
-					Txt: []string{
-						"upNh05zi9flqN2puI9eIGgAgl3gwc65l3WjFdnE3u55dhyUyIoKbOlc1mQJPULPkn1V5TTG9rLBB8AzNfeL8jvwO8h0mzmJhPH8n6dkgI546jB8Z0g0MRJxN5VNSixjFjdR8vtUp6EWlVi7QSe9SYInghV0M17zZ8mXSHwTfYZaPH54ng22mSWzVbRX2tlUPLTNRB5CHrEtxliyhhQlRey98P5G0eo35FUXdqzOSJ3HGqDssBWQAxK3I9feOjbE",
-					},
-				},
-				&dns.TXT{
-					Hdr: dns.RR_Header{
-						Name:     "long.newdns.256dpi.com.",
-						Rrtype:   dns.TypeTXT,
-						Class:    dns.ClassINET,
-						Ttl:      300,
-						Rdlength: 256,
-					},
-					Txt: []string{
-						"z4e6ycRMp6MP3WvWQMxIAOXglxANbj3oB0xD8BffktO4eo3VCR0s6TyGHKixvarOFJU0fqNkXeFOeI7sTXH5X0iXZukfLgnGTxLXNC7KkVFwtVFsh1P0IUNXtNBlOVWrVbxkS62ezbLpENNkiBwbkCvcTjwF2kyI0curAt9JhhJFb3AAq0q1iHWlJLn1KSrev9PIsY3alndDKjYTPxAojxzGKdK3A7rWLJ8Uzb3Z5OhLwP7jTKqbWVUocJRFLYp",
-					},
-				},
-			},
-			Ns: nsRRs,
-			Extra: []dns.RR{
-				&dns.OPT{
-					Hdr: dns.RR_Header{
-						Name:     ".",
-						Rrtype:   dns.TypeOPT,
-						Class:    4096,
-						Ttl:      0,
-						Rdlength: 0,
-					},
+		assert.Equal(t, dns.RcodeNameError, ret.Rcode)
+	})
+}
+
+func TestServerTTLLimits(t *testing.T) {
+	zone := testZone(func(ctx context.Context, name string) ([]Set, error) {
+		return []Set{
+			{
+				Name: name + ".example.com.",
+				Type: A,
+				Records: []Record{
+					{Address: "1.1.1.1"},
+					{Address: "2.2.2.2"},
 				},
+				TTL: 48 * time.Hour,
 			},
-		}, ret)
+		}, nil
 	})
+	zone.MinTTL = 50 * time.Minute
+	zone.MaxTTL = time.Hour
+	zone.TTLJitter = 0.5
 
-	t.Run("RecursionDesired", func(t *testing.T) {
-		ret, err := Query(proto, addr, "newdns.256dpi.com.", "A", func(msg *dns.Msg) {
-			msg.RecursionDesired = true
+	server := NewServer(Config{
+		Handler:           testHandler(zone),
+		ResponseCacheSize: 10,
+	})
+
+	run(server, "127.0.0.1:0", func() {
+		addr := server.Addr().String()
+
+		ttls := map[uint32]bool{}
+		for i := 0; i < 20; i++ {
+			ret, err := Query("udp", addr, "foo.example.com.", "A", nil)
+			assert.NoError(t, err)
+			assert.Len(t, ret.Answer, 2)
+
+			ttl := ret.Answer[0].Header().Ttl
+			assert.True(t, ttl >= 3000 && ttl <= 3600, ttl)
+			assert.Equal(t, ttl, ret.Answer[1].Header().Ttl)
+			ttls[ttl] = true
+		}
+		assert.True(t, len(ttls) > 1)
+
+		server.responses.mutex.Lock()
+		for _, entry := range server.responses.entries {
+			ret := new(dns.Msg)
+			assert.NoError(t, ret.Unpack(entry.data))
+			assert.Equal(t, uint32(3600), ret.Answer[0].Header().Ttl)
+		}
+		server.responses.mutex.Unlock()
+	})
+}
+
+func TestServerFallbackFailover(t *testing.T) {
+	upstream := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		res := new(dns.Msg)
+		res.SetReply(req)
+		res.Answer = append(res.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.ParseIP("1.2.3.4"),
 		})
-		assert.NoError(t, err)
-		equalJSON(t, &dns.Msg{
-			MsgHdr: dns.MsgHdr{
-				Response:         true,
-				Authoritative:    true,
-				RecursionDesired: true,
-			},
-			Question: []dns.Question{
-				{Name: "newdns.256dpi.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
-			},
-			Answer: []dns.RR{
-				&dns.A{
-					Hdr: dns.RR_Header{
-						Name:     "newdns.256dpi.com.",
-						Rrtype:   dns.TypeA,
-						Class:    dns.ClassINET,
-						Ttl:      300,
-						Rdlength: 4,
-					},
-					A: net.ParseIP("1.2.3.4"),
-				},
-			},
-			Ns: nsRRs,
-		}, ret)
+		_ = w.WriteMsg(res)
 	})
 
-	t.Run("UnsupportedMessage", func(t *testing.T) {
-		_, err := Query(proto, addr, "newdns.256dpi.com.", "A", func(msg *dns.Msg) {
-			msg.Response = true
+	server := NewServer(Config{
+		Zones:          []string{"example.com."},
+		Handler:        testHandler(),
+		Fallback:       []string{"127.0.0.1:53061", "127.0.0.1:53062"},
+		FallbackPolicy: FallbackFailover,
+	})
+
+	addr := "0.0.0.0:53063"
+
+	serve(upstream, "127.0.0.1:53062", func() {
+		run(server, addr, func() {
+			for i := 0; i < 5; i++ {
+				ret, err := Query("udp", addr, "example.org.", "A", nil)
+				assert.NoError(t, err)
+				assert.Len(t, ret.Answer, 1)
+			}
 		})
-		assert.True(t, isIOError(err), err)
 	})
+}
 
-	t.Run("UnsupportedOpcode", func(t *testing.T) {
-		_, err := Query(proto, addr, "newdns.256dpi.com.", "A", func(msg *dns.Msg) {
-			msg.Opcode = dns.OpcodeNotify
-		})
-		assert.True(t, isIOError(err), err)
+func TestServerFallbackCache(t *testing.T) {
+	var queries int32
+	upstream := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+
+		res := new(dns.Msg)
+		res.SetReply(req)
+		if strings.EqualFold(req.Question[0].Name, "example.org.") {
+			res.Answer = append(res.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.ParseIP("1.2.3.4"),
+			})
+		} else {
+			res.Rcode = dns.RcodeServerFailure
+		}
+		_ = w.WriteMsg(res)
 	})
 
-	t.Run("UnsupportedClass", func(t *testing.T) {
-		_, err := Query(proto, addr, "newdns.256dpi.com.", "A", func(msg *dns.Msg) {
-			msg.Question[0].Qclass = dns.ClassANY
-		})
-		assert.True(t, isIOError(err), err)
+	metrics := NewMetrics(nil)
+
+	var msgs testMsgLog
+
+	server := NewServer(Config{
+		Zones:             []string{"example.com."},
+		Handler:           testHandler(),
+		Fallback:          []string{"127.0.0.1:53071"},
+		FallbackCacheSize: 10,
+		Logger:            metrics,
+		Middleware: []func(dns.Handler) dns.Handler{
+			func(next dns.Handler) dns.Handler {
+				return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+					next.ServeDNS(&testMsgWriter{ResponseWriter: w, log: &msgs}, req)
+				})
+			},
+		},
 	})
 
-	t.Run("IgnorePayload", func(t *testing.T) {
-		ret, err := Query(proto, addr, "newdns.256dpi.com.", "A", func(msg *dns.Msg) {
-			msg.Answer = []dns.RR{
-				&dns.A{
-					Hdr: dns.RR_Header{
-						Name:     "newdns.256dpi.com.",
-						Rrtype:   dns.TypeA,
-						Class:    dns.ClassINET,
-						Ttl:      300,
-						Rdlength: 4,
-					},
-					A: net.ParseIP("1.2.3.4"),
-				},
-				&dns.AAAA{
-					Hdr: dns.RR_Header{
-						Name:     "newdns.256dpi.com.",
-						Rrtype:   dns.TypeAAAA,
-						Class:    dns.ClassINET,
-						Ttl:      300,
-						Rdlength: 4,
-					},
-					AAAA: net.ParseIP("1:2:3:4::"),
-				},
-			}
-			msg.Ns = []dns.RR{
-				nsRRs[0],
+	addr := "0.0.0.0:53072"
+
+	serve(upstream, "127.0.0.1:53071", func() {
+		run(server, addr, func() {
+			for i := 0; i < 3; i++ {
+				ret, err := Query("udp", addr, "example.org.", "A", nil)
+				assert.NoError(t, err)
+				assert.Len(t, ret.Answer, 1)
 			}
-			msg.Extra = []dns.RR{
-				&dns.TXT{
-					Hdr: dns.RR_Header{
-						Name:     "newdns.256dpi.com.",
-						Rrtype:   dns.TypeTXT,
-						Class:    dns.ClassINET,
-						Ttl:      300,
-						Rdlength: 4,
-					},
-					Txt: []string{"baz"},
-				},
+			assert.Equal(t, int32(1), atomic.LoadInt32(&queries))
+			assert.Equal(t, []int{1, 1, 1}, msgs.get())
+
+			for i := 0; i < 2; i++ {
+				ret, err := Query("udp", addr, "example.net.", "A", nil)
+				assert.NoError(t, err)
+				assert.Equal(t, dns.RcodeServerFailure, ret.Rcode)
 			}
+			assert.Equal(t, int32(3), atomic.LoadInt32(&queries))
+
+			server.PurgeFallback()
+			_, err := Query("udp", addr, "example.org.", "A", nil)
+			assert.NoError(t, err)
+			assert.Equal(t, int32(4), atomic.LoadInt32(&queries))
 		})
-		assert.NoError(t, err)
-		equalJSON(t, &dns.Msg{
-			MsgHdr: dns.MsgHdr{
-				Response:      true,
-				Authoritative: true,
-			},
-			Question: []dns.Question{
-				{Name: "newdns.256dpi.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
-			},
-			Answer: []dns.RR{
-				&dns.A{
-					Hdr: dns.RR_Header{
-						Name:     "newdns.256dpi.com.",
-						Rrtype:   dns.TypeA,
-						Class:    dns.ClassINET,
-						Ttl:      300,
-						Rdlength: 4,
-					},
-					A: net.ParseIP("1.2.3.4"),
-				},
-			},
-			Ns: nsRRs,
-		}, ret)
 	})
 
-	t.Run("MultipleQuestions", func(t *testing.T) {
-		_, err := Query(proto, addr, "newdns.256dpi.com.", "A", func(msg *dns.Msg) {
-			msg.Question = append(msg.Question, dns.Question{
-				Name:   "newdns.256dpi.com.",
-				Qtype:  dns.TypeA,
-				Qclass: dns.ClassINET,
-			})
+	var buf bytes.Buffer
+	_, err := metrics.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.Contains(t, buf.String(), "newdns_fallback_cache_hits_total 2")
+}
+
+func TestServerFallbackFailure(t *testing.T) {
+	var queries int32
+	upstream := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if atomic.AddInt32(&queries, 1) == 1 {
+			time.Sleep(300 * time.Millisecond)
+		}
+
+		res := new(dns.Msg)
+		res.SetReply(req)
+		_ = w.WriteMsg(res)
+	})
+
+	handler := func(ctx context.Context, name string) (*Zone, error) {
+		return nil, nil
+	}
+
+	server := NewServer(Config{
+		Zones:           []string{"example.com."},
+		Handler:         handler,
+		Fallback:        []string{"127.0.0.1:53081"},
+		FallbackTimeout: 100 * time.Millisecond,
+		FallbackRetries: 1,
+	})
+
+	addr := "0.0.0.0:53082"
+
+	serve(upstream, "127.0.0.1:53081", func() {
+		run(server, addr, func() {
+			ret, err := Query("udp", addr, "example.org.", "A", nil)
+			assert.NoError(t, err)
+			assert.Equal(t, dns.RcodeSuccess, ret.Rcode)
+			assert.Equal(t, int32(2), atomic.LoadInt32(&queries))
 		})
-		assert.True(t, isIOError(err), err)
 	})
 
-	t.Run("UnsupportedType", func(t *testing.T) {
-		assertMissing(t, proto, addr, "missing.newdns.256dpi.com.", "NULL", dns.RcodeNameError)
+	server = NewServer(Config{
+		Zones:           []string{"example.com."},
+		Handler:         handler,
+		Fallback:        []string{"127.0.0.1:53083"},
+		FallbackTimeout: 100 * time.Millisecond,
+		FailurePolicy:   FailureServerFailure,
 	})
 
-	t.Run("NonAuthoritativeZone", func(t *testing.T) {
-		ret, err := Query(proto, addr, "foo.256dpi.com.", "A", nil)
+	addr = "0.0.0.0:53084"
+
+	run(server, addr, func() {
+		ret, err := Query("udp", addr, "example.org.", "A", nil)
 		assert.NoError(t, err)
-		equalJSON(t, &dns.Msg{
-			MsgHdr: dns.MsgHdr{
-				Response:      true,
-				Authoritative: false,
-				Rcode:         dns.RcodeRefused,
-			},
-			Question: []dns.Question{
-				{Name: "foo.256dpi.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
-			},
-		}, ret)
+		assert.Equal(t, dns.RcodeServerFailure, ret.Rcode)
 	})
 }
 
-func additionalTests(t *testing.T, proto, addr string) {
-	t.Run("UnsupportedAny", func(t *testing.T) {
-		ret, err := Query(proto, addr, "newdns.256dpi.com.", "ANY", nil)
+func TestServerHandlerTimeout(t *testing.T) {
+	var deadline int32
+
+	server := NewServer(Config{
+		Zones: []string{"example.com."},
+		Handler: func(ctx context.Context, name string) (*Zone, error) {
+			if _, ok := ctx.Deadline(); ok {
+				atomic.StoreInt32(&deadline, 1)
+			}
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+		HandlerTimeout: 50 * time.Millisecond,
+	})
+
+	addr := "0.0.0.0:53094"
+
+	run(server, addr, func() {
+		start := time.Now()
+		ret, err := Query("udp", addr, "example.com.", "A", nil)
 		assert.NoError(t, err)
-		equalJSON(t, &dns.Msg{
-			MsgHdr: dns.MsgHdr{
-				Response:      true,
-				Authoritative: true,
-				Rcode:         dns.RcodeNotImplemented,
-			},
-			Question: []dns.Question{
-				{Name: "newdns.256dpi.com.", Qtype: dns.TypeANY, Qclass: dns.ClassINET},
-			},
-		}, ret)
+		assert.Equal(t, dns.RcodeServerFailure, ret.Rcode)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&deadline))
+		assert.True(t, time.Since(start) < time.Second)
 	})
 }
 
-func assertMissing(t *testing.T, proto, addr, name, typ string, code int) {
-	qt := dns.StringToType[typ]
+func TestServerRequestInfo(t *testing.T) {
+	var mutex sync.Mutex
+	var infos []*RequestInfo
 
-	ret, err := Query(proto, addr, name, typ, nil)
-	assert.NoError(t, err)
-	equalJSON(t, &dns.Msg{
-		MsgHdr: dns.MsgHdr{
-			Response:      true,
-			Authoritative: true,
-			Rcode:         code,
-		},
-		Question: []dns.Question{
-			{Name: name, Qtype: qt, Qclass: dns.ClassINET},
-		},
-		Ns: []dns.RR{
-			&dns.SOA{
-				Hdr: dns.RR_Header{
-					Name:     "newdns.256dpi.com.",
-					Rrtype:   dns.TypeSOA,
-					Class:    dns.ClassINET,
-					Ttl:      900,
-					Rdlength: 66,
-				},
-				Ns:      awsPrimaryNS,
-				Mbox:    "awsdns-hostmaster.amazon.com.",
-				Serial:  1,
-				Refresh: 7200,
-				Retry:   900,
-				Expire:  1209600,
-				Minttl:  300,
-			},
-		},
-	}, ret)
-}
+	zone := testZone(func(ctx context.Context, name string) ([]Set, error) {
+		mutex.Lock()
+		infos = append(infos, GetRequestInfo(ctx))
+		mutex.Unlock()
+		return nil, nil
+	})
 
-func resolverTests(t *testing.T, fallback string) {
-	var dialer net.Dialer
+	server := NewServer(Config{
+		Handler: testHandler(zone),
+	})
 
-	resolver := net.Resolver{
-		PreferGo: true,
-		Dial: func(ctx context.Context, network, address string) (conn net.Conn, err error) {
-			return dialer.DialContext(ctx, network, fallback)
-		},
-	}
+	run(server, "127.0.0.1:0", func() {
+		addr := server.Addr().String()
 
-	ctx := context.Background()
+		_, err := Query("udp", addr, "foo.example.com.", "A", nil)
+		assert.NoError(t, err)
 
-	t.Run("LookupHost", func(t *testing.T) {
-		addrs, err := resolver.LookupHost(ctx, "newdns.256dpi.com")
+		_, err = Query("tcp", addr, "bar.example.com.", "TXT", func(msg *dns.Msg) {
+			msg.SetEdns0(4096, true)
+			opt := msg.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+				Code:          dns.EDNS0SUBNET,
+				Family:        1,
+				SourceNetmask: 24,
+				Address:       net.ParseIP("192.0.2.0").To4(),
+			})
+		})
 		assert.NoError(t, err)
-		sort.Strings(addrs)
-		assert.Equal(t, []string{"1.2.3.4", "1:2:3:4::"}, addrs)
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		assert.Len(t, infos, 2)
+
+		assert.NotZero(t, infos[0].ID)
+		assert.Equal(t, "127.0.0.1", infos[0].Remote.(*net.UDPAddr).IP.String())
+		assert.Equal(t, "udp", infos[0].Transport)
+		assert.Equal(t, "foo.example.com.", infos[0].Question.Name)
+		assert.False(t, infos[0].EDNS)
+		assert.Nil(t, infos[0].ClientSubnet)
+
+		assert.Equal(t, "tcp", infos[1].Transport)
+		assert.Equal(t, dns.TypeTXT, infos[1].Question.Qtype)
+		assert.True(t, infos[1].EDNS)
+		assert.True(t, infos[1].DNSSEC)
+		assert.Equal(t, uint16(4096), infos[1].UDPSize)
+		assert.Equal(t, "192.0.2.0/24", infos[1].ClientSubnet.String())
 	})
 
-	t.Run("LookupCNAME", func(t *testing.T) {
-		cname, err := resolver.LookupCNAME(ctx, "ref4.newdns.256dpi.com")
-		assert.NoError(t, err)
-		assert.Equal(t, "ip4.newdns.256dpi.com.", cname)
+	assert.Nil(t, GetRequestInfo(context.Background()))
+}
+
+func TestServerHandlerSections(t *testing.T) {
+	zone := testZone(func(ctx context.Context, name string) ([]Set, error) {
+		if name == "foo" {
+			AddAuthority(ctx, Set{
+				Name:    "example.com.",
+				Type:    TXT,
+				Records: []Record{{Data: []string{"hint"}}},
+			})
+			AddAdditional(ctx, Set{
+				Name:    "glue.example.com.",
+				Type:    A,
+				Records: []Record{{Address: "1.2.3.5"}},
+				TTL:     10 * time.Minute,
+			})
+			return []Set{
+				{
+					Name:    "foo.example.com.",
+					Type:    A,
+					Records: []Record{{Address: "1.2.3.4"}},
+				},
+			}, nil
+		}
+
+		if name == "bar" {
+			AddAdditional(ctx, Set{
+				Name:    "bar.example.org.",
+				Type:    A,
+				Records: []Record{{Address: "1.2.3.5"}},
+			})
+			return []Set{
+				{
+					Name:    "bar.example.com.",
+					Type:    A,
+					Records: []Record{{Address: "1.2.3.4"}},
+				},
+			}, nil
+		}
+
+		return nil, nil
 	})
 
-	t.Run("LookupTXT", func(t *testing.T) {
-		txt, err := resolver.LookupTXT(ctx, "newdns.256dpi.com")
-		assert.NoError(t, err)
-		assert.Equal(t, []string{"baz", "foobar"}, txt)
+	server := NewServer(Config{
+		Handler: testHandler(zone),
 	})
 
-	t.Run("LookupMX", func(t *testing.T) {
-		mx, err := resolver.LookupMX(ctx, "ref4m.newdns.256dpi.com")
+	run(server, "127.0.0.1:0", func() {
+		addr := server.Addr().String()
+
+		ret, err := Query("udp", addr, "foo.example.com.", "A", nil)
 		assert.NoError(t, err)
-		assert.Equal(t, []*net.MX{
-			{Host: "ip4.newdns.256dpi.com.", Pref: 7},
-		}, mx)
+		assert.Equal(t, dns.RcodeSuccess, ret.Rcode)
+		assert.Len(t, ret.Answer, 1)
+		assert.Len(t, ret.Ns, 2)
+		assert.Equal(t, &dns.TXT{
+			Hdr: dns.RR_Header{
+				Name:     "example.com.",
+				Rrtype:   dns.TypeTXT,
+				Class:    dns.ClassINET,
+				Ttl:      300,
+				Rdlength: 5,
+			},
+			Txt: []string{"hint"},
+		}, ret.Ns[1])
+		assert.Equal(t, []dns.RR{
+			&dns.A{
+				Hdr: dns.RR_Header{
+					Name:     "glue.example.com.",
+					Rrtype:   dns.TypeA,
+					Class:    dns.ClassINET,
+					Ttl:      600,
+					Rdlength: 4,
+				},
+				A: net.ParseIP("1.2.3.5").To4(),
+			},
+		}, ret.Extra)
+
+		ret, err = Query("udp", addr, "bar.example.com.", "A", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, dns.RcodeServerFailure, ret.Rcode)
 	})
+}
 
-	t.Run("LookupNS", func(t *testing.T) {
-		ns, err := resolver.LookupNS(ctx, "other.newdns.256dpi.com")
-		assert.Error(t, err) // zone is not served by server
-		assert.Nil(t, ns)
+func TestServerRawRecords(t *testing.T) {
+	zone := testZone(func(ctx context.Context, name string) ([]Set, error) {
+		if name == "" {
+			return []Set{
+				{
+					Name: "example.com.",
+					Type: Type(dns.TypeCAA),
+					Raw: []dns.RR{
+						&dns.CAA{
+							Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeCAA, Ttl: 42},
+							Tag: "issue", Value: "ca.example.net",
+						},
+					},
+					TTL: time.Hour,
+				},
+			}, nil
+		}
+
+		return nil, nil
+	})
+	zone.MaxTTL = 10 * time.Minute
+
+	server := NewServer(Config{
+		Handler: testHandler(zone),
+	})
+
+	run(server, "127.0.0.1:0", func() {
+		addr := server.Addr().String()
+
+		ret, err := Query("udp", addr, "EXAMPLE.com.", "CAA", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, dns.RcodeSuccess, ret.Rcode)
+		assert.Equal(t, []dns.RR{
+			&dns.CAA{
+				Hdr: dns.RR_Header{
+					Name:     "EXAMPLE.com.",
+					Rrtype:   dns.TypeCAA,
+					Class:    dns.ClassINET,
+					Ttl:      600,
+					Rdlength: 21,
+				},
+				Tag:   "issue",
+				Value: "ca.example.net",
+			},
+		}, ret.Answer)
+
+		ret, err = Query("udp", addr, "example.com.", "A", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, dns.RcodeSuccess, ret.Rcode)
+		assert.Empty(t, ret.Answer)
 	})
 }
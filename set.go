@@ -2,12 +2,18 @@ package newdns
 
 import (
 	"fmt"
+	"strings"
 	"time"
+
+	"github.com/miekg/dns"
 )
 
 // Set is a set of records.
 type Set struct {
-	// The FQDN of the set.
+	// The FQDN of the set. Labels may start with an underscore e.g.
+	// "_dmarc.example.com.". The leftmost label may be an asterisk to define
+	// a wildcard set e.g. "*.example.com." which is used to synthesize sets if
+	// wildcards are enabled for the zone.
 	Name string
 
 	// The type of the record.
@@ -16,9 +22,16 @@ type Set struct {
 	// The records in the set.
 	Records []Record
 
+	// The pre-built records in the set. Raw records can be used instead of
+	// records to serve types that are not supported natively e.g. CAA or
+	// SSHFP. The records must match the name and type of the set. Their name
+	// case, class and TTL are replaced when served. Sets with raw records
+	// cannot be defined or updated dynamically.
+	Raw []dns.RR
+
 	// The TTL of the set.
 	//
-	// Default: 5m.
+	// Default: The default TTL of the zone or 5m if validated standalone.
 	TTL time.Duration
 }
 
@@ -29,6 +42,18 @@ func (s *Set) Validate() error {
 		return fmt.Errorf("invalid name: %s", s.Name)
 	}
 
+	// check wildcard labels
+	for i, label := range dns.SplitDomainName(s.Name) {
+		if i > 0 && label == "*" {
+			return fmt.Errorf("wildcard label not leftmost: %s", s.Name)
+		}
+	}
+
+	// validate raw records
+	if len(s.Raw) > 0 {
+		return s.validateRaw()
+	}
+
 	// check type
 	if !s.Type.supported() {
 		return fmt.Errorf("unsupported type: %d", s.Type)
@@ -68,3 +93,37 @@ func (s *Set) Validate() error {
 
 	return nil
 }
+
+func (s *Set) validateRaw() error {
+	// check type
+	switch uint16(s.Type) {
+	case dns.TypeNone, dns.TypeSOA, dns.TypeOPT, dns.TypeANY, dns.TypeAXFR, dns.TypeIXFR:
+		return fmt.Errorf("unsupported raw type: %d", s.Type)
+	}
+	if s.Type.supported() {
+		return fmt.Errorf("raw records for supported type: %d", s.Type)
+	}
+
+	// check records
+	if len(s.Records) > 0 {
+		return fmt.Errorf("records and raw records")
+	}
+
+	// check raw records
+	for _, rr := range s.Raw {
+		if rr == nil {
+			return fmt.Errorf("missing raw record")
+		} else if rr.Header().Rrtype != uint16(s.Type) {
+			return fmt.Errorf("raw record type mismatch: %d", rr.Header().Rrtype)
+		} else if !strings.EqualFold(dns.Fqdn(rr.Header().Name), s.Name) {
+			return fmt.Errorf("raw record name mismatch: %s", rr.Header().Name)
+		}
+	}
+
+	// set default ttl
+	if s.TTL == 0 {
+		s.TTL = 5 * time.Minute
+	}
+
+	return nil
+}
@@ -3,6 +3,7 @@ package newdns
 import (
 	"testing"
 
+	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -23,6 +24,18 @@ func TestSetValidate(t *testing.T) {
 			},
 			err: "unsupported type: 0",
 		},
+		{
+			set: Set{
+				Name: "foo.*.example.com.",
+			},
+			err: "wildcard label not leftmost: foo.*.example.com.",
+		},
+		{
+			set: Set{
+				Name: "*.*.example.com.",
+			},
+			err: "wildcard label not leftmost: *.*.example.com.",
+		},
 		{
 			set: Set{
 				Name: "example.com.",
@@ -72,6 +85,81 @@ func TestSetValidate(t *testing.T) {
 			},
 			err: "duplicate address: 1.2.3.4",
 		},
+		{
+			set: Set{
+				Name: "*.example.com.",
+				Type: A,
+				Records: []Record{
+					{Address: "1.2.3.4"},
+				},
+			},
+		},
+		{
+			set: Set{
+				Name: "*.foo.example.com.",
+				Type: MX,
+				Records: []Record{
+					{Address: "mail.example.com."},
+				},
+			},
+		},
+		{
+			set: Set{
+				Name: "_dmarc.example.com.",
+				Type: TXT,
+				Records: []Record{
+					{Data: []string{"v=DMARC1; p=none"}},
+				},
+			},
+		},
+		{
+			set: Set{
+				Name: "_acme-challenge.www.example.com.",
+				Type: TXT,
+				Records: []Record{
+					{Data: []string{"token"}},
+				},
+			},
+		},
+		{
+			set: Set{
+				Name: "example.com.",
+				Type: A,
+				Raw:  []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA}}},
+			},
+			err: "raw records for supported type: 1",
+		},
+		{
+			set: Set{
+				Name: "example.com.",
+				Type: Type(dns.TypeSOA),
+				Raw:  []dns.RR{&dns.SOA{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA}}},
+			},
+			err: "unsupported raw type: 6",
+		},
+		{
+			set: Set{
+				Name: "example.com.",
+				Type: Type(dns.TypeCAA),
+				Raw:  []dns.RR{&dns.SSHFP{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSSHFP}}},
+			},
+			err: "raw record type mismatch: 44",
+		},
+		{
+			set: Set{
+				Name: "example.com.",
+				Type: Type(dns.TypeCAA),
+				Raw:  []dns.RR{&dns.CAA{Hdr: dns.RR_Header{Name: "foo.example.com.", Rrtype: dns.TypeCAA}}},
+			},
+			err: "raw record name mismatch: foo.example.com.",
+		},
+		{
+			set: Set{
+				Name: "example.com.",
+				Type: Type(dns.TypeCAA),
+				Raw:  []dns.RR{&dns.CAA{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeCAA}}},
+			},
+		},
 	}
 
 	for i, item := range table {
@@ -0,0 +1,89 @@
+//go:build go1.21
+// +build go1.21
+
+package newdns
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/miekg/dns"
+)
+
+// SlogLogger returns a logger that writes events to the provided slog logger.
+// Errors are logged at the error level, ignored and refused requests at the
+// warn level and all other events at the debug level.
+func SlogLogger(logger *slog.Logger) Logger {
+	return LoggerFunc(func(entry Entry) {
+		// determine level
+		level := slog.LevelDebug
+		switch entry.Event {
+		case BackendError, NetworkError, ProxyError:
+			level = slog.LevelError
+		case Ignored, Refused, UpstreamDown:
+			level = slog.LevelWarn
+		}
+
+		// check level
+		if !logger.Enabled(context.Background(), level) {
+			return
+		}
+
+		// prepare attributes
+		attrs := make([]slog.Attr, 0, len(entry.Fields)+6)
+
+		// add request ID
+		if entry.RequestID != 0 {
+			attrs = append(attrs, slog.Uint64("request_id", entry.RequestID))
+		}
+
+		// add message attributes
+		if entry.Msg != nil {
+			attrs = append(attrs, slog.Int("id", int(entry.Msg.Id)))
+			if len(entry.Msg.Question) > 0 {
+				attrs = append(attrs,
+					slog.String("name", entry.Msg.Question[0].Name),
+					slog.String("type", dns.TypeToString[entry.Msg.Question[0].Qtype]),
+				)
+			}
+			if entry.Msg.Response && entry.Info == nil {
+				attrs = append(attrs, slog.String("rcode", dns.RcodeToString[entry.Msg.Rcode]))
+			}
+		}
+
+		// add info attributes
+		if entry.Info != nil {
+			if entry.Info.Remote != nil {
+				attrs = append(attrs, slog.String("remote", entry.Info.Remote.String()))
+			}
+			attrs = append(attrs,
+				slog.String("transport", entry.Info.Transport),
+				slog.Duration("elapsed", entry.Info.Elapsed),
+			)
+			if entry.Event == Finish {
+				attrs = append(attrs, slog.Duration("handler", entry.Info.HandlerDuration))
+			}
+			if entry.Event != Request && entry.Info.ResponseSize > 0 {
+				attrs = append(attrs, slog.String("rcode", dns.RcodeToString[entry.Info.Rcode]))
+			}
+		}
+
+		// add reason
+		if entry.Reason != "" {
+			attrs = append(attrs, slog.String("reason", entry.Reason))
+		}
+
+		// add error
+		if entry.Error != nil && entry.Error.Error() != entry.Reason {
+			attrs = append(attrs, slog.String("error", entry.Error.Error()))
+		}
+
+		// add fields
+		for _, field := range entry.Fields {
+			attrs = append(attrs, slog.Any(field.Key, field.Value))
+		}
+
+		// log event
+		logger.LogAttrs(context.Background(), level, entry.Event.String(), attrs...)
+	})
+}
@@ -0,0 +1,32 @@
+//go:build go1.21
+// +build go1.21
+
+package newdns
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := SlogLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		Level: slog.LevelWarn,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})))
+
+	log(logger, Request, nil, nil, "")
+	log(logger, Refused, nil, nil, "unsupported EDNS version", Field{"version", 1})
+	log(logger, BackendError, nil, errors.New("foo"), "")
+
+	assert.Equal(t, "level=WARN msg=Refused reason=\"unsupported EDNS version\" version=1\nlevel=ERROR msg=BackendError error=foo\n", buf.String())
+}
@@ -0,0 +1,184 @@
+package newdns
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Snapshot returns an immutable copy of the zone that serves the sets that are
+// currently enumerated by the zone lister. The copy is frozen with the current
+// serial, does not share any sets or lists with the zone and does not support
+// dynamic updates or incremental transfers. The returned zone must not be
+// modified.
+func (z *Zone) Snapshot(ctx context.Context) (*Zone, error) {
+	// freeze zone with current serial
+	frozen, err := z.withSerial().Freeze()
+	if err != nil {
+		return nil, err
+	}
+
+	// collect sets
+	sets := map[string][]Set{}
+	err = frozen.List(ctx, func(set Set) error {
+		key := TrimZone(frozen.Name, set.Name)
+		sets[key] = append(sets[key], copySet(set))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return NewStaticZone(frozen.Name, sets, func(zone *Zone) {
+		// keep static callbacks
+		handler := zone.Handler
+		nonTerminal := zone.NonTerminal
+		lister := zone.Lister
+
+		// copy settings
+		*zone = *frozen.clone()
+
+		// set static callbacks
+		zone.Handler = handler
+		zone.NonTerminal = nonTerminal
+		zone.Lister = lister
+
+		// remove dynamic callbacks
+		zone.SerialFunc = nil
+		zone.BatchHandler = nil
+		zone.TypeHandler = nil
+		zone.Cache = nil
+		zone.Journal = nil
+		zone.UpdateHandler = nil
+		zone.UpdatePolicy = nil
+	})
+}
+
+// Diff compares the sets enumerated by the listers of the provided zones and
+// returns the change that turns the first zone into the second. Sets that
+// only exist in the first zone are removed and sets that only exist in the
+// second zone are added. Sets that exist in both zones with different records
+// or TTLs are replaced by removing the old and adding the new set. The sets of
+// the change are sorted by name and type. Use snapshots to compare dynamic
+// zones consistently.
+func Diff(ctx context.Context, a, b *Zone) (Change, error) {
+	// check names
+	if !strings.EqualFold(a.Name, b.Name) {
+		return Change{}, fmt.Errorf("zone names do not match: %s, %s", a.Name, b.Name)
+	}
+
+	// prepare change
+	change := Change{
+		From: a.withSerial().Serial,
+		To:   b.withSerial().Serial,
+	}
+
+	// collect old sets
+	old := map[string]Set{}
+	err := a.List(ctx, func(set Set) error {
+		old[setKey(set)] = set
+		return nil
+	})
+	if err != nil {
+		return Change{}, err
+	}
+
+	// compare new sets
+	err = b.List(ctx, func(set Set) error {
+		// get key
+		key := setKey(set)
+
+		// check old set
+		prev, ok := old[key]
+		delete(old, key)
+		if ok && prev.TTL == set.TTL && recordsEqual(prev.Records, set.Records) && rawEqual(prev.Raw, set.Raw) {
+			return nil
+		}
+
+		// replace or add set
+		if ok {
+			change.Removed = append(change.Removed, copySet(prev))
+		}
+		change.Added = append(change.Added, copySet(set))
+
+		return nil
+	})
+	if err != nil {
+		return Change{}, err
+	}
+
+	// remove remaining old sets
+	for _, set := range old {
+		change.Removed = append(change.Removed, copySet(set))
+	}
+
+	// sort sets
+	sortSets(change.Removed)
+	sortSets(change.Added)
+
+	return change, nil
+}
+
+func setKey(set Set) string {
+	return fmt.Sprintf("%s/%d", NormalizeDomain(set.Name, true, false, false), set.Type)
+}
+
+func sortSets(list []Set) {
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].Type < list[j].Type
+	})
+}
+
+func rawEqual(a, b []dns.RR) bool {
+	// check length
+	if len(a) != len(b) {
+		return false
+	}
+
+	// get keys
+	keys := func(list []dns.RR) []string {
+		var keys []string
+		for _, rr := range list {
+			keys = append(keys, strings.TrimPrefix(rr.String(), rr.Header().String()))
+		}
+		sort.Strings(keys)
+		return keys
+	}
+
+	// compare keys
+	ka, kb := keys(a), keys(b)
+	for i := range ka {
+		if ka[i] != kb[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func copySet(set Set) Set {
+	// copy records
+	records := make([]Record, 0, len(set.Records))
+	for _, record := range set.Records {
+		record.Data = append([]string(nil), record.Data...)
+		records = append(records, record)
+	}
+	set.Records = records
+
+	// copy raw records
+	if set.Raw != nil {
+		raw := make([]dns.RR, 0, len(set.Raw))
+		for _, rr := range set.Raw {
+			raw = append(raw, dns.Copy(rr))
+		}
+		set.Raw = raw
+	}
+
+	return set
+}
@@ -0,0 +1,93 @@
+package newdns
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestZoneSnapshot(t *testing.T) {
+	sets := map[string][]Set{
+		"": {
+			{Name: "example.com.", Type: A, Records: []Record{{Address: "1.2.3.4"}}},
+		},
+		"www": {
+			{Name: "www.example.com.", Type: TXT, Records: []Record{{Data: []string{"foo"}}}},
+		},
+	}
+
+	serial := uint32(1)
+
+	zone := &Zone{
+		Name:             "example.com.",
+		MasterNameServer: "ns1.example.com.",
+		AllNameServers:   []string{"ns1.example.com."},
+		SerialFunc: func() uint32 {
+			return serial
+		},
+		Handler: func(ctx context.Context, name string) ([]Set, error) {
+			return sets[name], nil
+		},
+		Lister: func(ctx context.Context, fn func(Set) error) error {
+			for _, list := range sets {
+				for _, set := range list {
+					err := fn(set)
+					if err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+		UpdateHandler: func(ctx context.Context, updates []Update) error {
+			return nil
+		},
+	}
+
+	snapshot, err := zone.Snapshot(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1), snapshot.Serial)
+	assert.Nil(t, snapshot.SerialFunc)
+	assert.Nil(t, snapshot.UpdateHandler)
+
+	sets["www"][0].Records[0].Data[0] = "bar"
+	sets["www"] = append(sets["www"], Set{Name: "www.example.com.", Type: A, Records: []Record{{Address: "1.2.3.5"}}})
+	sets["foo"] = []Set{{Name: "foo.example.com.", Type: A, Records: []Record{{Address: "1.2.3.6"}}}}
+	delete(sets, "")
+	serial = 2
+
+	res, _, err := snapshot.Lookup(context.Background(), "www.example.com.", TXT)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"foo"}, res[0].Records[0].Data)
+
+	res, _, err = snapshot.Lookup(context.Background(), "foo.example.com.", A)
+	assert.NoError(t, err)
+	assert.Empty(t, res)
+
+	change, err := Diff(context.Background(), snapshot, zone)
+	assert.NoError(t, err)
+	assert.Equal(t, Change{
+		From: 1,
+		To:   2,
+		Removed: []Set{
+			{Name: "example.com.", Type: A, Records: []Record{{Address: "1.2.3.4"}}, TTL: 5 * time.Minute},
+			{Name: "www.example.com.", Type: TXT, Records: []Record{{Data: []string{"foo"}}}, TTL: 5 * time.Minute},
+		},
+		Added: []Set{
+			{Name: "foo.example.com.", Type: A, Records: []Record{{Address: "1.2.3.6"}}, TTL: 5 * time.Minute},
+			{Name: "www.example.com.", Type: A, Records: []Record{{Address: "1.2.3.5"}}, TTL: 5 * time.Minute},
+			{Name: "www.example.com.", Type: TXT, Records: []Record{{Data: []string{"bar"}}}, TTL: 5 * time.Minute},
+		},
+	}, change)
+
+	change, err = Diff(context.Background(), zone, zone)
+	assert.NoError(t, err)
+	assert.Equal(t, Change{From: 2, To: 2}, change)
+
+	other := *zone
+	other.Name = "example.org."
+	_, err = Diff(context.Background(), zone, &other)
+	assert.Error(t, err)
+}
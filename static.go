@@ -0,0 +1,136 @@
+package newdns
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// ZoneOption is a function that configures a zone.
+type ZoneOption func(zone *Zone)
+
+// NewStaticZone creates and returns a validated zone that serves the provided
+// sets. The sets are keyed by their name relative to the zone like in the zone
+// handler e.g. "www" or "" for the apex. The name servers default to the NS
+// set at the apex and wildcards are enabled if wildcard sets are provided. The
+// handler, non-terminal callback and lister are set to serve the sets. The
+// options are applied before the zone is validated.
+func NewStaticZone(name string, sets map[string][]Set, opts ...ZoneOption) (*Zone, error) {
+	// prepare zone
+	zone := &Zone{
+		Name: name,
+	}
+
+	// check name
+	if !IsDomain(name, true) {
+		return nil, fmt.Errorf("name not fully qualified: %s", name)
+	}
+
+	// prepare index
+	index := map[string][]Set{}
+	nonTerminals := map[string]bool{}
+	var apexNS []string
+	var list []Set
+
+	// validate and index sets
+	for key, keySets := range sets {
+		// get full name
+		key = strings.ToLower(key)
+		full := strings.ToLower(name)
+		if key != "" {
+			full = key + "." + full
+		}
+
+		for _, set := range keySets {
+			// validate set, the default TTL is applied by the zone
+			check := set
+			err := check.Validate()
+			if err != nil {
+				return nil, fmt.Errorf("invalid set: %w", err)
+			}
+
+			// check name
+			if !strings.EqualFold(set.Name, full) {
+				return nil, fmt.Errorf("set name does not match key: %s", set.Name)
+			}
+
+			// use apex NS set as name servers
+			if key == "" && set.Type == NS {
+				for _, record := range set.Records {
+					apexNS = append(apexNS, record.Address)
+				}
+				continue
+			}
+
+			// enable wildcards
+			if strings.HasPrefix(key, "*") {
+				zone.Wildcards = true
+			}
+
+			// add set
+			index[key] = append(index[key], set)
+			list = append(list, set)
+		}
+
+		// check CNAME sets
+		for _, set := range index[key] {
+			if set.Type == CNAME && len(index[key]) > 1 {
+				return nil, fmt.Errorf("CNAME set with other sets: %s", set.Name)
+			}
+		}
+
+		// mark ancestors as non-terminals
+		for i := strings.IndexByte(key, '.'); i >= 0; i = strings.IndexByte(key, '.') {
+			key = key[i+1:]
+			nonTerminals[key] = true
+		}
+	}
+
+	// sort list
+	sortSets(list)
+
+	// set default name servers
+	if len(apexNS) > 0 {
+		zone.MasterNameServer = apexNS[0]
+		zone.AllNameServers = apexNS
+	}
+
+	// set handler
+	zone.Handler = func(ctx context.Context, name string) ([]Set, error) {
+		return index[strings.ToLower(name)], nil
+	}
+
+	// set non-terminal callback
+	zone.NonTerminal = func(ctx context.Context, name string) (bool, error) {
+		return nonTerminals[strings.ToLower(name)], nil
+	}
+
+	// set lister
+	zone.Lister = func(ctx context.Context, fn func(Set) error) error {
+		for _, set := range list {
+			err := fn(set)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// apply options
+	for _, opt := range opts {
+		opt(zone)
+	}
+
+	// check name servers
+	if len(zone.AllNameServers) == 0 {
+		return nil, fmt.Errorf("missing name servers")
+	}
+
+	// validate zone
+	err := zone.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return zone, nil
+}
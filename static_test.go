@@ -0,0 +1,98 @@
+package newdns
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewStaticZone(t *testing.T) {
+	zone, err := NewStaticZone("example.com.", map[string][]Set{
+		"": {
+			{Name: "example.com.", Type: NS, Records: []Record{{Address: "ns1.example.com."}, {Address: "ns2.example.com."}}},
+			{Name: "example.com.", Type: A, Records: []Record{{Address: "1.2.3.4"}}},
+		},
+		"www": {
+			{Name: "www.example.com.", Type: CNAME, Records: []Record{{Address: "example.com."}}},
+		},
+		"*.wild": {
+			{Name: "*.wild.example.com.", Type: TXT, Records: []Record{{Data: []string{"foo"}}}},
+		},
+		"foo.bar": {
+			{Name: "foo.bar.example.com.", Type: A, Records: []Record{{Address: "1.2.3.4"}}},
+		},
+	}, func(zone *Zone) {
+		zone.MinTTL = time.Minute
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "ns1.example.com.", zone.MasterNameServer)
+	assert.Equal(t, []string{"ns1.example.com.", "ns2.example.com."}, zone.AllNameServers)
+	assert.Equal(t, time.Minute, zone.MinTTL)
+	assert.True(t, zone.Wildcards)
+
+	res, exists, err := zone.Lookup(context.Background(), "WWW.example.com.", A)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, CNAME, res[0].Type)
+
+	res, exists, err = zone.Lookup(context.Background(), "x.wild.example.com.", TXT)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, "x.wild.example.com.", res[0].Name)
+
+	res, exists, err = zone.Lookup(context.Background(), "bar.example.com.", A)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.Nil(t, res)
+
+	res, exists, err = zone.Lookup(context.Background(), "baz.example.com.", A)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.Nil(t, res)
+
+	var names []string
+	err = zone.Lister(context.Background(), func(set Set) error {
+		names = append(names, set.Name)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"*.wild.example.com.",
+		"example.com.",
+		"foo.bar.example.com.",
+		"www.example.com.",
+	}, names)
+}
+
+func TestNewStaticZoneErrors(t *testing.T) {
+	_, err := NewStaticZone("example.com", nil)
+	assert.Error(t, err)
+
+	_, err = NewStaticZone("example.com.", nil)
+	assert.Equal(t, "missing name servers", err.Error())
+
+	ns := Set{Name: "example.com.", Type: NS, Records: []Record{{Address: "ns1.example.com."}}}
+
+	_, err = NewStaticZone("example.com.", map[string][]Set{
+		"":    {ns},
+		"www": {{Name: "foo.example.com.", Type: A, Records: []Record{{Address: "1.2.3.4"}}}},
+	})
+	assert.Equal(t, "set name does not match key: foo.example.com.", err.Error())
+
+	_, err = NewStaticZone("example.com.", map[string][]Set{
+		"":    {ns},
+		"www": {{Name: "www.example.com.", Type: A}},
+	})
+	assert.Equal(t, "invalid set: missing records", err.Error())
+
+	_, err = NewStaticZone("example.com.", map[string][]Set{
+		"": {ns},
+		"www": {
+			{Name: "www.example.com.", Type: CNAME, Records: []Record{{Address: "example.com."}}},
+			{Name: "www.example.com.", Type: A, Records: []Record{{Address: "1.2.3.4"}}},
+		},
+	})
+	assert.Equal(t, "CNAME set with other sets: www.example.com.", err.Error())
+}
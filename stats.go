@@ -0,0 +1,128 @@
+package newdns
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// StatsSink receives the counter and timing updates collected by the metrics.
+type StatsSink interface {
+	// Count is called when the named counter has been incremented.
+	Count(name string, tags map[string]string, delta uint64)
+
+	// Timing is called when a duration has been observed.
+	Timing(name string, duration time.Duration)
+}
+
+// ExpvarSink is a stats sink that publishes counters and timings using the
+// expvar package.
+type ExpvarSink struct {
+	vars *expvar.Map
+}
+
+// NewExpvarSink creates and returns a new expvar sink that publishes a map
+// with the specified name. As with expvar.Publish, the name must be unique.
+func NewExpvarSink(name string) *ExpvarSink {
+	return &ExpvarSink{
+		vars: expvar.NewMap(name),
+	}
+}
+
+// Count implements the StatsSink interface.
+func (s *ExpvarSink) Count(name string, tags map[string]string, delta uint64) {
+	s.vars.Add(statsName(name, tags), int64(delta))
+}
+
+// Timing implements the StatsSink interface.
+func (s *ExpvarSink) Timing(name string, duration time.Duration) {
+	s.vars.Add(name+"_count", 1)
+	s.vars.AddFloat(name+"_seconds", duration.Seconds())
+}
+
+// StatsdSink is a stats sink that sends counters and timings to a statsd
+// server over UDP. Tags are appended to the metric names.
+type StatsdSink struct {
+	conn   net.Conn
+	prefix string
+}
+
+// NewStatsdSink creates and returns a new statsd sink that sends metrics
+// prefixed with the optional prefix to the specified address.
+func NewStatsdSink(addr, prefix string) (*StatsdSink, error) {
+	// dial server
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// ensure prefix separator
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+
+	return &StatsdSink{
+		conn:   conn,
+		prefix: prefix,
+	}, nil
+}
+
+// Count implements the StatsSink interface.
+func (s *StatsdSink) Count(name string, tags map[string]string, delta uint64) {
+	s.send(fmt.Sprintf("%s%s:%d|c", s.prefix, statsName(name, tags), delta))
+}
+
+// Timing implements the StatsSink interface.
+func (s *StatsdSink) Timing(name string, duration time.Duration) {
+	s.send(fmt.Sprintf("%s%s:%g|ms", s.prefix, name, float64(duration)/float64(time.Millisecond)))
+}
+
+// Close will close the connection.
+func (s *StatsdSink) Close() error {
+	return s.conn.Close()
+}
+
+func (s *StatsdSink) send(line string) {
+	_, _ = s.conn.Write([]byte(line))
+}
+
+func statsName(name string, tags map[string]string) string {
+	// sort keys
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// append values
+	var buf bytes.Buffer
+	buf.WriteString(name)
+	for _, key := range keys {
+		buf.WriteByte('.')
+		buf.WriteString(statsValue(tags[key]))
+	}
+
+	return buf.String()
+}
+
+func statsValue(value string) string {
+	// trim trailing dot
+	value = strings.TrimSuffix(value, ".")
+	if value == "" {
+		return "none"
+	}
+
+	// replace reserved characters
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', ':', '|', '@', '#', ' ':
+			return '_'
+		default:
+			return r
+		}
+	}, value)
+}
@@ -0,0 +1,49 @@
+package newdns
+
+import (
+	"expvar"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatsSinks(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	statsd, err := NewStatsdSink(conn.LocalAddr().String(), "newdns")
+	assert.NoError(t, err)
+	defer statsd.Close()
+
+	ev := NewExpvarSink("newdns-test")
+
+	metrics := NewMetrics(nil)
+	metrics.AddSink(statsd)
+	metrics.AddSink(ev)
+
+	metrics.Log(Entry{Event: Finish, Info: &EventInfo{
+		Question:     dns.Question{Name: "example.com.", Qtype: dns.TypeA},
+		Zone:         "example.com.",
+		ResponseSize: 100,
+		Elapsed:      5 * time.Millisecond,
+	}})
+
+	buf := make([]byte, 512)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	n, _, err := conn.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "newdns.queries.NOERROR.A.example_com:1|c", string(buf[:n]))
+
+	n, _, err = conn.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "newdns.query_duration:5|ms", string(buf[:n]))
+
+	vars := expvar.Get("newdns-test").(*expvar.Map)
+	assert.Equal(t, "1", vars.Get("queries.NOERROR.A.example_com").String())
+	assert.Equal(t, "1", vars.Get("query_duration_count").String())
+}
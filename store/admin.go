@@ -0,0 +1,761 @@
+package store
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/256dpi/newdns"
+)
+
+// ErrUnknownZone is returned by the admin service for zones that are not
+// managed by it.
+var ErrUnknownZone = errors.New("unknown zone")
+
+// ErrUnknownSet is returned by the admin service for sets that do not exist.
+var ErrUnknownSet = errors.New("unknown set")
+
+// ErrWatcherBehind is returned by Watch if the watcher fell behind.
+var ErrWatcherBehind = errors.New("watcher fell behind")
+
+// ErrZoneExists is returned by the admin service for zones that are already
+// managed by it.
+var ErrZoneExists = errors.New("zone already added")
+
+// ZoneInfo is the serializable description of a zone managed by the admin
+// service.
+type ZoneInfo struct {
+	// The FQDN of the zone.
+	Name string `json:"name"`
+
+	// The FQDN of the master name server.
+	//
+	// Default: The first name server.
+	MasterNameServer string `json:"master_name_server,omitempty"`
+
+	// The FQDNs of all name servers.
+	AllNameServers []string `json:"all_name_servers"`
+
+	// The email address of the administrator.
+	AdminEmail string `json:"admin_email,omitempty"`
+
+	// The current serial of the zone. It is ignored when creating zones.
+	Serial uint32 `json:"serial,omitempty"`
+}
+
+// AdminStatus describes the status of the admin service.
+type AdminStatus struct {
+	// The number of managed zones.
+	Zones int `json:"zones"`
+
+	// The query counters of the server if available.
+	Queries uint64            `json:"queries"`
+	Rcodes  map[string]uint64 `json:"rcodes,omitempty"`
+	Types   map[string]uint64 `json:"types,omitempty"`
+}
+
+// AdminChange describes a change made using the admin service.
+type AdminChange struct {
+	// The FQDN of the changed zone.
+	Zone string `json:"zone"`
+
+	// The relative name and type of the changed set. Both are empty if the
+	// zone itself has been created or deleted.
+	Name string `json:"name,omitempty"`
+	Type string `json:"type,omitempty"`
+
+	// Whether the zone or set has been deleted.
+	Deleted bool `json:"deleted,omitempty"`
+
+	// The serial of the zone after the change.
+	Serial uint32 `json:"serial,omitempty"`
+}
+
+// AdminConfig provides configuration for an admin service.
+type AdminConfig struct {
+	// The mux that serves the managed zones.
+	Mux *newdns.ZoneMux
+
+	// The API keys that are accepted in the "Authorization" header using the
+	// "Bearer" scheme. Requests are rejected if no keys are configured.
+	Keys []string
+
+	// The function used to create the backend for a new zone.
+	//
+	// Default: NewMemory.
+	Backend func(name string) (Backend, error)
+
+	// The optional server used to report query counters with the status.
+	Server *newdns.Server
+
+	// The number of changes queued for each watcher of the changes stream.
+	// Watchers that fall behind are disconnected.
+	//
+	// Default: 64.
+	WatchBuffer int
+}
+
+// Admin is an HTTP service that manages the zones, sets and records of
+// store backends. It provides the following endpoints:
+//
+//	GET    /zones                                   list zones
+//	POST   /zones                                   create zone
+//	GET    /zones/{zone}                            get zone
+//	DELETE /zones/{zone}                            delete zone
+//	GET    /zones/{zone}/sets?search={term}         list or search sets
+//	GET    /zones/{zone}/sets/{name}/{type}         get set
+//	PUT    /zones/{zone}/sets/{name}/{type}         replace set
+//	DELETE /zones/{zone}/sets/{name}/{type}         delete set
+//	POST   /zones/{zone}/sets/{name}/{type}/records add record
+//	DELETE /zones/{zone}/sets/{name}/{type}/records delete record
+//	GET    /status                                  get status
+//	GET    /changes                                 stream changes
+//
+// Zones are encoded as ZoneInfo, sets as newdns.SetDefinition and records as
+// newdns.RecordDefinition. The status is encoded as AdminStatus and changes are
+// streamed as newline delimited AdminChange objects. Set names are relative to
+// the zone e.g. "www" or "@" for the apex. Changes increment the serial of the
+// zone. The same operations are available as methods to build other
+// interfaces.
+type Admin struct {
+	config    AdminConfig
+	mutex     sync.RWMutex
+	zones     map[string]*adminZone
+	listeners map[*func(AdminChange)]struct{}
+}
+
+type adminZone struct {
+	zone    *newdns.Zone
+	backend Backend
+}
+
+// NewAdmin creates and returns a new admin service.
+func NewAdmin(config AdminConfig) *Admin {
+	// set default backend
+	if config.Backend == nil {
+		config.Backend = func(string) (Backend, error) {
+			return NewMemory(), nil
+		}
+	}
+
+	// set default watch buffer
+	if config.WatchBuffer <= 0 {
+		config.WatchBuffer = 64
+	}
+
+	return &Admin{
+		config:    config,
+		zones:     map[string]*adminZone{},
+		listeners: map[*func(AdminChange)]struct{}{},
+	}
+}
+
+// Add will configure the provided zone to use the backend, add it to the mux
+// and manage it using the admin service.
+func (a *Admin) Add(zone *newdns.Zone, backend Backend) error {
+	// acquire mutex
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	// check existing
+	name := newdns.NormalizeDomain(zone.Name, true, true, false)
+	if _, ok := a.zones[name]; ok {
+		return fmt.Errorf("%w: %s", ErrZoneExists, zone.Name)
+	}
+
+	// configure zone
+	Configure(zone, backend)
+
+	// add zone
+	err := a.config.Mux.Add(zone)
+	if err != nil {
+		return invalid(err)
+	}
+
+	// store zone
+	a.zones[name] = &adminZone{
+		zone:    zone,
+		backend: backend,
+	}
+
+	return nil
+}
+
+// Subscribe will register the provided function to be called with every
+// change made using the admin service. The returned function removes the
+// subscription.
+func (a *Admin) Subscribe(fn func(AdminChange)) func() {
+	// acquire mutex
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	// add listener
+	key := &fn
+	a.listeners[key] = struct{}{}
+
+	return func() {
+		a.mutex.Lock()
+		delete(a.listeners, key)
+		a.mutex.Unlock()
+	}
+}
+
+// Zones returns the sorted managed zones.
+func (a *Admin) Zones() []ZoneInfo {
+	// acquire mutex
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	// collect zones
+	list := make([]ZoneInfo, 0, len(a.zones))
+	for _, zone := range a.zones {
+		list = append(list, zone.info())
+	}
+
+	// sort zones
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+
+	return list
+}
+
+// Zone returns the managed zone with the specified name.
+func (a *Admin) Zone(name string) (ZoneInfo, error) {
+	// get zone
+	zone, err := a.get(name)
+	if err != nil {
+		return ZoneInfo{}, err
+	}
+
+	return zone.info(), nil
+}
+
+// CreateZone will create a zone with a new backend and add it to the mux.
+func (a *Admin) CreateZone(info ZoneInfo) (ZoneInfo, error) {
+	// prepare zone
+	zone := &newdns.Zone{
+		Name:             newdns.NormalizeDomain(info.Name, true, true, false),
+		MasterNameServer: info.MasterNameServer,
+		AllNameServers:   info.AllNameServers,
+		AdminEmail:       info.AdminEmail,
+	}
+
+	// set default master name server
+	if zone.MasterNameServer == "" && len(zone.AllNameServers) > 0 {
+		zone.MasterNameServer = zone.AllNameServers[0]
+	}
+
+	// create backend
+	backend, err := a.config.Backend(zone.Name)
+	if err != nil {
+		return ZoneInfo{}, err
+	}
+
+	// add zone
+	err = a.Add(zone, backend)
+	if err != nil {
+		return ZoneInfo{}, err
+	}
+
+	// get info
+	info = (&adminZone{zone: zone, backend: backend}).info()
+
+	// emit change
+	a.emit(AdminChange{
+		Zone:   info.Name,
+		Serial: info.Serial,
+	})
+
+	return info, nil
+}
+
+// DeleteZone will remove the zone with the specified name from the mux and
+// stop managing it. The backend is left untouched.
+func (a *Admin) DeleteZone(name string) error {
+	// acquire mutex
+	a.mutex.Lock()
+
+	// check zone
+	name = newdns.NormalizeDomain(name, true, true, false)
+	if _, ok := a.zones[name]; !ok {
+		a.mutex.Unlock()
+		return ErrUnknownZone
+	}
+
+	// remove zone
+	a.config.Mux.Remove(name)
+	delete(a.zones, name)
+
+	// release mutex
+	a.mutex.Unlock()
+
+	// emit change
+	a.emit(AdminChange{
+		Zone:    name,
+		Deleted: true,
+	})
+
+	return nil
+}
+
+// Sets returns the sets of the specified zone. If a search term is provided,
+// only sets with names that contain the term are returned.
+func (a *Admin) Sets(ctx context.Context, zone, search string) ([]newdns.SetDefinition, error) {
+	// get zone
+	z, err := a.get(zone)
+	if err != nil {
+		return nil, err
+	}
+
+	// collect sets
+	term := strings.ToLower(search)
+	list := make([]newdns.SetDefinition, 0)
+	err = z.backend.List(ctx, func(set newdns.Set) error {
+		if term == "" || strings.Contains(strings.ToLower(set.Name), term) {
+			list = append(list, newdns.DefineSet(z.zone.Name, set))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// Set returns the set with the specified relative name and type.
+func (a *Admin) Set(ctx context.Context, zone, name, typ string) (newdns.SetDefinition, error) {
+	// get zone and set
+	z, set, err := a.getSet(zone, name, typ)
+	if err != nil {
+		return newdns.SetDefinition{}, err
+	}
+
+	// lookup sets
+	sets, err := z.backend.Lookup(ctx, set.Name)
+	if err != nil {
+		return newdns.SetDefinition{}, err
+	}
+
+	// find set
+	for _, item := range sets {
+		if item.Type == set.Type {
+			return newdns.DefineSet(z.zone.Name, item), nil
+		}
+	}
+
+	return newdns.SetDefinition{}, ErrUnknownSet
+}
+
+// PutSet will replace or add the set with the name and type of the provided
+// definition.
+func (a *Admin) PutSet(ctx context.Context, zone string, def newdns.SetDefinition) (newdns.SetDefinition, error) {
+	// get zone
+	z, err := a.get(zone)
+	if err != nil {
+		return newdns.SetDefinition{}, err
+	}
+
+	// get set
+	set, err := def.Set(z.zone.Name)
+	if err != nil {
+		return newdns.SetDefinition{}, invalid(err)
+	}
+
+	// replace set
+	err = a.commit(ctx, z, set, newdns.DeleteSet, newdns.AddRecords)
+	if err != nil {
+		return newdns.SetDefinition{}, err
+	}
+
+	return newdns.DefineSet(z.zone.Name, set), nil
+}
+
+// DeleteSet will delete the set with the specified relative name and type.
+func (a *Admin) DeleteSet(ctx context.Context, zone, name, typ string) error {
+	// get zone and set
+	z, set, err := a.getSet(zone, name, typ)
+	if err != nil {
+		return err
+	}
+
+	return a.commit(ctx, z, set, newdns.DeleteSet)
+}
+
+// AddRecord will add the record to the set with the specified relative name
+// and type. The set is created if it does not exist.
+func (a *Admin) AddRecord(ctx context.Context, zone, name, typ string, record newdns.RecordDefinition) error {
+	return a.updateRecord(ctx, zone, name, typ, record, newdns.AddRecords)
+}
+
+// DeleteRecord will delete the record from the set with the specified
+// relative name and type. The set is deleted if it becomes empty.
+func (a *Admin) DeleteRecord(ctx context.Context, zone, name, typ string, record newdns.RecordDefinition) error {
+	return a.updateRecord(ctx, zone, name, typ, record, newdns.DeleteRecords)
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// check key
+	if !a.Authorized(r.Header.Get("Authorization")) {
+		writeError(w, http.StatusUnauthorized, errors.New("invalid API key"))
+		return
+	}
+
+	// split path
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	// handle status and changes
+	if len(path) == 1 && r.Method == http.MethodGet {
+		switch path[0] {
+		case "status":
+			writeJSON(w, http.StatusOK, a.Status())
+			return
+		case "changes":
+			a.watch(w, r)
+			return
+		}
+	}
+
+	// check path
+	if path[0] != "zones" {
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+
+	// handle zones
+	if len(path) == 1 {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, a.Zones())
+		case http.MethodPost:
+			var info ZoneInfo
+			err := invalid(json.NewDecoder(r.Body).Decode(&info))
+			if err == nil {
+				info, err = a.CreateZone(info)
+			}
+			writeResult(w, http.StatusCreated, info, err)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		}
+		return
+	}
+
+	// handle zone
+	zone := path[1]
+	switch {
+	case len(path) == 2 && r.Method == http.MethodGet:
+		info, err := a.Zone(zone)
+		writeResult(w, http.StatusOK, info, err)
+	case len(path) == 2 && r.Method == http.MethodDelete:
+		err := a.DeleteZone(zone)
+		writeResult(w, http.StatusNoContent, nil, err)
+	case len(path) == 3 && path[2] == "sets" && r.Method == http.MethodGet:
+		sets, err := a.Sets(r.Context(), zone, r.URL.Query().Get("search"))
+		writeResult(w, http.StatusOK, sets, err)
+	case len(path) == 5 && path[2] == "sets" && r.Method == http.MethodGet:
+		set, err := a.Set(r.Context(), zone, path[3], path[4])
+		writeResult(w, http.StatusOK, set, err)
+	case len(path) == 5 && path[2] == "sets" && r.Method == http.MethodPut:
+		var def newdns.SetDefinition
+		err := invalid(json.NewDecoder(r.Body).Decode(&def))
+		if err == nil {
+			def.Name, def.Type = path[3], path[4]
+			def, err = a.PutSet(r.Context(), zone, def)
+		}
+		writeResult(w, http.StatusOK, def, err)
+	case len(path) == 5 && path[2] == "sets" && r.Method == http.MethodDelete:
+		err := a.DeleteSet(r.Context(), zone, path[3], path[4])
+		writeResult(w, http.StatusNoContent, nil, err)
+	case len(path) == 6 && path[2] == "sets" && path[5] == "records" && (r.Method == http.MethodPost || r.Method == http.MethodDelete):
+		var record newdns.RecordDefinition
+		err := invalid(json.NewDecoder(r.Body).Decode(&record))
+		if err == nil && r.Method == http.MethodPost {
+			err = a.AddRecord(r.Context(), zone, path[3], path[4], record)
+		} else if err == nil {
+			err = a.DeleteRecord(r.Context(), zone, path[3], path[4], record)
+		}
+		writeResult(w, http.StatusNoContent, nil, err)
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+// Status returns the status of the admin service.
+func (a *Admin) Status() AdminStatus {
+	// prepare status
+	status := AdminStatus{
+		Zones: len(a.Zones()),
+	}
+
+	// add counters
+	if a.config.Server != nil {
+		counters := a.config.Server.Counters()
+		status.Queries = counters.Queries
+		status.Rcodes = counters.Rcodes
+		status.Types = counters.Types
+	}
+
+	return status
+}
+
+// Authorized returns whether the provided "Authorization" header value
+// contains a configured API key using the "Bearer" scheme.
+func (a *Admin) Authorized(header string) bool {
+	// get key
+	key, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok {
+		return false
+	}
+
+	// check keys
+	for _, item := range a.config.Keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(item)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Watch returns a watcher that queues all changes made using the admin service
+// until it is closed. The number of queued changes is limited by the
+// configured watch buffer.
+func (a *Admin) Watch() *AdminWatcher {
+	// prepare watcher
+	w := &AdminWatcher{
+		queue:    make(chan AdminChange, a.config.WatchBuffer),
+		overflow: make(chan struct{}),
+	}
+
+	// subscribe changes
+	w.unsubscribe = a.Subscribe(func(change AdminChange) {
+		select {
+		case w.queue <- change:
+		default:
+			select {
+			case <-w.overflow:
+			default:
+				close(w.overflow)
+			}
+		}
+	})
+
+	return w
+}
+
+// AdminWatcher queues the changes made using an admin service.
+type AdminWatcher struct {
+	queue       chan AdminChange
+	overflow    chan struct{}
+	unsubscribe func()
+}
+
+// Next returns the next queued change. It returns ErrWatcherBehind if the
+// queue overflowed and the context error if the context is cancelled.
+func (w *AdminWatcher) Next(ctx context.Context) (AdminChange, error) {
+	select {
+	case change := <-w.queue:
+		return change, nil
+	case <-w.overflow:
+		return AdminChange{}, ErrWatcherBehind
+	case <-ctx.Done():
+		return AdminChange{}, ctx.Err()
+	}
+}
+
+// Close will stop queueing changes.
+func (w *AdminWatcher) Close() {
+	w.unsubscribe()
+}
+
+func (a *Admin) watch(w http.ResponseWriter, r *http.Request) {
+	// check flusher
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming not supported"))
+		return
+	}
+
+	// watch changes
+	watcher := a.Watch()
+	defer watcher.Close()
+
+	// write header
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// stream changes
+	encoder := json.NewEncoder(w)
+	for {
+		change, err := watcher.Next(r.Context())
+		if err != nil {
+			return
+		}
+		err = encoder.Encode(change)
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func (a *Admin) get(name string) (*adminZone, error) {
+	// acquire mutex
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	// get zone
+	zone, ok := a.zones[newdns.NormalizeDomain(name, true, true, false)]
+	if !ok {
+		return nil, ErrUnknownZone
+	}
+
+	return zone, nil
+}
+
+func (a *Admin) getSet(zone, name, typ string) (*adminZone, newdns.Set, error) {
+	// get zone
+	z, err := a.get(zone)
+	if err != nil {
+		return nil, newdns.Set{}, err
+	}
+
+	// get set
+	def := newdns.SetDefinition{
+		Name: name,
+		Type: typ,
+	}
+	set, err := def.Set(z.zone.Name)
+	if err != nil {
+		return nil, newdns.Set{}, invalid(err)
+	}
+
+	return z, set, nil
+}
+
+func (a *Admin) updateRecord(ctx context.Context, zone, name, typ string, record newdns.RecordDefinition, op newdns.UpdateOperation) error {
+	// get zone and set
+	z, set, err := a.getSet(zone, name, typ)
+	if err != nil {
+		return err
+	}
+
+	// add record
+	set.Records = []newdns.Record{{
+		Address:  record.Address,
+		Priority: record.Priority,
+		Weight:   record.Weight,
+		Port:     record.Port,
+		Data:     record.Data,
+	}}
+
+	return a.commit(ctx, z, set, op)
+}
+
+func (a *Admin) commit(ctx context.Context, zone *adminZone, set newdns.Set, ops ...newdns.UpdateOperation) error {
+	// prepare updates
+	updates := make([]newdns.Update, 0, len(ops))
+	for _, op := range ops {
+		updates = append(updates, newdns.Update{
+			Operation: op,
+			Set:       set,
+		})
+	}
+
+	// commit updates
+	err := Commit(ctx, zone.backend, updates)
+	if err != nil {
+		return err
+	}
+
+	// get definition
+	def := newdns.DefineSet(zone.zone.Name, set)
+
+	// emit change
+	a.emit(AdminChange{
+		Zone:    zone.zone.Name,
+		Name:    def.Name,
+		Type:    def.Type,
+		Deleted: ops[0] == newdns.DeleteSet && len(ops) == 1,
+		Serial:  zone.backend.Serial(),
+	})
+
+	return nil
+}
+
+func (a *Admin) emit(change AdminChange) {
+	// acquire mutex
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	// call listeners
+	for fn := range a.listeners {
+		(*fn)(change)
+	}
+}
+
+func (z *adminZone) info() ZoneInfo {
+	return ZoneInfo{
+		Name:             z.zone.Name,
+		MasterNameServer: z.zone.MasterNameServer,
+		AllNameServers:   z.zone.AllNameServers,
+		AdminEmail:       z.zone.AdminEmail,
+		Serial:           z.backend.Serial(),
+	}
+}
+
+func writeResult(w http.ResponseWriter, status int, value interface{}, err error) {
+	// handle error
+	switch {
+	case errors.Is(err, ErrUnknownZone) || errors.Is(err, ErrUnknownSet):
+		writeError(w, http.StatusNotFound, err)
+		return
+	case errors.Is(err, ErrZoneExists):
+		writeError(w, http.StatusConflict, err)
+		return
+	case errors.Is(err, newdns.ErrValidation):
+		writeError(w, http.StatusBadRequest, err)
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// handle empty response
+	if value == nil {
+		w.WriteHeader(status)
+		return
+	}
+
+	writeJSON(w, status, value)
+}
+
+func invalid(err error) error {
+	// check error
+	if err == nil {
+		return nil
+	}
+
+	return &newdns.Error{Kind: newdns.ErrValidation, Err: err}
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{
+		"error": err.Error(),
+	})
+}
@@ -0,0 +1,199 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/256dpi/newdns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdmin(t *testing.T) {
+	mux := newdns.NewZoneMux()
+	admin := NewAdmin(AdminConfig{
+		Mux:  mux,
+		Keys: []string{"secret"},
+	})
+
+	var changes []AdminChange
+	unsubscribe := admin.Subscribe(func(change AdminChange) {
+		changes = append(changes, change)
+	})
+
+	request := func(method, path, body string) (int, string) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, req)
+		return rec.Code, strings.TrimSpace(rec.Body.String())
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/zones", nil)
+	rec := httptest.NewRecorder()
+	admin.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/zones", nil)
+	req.Header.Set("Authorization", "secret")
+	rec = httptest.NewRecorder()
+	admin.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	code, body := request(http.MethodPost, "/zones", `{"name": "example.com", "all_name_servers": ["ns1.example.com."]}`)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, `{"name":"example.com.","master_name_server":"ns1.example.com.","all_name_servers":["ns1.example.com."],"admin_email":"hostmaster@example.com.","serial":1}`, body)
+	assert.Equal(t, []string{"example.com."}, mux.Zones())
+
+	code, _ = request(http.MethodPost, "/zones", `{"name": "example.com.", "all_name_servers": ["ns1.example.com."]}`)
+	assert.Equal(t, http.StatusConflict, code)
+
+	code, body = request(http.MethodGet, "/zones", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `[{"name":"example.com.","master_name_server":"ns1.example.com.","all_name_servers":["ns1.example.com."],"admin_email":"hostmaster@example.com.","serial":1}]`, body)
+
+	code, body = request(http.MethodPut, "/zones/example.com/sets/www/A", `{"ttl": "1m", "records": [{"address": "1.2.3.4"}]}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `{"name":"www","type":"A","ttl":"1m","records":[{"address":"1.2.3.4"}]}`, body)
+
+	code, _ = request(http.MethodPost, "/zones/example.com/sets/www/A/records", `{"address": "1.2.3.5"}`)
+	assert.Equal(t, http.StatusNoContent, code)
+
+	code, _ = request(http.MethodPut, "/zones/example.com/sets/mail/MX", `{"records": [{"address": "mail.example.com.", "priority": 10}]}`)
+	assert.Equal(t, http.StatusOK, code)
+
+	code, body = request(http.MethodGet, "/zones/example.com/sets/www/A", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `{"name":"www","type":"A","ttl":"1m","records":[{"address":"1.2.3.4"},{"address":"1.2.3.5"}]}`, body)
+
+	code, body = request(http.MethodGet, "/zones/example.com/sets?search=mail", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `[{"name":"mail","type":"MX","ttl":"5m","records":[{"address":"mail.example.com.","priority":10}]}]`, body)
+
+	zone, err := mux.Handle(context.Background(), "www.example.com.")
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(4), zone.SerialFunc())
+
+	sets, err := zone.Handler(context.Background(), "www")
+	assert.NoError(t, err)
+	assert.Equal(t, []newdns.Set{
+		{
+			Name: "www.example.com.",
+			Type: newdns.A,
+			Records: []newdns.Record{
+				{Address: "1.2.3.4"},
+				{Address: "1.2.3.5"},
+			},
+			TTL: time.Minute,
+		},
+	}, sets)
+
+	code, _ = request(http.MethodDelete, "/zones/example.com/sets/www/A/records", `{"address": "1.2.3.4"}`)
+	assert.Equal(t, http.StatusNoContent, code)
+
+	code, _ = request(http.MethodDelete, "/zones/example.com/sets/mail/MX", "")
+	assert.Equal(t, http.StatusNoContent, code)
+
+	code, body = request(http.MethodGet, "/zones/example.com/sets", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `[{"name":"www","type":"A","ttl":"1m","records":[{"address":"1.2.3.5"}]}]`, body)
+
+	code, body = request(http.MethodPut, "/zones/example.com/sets/www/CAA", `{}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, `{"error":"unsupported type: CAA"}`, body)
+
+	code, _ = request(http.MethodPost, "/zones/example.com/sets/www/A/records", `{"address": "foo"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = request(http.MethodPost, "/zones/example.com/sets/www/A/records", `{"address":`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = request(http.MethodDelete, "/zones/example.com", "")
+	assert.Equal(t, http.StatusNoContent, code)
+	assert.Empty(t, mux.Zones())
+
+	unsubscribe()
+
+	assert.Equal(t, []AdminChange{
+		{Zone: "example.com.", Serial: 1},
+		{Zone: "example.com.", Name: "www", Type: "A", Serial: 2},
+		{Zone: "example.com.", Name: "www", Type: "A", Serial: 3},
+		{Zone: "example.com.", Name: "mail", Type: "MX", Serial: 4},
+		{Zone: "example.com.", Name: "www", Type: "A", Serial: 5},
+		{Zone: "example.com.", Name: "mail", Type: "MX", Deleted: true, Serial: 6},
+		{Zone: "example.com.", Deleted: true},
+	}, changes)
+
+	code, _ = request(http.MethodGet, "/zones/example.com", "")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, body = request(http.MethodGet, "/status", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `{"zones":0,"queries":0}`, body)
+}
+
+func TestAdminBackendError(t *testing.T) {
+	admin := NewAdmin(AdminConfig{
+		Mux:  newdns.NewZoneMux(),
+		Keys: []string{"secret"},
+		Backend: func(string) (Backend, error) {
+			return nil, errors.New("unavailable")
+		},
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/zones", strings.NewReader(`{"name": "example.com", "all_name_servers": ["ns1.example.com."]}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	admin.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Equal(t, `{"error":"unavailable"}`, strings.TrimSpace(rec.Body.String()))
+}
+
+func TestAdminServer(t *testing.T) {
+	admin := NewAdmin(AdminConfig{
+		Mux:  newdns.NewZoneMux(),
+		Keys: []string{"secret"},
+	})
+
+	server := httptest.NewServer(admin)
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/zones", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer secret")
+
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	assert.NoError(t, err)
+
+	var list []ZoneInfo
+	err = json.Unmarshal(data, &list)
+	assert.NoError(t, err)
+	assert.Empty(t, list)
+
+	req, err = http.NewRequest(http.MethodGet, server.URL+"/changes", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer secret")
+
+	stream, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer stream.Body.Close()
+	assert.Equal(t, "application/x-ndjson", stream.Header.Get("Content-Type"))
+
+	_, err = admin.CreateZone(ZoneInfo{Name: "example.com.", AllNameServers: []string{"ns1.example.com."}})
+	assert.NoError(t, err)
+
+	var change AdminChange
+	err = json.NewDecoder(stream.Body).Decode(&change)
+	assert.NoError(t, err)
+	assert.Equal(t, AdminChange{Zone: "example.com.", Serial: 1}, change)
+}
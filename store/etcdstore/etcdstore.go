@@ -0,0 +1,491 @@
+// Package etcdstore provides a store backend for newdns zones that keeps the
+// sets in etcd.
+//
+// The sets of a zone are stored using the following key layout, where the
+// prefix is configurable and the zone and names are fully qualified and in
+// lower case:
+//
+//	{prefix}/{zone}/serial              the serial as a decimal string
+//	{prefix}/{zone}/sets/{name}/{type}  a set encoded as JSON (see below)
+//
+// Sets are encoded as JSON objects with the TTL in seconds and the records as
+// newdns.RecordDefinition values e.g. {"ttl":300,"records":[{"address":
+// "1.2.3.4"}]}. The type is the numeric record type e.g. "1" for A records.
+//
+// The backend watches the zone prefix and serves lookups from an in-memory
+// snapshot that reflects all changes up to the latest watched revision.
+package etcdstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/256dpi/newdns"
+	"github.com/256dpi/newdns/store"
+)
+
+// ErrConflict is returned by Update if the zone has been modified
+// concurrently.
+var ErrConflict = errors.New("concurrent modification")
+
+// Config provides configuration for an etcd backend.
+type Config struct {
+	// The client used to access etcd.
+	Client *clientv3.Client
+
+	// The FQDN of the zone.
+	Zone string
+
+	// The prefix of all keys.
+	//
+	// Default: "/newdns".
+	Prefix string
+
+	// The logger called with errors encountered while watching the zone.
+	Logger newdns.Logger
+}
+
+// Backend is a store backend that keeps the sets of a zone in etcd.
+type Backend struct {
+	config   Config
+	prefix   string
+	mutex    sync.RWMutex
+	snapshot *store.Trie
+	revision int64
+	changed  chan struct{}
+	ready    chan struct{}
+	close    chan struct{}
+}
+
+// New creates and returns a new etcd backend. The backend must be run to load
+// and watch the zone.
+func New(config Config) *Backend {
+	// normalize zone
+	config.Zone = newdns.NormalizeDomain(config.Zone, true, true, false)
+
+	// set default prefix
+	if config.Prefix == "" {
+		config.Prefix = "/newdns"
+	}
+
+	return &Backend{
+		config:   config,
+		prefix:   strings.TrimSuffix(config.Prefix, "/") + "/" + config.Zone + "/",
+		snapshot: store.NewTrie(),
+		changed:  make(chan struct{}),
+		ready:    make(chan struct{}),
+		close:    make(chan struct{}),
+	}
+}
+
+// Ready returns a channel that is closed once the zone has been loaded.
+func (b *Backend) Ready() <-chan struct{} {
+	return b.ready
+}
+
+// Lookup implements the store.Backend interface.
+func (b *Backend) Lookup(ctx context.Context, name string) ([]newdns.Set, error) {
+	return b.current().Lookup(ctx, name)
+}
+
+// NonTerminal implements the store.NonTerminalBackend interface.
+func (b *Backend) NonTerminal(ctx context.Context, name string) (bool, error) {
+	return b.current().NonTerminal(ctx, name)
+}
+
+// List implements the store.Backend interface.
+func (b *Backend) List(ctx context.Context, fn func(newdns.Set) error) error {
+	return b.current().List(ctx, fn)
+}
+
+// Serial implements the store.Backend interface.
+func (b *Backend) Serial() uint32 {
+	return b.current().Serial()
+}
+
+// Update implements the store.Backend interface. The transaction reads from
+// the current snapshot and is committed atomically if no key of the zone has
+// been modified since. Otherwise, ErrConflict is returned. Once committed,
+// the method waits until the changes are reflected by the snapshot.
+func (b *Backend) Update(ctx context.Context, fn func(store.Tx) error) error {
+	// get snapshot and revision
+	b.mutex.RLock()
+	snapshot := b.snapshot.Snapshot()
+	revision := b.revision
+	b.mutex.RUnlock()
+
+	// prepare transaction
+	tx := &backendTx{
+		backend:  b,
+		snapshot: snapshot,
+		serial:   snapshot.Serial(),
+	}
+
+	// run function
+	err := snapshot.Update(ctx, func(stx store.Tx) error {
+		tx.tx = stx
+		return fn(tx)
+	})
+	if err != nil {
+		return err
+	}
+
+	// check operations
+	if len(tx.ops) == 0 {
+		return nil
+	}
+
+	// commit operations
+	res, err := b.config.Client.Txn(ctx).If(
+		clientv3.Compare(clientv3.ModRevision(b.prefix).WithPrefix(), "<", revision+1),
+	).Then(tx.ops...).Commit()
+	if err != nil {
+		return err
+	} else if !res.Succeeded {
+		return ErrConflict
+	}
+
+	return b.await(ctx, res.Header.Revision)
+}
+
+// Run will load the zone and apply changes to the snapshot until the backend
+// is closed. The zone is reloaded if the watch fails.
+func (b *Backend) Run() error {
+	// prepare context
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// cancel on close
+	go func() {
+		select {
+		case <-b.close:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		// load and watch zone
+		err := b.watch(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		// log error
+		b.log(err)
+
+		// await retry
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Close will stop the backend.
+func (b *Backend) Close() {
+	defer func() { recover() }()
+	close(b.close)
+}
+
+func (b *Backend) watch(ctx context.Context) error {
+	// load zone
+	res, err := b.config.Client.Get(ctx, b.prefix, clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+
+	// build snapshot
+	snapshot := store.NewTrie()
+	err = b.apply(ctx, snapshot, res.Kvs, nil)
+	if err != nil {
+		return err
+	}
+
+	// set snapshot
+	b.publish(snapshot, res.Header.Revision)
+
+	// watch zone
+	wch := b.config.Client.Watch(ctx, b.prefix, clientv3.WithPrefix(), clientv3.WithRev(res.Header.Revision+1))
+	for wres := range wch {
+		// check error
+		err = wres.Err()
+		if err != nil {
+			return err
+		}
+
+		// apply events
+		if len(wres.Events) > 0 {
+			snapshot = b.current().Snapshot()
+			err = b.apply(ctx, snapshot, nil, wres.Events)
+			if err != nil {
+				return err
+			}
+			b.publish(snapshot, wres.Header.Revision)
+		}
+	}
+
+	return ctx.Err()
+}
+
+func (b *Backend) apply(ctx context.Context, snapshot *store.Trie, kvs []*mvccpb.KeyValue, events []*clientv3.Event) error {
+	return snapshot.Update(ctx, func(tx store.Tx) error {
+		// collect events
+		for _, kv := range kvs {
+			events = append(events, &clientv3.Event{Type: mvccpb.PUT, Kv: kv})
+		}
+
+		// apply events
+		for _, event := range events {
+			// get key
+			key := strings.TrimPrefix(string(event.Kv.Key), b.prefix)
+
+			// handle serial
+			if key == "serial" {
+				if event.Type != mvccpb.PUT {
+					continue
+				}
+				serial, err := strconv.ParseUint(string(event.Kv.Value), 10, 32)
+				if err != nil {
+					return err
+				}
+				err = tx.SetSerial(uint32(serial))
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			// parse set key
+			name, typ, err := parseSetKey(key)
+			if err != nil {
+				return err
+			}
+
+			// handle deletion
+			if event.Type == mvccpb.DELETE {
+				err = tx.Delete(name, typ)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			// decode set
+			set, err := decodeSet(event.Kv.Value)
+			if err != nil {
+				return err
+			}
+			set.Name = name
+			set.Type = typ
+
+			// put set
+			err = tx.Put(set)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (b *Backend) current() *store.Trie {
+	// acquire mutex
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return b.snapshot
+}
+
+func (b *Backend) publish(snapshot *store.Trie, revision int64) {
+	// acquire mutex
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// set snapshot
+	b.snapshot = snapshot
+	b.revision = revision
+
+	// signal change
+	close(b.changed)
+	b.changed = make(chan struct{})
+
+	// signal readiness
+	select {
+	case <-b.ready:
+	default:
+		close(b.ready)
+	}
+}
+
+func (b *Backend) await(ctx context.Context, revision int64) error {
+	for {
+		// check revision
+		b.mutex.RLock()
+		current := b.revision
+		changed := b.changed
+		b.mutex.RUnlock()
+		if current >= revision {
+			return nil
+		}
+
+		// await change
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (b *Backend) log(err error) {
+	// check logger
+	if b.config.Logger == nil {
+		return
+	}
+
+	// log error
+	b.config.Logger.Log(newdns.Entry{
+		Event: newdns.BackendError,
+		Error: &newdns.Error{Kind: newdns.ErrHandler, Err: err},
+	})
+}
+
+func (b *Backend) setKey(name string, typ newdns.Type) string {
+	return b.prefix + "sets/" + name + "/" + strconv.Itoa(int(typ))
+}
+
+type backendTx struct {
+	backend  *Backend
+	snapshot *store.Trie
+	tx       store.Tx
+	serial   uint32
+	ops      []clientv3.Op
+}
+
+func (t *backendTx) Get(name string) ([]newdns.Set, error) {
+	return t.tx.Get(name)
+}
+
+func (t *backendTx) Put(set newdns.Set) error {
+	// normalize name
+	set.Name = newdns.NormalizeDomain(set.Name, true, true, false)
+
+	// encode set
+	data, err := encodeSet(set)
+	if err != nil {
+		return err
+	}
+
+	// add operation
+	t.ops = append(t.ops, clientv3.OpPut(t.backend.setKey(set.Name, set.Type), data))
+
+	return t.tx.Put(set)
+}
+
+func (t *backendTx) Delete(name string, typ newdns.Type) error {
+	// normalize name
+	name = newdns.NormalizeDomain(name, true, true, false)
+
+	// add operation
+	if typ == 0 {
+		t.ops = append(t.ops, clientv3.OpDelete(t.backend.prefix+"sets/"+name+"/", clientv3.WithPrefix()))
+	} else {
+		t.ops = append(t.ops, clientv3.OpDelete(t.backend.setKey(name, typ)))
+	}
+
+	return t.tx.Delete(name, typ)
+}
+
+func (t *backendTx) Serial() uint32 {
+	return t.serial
+}
+
+func (t *backendTx) SetSerial(serial uint32) error {
+	// add operation
+	t.ops = append(t.ops, clientv3.OpPut(t.backend.prefix+"serial", strconv.FormatUint(uint64(serial), 10)))
+	t.serial = serial
+
+	return t.tx.SetSerial(serial)
+}
+
+func parseSetKey(key string) (string, newdns.Type, error) {
+	// split key
+	i := strings.LastIndexByte(key, '/')
+	if !strings.HasPrefix(key, "sets/") || i < len("sets/") {
+		return "", 0, fmt.Errorf("invalid key: %s", key)
+	}
+
+	// parse type
+	typ, err := strconv.ParseUint(key[i+1:], 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid key: %s", key)
+	}
+
+	return key[len("sets/"):i], newdns.Type(typ), nil
+}
+
+type setData struct {
+	TTL     int64                     `json:"ttl"`
+	Records []newdns.RecordDefinition `json:"records"`
+}
+
+func encodeSet(set newdns.Set) (string, error) {
+	// prepare data
+	data := setData{
+		TTL: int64(set.TTL / time.Second),
+	}
+	for _, record := range set.Records {
+		data.Records = append(data.Records, newdns.RecordDefinition{
+			Address:  record.Address,
+			Priority: record.Priority,
+			Weight:   record.Weight,
+			Port:     record.Port,
+			Data:     record.Data,
+		})
+	}
+
+	// encode data
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+
+	return string(buf), nil
+}
+
+func decodeSet(buf []byte) (newdns.Set, error) {
+	// decode data
+	var data setData
+	err := json.Unmarshal(buf, &data)
+	if err != nil {
+		return newdns.Set{}, err
+	}
+
+	// prepare set
+	set := newdns.Set{
+		TTL: time.Duration(data.TTL) * time.Second,
+	}
+	for _, record := range data.Records {
+		set.Records = append(set.Records, newdns.Record{
+			Address:  record.Address,
+			Priority: record.Priority,
+			Weight:   record.Weight,
+			Port:     record.Port,
+			Data:     record.Data,
+		})
+	}
+
+	return set, nil
+}
@@ -0,0 +1,118 @@
+package etcdstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/256dpi/newdns"
+	"github.com/256dpi/newdns/store"
+)
+
+func TestParseSetKey(t *testing.T) {
+	name, typ, err := parseSetKey("sets/www.example.com./1")
+	assert.NoError(t, err)
+	assert.Equal(t, "www.example.com.", name)
+	assert.Equal(t, newdns.A, typ)
+
+	_, _, err = parseSetKey("sets/www.example.com.")
+	assert.Error(t, err)
+
+	_, _, err = parseSetKey("foo/www.example.com./1")
+	assert.Error(t, err)
+
+	_, _, err = parseSetKey("sets/www.example.com./foo")
+	assert.Error(t, err)
+}
+
+func TestEncodeSet(t *testing.T) {
+	data, err := encodeSet(newdns.Set{
+		Name: "www.example.com.",
+		Type: newdns.MX,
+		Records: []newdns.Record{
+			{Address: "mail.example.com.", Priority: 10},
+		},
+		TTL: time.Minute,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, `{"ttl":60,"records":[{"address":"mail.example.com.","priority":10}]}`, data)
+
+	set, err := decodeSet([]byte(data))
+	assert.NoError(t, err)
+	assert.Equal(t, newdns.Set{
+		Records: []newdns.Record{
+			{Address: "mail.example.com.", Priority: 10},
+		},
+		TTL: time.Minute,
+	}, set)
+}
+
+func TestBackendApply(t *testing.T) {
+	ctx := context.Background()
+
+	backend := New(Config{
+		Zone: "Example.com",
+	})
+
+	key := func(name string, typ newdns.Type) []byte {
+		return []byte(backend.setKey(name, typ))
+	}
+
+	snapshot := store.NewTrie()
+	err := backend.apply(ctx, snapshot, []*mvccpb.KeyValue{
+		{Key: []byte("/newdns/example.com./serial"), Value: []byte("7")},
+		{Key: key("www.example.com.", newdns.A), Value: []byte(`{"ttl":300,"records":[{"address":"1.2.3.4"}]}`)},
+		{Key: key("www.example.com.", newdns.TXT), Value: []byte(`{"ttl":300,"records":[{"data":["foo"]}]}`)},
+	}, nil)
+	assert.NoError(t, err)
+	backend.publish(snapshot, 3)
+
+	select {
+	case <-backend.Ready():
+	default:
+		t.Fatal("not ready")
+	}
+
+	assert.Equal(t, uint32(7), backend.Serial())
+
+	sets, err := backend.Lookup(ctx, "www.example.com.")
+	assert.NoError(t, err)
+	assert.Len(t, sets, 2)
+
+	snapshot = backend.current().Snapshot()
+	err = backend.apply(ctx, snapshot, nil, []*clientv3.Event{
+		{Type: mvccpb.DELETE, Kv: &mvccpb.KeyValue{Key: key("www.example.com.", newdns.TXT)}},
+		{Type: mvccpb.PUT, Kv: &mvccpb.KeyValue{Key: key("a.b.example.com.", newdns.A), Value: []byte(`{"ttl":60,"records":[{"address":"1.2.3.5"}]}`)}},
+	})
+	assert.NoError(t, err)
+	backend.publish(snapshot, 4)
+
+	sets, err = backend.Lookup(ctx, "www.example.com.")
+	assert.NoError(t, err)
+	assert.Equal(t, []newdns.Set{
+		{
+			Name: "www.example.com.",
+			Type: newdns.A,
+			Records: []newdns.Record{
+				{Address: "1.2.3.4"},
+			},
+			TTL: 5 * time.Minute,
+		},
+	}, sets)
+
+	ok, err := backend.NonTerminal(ctx, "b.example.com.")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	err = backend.await(ctx, 4)
+	assert.NoError(t, err)
+
+	err = backend.apply(ctx, store.NewTrie(), []*mvccpb.KeyValue{
+		{Key: []byte("/newdns/example.com./foo"), Value: []byte("bar")},
+	}, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,354 @@
+// Package externaldns implements the webhook provider API of Kubernetes
+// external-dns on top of the zones managed by a store.Admin service.
+//
+// The provider is run as a sidecar of external-dns which is configured with
+// "--provider=webhook" and the URL of the provider. The records created by
+// external-dns are then served authoritatively by newdns.
+package externaldns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/256dpi/newdns"
+	"github.com/256dpi/newdns/store"
+)
+
+// MediaType is the media type used by the webhook provider API.
+const MediaType = "application/external.dns.webhook+json;version=1"
+
+// Endpoint is a record set as represented by external-dns. The targets are
+// encoded in the zone file presentation format without the record name, TTL
+// and type e.g. "10 mail.example.com" for MX records.
+type Endpoint struct {
+	DNSName          string                     `json:"dnsName,omitempty"`
+	Targets          []string                   `json:"targets,omitempty"`
+	RecordType       string                     `json:"recordType,omitempty"`
+	SetIdentifier    string                     `json:"setIdentifier,omitempty"`
+	RecordTTL        int64                      `json:"recordTTL,omitempty"`
+	Labels           map[string]string          `json:"labels,omitempty"`
+	ProviderSpecific []ProviderSpecificProperty `json:"providerSpecific,omitempty"`
+}
+
+// ProviderSpecificProperty is a provider specific property of an endpoint.
+type ProviderSpecificProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Changes are the changes requested by external-dns.
+type Changes struct {
+	Create    []*Endpoint `json:"Create"`
+	UpdateOld []*Endpoint `json:"UpdateOld"`
+	UpdateNew []*Endpoint `json:"UpdateNew"`
+	Delete    []*Endpoint `json:"Delete"`
+}
+
+// DomainFilter lists the domains that are managed by the provider.
+type DomainFilter struct {
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// Config provides configuration for a webhook provider.
+type Config struct {
+	// The admin service that manages the zones.
+	Admin *store.Admin
+
+	// The logger called with errors encountered while handling requests.
+	Logger newdns.Logger
+}
+
+// Provider implements the external-dns webhook provider API. It provides the
+// following endpoints:
+//
+//	GET  /                 negotiate and return the domain filter
+//	GET  /records          list all records
+//	POST /records          apply changes
+//	POST /adjustendpoints  adjust endpoints before planning
+//	GET  /healthz          check health
+//
+// Endpoints are mapped to the sets of the zone with the longest matching
+// name. Set identifiers, labels and provider specific properties are not
+// supported. TXT targets are stored without surrounding quotes and returned
+// quoted as generated by the external-dns TXT registry.
+type Provider struct {
+	config Config
+}
+
+// NewProvider creates and returns a new webhook provider.
+func NewProvider(config Config) *Provider {
+	return &Provider{
+		config: config,
+	}
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (p *Provider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// handle request
+	var res interface{}
+	var err error
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/":
+		res = p.DomainFilter()
+	case r.Method == http.MethodGet && r.URL.Path == "/records":
+		res, err = p.Records(r.Context())
+	case r.Method == http.MethodPost && r.URL.Path == "/records":
+		var changes Changes
+		err = json.NewDecoder(r.Body).Decode(&changes)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = p.ApplyChanges(r.Context(), &changes)
+		if err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	case r.Method == http.MethodPost && r.URL.Path == "/adjustendpoints":
+		var endpoints []*Endpoint
+		err = json.NewDecoder(r.Body).Decode(&endpoints)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		res = p.AdjustEndpoints(endpoints)
+	case r.Method == http.MethodGet && r.URL.Path == "/healthz":
+		_, _ = w.Write([]byte("ok"))
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	// handle error
+	if err != nil {
+		p.log(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// write response
+	w.Header().Set("Content-Type", MediaType)
+	w.Header().Set("Vary", "Content-Type")
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// DomainFilter returns a filter that includes all managed zones.
+func (p *Provider) DomainFilter() DomainFilter {
+	// collect zones
+	var filter DomainFilter
+	for _, zone := range p.config.Admin.Zones() {
+		filter.Include = append(filter.Include, strings.TrimSuffix(zone.Name, "."))
+	}
+
+	return filter
+}
+
+// Records returns the sets of all managed zones as endpoints.
+func (p *Provider) Records(ctx context.Context) ([]*Endpoint, error) {
+	// prepare list
+	list := make([]*Endpoint, 0)
+
+	for _, zone := range p.config.Admin.Zones() {
+		// get sets
+		defs, err := p.config.Admin.Sets(ctx, zone.Name, "")
+		if err != nil {
+			return nil, err
+		}
+
+		// add endpoints
+		for _, def := range defs {
+			set, err := def.Set(zone.Name)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, endpointFromSet(def.Type, set))
+		}
+	}
+
+	return list, nil
+}
+
+// ApplyChanges applies the deletions, updates and creations in that order.
+func (p *Provider) ApplyChanges(ctx context.Context, changes *Changes) error {
+	// apply deletions
+	for _, ep := range changes.Delete {
+		// get zone and name
+		zone, name, err := p.locate(ep.DNSName)
+		if err != nil {
+			return err
+		}
+
+		// delete set
+		err = p.config.Admin.DeleteSet(ctx, zone, name, ep.RecordType)
+		if err != nil {
+			return err
+		}
+	}
+
+	// apply updates and creations
+	for _, ep := range append(changes.UpdateNew, changes.Create...) {
+		// get zone and name
+		zone, name, err := p.locate(ep.DNSName)
+		if err != nil {
+			return err
+		}
+
+		// get definition
+		def, err := setDefinition(name, ep)
+		if err != nil {
+			return err
+		}
+
+		// replace set
+		_, err = p.config.Admin.PutSet(ctx, zone, def)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AdjustEndpoints removes endpoints with unsupported record types and
+// normalizes the names.
+func (p *Provider) AdjustEndpoints(endpoints []*Endpoint) []*Endpoint {
+	// filter endpoints
+	list := make([]*Endpoint, 0, len(endpoints))
+	for _, ep := range endpoints {
+		switch ep.RecordType {
+		case "A", "AAAA", "CNAME", "MX", "TXT", "NS", "PTR", "SRV":
+			ep.DNSName = strings.ToLower(strings.TrimSuffix(ep.DNSName, "."))
+			list = append(list, ep)
+		}
+	}
+
+	return list
+}
+
+func (p *Provider) locate(dnsName string) (string, string, error) {
+	// normalize name
+	fqdn := newdns.NormalizeDomain(dnsName, true, true, false)
+
+	// find zone with longest name
+	var zone string
+	for _, info := range p.config.Admin.Zones() {
+		if newdns.InZone(info.Name, fqdn) && len(info.Name) > len(zone) {
+			zone = info.Name
+		}
+	}
+	if zone == "" {
+		return "", "", fmt.Errorf("no zone for name: %s", dnsName)
+	}
+
+	// get relative name
+	name := newdns.TrimZone(zone, fqdn)
+	if name == "" {
+		name = "@"
+	}
+
+	return zone, name, nil
+}
+
+func (p *Provider) log(err error) {
+	// check logger
+	if p.config.Logger == nil {
+		return
+	}
+
+	// log error
+	p.config.Logger.Log(newdns.Entry{
+		Event: newdns.BackendError,
+		Error: &newdns.Error{Kind: newdns.ErrHandler, Err: err},
+	})
+}
+
+func setDefinition(name string, ep *Endpoint) (newdns.SetDefinition, error) {
+	// prepare definition
+	def := newdns.SetDefinition{
+		Name: name,
+		Type: ep.RecordType,
+	}
+
+	// set TTL
+	if ep.RecordTTL > 0 {
+		def.TTL = (time.Duration(ep.RecordTTL) * time.Second).String()
+	}
+
+	// parse targets
+	for _, target := range ep.Targets {
+		var record newdns.RecordDefinition
+		fields := strings.Fields(target)
+		switch ep.RecordType {
+		case "A", "AAAA":
+			record.Address = target
+		case "CNAME", "NS", "PTR":
+			record.Address = newdns.NormalizeDomain(target, false, true, false)
+		case "MX":
+			if len(fields) != 2 {
+				return def, fmt.Errorf("invalid MX target: %s", target)
+			}
+			record.Priority, _ = strconv.Atoi(fields[0])
+			record.Address = newdns.NormalizeDomain(fields[1], false, true, false)
+		case "SRV":
+			if len(fields) != 4 {
+				return def, fmt.Errorf("invalid SRV target: %s", target)
+			}
+			record.Priority, _ = strconv.Atoi(fields[0])
+			record.Weight, _ = strconv.Atoi(fields[1])
+			record.Port, _ = strconv.Atoi(fields[2])
+			record.Address = newdns.NormalizeDomain(fields[3], false, true, false)
+		case "TXT":
+			record.Data = splitText(strings.TrimSuffix(strings.TrimPrefix(target, `"`), `"`))
+		}
+		def.Records = append(def.Records, record)
+	}
+
+	return def, nil
+}
+
+func endpointFromSet(typ string, set newdns.Set) *Endpoint {
+	// prepare endpoint
+	ep := &Endpoint{
+		DNSName:    strings.TrimSuffix(set.Name, "."),
+		RecordType: typ,
+		RecordTTL:  int64(set.TTL / time.Second),
+	}
+
+	// format targets
+	for _, record := range set.Records {
+		var target string
+		switch set.Type {
+		case newdns.A, newdns.AAAA:
+			target = record.Address
+		case newdns.CNAME, newdns.NS, newdns.PTR:
+			target = strings.TrimSuffix(record.Address, ".")
+		case newdns.MX:
+			target = fmt.Sprintf("%d %s", record.Priority, strings.TrimSuffix(record.Address, "."))
+		case newdns.SRV:
+			target = fmt.Sprintf("%d %d %d %s", record.Priority, record.Weight, record.Port, strings.TrimSuffix(record.Address, "."))
+		case newdns.TXT:
+			target = `"` + strings.Join(record.Data, "") + `"`
+		}
+		ep.Targets = append(ep.Targets, target)
+	}
+
+	return ep
+}
+
+func splitText(text string) []string {
+	// split text into strings of at most 255 bytes
+	var list []string
+	for len(text) > 255 {
+		list = append(list, text[:255])
+		text = text[255:]
+	}
+
+	return append(list, text)
+}
@@ -0,0 +1,126 @@
+package externaldns
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/256dpi/newdns"
+	"github.com/256dpi/newdns/store"
+)
+
+func TestProvider(t *testing.T) {
+	admin := store.NewAdmin(store.AdminConfig{
+		Mux: newdns.NewZoneMux(),
+	})
+
+	_, err := admin.CreateZone(store.ZoneInfo{
+		Name:           "example.com.",
+		AllNameServers: []string{"ns1.example.com."},
+	})
+	assert.NoError(t, err)
+
+	_, err = admin.CreateZone(store.ZoneInfo{
+		Name:           "sub.example.com.",
+		AllNameServers: []string{"ns1.example.com."},
+	})
+	assert.NoError(t, err)
+
+	provider := NewProvider(Config{
+		Admin: admin,
+	})
+
+	request := func(method, path, body string) (int, string) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Accept", MediaType)
+		rec := httptest.NewRecorder()
+		provider.ServeHTTP(rec, req)
+		return rec.Code, strings.TrimSpace(rec.Body.String())
+	}
+
+	code, res := request(http.MethodGet, "/", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `{"include":["example.com","sub.example.com"]}`, res)
+
+	code, res = request(http.MethodGet, "/healthz", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", res)
+
+	code, res = request(http.MethodPost, "/adjustendpoints", `[
+		{"dnsName": "WWW.example.com.", "targets": ["1.2.3.4"], "recordType": "A"},
+		{"dnsName": "foo.example.com", "targets": ["0 issue \"ca.example.net\""], "recordType": "CAA"}
+	]`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `[{"dnsName":"www.example.com","targets":["1.2.3.4"],"recordType":"A"}]`, res)
+
+	code, _ = request(http.MethodPost, "/records", `{
+		"Create": [
+			{"dnsName": "example.com", "targets": ["10 mail.example.com"], "recordType": "MX", "recordTTL": 60},
+			{"dnsName": "www.example.com", "targets": ["1.2.3.4", "5.6.7.8"], "recordType": "A"},
+			{"dnsName": "www.example.com", "targets": ["\"heritage=external-dns,external-dns/owner=default\""], "recordType": "TXT"},
+			{"dnsName": "_http._tcp.sub.example.com", "targets": ["0 10 80 www.example.com"], "recordType": "SRV"}
+		]
+	}`)
+	assert.Equal(t, http.StatusNoContent, code)
+
+	sets, err := admin.Sets(context.Background(), "sub.example.com.", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []newdns.SetDefinition{
+		{
+			Name: "_http._tcp",
+			Type: "SRV",
+			TTL:  "5m",
+			Records: []newdns.RecordDefinition{
+				{Address: "www.example.com.", Weight: 10, Port: 80},
+			},
+		},
+	}, sets)
+
+	code, res = request(http.MethodGet, "/records", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `[`+
+		`{"dnsName":"example.com","targets":["10 mail.example.com"],"recordType":"MX","recordTTL":60},`+
+		`{"dnsName":"www.example.com","targets":["1.2.3.4","5.6.7.8"],"recordType":"A","recordTTL":300},`+
+		`{"dnsName":"www.example.com","targets":["\"heritage=external-dns,external-dns/owner=default\""],"recordType":"TXT","recordTTL":300},`+
+		`{"dnsName":"_http._tcp.sub.example.com","targets":["0 10 80 www.example.com"],"recordType":"SRV","recordTTL":300}`+
+		`]`, res)
+
+	code, _ = request(http.MethodPost, "/records", `{
+		"UpdateOld": [
+			{"dnsName": "www.example.com", "targets": ["1.2.3.4", "5.6.7.8"], "recordType": "A"}
+		],
+		"UpdateNew": [
+			{"dnsName": "www.example.com", "targets": ["1.2.3.4"], "recordType": "A"}
+		],
+		"Delete": [
+			{"dnsName": "www.example.com", "targets": ["\"heritage=external-dns,external-dns/owner=default\""], "recordType": "TXT"}
+		]
+	}`)
+	assert.Equal(t, http.StatusNoContent, code)
+
+	sets, err = admin.Sets(context.Background(), "example.com.", "www")
+	assert.NoError(t, err)
+	assert.Equal(t, []newdns.SetDefinition{
+		{
+			Name:    "www",
+			Type:    "A",
+			TTL:     "5m",
+			Records: []newdns.RecordDefinition{{Address: "1.2.3.4"}},
+		},
+	}, sets)
+
+	code, res = request(http.MethodPost, "/records", `{
+		"Create": [
+			{"dnsName": "www.example.org", "targets": ["1.2.3.4"], "recordType": "A"}
+		]
+	}`)
+	assert.Equal(t, http.StatusInternalServerError, code)
+	assert.Equal(t, "no zone for name: www.example.org", res)
+
+	code, _ = request(http.MethodGet, "/foo", "")
+	assert.Equal(t, http.StatusNotFound, code)
+}
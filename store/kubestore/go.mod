@@ -0,0 +1,23 @@
+module github.com/256dpi/newdns/store/kubestore
+
+go 1.21
+
+require (
+	github.com/256dpi/newdns v0.0.0-20261016092631-8f127d0187f2
+	github.com/stretchr/testify v1.9.0
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/fsnotify/fsnotify v1.7.0 // indirect
+	github.com/miekg/dns v1.1.58 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/mod v0.14.0 // indirect
+	golang.org/x/net v0.22.0 // indirect
+	golang.org/x/sys v0.18.0 // indirect
+	golang.org/x/tools v0.17.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
+
+// use the parent module during local development
+replace github.com/256dpi/newdns => ../../
@@ -0,0 +1,539 @@
+// Package kubestore provides a read-only store backend for newdns zones that
+// serves records for Kubernetes services and ingresses.
+//
+// The backend watches services, endpoints and ingresses using the Kubernetes
+// API and serves the following records from an in-memory snapshot:
+//
+//	{service}.{namespace}.{zone}                      A/AAAA records of services
+//	_{port}._{protocol}.{service}.{namespace}.{zone}  SRV records of named ports
+//	{host}                                            A/AAAA records of ingresses
+//
+// The addresses of a service are the load balancer addresses for services of
+// type LoadBalancer, the ready endpoint addresses for headless services and
+// the cluster addresses otherwise. Services of type ExternalName are served as
+// CNAME records. Ingress hosts are only served if they are within the zone and
+// resolve to the load balancer addresses of the ingress or a CNAME record if
+// the load balancer only provides a hostname.
+package kubestore
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/256dpi/newdns"
+	"github.com/256dpi/newdns/store"
+)
+
+// ErrReadOnly is returned by Update as the records are derived from the
+// Kubernetes resources.
+var ErrReadOnly = errors.New("read only backend")
+
+var errExpired = errors.New("resource version expired")
+
+// Config provides configuration for a Kubernetes backend.
+type Config struct {
+	// The URL of the Kubernetes API server e.g.
+	// "https://kubernetes.default.svc".
+	Server string
+
+	// The client used to access the API server.
+	//
+	// Default: http.DefaultClient.
+	Client *http.Client
+
+	// The bearer token used to authenticate with the API server.
+	Token string
+
+	// The file that contains the bearer token. The file is read before every
+	// request to support rotated tokens and takes precedence over Token.
+	TokenFile string
+
+	// The FQDN of the zone.
+	Zone string
+
+	// The namespace of the watched resources.
+	//
+	// Default: All namespaces.
+	Namespace string
+
+	// The TTL of the served sets.
+	//
+	// Default: 30s.
+	TTL time.Duration
+
+	// The logger called with errors encountered while watching the resources.
+	Logger newdns.Logger
+}
+
+// InClusterConfig returns a configuration that uses the service account of
+// the pod to access the API server of the cluster it is running in.
+func InClusterConfig() (Config, error) {
+	// get host and port
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return Config{}, fmt.Errorf("not running in a cluster")
+	}
+
+	// read certificate authority
+	const dir = "/var/run/secrets/kubernetes.io/serviceaccount/"
+	ca, err := ioutil.ReadFile(dir + "ca.crt")
+	if err != nil {
+		return Config{}, err
+	}
+
+	// prepare pool
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return Config{}, fmt.Errorf("invalid certificate authority")
+	}
+
+	return Config{
+		Server: "https://" + net.JoinHostPort(host, port),
+		Client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		},
+		TokenFile: dir + "token",
+	}, nil
+}
+
+// Backend is a read-only store backend that serves records for the services
+// and ingresses of a Kubernetes cluster.
+type Backend struct {
+	config   Config
+	mutex    sync.RWMutex
+	objects  map[string]map[string]*object
+	names    map[string][]string
+	sources  map[string]map[string]bool
+	snapshot *store.Trie
+	ready    chan struct{}
+	close    chan struct{}
+	once     sync.Once
+}
+
+// New creates and returns a new Kubernetes backend. The backend must be run to
+// load and watch the resources.
+func New(config Config) *Backend {
+	// normalize zone
+	config.Zone = newdns.NormalizeDomain(config.Zone, true, true, false)
+
+	// set default client
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+
+	// set default TTL
+	if config.TTL == 0 {
+		config.TTL = 30 * time.Second
+	}
+
+	return &Backend{
+		config:   config,
+		objects:  map[string]map[string]*object{},
+		names:    map[string][]string{},
+		sources:  map[string]map[string]bool{},
+		snapshot: store.NewTrie(),
+		ready:    make(chan struct{}),
+		close:    make(chan struct{}),
+	}
+}
+
+// Ready returns a channel that is closed once all resources have been loaded.
+func (b *Backend) Ready() <-chan struct{} {
+	return b.ready
+}
+
+// Lookup implements the store.Backend interface.
+func (b *Backend) Lookup(ctx context.Context, name string) ([]newdns.Set, error) {
+	return b.current().Lookup(ctx, name)
+}
+
+// NonTerminal implements the store.NonTerminalBackend interface.
+func (b *Backend) NonTerminal(ctx context.Context, name string) (bool, error) {
+	return b.current().NonTerminal(ctx, name)
+}
+
+// List implements the store.Backend interface.
+func (b *Backend) List(ctx context.Context, fn func(newdns.Set) error) error {
+	return b.current().List(ctx, fn)
+}
+
+// Serial implements the store.Backend interface.
+func (b *Backend) Serial() uint32 {
+	return b.current().Serial()
+}
+
+// Update implements the store.Backend interface. It always returns
+// ErrReadOnly.
+func (b *Backend) Update(context.Context, func(store.Tx) error) error {
+	return ErrReadOnly
+}
+
+// Run will load and watch the resources until the backend is closed. The
+// resources are reloaded if a watch fails.
+func (b *Backend) Run() error {
+	// prepare context
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// watch resources
+	var wg sync.WaitGroup
+	for _, res := range resources {
+		wg.Add(1)
+		go func(res resource) {
+			defer wg.Done()
+			for {
+				// load and watch resource
+				err := b.watch(ctx, res)
+				if ctx.Err() != nil {
+					return
+				} else if err == errExpired {
+					continue
+				}
+
+				// log error
+				b.log(err)
+
+				// await retry
+				select {
+				case <-time.After(time.Second):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(res)
+	}
+
+	// await close
+	<-b.close
+	cancel()
+	wg.Wait()
+
+	return nil
+}
+
+// Close will stop the backend.
+func (b *Backend) Close() {
+	b.once.Do(func() {
+		close(b.close)
+	})
+}
+
+func (b *Backend) watch(ctx context.Context, res resource) error {
+	// get path
+	path := res.path(b.config.Namespace)
+
+	// list objects
+	var list struct {
+		Metadata objectMeta `json:"metadata"`
+		Items    []*object  `json:"items"`
+	}
+	err := b.request(ctx, path, nil, func(r io.Reader) error {
+		return json.NewDecoder(r).Decode(&list)
+	})
+	if err != nil {
+		return err
+	}
+
+	// replace objects
+	objects := map[string]*object{}
+	for _, obj := range list.Items {
+		objects[obj.key()] = obj
+	}
+	b.reload(res.name, objects)
+
+	// watch objects
+	version := list.Metadata.ResourceVersion
+	for {
+		err = b.request(ctx, path, url.Values{
+			"watch":               {"1"},
+			"resourceVersion":     {version},
+			"allowWatchBookmarks": {"true"},
+		}, func(r io.Reader) error {
+			// prepare decoder
+			dec := json.NewDecoder(r)
+
+			for {
+				// decode event
+				var event struct {
+					Type   string          `json:"type"`
+					Object json.RawMessage `json:"object"`
+				}
+				err := dec.Decode(&event)
+				if err == io.EOF {
+					return nil
+				} else if err != nil {
+					return err
+				}
+
+				// handle errors
+				if event.Type == "ERROR" {
+					var status struct {
+						Code    int    `json:"code"`
+						Message string `json:"message"`
+					}
+					_ = json.Unmarshal(event.Object, &status)
+					if status.Code == http.StatusGone {
+						return errExpired
+					}
+					return fmt.Errorf("watch error: %s", status.Message)
+				}
+
+				// decode object
+				var obj object
+				err = json.Unmarshal(event.Object, &obj)
+				if err != nil {
+					return err
+				}
+
+				// update version
+				version = obj.Metadata.ResourceVersion
+
+				// apply event
+				switch event.Type {
+				case "ADDED", "MODIFIED":
+					b.apply(res.name, obj.key(), &obj)
+				case "DELETED":
+					b.apply(res.name, obj.key(), nil)
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (b *Backend) request(ctx context.Context, path string, query url.Values, fn func(io.Reader) error) error {
+	// prepare request
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(b.config.Server, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.URL.RawQuery = query.Encode()
+	req.Header.Set("Accept", "application/json")
+
+	// get token
+	token := b.config.Token
+	if b.config.TokenFile != "" {
+		data, err := ioutil.ReadFile(b.config.TokenFile)
+		if err != nil {
+			return err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+
+	// set token
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	// perform request
+	res, err := b.config.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// check status
+	if res.StatusCode == http.StatusGone {
+		return errExpired
+	} else if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", res.Status)
+	}
+
+	return fn(res.Body)
+}
+
+func (b *Backend) reload(res string, objects map[string]*object) {
+	// acquire mutex
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// replace objects
+	b.objects[res] = objects
+
+	// check objects
+	if !b.loaded() {
+		return
+	}
+
+	// collect records and index names
+	recs := records{}
+	b.names = map[string][]string{}
+	b.sources = map[string]map[string]bool{}
+	for _, res := range []string{"services", "ingresses"} {
+		for key := range b.objects[res] {
+			source := sourceOf(res, key)
+			r := records{}
+			r.addSource(b.config.Zone, source, b.objects)
+			b.index(source, r)
+			recs.merge(r)
+		}
+	}
+
+	// build snapshot
+	snapshot := store.NewTrie()
+	_ = snapshot.Update(context.Background(), func(tx store.Tx) error {
+		for name := range recs {
+			for _, set := range recs.sets(name, b.config.TTL) {
+				_ = tx.Put(set)
+			}
+		}
+		return tx.SetSerial(newdns.DateSerial(time.Now(), b.snapshot.Serial()))
+	})
+
+	// set snapshot
+	b.snapshot = snapshot
+
+	// signal readiness
+	select {
+	case <-b.ready:
+	default:
+		close(b.ready)
+	}
+}
+
+func (b *Backend) apply(res, key string, obj *object) {
+	// acquire mutex
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// apply change
+	if obj != nil {
+		b.objects[res][key] = obj
+	} else {
+		delete(b.objects[res], key)
+	}
+
+	// check objects
+	if !b.loaded() {
+		return
+	}
+
+	// get source records
+	source := sourceOf(res, key)
+	r := records{}
+	r.addSource(b.config.Zone, source, b.objects)
+
+	// collect previous and current names
+	names := map[string]bool{}
+	for _, name := range b.names[source] {
+		names[name] = true
+	}
+	for name := range r {
+		names[name] = true
+	}
+
+	// update index
+	b.index(source, r)
+
+	// collect records of all sources of the affected names
+	recs := records{}
+	done := map[string]bool{}
+	for name := range names {
+		for src := range b.sources[name] {
+			if !done[src] {
+				recs.addSource(b.config.Zone, src, b.objects)
+				done[src] = true
+			}
+		}
+	}
+
+	// update snapshot in place as lookups read a consistent copy
+	_ = b.snapshot.Update(context.Background(), func(tx store.Tx) error {
+		// replace sets of affected names
+		var changed bool
+		for name := range names {
+			existing, _ := tx.Get(name)
+			sets := recs.sets(name, b.config.TTL)
+			if setsEqual(existing, sets) {
+				continue
+			}
+			_ = tx.Delete(name, 0)
+			for _, set := range sets {
+				_ = tx.Put(set)
+			}
+			changed = true
+		}
+
+		// bump serial if changed
+		if !changed {
+			return nil
+		}
+
+		return tx.SetSerial(newdns.DateSerial(time.Now(), tx.Serial()))
+	})
+}
+
+func (b *Backend) loaded() bool {
+	for _, res := range resources {
+		if b.objects[res.name] == nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (b *Backend) index(source string, r records) {
+	// remove previous names
+	for _, name := range b.names[source] {
+		delete(b.sources[name], source)
+		if len(b.sources[name]) == 0 {
+			delete(b.sources, name)
+		}
+	}
+
+	// add current names
+	names := make([]string, 0, len(r))
+	for name := range r {
+		names = append(names, name)
+		if b.sources[name] == nil {
+			b.sources[name] = map[string]bool{}
+		}
+		b.sources[name][source] = true
+	}
+	if len(names) > 0 {
+		b.names[source] = names
+	} else {
+		delete(b.names, source)
+	}
+}
+
+func (b *Backend) current() *store.Trie {
+	// acquire mutex
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return b.snapshot
+}
+
+func (b *Backend) log(err error) {
+	// check logger
+	if b.config.Logger == nil {
+		return
+	}
+
+	// log error
+	b.config.Logger.Log(newdns.Entry{
+		Event: newdns.BackendError,
+		Error: &newdns.Error{Kind: newdns.ErrHandler, Err: err},
+	})
+}
@@ -0,0 +1,149 @@
+package kubestore
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/256dpi/newdns"
+	"github.com/256dpi/newdns/store"
+)
+
+const services = `{"metadata": {"resourceVersion": "10"}, "items": [
+	{"metadata": {"name": "web", "namespace": "default"}, "spec": {"type": "ClusterIP", "clusterIP": "10.0.0.1", "clusterIPs": ["10.0.0.1", "fd00::1"], "ports": [{"name": "http", "protocol": "TCP", "port": 80}, {"port": 81}]}},
+	{"metadata": {"name": "lb", "namespace": "default"}, "spec": {"type": "LoadBalancer", "clusterIP": "10.0.0.2"}, "status": {"loadBalancer": {"ingress": [{"ip": "1.2.3.4"}]}}},
+	{"metadata": {"name": "db", "namespace": "prod"}, "spec": {"type": "ClusterIP", "clusterIP": "None"}},
+	{"metadata": {"name": "ext", "namespace": "prod"}, "spec": {"type": "ExternalName", "externalName": "db.example.org"}}
+]}`
+
+const endpoints = `{"metadata": {"resourceVersion": "10"}, "items": [
+	{"metadata": {"name": "db", "namespace": "prod"}, "subsets": [{"addresses": [{"ip": "10.1.0.2"}, {"ip": "10.1.0.1"}]}]}
+]}`
+
+const ingresses = `{"metadata": {"resourceVersion": "10"}, "items": [
+	{"metadata": {"name": "app", "namespace": "default"}, "spec": {"rules": [{"host": "app.example.com"}, {"host": "app.example.org"}]}, "status": {"loadBalancer": {"ingress": [{"ip": "5.6.7.8"}]}}},
+	{"metadata": {"name": "cdn", "namespace": "default"}, "spec": {"rules": [{"host": "cdn.example.com"}]}, "status": {"loadBalancer": {"ingress": [{"hostname": "lb.example.net"}]}}}
+]}`
+
+const event = `{"type": "DELETED", "object": {"metadata": {"name": "lb", "namespace": "default", "resourceVersion": "11"}}}`
+
+func TestBackend(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+
+		// handle watches
+		if r.URL.Query().Get("watch") == "1" {
+			assert.Equal(t, "10", r.URL.Query().Get("resourceVersion"))
+			if r.URL.Path == "/api/v1/services" {
+				_, _ = w.Write([]byte(event))
+				w.(http.Flusher).Flush()
+			}
+			<-r.Context().Done()
+			return
+		}
+
+		// handle lists
+		switch r.URL.Path {
+		case "/api/v1/services":
+			_, _ = w.Write([]byte(services))
+		case "/api/v1/endpoints":
+			_, _ = w.Write([]byte(endpoints))
+		case "/apis/networking.k8s.io/v1/ingresses":
+			_, _ = w.Write([]byte(ingresses))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	backend := New(Config{
+		Server: server.URL,
+		Token:  "secret",
+		Zone:   "example.com",
+	})
+
+	done := make(chan error)
+	go func() {
+		done <- backend.Run()
+	}()
+
+	select {
+	case <-backend.Ready():
+	case <-time.After(time.Second):
+		t.Fatal("not ready")
+	}
+
+	ctx := context.Background()
+
+	zone := &newdns.Zone{
+		Name:             "example.com.",
+		MasterNameServer: "ns1.example.com.",
+		AllNameServers:   []string{"ns1.example.com."},
+	}
+	store.Configure(zone, backend)
+
+	sets, err := zone.Handler(ctx, "web.default")
+	assert.NoError(t, err)
+	assert.Equal(t, []newdns.Set{
+		{
+			Name:    "web.default.example.com.",
+			Type:    newdns.A,
+			Records: []newdns.Record{{Address: "10.0.0.1"}},
+			TTL:     30 * time.Second,
+		},
+		{
+			Name:    "web.default.example.com.",
+			Type:    newdns.AAAA,
+			Records: []newdns.Record{{Address: "fd00::1"}},
+			TTL:     30 * time.Second,
+		},
+	}, sets)
+
+	sets, err = zone.Handler(ctx, "_http._tcp.web.default")
+	assert.NoError(t, err)
+	assert.Equal(t, []newdns.Set{
+		{
+			Name:    "_http._tcp.web.default.example.com.",
+			Type:    newdns.SRV,
+			Records: []newdns.Record{{Address: "web.default.example.com.", Port: 80}},
+			TTL:     30 * time.Second,
+		},
+	}, sets)
+
+	sets, err = zone.Handler(ctx, "db.prod")
+	assert.NoError(t, err)
+	assert.Equal(t, []newdns.Record{{Address: "10.1.0.1"}, {Address: "10.1.0.2"}}, sets[0].Records)
+
+	sets, err = zone.Handler(ctx, "ext.prod")
+	assert.NoError(t, err)
+	assert.Equal(t, newdns.CNAME, sets[0].Type)
+	assert.Equal(t, []newdns.Record{{Address: "db.example.org."}}, sets[0].Records)
+
+	sets, err = zone.Handler(ctx, "app")
+	assert.NoError(t, err)
+	assert.Equal(t, []newdns.Record{{Address: "5.6.7.8"}}, sets[0].Records)
+
+	sets, err = zone.Handler(ctx, "cdn")
+	assert.NoError(t, err)
+	assert.Equal(t, newdns.CNAME, sets[0].Type)
+
+	ok, err := zone.NonTerminal(ctx, "prod")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	assert.Eventually(t, func() bool {
+		sets, err := zone.Handler(ctx, "lb.default")
+		return err == nil && len(sets) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	err = zone.UpdateHandler(ctx, nil)
+	assert.Equal(t, ErrReadOnly, err)
+
+	backend.Close()
+	backend.Close()
+	assert.NoError(t, <-done)
+}
@@ -0,0 +1,284 @@
+package kubestore
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/256dpi/newdns"
+)
+
+type resource struct {
+	name  string
+	group string
+}
+
+var resources = []resource{
+	{name: "services", group: "/api/v1"},
+	{name: "endpoints", group: "/api/v1"},
+	{name: "ingresses", group: "/apis/networking.k8s.io/v1"},
+}
+
+func (r resource) path(namespace string) string {
+	if namespace != "" {
+		return r.group + "/namespaces/" + namespace + "/" + r.name
+	}
+
+	return r.group + "/" + r.name
+}
+
+type objectMeta struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace"`
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+type loadBalancerStatus struct {
+	Ingress []struct {
+		IP       string `json:"ip"`
+		Hostname string `json:"hostname"`
+	} `json:"ingress"`
+}
+
+// object holds the used fields of services, endpoints and ingresses.
+type object struct {
+	Metadata objectMeta `json:"metadata"`
+	Spec     struct {
+		Type         string   `json:"type"`
+		ClusterIP    string   `json:"clusterIP"`
+		ClusterIPs   []string `json:"clusterIPs"`
+		ExternalName string   `json:"externalName"`
+		Ports        []struct {
+			Name     string `json:"name"`
+			Protocol string `json:"protocol"`
+			Port     int    `json:"port"`
+		} `json:"ports"`
+		Rules []struct {
+			Host string `json:"host"`
+		} `json:"rules"`
+	} `json:"spec"`
+	Status struct {
+		LoadBalancer loadBalancerStatus `json:"loadBalancer"`
+	} `json:"status"`
+	Subsets []struct {
+		Addresses []struct {
+			IP string `json:"ip"`
+		} `json:"addresses"`
+	} `json:"subsets"`
+}
+
+func (o *object) key() string {
+	return o.Metadata.Namespace + "/" + o.Metadata.Name
+}
+
+// records holds records by name and type.
+type records map[string]map[newdns.Type][]newdns.Record
+
+func (r records) add(name string, typ newdns.Type, record newdns.Record) {
+	// get types
+	types := r[name]
+	if types == nil {
+		types = map[newdns.Type][]newdns.Record{}
+		r[name] = types
+	}
+
+	// check existing
+	for _, item := range types[typ] {
+		if item.Address == record.Address && item.Port == record.Port {
+			return
+		}
+	}
+
+	types[typ] = append(types[typ], record)
+}
+
+func (r records) addIP(name, address string) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return
+	} else if ip.To4() != nil {
+		r.add(name, newdns.A, newdns.Record{Address: ip.String()})
+	} else {
+		r.add(name, newdns.AAAA, newdns.Record{Address: ip.String()})
+	}
+}
+
+// addService adds the records of the service and its endpoints.
+func (r records) addService(zone string, svc, eps *object) {
+	// get name
+	name := strings.ToLower(svc.Metadata.Name + "." + svc.Metadata.Namespace + "." + zone)
+
+	// add addresses
+	switch {
+	case svc.Spec.Type == "ExternalName":
+		if newdns.IsDomain(svc.Spec.ExternalName, false) {
+			r.add(name, newdns.CNAME, newdns.Record{Address: newdns.NormalizeDomain(svc.Spec.ExternalName, true, true, false)})
+		}
+	case svc.Spec.Type == "LoadBalancer" && len(svc.Status.LoadBalancer.Ingress) > 0:
+		for _, ingress := range svc.Status.LoadBalancer.Ingress {
+			r.addIP(name, ingress.IP)
+		}
+	case svc.Spec.ClusterIP == "None":
+		if eps != nil {
+			for _, subset := range eps.Subsets {
+				for _, address := range subset.Addresses {
+					r.addIP(name, address.IP)
+				}
+			}
+		}
+	default:
+		ips := svc.Spec.ClusterIPs
+		if len(ips) == 0 {
+			ips = []string{svc.Spec.ClusterIP}
+		}
+		for _, ip := range ips {
+			r.addIP(name, ip)
+		}
+	}
+
+	// add named ports
+	for _, port := range svc.Spec.Ports {
+		if port.Name != "" {
+			protocol := strings.ToLower(port.Protocol)
+			if protocol == "" {
+				protocol = "tcp"
+			}
+			r.add("_"+strings.ToLower(port.Name)+"._"+protocol+"."+name, newdns.SRV, newdns.Record{
+				Address: name,
+				Port:    port.Port,
+			})
+		}
+	}
+}
+
+// addIngress adds the records of the ingress hosts within the zone.
+func (r records) addIngress(zone string, ing *object) {
+	for _, rule := range ing.Spec.Rules {
+		// check host
+		name := newdns.NormalizeDomain(rule.Host, true, true, false)
+		if !newdns.IsDomain(name, true) || !newdns.InZone(zone, name) {
+			continue
+		}
+
+		// add addresses or hostnames
+		for _, ingress := range ing.Status.LoadBalancer.Ingress {
+			if ingress.IP != "" {
+				r.addIP(name, ingress.IP)
+			} else if newdns.IsDomain(ingress.Hostname, false) {
+				r.add(name, newdns.CNAME, newdns.Record{Address: newdns.NormalizeDomain(ingress.Hostname, true, true, false)})
+			}
+		}
+	}
+}
+
+// addSource adds the records of the source, which is either a service or an
+// ingress key prefixed with the resource name.
+func (r records) addSource(zone, source string, objects map[string]map[string]*object) {
+	// split source
+	res, key := splitSource(source)
+
+	// add records
+	switch res {
+	case "services":
+		if svc := objects["services"][key]; svc != nil {
+			r.addService(zone, svc, objects["endpoints"][key])
+		}
+	case "ingresses":
+		if ing := objects["ingresses"][key]; ing != nil {
+			r.addIngress(zone, ing)
+		}
+	}
+}
+
+// sets returns the sets of the name.
+func (r records) sets(name string, ttl time.Duration) []newdns.Set {
+	// get types
+	types := r[name]
+
+	// prepare sets
+	var sets []newdns.Set
+	for typ, list := range types {
+		// sort records
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].Address != list[j].Address {
+				return list[i].Address < list[j].Address
+			}
+			return list[i].Port < list[j].Port
+		})
+
+		// skip CNAME if other records exist and limit to one target
+		if typ == newdns.CNAME {
+			if len(types) > 1 {
+				continue
+			}
+			list = list[:1]
+		}
+
+		// add set
+		sets = append(sets, newdns.Set{
+			Name:    name,
+			Type:    typ,
+			Records: list,
+			TTL:     ttl,
+		})
+	}
+
+	// sort sets
+	sort.Slice(sets, func(i, j int) bool {
+		return sets[i].Type < sets[j].Type
+	})
+
+	return sets
+}
+
+// sourceOf returns the source of the records derived from the object of the
+// resource. Endpoints contribute to the records of their service.
+func sourceOf(res, key string) string {
+	if res == "endpoints" {
+		res = "services"
+	}
+
+	return res + "/" + key
+}
+
+func splitSource(source string) (string, string) {
+	i := strings.Index(source, "/")
+	return source[:i], source[i+1:]
+}
+
+// merge adds all records of the other records.
+func (r records) merge(other records) {
+	for name, types := range other {
+		for typ, list := range types {
+			for _, record := range list {
+				r.add(name, typ, record)
+			}
+		}
+	}
+}
+
+// setsEqual returns whether both lists contain the same sets.
+func setsEqual(a, b []newdns.Set) bool {
+	// check length
+	if len(a) != len(b) {
+		return false
+	}
+
+	// compare sets by type
+	for _, set := range a {
+		var found bool
+		for _, other := range b {
+			if set.Type == other.Type {
+				found = reflect.DeepEqual(set, other)
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
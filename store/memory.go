@@ -0,0 +1,213 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/256dpi/newdns"
+)
+
+// Memory is an in-memory backend.
+type Memory struct {
+	mutex  sync.RWMutex
+	sets   map[string][]newdns.Set
+	below  map[string]int
+	serial uint32
+}
+
+// NewMemory creates and returns a new in-memory backend.
+func NewMemory() *Memory {
+	return &Memory{
+		sets:   map[string][]newdns.Set{},
+		below:  map[string]int{},
+		serial: 1,
+	}
+}
+
+// Lookup implements the Backend interface.
+func (m *Memory) Lookup(_ context.Context, name string) ([]newdns.Set, error) {
+	// acquire lock
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return m.sets[newdns.NormalizeDomain(name, true, true, false)], nil
+}
+
+// NonTerminal implements the NonTerminalBackend interface.
+func (m *Memory) NonTerminal(_ context.Context, name string) (bool, error) {
+	// acquire lock
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return m.below[newdns.NormalizeDomain(name, true, true, false)] > 0, nil
+}
+
+// List implements the Backend interface.
+func (m *Memory) List(_ context.Context, fn func(newdns.Set) error) error {
+	// get sets
+	m.mutex.RLock()
+	sets := m.sets
+	m.mutex.RUnlock()
+
+	// sort names
+	names := make([]string, 0, len(sets))
+	for name := range sets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// yield sets
+	for _, name := range names {
+		for _, set := range sets[name] {
+			err := fn(set)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Serial implements the Backend interface.
+func (m *Memory) Serial() uint32 {
+	// acquire lock
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return m.serial
+}
+
+// Update implements the Backend interface.
+func (m *Memory) Update(_ context.Context, fn func(Tx) error) error {
+	// acquire lock
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// prepare transaction
+	tx := &memoryTx{
+		sets:   make(map[string][]newdns.Set, len(m.sets)),
+		below:  make(map[string]int, len(m.below)),
+		serial: m.serial,
+	}
+	for name, sets := range m.sets {
+		tx.sets[name] = sets
+	}
+	for name, count := range m.below {
+		tx.below[name] = count
+	}
+
+	// run function
+	err := fn(tx)
+	if err != nil {
+		return err
+	}
+
+	// commit
+	m.sets = tx.sets
+	m.below = tx.below
+	m.serial = tx.serial
+
+	return nil
+}
+
+type memoryTx struct {
+	sets   map[string][]newdns.Set
+	below  map[string]int
+	serial uint32
+}
+
+func (t *memoryTx) Get(name string) ([]newdns.Set, error) {
+	return t.sets[newdns.NormalizeDomain(name, true, true, false)], nil
+}
+
+func (t *memoryTx) Put(set newdns.Set) error {
+	// get name
+	name := newdns.NormalizeDomain(set.Name, true, true, false)
+	set.Name = name
+
+	// replace or add set
+	var list []newdns.Set
+	for _, item := range t.sets[name] {
+		if item.Type != set.Type {
+			list = append(list, item)
+		}
+	}
+	list = append(list, set)
+
+	// sort by type
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Type < list[j].Type
+	})
+
+	// index new name
+	if _, ok := t.sets[name]; !ok {
+		t.index(name, 1)
+	}
+
+	t.sets[name] = list
+
+	return nil
+}
+
+func (t *memoryTx) Delete(name string, typ newdns.Type) error {
+	// get name
+	name = newdns.NormalizeDomain(name, true, true, false)
+
+	// check name
+	if _, ok := t.sets[name]; !ok {
+		return nil
+	}
+
+	// delete all sets
+	if typ == 0 {
+		delete(t.sets, name)
+		t.index(name, -1)
+		return nil
+	}
+
+	// delete set
+	var list []newdns.Set
+	for _, item := range t.sets[name] {
+		if item.Type != typ {
+			list = append(list, item)
+		}
+	}
+	if len(list) == 0 {
+		delete(t.sets, name)
+		t.index(name, -1)
+	} else {
+		t.sets[name] = list
+	}
+
+	return nil
+}
+
+// index adds the delta to the number of names below the ancestors of the name.
+func (t *memoryTx) index(name string, delta int) {
+	for name != "." {
+		// get parent
+		i := strings.IndexByte(name, '.')
+		name = name[i+1:]
+		if name == "" {
+			name = "."
+		}
+
+		// update count
+		t.below[name] += delta
+		if t.below[name] == 0 {
+			delete(t.below, name)
+		}
+	}
+}
+
+func (t *memoryTx) Serial() uint32 {
+	return t.serial
+}
+
+func (t *memoryTx) SetSerial(serial uint32) error {
+	t.serial = serial
+	return nil
+}
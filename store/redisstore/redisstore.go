@@ -0,0 +1,552 @@
+// Package redisstore provides a store backend for newdns zones that keeps the
+// sets in Redis.
+//
+// The sets of a zone are stored using the following key layout, where the
+// prefix is configurable and the zone and names are fully qualified and in
+// lower case:
+//
+//	{prefix}:{zone}:serial              the serial as a decimal string
+//	{prefix}:{zone}:names               a sorted set of all names with sets
+//	{prefix}:{zone}:set:{name}:{type}   a set encoded as JSON (see below)
+//	{prefix}:{zone}:changes             the channel for changed names
+//
+// Sets are encoded as JSON objects with the TTL in seconds and the records as
+// newdns.RecordDefinition values e.g. {"ttl":300,"records":[{"address":
+// "1.2.3.4"}]}. The type is the numeric record type e.g. "1" for A records.
+//
+// Lookups fetch the sets of all supported types in a single pipeline. While
+// the backend is running, lookups are cached in memory and invalidated using
+// the names published by other instances on the changes channel. The serial is
+// cached in memory as well and refreshed by updates, when the backend starts
+// running and with every received change.
+package redisstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/256dpi/newdns"
+	"github.com/256dpi/newdns/store"
+)
+
+// ErrConflict is returned by Update if the zone has been modified
+// concurrently.
+var ErrConflict = errors.New("concurrent modification")
+
+var types = []newdns.Type{
+	newdns.A,
+	newdns.AAAA,
+	newdns.CNAME,
+	newdns.MX,
+	newdns.TXT,
+	newdns.NS,
+	newdns.PTR,
+	newdns.SRV,
+}
+
+// Config provides configuration for a Redis backend.
+type Config struct {
+	// The client used to access Redis.
+	Client redis.UniversalClient
+
+	// The FQDN of the zone.
+	Zone string
+
+	// The prefix of all keys.
+	//
+	// Default: "newdns".
+	Prefix string
+}
+
+// Backend is a store backend that keeps the sets of a zone in Redis.
+type Backend struct {
+	config  Config
+	prefix  string
+	mutex   sync.RWMutex
+	cache   map[string][]newdns.Set
+	gen     uint64
+	serial  uint32
+	update  sync.Mutex
+	running bool
+	close   chan struct{}
+	once    sync.Once
+}
+
+// New creates and returns a new Redis backend.
+func New(config Config) *Backend {
+	// normalize zone
+	config.Zone = newdns.NormalizeDomain(config.Zone, true, true, false)
+
+	// set default prefix
+	if config.Prefix == "" {
+		config.Prefix = "newdns"
+	}
+
+	return &Backend{
+		config: config,
+		prefix: config.Prefix + ":" + config.Zone + ":",
+		serial: 1,
+		close:  make(chan struct{}),
+	}
+}
+
+// Lookup implements the store.Backend interface.
+func (b *Backend) Lookup(ctx context.Context, name string) ([]newdns.Set, error) {
+	// normalize name
+	name = newdns.NormalizeDomain(name, true, true, false)
+
+	// check cache
+	b.mutex.RLock()
+	sets, ok := b.cache[name]
+	gen := b.gen
+	b.mutex.RUnlock()
+	if ok {
+		return sets, nil
+	}
+
+	// fetch sets
+	list, err := b.fetch(ctx, b.config.Client, []string{name})
+	if err != nil {
+		return nil, err
+	}
+
+	// cache sets if running and not invalidated meanwhile
+	b.mutex.Lock()
+	if b.running && b.gen == gen {
+		b.cache[name] = list[0]
+	}
+	b.mutex.Unlock()
+
+	return list[0], nil
+}
+
+// List implements the store.Backend interface.
+func (b *Backend) List(ctx context.Context, fn func(newdns.Set) error) error {
+	// get names
+	names, err := b.config.Client.ZRange(ctx, b.prefix+"names", 0, -1).Result()
+	if err != nil {
+		return err
+	}
+
+	// fetch sets in batches
+	for len(names) > 0 {
+		// get batch
+		batch := names
+		if len(batch) > 100 {
+			batch = batch[:100]
+		}
+		names = names[len(batch):]
+
+		// fetch sets
+		list, err := b.fetch(ctx, b.config.Client, batch)
+		if err != nil {
+			return err
+		}
+
+		// yield sets
+		for _, sets := range list {
+			for _, set := range sets {
+				err = fn(set)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Serial implements the store.Backend interface. The cached serial is
+// returned without querying Redis.
+func (b *Backend) Serial() uint32 {
+	return atomic.LoadUint32(&b.serial)
+}
+
+// Update implements the store.Backend interface. The transaction is committed
+// atomically and fails with ErrConflict if the zone has been modified
+// concurrently. The changed names are published on the changes channel.
+func (b *Backend) Update(ctx context.Context, fn func(store.Tx) error) error {
+	// watch serial
+	err := b.config.Client.Watch(ctx, func(rtx *redis.Tx) error {
+		// get serial
+		serial, err := b.getSerial(ctx, rtx)
+		if err != nil {
+			return err
+		}
+
+		// prepare transaction
+		tx := &backendTx{
+			ctx:     ctx,
+			backend: b,
+			client:  rtx,
+			sets:    map[string][]newdns.Set{},
+			serial:  serial,
+		}
+
+		// run function
+		err = fn(tx)
+		if err != nil {
+			return err
+		}
+
+		// check changes
+		if len(tx.sets) == 0 && tx.serial == serial {
+			return nil
+		}
+
+		// commit changes
+		_, err = rtx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for name, sets := range tx.sets {
+				// delete sets
+				for _, typ := range types {
+					pipe.Del(ctx, b.setKey(name, typ))
+				}
+
+				// remove name if empty
+				if len(sets) == 0 {
+					pipe.ZRem(ctx, b.prefix+"names", name)
+					continue
+				}
+
+				// store sets
+				for _, set := range sets {
+					data, err := encodeSet(set)
+					if err != nil {
+						return err
+					}
+					pipe.Set(ctx, b.setKey(name, set.Type), data, 0)
+				}
+
+				// add name
+				pipe.ZAdd(ctx, b.prefix+"names", redis.Z{Member: name})
+			}
+
+			// set serial
+			pipe.Set(ctx, b.prefix+"serial", strconv.FormatUint(uint64(tx.serial), 10), 0)
+
+			// publish names
+			for name := range tx.sets {
+				pipe.Publish(ctx, b.prefix+"changes", name)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// update serial
+		b.update.Lock()
+		atomic.StoreUint32(&b.serial, tx.serial)
+		b.update.Unlock()
+
+		// invalidate names
+		b.mutex.Lock()
+		for name := range tx.sets {
+			delete(b.cache, name)
+		}
+		b.gen++
+		b.mutex.Unlock()
+
+		return nil
+	}, b.prefix+"serial")
+	if errors.Is(err, redis.TxFailedErr) {
+		_ = b.refresh(ctx)
+		return ErrConflict
+	}
+
+	return err
+}
+
+// Run will subscribe to the changes channel and cache lookups until the
+// backend is closed. The cache is invalidated with every received name and
+// dropped when the backend stops running.
+func (b *Backend) Run() error {
+	// prepare context
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// subscribe changes
+	sub := b.config.Client.Subscribe(ctx, b.prefix+"changes")
+	defer sub.Close()
+
+	// await confirmation
+	_, err := sub.Receive(ctx)
+	if err != nil {
+		return err
+	}
+
+	// refresh serial
+	err = b.refresh(ctx)
+	if err != nil {
+		return err
+	}
+
+	// enable cache
+	b.mutex.Lock()
+	b.cache = map[string][]newdns.Set{}
+	b.running = true
+	b.mutex.Unlock()
+
+	// disable cache on return
+	defer func() {
+		b.mutex.Lock()
+		b.cache = nil
+		b.running = false
+		b.mutex.Unlock()
+	}()
+
+	// get channel
+	ch := sub.Channel()
+
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				return nil
+			}
+
+			// invalidate name
+			b.mutex.Lock()
+			delete(b.cache, msg.Payload)
+			b.gen++
+			b.mutex.Unlock()
+
+			// refresh serial, the last known serial is kept on errors
+			_ = b.refresh(ctx)
+		case <-b.close:
+			return nil
+		}
+	}
+}
+
+// Close will stop the backend.
+func (b *Backend) Close() {
+	b.once.Do(func() {
+		close(b.close)
+	})
+}
+
+func (b *Backend) refresh(ctx context.Context) error {
+	// acquire mutex to not overwrite the serial of a concurrent update
+	b.update.Lock()
+	defer b.update.Unlock()
+
+	// get serial
+	serial, err := b.getSerial(ctx, b.config.Client)
+	if err != nil {
+		return err
+	}
+
+	// set serial
+	atomic.StoreUint32(&b.serial, serial)
+
+	return nil
+}
+
+func (b *Backend) setKey(name string, typ newdns.Type) string {
+	return b.prefix + "set:" + name + ":" + strconv.Itoa(int(typ))
+}
+
+func (b *Backend) getSerial(ctx context.Context, client redis.Cmdable) (uint32, error) {
+	// get serial
+	value, err := client.Get(ctx, b.prefix+"serial").Result()
+	if errors.Is(err, redis.Nil) {
+		return 1, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	// parse serial
+	serial, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint32(serial), nil
+}
+
+func (b *Backend) fetch(ctx context.Context, client redis.Cmdable, names []string) ([][]newdns.Set, error) {
+	// queue commands
+	pipe := client.Pipeline()
+	cmds := make([]*redis.StringCmd, 0, len(names)*len(types))
+	for _, name := range names {
+		for _, typ := range types {
+			cmds = append(cmds, pipe.Get(ctx, b.setKey(name, typ)))
+		}
+	}
+
+	// execute pipeline
+	_, err := pipe.Exec(ctx)
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+
+	// decode sets
+	list := make([][]newdns.Set, len(names))
+	for i, cmd := range cmds {
+		// get data
+		data, err := cmd.Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		// decode set
+		set, err := decodeSet(data)
+		if err != nil {
+			return nil, err
+		}
+
+		// set name and type
+		set.Name = names[i/len(types)]
+		set.Type = types[i%len(types)]
+
+		// add set
+		list[i/len(types)] = append(list[i/len(types)], set)
+	}
+
+	return list, nil
+}
+
+type backendTx struct {
+	ctx     context.Context
+	backend *Backend
+	client  redis.Cmdable
+	sets    map[string][]newdns.Set
+	serial  uint32
+}
+
+func (t *backendTx) Get(name string) ([]newdns.Set, error) {
+	// normalize name
+	name = newdns.NormalizeDomain(name, true, true, false)
+
+	// check changed sets
+	if sets, ok := t.sets[name]; ok {
+		return sets, nil
+	}
+
+	// fetch sets
+	list, err := t.backend.fetch(t.ctx, t.client, []string{name})
+	if err != nil {
+		return nil, err
+	}
+
+	return list[0], nil
+}
+
+func (t *backendTx) Put(set newdns.Set) error {
+	// normalize name
+	set.Name = newdns.NormalizeDomain(set.Name, true, true, false)
+
+	// get sets
+	sets, err := t.Get(set.Name)
+	if err != nil {
+		return err
+	}
+
+	// replace or add set
+	var list []newdns.Set
+	for _, item := range sets {
+		if item.Type != set.Type {
+			list = append(list, item)
+		}
+	}
+	t.sets[set.Name] = append(list, set)
+
+	return nil
+}
+
+func (t *backendTx) Delete(name string, typ newdns.Type) error {
+	// normalize name
+	name = newdns.NormalizeDomain(name, true, true, false)
+
+	// get sets
+	sets, err := t.Get(name)
+	if err != nil {
+		return err
+	}
+
+	// remove sets
+	list := []newdns.Set{}
+	for _, item := range sets {
+		if typ != 0 && item.Type != typ {
+			list = append(list, item)
+		}
+	}
+	t.sets[name] = list
+
+	return nil
+}
+
+func (t *backendTx) Serial() uint32 {
+	return t.serial
+}
+
+func (t *backendTx) SetSerial(serial uint32) error {
+	t.serial = serial
+	return nil
+}
+
+type setData struct {
+	TTL     int64                     `json:"ttl"`
+	Records []newdns.RecordDefinition `json:"records"`
+}
+
+func encodeSet(set newdns.Set) (string, error) {
+	// prepare data
+	data := setData{
+		TTL: int64(set.TTL / time.Second),
+	}
+	for _, record := range set.Records {
+		data.Records = append(data.Records, newdns.RecordDefinition{
+			Address:  record.Address,
+			Priority: record.Priority,
+			Weight:   record.Weight,
+			Port:     record.Port,
+			Data:     record.Data,
+		})
+	}
+
+	// encode data
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+
+	return string(buf), nil
+}
+
+func decodeSet(str string) (newdns.Set, error) {
+	// decode data
+	var data setData
+	err := json.Unmarshal([]byte(str), &data)
+	if err != nil {
+		return newdns.Set{}, err
+	}
+
+	// prepare set
+	set := newdns.Set{
+		TTL: time.Duration(data.TTL) * time.Second,
+	}
+	for _, record := range data.Records {
+		set.Records = append(set.Records, newdns.Record{
+			Address:  record.Address,
+			Priority: record.Priority,
+			Weight:   record.Weight,
+			Port:     record.Port,
+			Data:     record.Data,
+		})
+	}
+
+	return set, nil
+}
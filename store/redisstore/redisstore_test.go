@@ -0,0 +1,188 @@
+package redisstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/256dpi/newdns"
+	"github.com/256dpi/newdns/store"
+)
+
+func TestBackend(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+
+	ctx := context.Background()
+
+	backend := New(Config{
+		Client: client,
+		Zone:   "example.com.",
+	})
+
+	zone := &newdns.Zone{
+		Name:             "example.com.",
+		MasterNameServer: "ns1.example.com.",
+		AllNameServers:   []string{"ns1.example.com."},
+	}
+	store.Configure(zone, backend)
+	assert.Equal(t, uint32(1), zone.SerialFunc())
+
+	err := zone.UpdateHandler(ctx, []newdns.Update{
+		{
+			Operation: newdns.AddRecords,
+			Set: newdns.Set{
+				Name: "host.example.com.",
+				Type: newdns.A,
+				Records: []newdns.Record{
+					{Address: "1.2.3.4"},
+				},
+				TTL: time.Minute,
+			},
+		},
+		{
+			Operation: newdns.AddRecords,
+			Set: newdns.Set{
+				Name: "mail.example.com.",
+				Type: newdns.MX,
+				Records: []newdns.Record{
+					{Address: "mx.example.com.", Priority: 10},
+				},
+			},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2), zone.SerialFunc())
+
+	data, err := server.Get("newdns:example.com.:set:host.example.com.:1")
+	assert.NoError(t, err)
+	assert.Equal(t, `{"ttl":60,"records":[{"address":"1.2.3.4"}]}`, data)
+
+	sets, err := zone.Handler(ctx, "host")
+	assert.NoError(t, err)
+	assert.Equal(t, []newdns.Set{
+		{
+			Name: "host.example.com.",
+			Type: newdns.A,
+			Records: []newdns.Record{
+				{Address: "1.2.3.4"},
+			},
+			TTL: time.Minute,
+		},
+	}, sets)
+
+	var list []newdns.Set
+	err = zone.Lister(ctx, func(set newdns.Set) error {
+		list = append(list, set)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Len(t, list, 2)
+	assert.Equal(t, "host.example.com.", list[0].Name)
+	assert.Equal(t, "mail.example.com.", list[1].Name)
+
+	err = zone.UpdateHandler(ctx, []newdns.Update{
+		{
+			Operation: newdns.DeleteName,
+			Set: newdns.Set{
+				Name: "host.example.com.",
+			},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(3), zone.SerialFunc())
+
+	sets, err = zone.Handler(ctx, "host")
+	assert.NoError(t, err)
+	assert.Empty(t, sets)
+
+	names, err := server.ZMembers("newdns:example.com.:names")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"mail.example.com."}, names)
+}
+
+func TestBackendInvalidation(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+
+	ctx := context.Background()
+
+	backend1 := New(Config{Client: client, Zone: "example.com."})
+	backend2 := New(Config{Client: client, Zone: "example.com."})
+
+	go func() {
+		_ = backend1.Run()
+	}()
+	defer backend1.Close()
+
+	put := func(addr string) {
+		err := store.Commit(ctx, backend2, []newdns.Update{
+			{
+				Operation: newdns.DeleteSet,
+				Set:       newdns.Set{Name: "host.example.com.", Type: newdns.A},
+			},
+			{
+				Operation: newdns.AddRecords,
+				Set: newdns.Set{
+					Name:    "host.example.com.",
+					Type:    newdns.A,
+					Records: []newdns.Record{{Address: addr}},
+				},
+			},
+		})
+		assert.NoError(t, err)
+	}
+
+	put("1.2.3.4")
+
+	assert.Eventually(t, func() bool {
+		backend1.mutex.RLock()
+		defer backend1.mutex.RUnlock()
+		return backend1.running
+	}, time.Second, time.Millisecond)
+
+	sets, err := backend1.Lookup(ctx, "host.example.com.")
+	assert.NoError(t, err)
+	assert.Equal(t, "1.2.3.4", sets[0].Records[0].Address)
+
+	server.Set("newdns:example.com.:set:host.example.com.:1", `{"ttl":60,"records":[{"address":"9.9.9.9"}]}`)
+
+	sets, err = backend1.Lookup(ctx, "host.example.com.")
+	assert.NoError(t, err)
+	assert.Equal(t, "1.2.3.4", sets[0].Records[0].Address)
+
+	put("1.2.3.5")
+
+	assert.Eventually(t, func() bool {
+		sets, err := backend1.Lookup(ctx, "host.example.com.")
+		return err == nil && sets[0].Records[0].Address == "1.2.3.5"
+	}, time.Second, time.Millisecond)
+
+	assert.Eventually(t, func() bool {
+		return backend1.Serial() == 3
+	}, time.Second, time.Millisecond)
+}
+
+func TestBackendConflict(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+
+	backend := New(Config{Client: client, Zone: "example.com."})
+
+	err := backend.Update(context.Background(), func(tx store.Tx) error {
+		server.Set("newdns:example.com.:serial", "5")
+		return tx.SetSerial(tx.Serial() + 1)
+	})
+	assert.Equal(t, ErrConflict, err)
+	assert.Equal(t, uint32(5), backend.Serial())
+}
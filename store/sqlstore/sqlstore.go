@@ -0,0 +1,694 @@
+// Package sqlstore provides a store backend for newdns zones that keeps the
+// sets in a SQL database.
+//
+// The backend uses the database/sql package and works with PostgreSQL, MySQL
+// and SQLite drivers. The tables are created by Migrate and shared by all
+// zones. Changes made by transactions are journaled to serve incremental zone
+// transfers (IXFR).
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/256dpi/newdns"
+	"github.com/256dpi/newdns/store"
+)
+
+// Dialect denotes the SQL dialect of a database.
+type Dialect int
+
+const (
+	// Postgres uses numbered placeholders e.g. "$1".
+	Postgres Dialect = iota
+
+	// MySQL uses question mark placeholders.
+	MySQL
+
+	// SQLite uses question mark placeholders.
+	SQLite
+)
+
+// rebind will replace question mark placeholders with the dialect specific
+// placeholders.
+func (d Dialect) rebind(query string) string {
+	// check dialect
+	if d != Postgres {
+		return query
+	}
+
+	// replace placeholders
+	var b strings.Builder
+	var n int
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+// migrations are the schema migrations in order. They use types that are
+// supported by all dialects.
+var migrations = []string{
+	`CREATE TABLE newdns_zones (
+		zone VARCHAR(255) NOT NULL PRIMARY KEY,
+		serial BIGINT NOT NULL
+	)`,
+	`CREATE TABLE newdns_sets (
+		zone VARCHAR(255) NOT NULL,
+		name VARCHAR(255) NOT NULL,
+		type INTEGER NOT NULL,
+		ttl BIGINT NOT NULL,
+		records TEXT NOT NULL,
+		PRIMARY KEY (zone, name, type)
+	)`,
+	`CREATE TABLE newdns_journal (
+		zone VARCHAR(255) NOT NULL,
+		seq BIGINT NOT NULL,
+		serial_from BIGINT NOT NULL,
+		serial_to BIGINT NOT NULL,
+		removed TEXT NOT NULL,
+		added TEXT NOT NULL,
+		PRIMARY KEY (zone, seq)
+	)`,
+}
+
+// Migrate will create or update the tables used by the backend. Applied
+// migrations are recorded in the "newdns_migrations" table.
+func Migrate(ctx context.Context, db *sql.DB, dialect Dialect) error {
+	// ensure migrations table
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS newdns_migrations (version INTEGER NOT NULL PRIMARY KEY)`)
+	if err != nil {
+		return err
+	}
+
+	// get current version
+	var version int
+	err = db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM newdns_migrations`).Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	// apply missing migrations
+	for i := version; i < len(migrations); i++ {
+		// begin transaction
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+
+		// apply migration
+		_, err = tx.ExecContext(ctx, migrations[i])
+		if err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("migration %d failed: %w", i+1, err)
+		}
+
+		// record migration
+		_, err = tx.ExecContext(ctx, dialect.rebind(`INSERT INTO newdns_migrations (version) VALUES (?)`), i+1)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+
+		// commit transaction
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Config provides configuration for a SQL backend.
+type Config struct {
+	// The database with the migrated tables.
+	DB *sql.DB
+
+	// The dialect of the database.
+	Dialect Dialect
+
+	// The FQDN of the zone.
+	Zone string
+
+	// The maximum number of journaled changes that are kept for the zone.
+	//
+	// Default: 100.
+	JournalSize int
+
+	// The interval at which the serial is read from the database to pick up
+	// changes made by other instances.
+	//
+	// Default: 5s.
+	PollInterval time.Duration
+}
+
+// Backend is a store backend that keeps the sets of a zone in a SQL database.
+// Lookups use prepared statements keyed by zone, name and type. The serial is
+// cached and refreshed on updates and periodically from the database.
+type Backend struct {
+	config     Config
+	lookup     *sql.Stmt
+	lookupType *sql.Stmt
+	list       *sql.Stmt
+	serial     *sql.Stmt
+	journal    *sql.Stmt
+	mutex      sync.Mutex
+	cached     uint32
+	done       chan struct{}
+	once       sync.Once
+}
+
+// New creates and returns a new SQL backend. The zone is created with the
+// serial 1 if it does not yet exist. The backend must be closed to stop
+// polling the serial.
+func New(ctx context.Context, config Config) (*Backend, error) {
+	// normalize zone
+	config.Zone = newdns.NormalizeDomain(config.Zone, true, true, false)
+
+	// set default journal size
+	if config.JournalSize <= 0 {
+		config.JournalSize = 100
+	}
+
+	// set default poll interval
+	if config.PollInterval <= 0 {
+		config.PollInterval = 5 * time.Second
+	}
+
+	// prepare backend
+	b := &Backend{
+		config: config,
+		done:   make(chan struct{}),
+	}
+
+	// prepare statements
+	for _, item := range []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&b.lookup, `SELECT name, type, ttl, records FROM newdns_sets WHERE zone = ? AND name = ? ORDER BY type`},
+		{&b.lookupType, `SELECT name, type, ttl, records FROM newdns_sets WHERE zone = ? AND name = ? AND type = ?`},
+		{&b.list, `SELECT name, type, ttl, records FROM newdns_sets WHERE zone = ? ORDER BY name, type`},
+		{&b.serial, `SELECT serial FROM newdns_zones WHERE zone = ?`},
+		{&b.journal, `SELECT serial_from, serial_to, removed, added FROM newdns_journal WHERE zone = ? ORDER BY seq`},
+	} {
+		stmt, err := config.DB.PrepareContext(ctx, config.Dialect.rebind(item.query))
+		if err != nil {
+			_ = b.Close()
+			return nil, err
+		}
+		*item.stmt = stmt
+	}
+
+	// get serial
+	err := b.serial.QueryRowContext(ctx, config.Zone).Scan(&b.cached)
+	if errors.Is(err, sql.ErrNoRows) {
+		// create zone
+		b.cached = 1
+		_, err = config.DB.ExecContext(ctx, config.Dialect.rebind(`INSERT INTO newdns_zones (zone, serial) VALUES (?, ?)`), config.Zone, b.cached)
+	}
+	if err != nil {
+		_ = b.Close()
+		return nil, err
+	}
+
+	// run poller
+	go b.poll()
+
+	return b, nil
+}
+
+// Lookup implements the store.Backend interface.
+func (b *Backend) Lookup(ctx context.Context, name string) ([]newdns.Set, error) {
+	// query sets
+	rows, err := b.lookup.QueryContext(ctx, b.config.Zone, newdns.NormalizeDomain(name, true, true, false))
+	if err != nil {
+		return nil, err
+	}
+
+	return scanSets(rows, nil)
+}
+
+// LookupType returns the set with the specified name and type. The second
+// return value indicates whether the set exists.
+func (b *Backend) LookupType(ctx context.Context, name string, typ newdns.Type) (newdns.Set, bool, error) {
+	// query set
+	rows, err := b.lookupType.QueryContext(ctx, b.config.Zone, newdns.NormalizeDomain(name, true, true, false), int(typ))
+	if err != nil {
+		return newdns.Set{}, false, err
+	}
+
+	// scan set
+	sets, err := scanSets(rows, nil)
+	if err != nil || len(sets) == 0 {
+		return newdns.Set{}, false, err
+	}
+
+	return sets[0], true, nil
+}
+
+// List implements the store.Backend interface.
+func (b *Backend) List(ctx context.Context, fn func(newdns.Set) error) error {
+	// query sets
+	rows, err := b.list.QueryContext(ctx, b.config.Zone)
+	if err != nil {
+		return err
+	}
+
+	// yield sets
+	_, err = scanSets(rows, fn)
+
+	return err
+}
+
+// Serial implements the store.Backend interface. The cached serial is
+// returned without querying the database.
+func (b *Backend) Serial() uint32 {
+	return atomic.LoadUint32(&b.cached)
+}
+
+// Update implements the store.Backend interface. The changes are journaled if
+// the serial is updated. The zone row is locked for the duration of the
+// transaction to serialize updates of multiple instances.
+func (b *Backend) Update(ctx context.Context, fn func(store.Tx) error) error {
+	// begin transaction
+	sqlTx, err := b.config.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	// prepare transaction
+	tx := &backendTx{
+		ctx:     ctx,
+		backend: b,
+		tx:      sqlTx,
+	}
+
+	// lock zone
+	_, err = sqlTx.ExecContext(ctx, b.config.Dialect.rebind(`UPDATE newdns_zones SET serial = serial WHERE zone = ?`), b.config.Zone)
+	if err != nil {
+		_ = sqlTx.Rollback()
+		return err
+	}
+
+	// get serial
+	err = tx.tx.StmtContext(ctx, b.serial).QueryRowContext(ctx, b.config.Zone).Scan(&tx.from)
+	if err != nil {
+		_ = sqlTx.Rollback()
+		return err
+	}
+	tx.to = tx.from
+
+	// run function
+	err = fn(tx)
+	if err == nil && tx.to != tx.from {
+		err = tx.record()
+	}
+	if err != nil {
+		_ = sqlTx.Rollback()
+		return err
+	}
+
+	// commit transaction
+	err = sqlTx.Commit()
+	if err != nil {
+		return err
+	}
+
+	// update cached serial
+	b.mutex.Lock()
+	atomic.StoreUint32(&b.cached, tx.to)
+	b.mutex.Unlock()
+
+	return nil
+}
+
+// Journal implements the store.JournalBackend interface.
+func (b *Backend) Journal(ctx context.Context, serial uint32) ([]newdns.Change, error) {
+	// query changes
+	rows, err := b.journal.QueryContext(ctx, b.config.Zone)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// scan changes
+	var changes []newdns.Change
+	for rows.Next() {
+		// scan row
+		var change newdns.Change
+		var removed, added string
+		err = rows.Scan(&change.From, &change.To, &removed, &added)
+		if err != nil {
+			return nil, err
+		}
+
+		// reset changes on requested serial
+		if change.From == serial {
+			changes = changes[:0]
+		}
+
+		// decode sets
+		change.Removed, err = decodeSets(b.config.Zone, removed)
+		if err != nil {
+			return nil, err
+		}
+		change.Added, err = decodeSets(b.config.Zone, added)
+		if err != nil {
+			return nil, err
+		}
+
+		// add change
+		changes = append(changes, change)
+	}
+
+	// check error
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	// drop changes before the requested serial
+	if len(changes) > 0 && changes[0].From != serial {
+		return nil, nil
+	}
+
+	return changes, nil
+}
+
+// Close will stop polling the serial and close the prepared statements.
+func (b *Backend) Close() error {
+	// stop poller
+	b.once.Do(func() {
+		close(b.done)
+	})
+
+	// close statements
+	var err error
+	for _, stmt := range []*sql.Stmt{b.lookup, b.lookupType, b.list, b.serial, b.journal} {
+		if stmt != nil {
+			if closeErr := stmt.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
+	}
+
+	return err
+}
+
+func (b *Backend) poll() {
+	// prepare ticker
+	ticker := time.NewTicker(b.config.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.refresh()
+		case <-b.done:
+			return
+		}
+	}
+}
+
+func (b *Backend) refresh() {
+	// acquire mutex to not overwrite the serial of a concurrent update
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// prepare context
+	ctx, cancel := context.WithTimeout(context.Background(), b.config.PollInterval)
+	defer cancel()
+
+	// query serial, the last known serial is kept on errors
+	var serial uint32
+	err := b.serial.QueryRowContext(ctx, b.config.Zone).Scan(&serial)
+	if err == nil {
+		atomic.StoreUint32(&b.cached, serial)
+	}
+}
+
+type backendTx struct {
+	ctx     context.Context
+	backend *Backend
+	tx      *sql.Tx
+	from    uint32
+	to      uint32
+	removed []newdns.Set
+	added   []newdns.Set
+}
+
+func (t *backendTx) Get(name string) ([]newdns.Set, error) {
+	// query sets
+	rows, err := t.tx.StmtContext(t.ctx, t.backend.lookup).QueryContext(t.ctx, t.backend.config.Zone, newdns.NormalizeDomain(name, true, true, false))
+	if err != nil {
+		return nil, err
+	}
+
+	return scanSets(rows, nil)
+}
+
+func (t *backendTx) Put(set newdns.Set) error {
+	// normalize name
+	set.Name = newdns.NormalizeDomain(set.Name, true, true, false)
+
+	// delete existing set
+	err := t.Delete(set.Name, set.Type)
+	if err != nil {
+		return err
+	}
+
+	// encode records
+	records, err := encodeRecords(set.Records)
+	if err != nil {
+		return err
+	}
+
+	// insert set
+	_, err = t.tx.ExecContext(t.ctx, t.backend.config.Dialect.rebind(`INSERT INTO newdns_sets (zone, name, type, ttl, records) VALUES (?, ?, ?, ?, ?)`),
+		t.backend.config.Zone, set.Name, int(set.Type), int64(set.TTL/time.Second), records)
+	if err != nil {
+		return err
+	}
+
+	// journal set
+	t.added = append(t.added, set)
+
+	return nil
+}
+
+func (t *backendTx) Delete(name string, typ newdns.Type) error {
+	// get sets
+	sets, err := t.Get(name)
+	if err != nil {
+		return err
+	}
+
+	// journal sets
+	for _, set := range sets {
+		if typ == 0 || set.Type == typ {
+			t.removed = append(t.removed, set)
+		}
+	}
+
+	// delete sets
+	name = newdns.NormalizeDomain(name, true, true, false)
+	if typ == 0 {
+		_, err = t.tx.ExecContext(t.ctx, t.backend.config.Dialect.rebind(`DELETE FROM newdns_sets WHERE zone = ? AND name = ?`), t.backend.config.Zone, name)
+	} else {
+		_, err = t.tx.ExecContext(t.ctx, t.backend.config.Dialect.rebind(`DELETE FROM newdns_sets WHERE zone = ? AND name = ? AND type = ?`), t.backend.config.Zone, name, int(typ))
+	}
+
+	return err
+}
+
+func (t *backendTx) Serial() uint32 {
+	return t.to
+}
+
+func (t *backendTx) SetSerial(serial uint32) error {
+	// update serial
+	_, err := t.tx.ExecContext(t.ctx, t.backend.config.Dialect.rebind(`UPDATE newdns_zones SET serial = ? WHERE zone = ?`), serial, t.backend.config.Zone)
+	if err != nil {
+		return err
+	}
+
+	// set serial
+	t.to = serial
+
+	return nil
+}
+
+func (t *backendTx) record() error {
+	// get dialect and zone
+	dialect := t.backend.config.Dialect
+	zone := t.backend.config.Zone
+
+	// encode sets
+	removed, err := encodeSets(t.backend.config.Zone, t.removed)
+	if err != nil {
+		return err
+	}
+	added, err := encodeSets(t.backend.config.Zone, t.added)
+	if err != nil {
+		return err
+	}
+
+	// get next sequence
+	var seq int64
+	err = t.tx.QueryRowContext(t.ctx, dialect.rebind(`SELECT COALESCE(MAX(seq), 0) FROM newdns_journal WHERE zone = ?`), zone).Scan(&seq)
+	if err != nil {
+		return err
+	}
+	seq++
+
+	// insert change
+	_, err = t.tx.ExecContext(t.ctx, dialect.rebind(`INSERT INTO newdns_journal (zone, seq, serial_from, serial_to, removed, added) VALUES (?, ?, ?, ?, ?, ?)`),
+		zone, seq, t.from, t.to, removed, added)
+	if err != nil {
+		return err
+	}
+
+	// prune journal
+	_, err = t.tx.ExecContext(t.ctx, dialect.rebind(`DELETE FROM newdns_journal WHERE zone = ? AND seq <= ?`), zone, seq-int64(t.backend.config.JournalSize))
+
+	return err
+}
+
+func scanSets(rows *sql.Rows, fn func(newdns.Set) error) ([]newdns.Set, error) {
+	// ensure close
+	defer rows.Close()
+
+	// scan sets
+	var sets []newdns.Set
+	for rows.Next() {
+		// scan row
+		var set newdns.Set
+		var typ int
+		var ttl int64
+		var records string
+		err := rows.Scan(&set.Name, &typ, &ttl, &records)
+		if err != nil {
+			return nil, err
+		}
+
+		// set type and TTL
+		set.Type = newdns.Type(typ)
+		set.TTL = time.Duration(ttl) * time.Second
+
+		// decode records
+		set.Records, err = decodeRecords(records)
+		if err != nil {
+			return nil, err
+		}
+
+		// yield or collect set
+		if fn != nil {
+			err = fn(set)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			sets = append(sets, set)
+		}
+	}
+
+	return sets, rows.Err()
+}
+
+func encodeRecords(records []newdns.Record) (string, error) {
+	// convert records
+	list := make([]newdns.RecordDefinition, 0, len(records))
+	for _, record := range records {
+		list = append(list, newdns.RecordDefinition{
+			Address:  record.Address,
+			Priority: record.Priority,
+			Weight:   record.Weight,
+			Port:     record.Port,
+			Data:     record.Data,
+		})
+	}
+
+	// encode records
+	data, err := json.Marshal(list)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+func decodeRecords(data string) ([]newdns.Record, error) {
+	// decode records
+	var list []newdns.RecordDefinition
+	err := json.Unmarshal([]byte(data), &list)
+	if err != nil {
+		return nil, err
+	}
+
+	// convert records
+	records := make([]newdns.Record, 0, len(list))
+	for _, record := range list {
+		records = append(records, newdns.Record{
+			Address:  record.Address,
+			Priority: record.Priority,
+			Weight:   record.Weight,
+			Port:     record.Port,
+			Data:     record.Data,
+		})
+	}
+
+	return records, nil
+}
+
+func encodeSets(zone string, sets []newdns.Set) (string, error) {
+	// define sets
+	list := make([]newdns.SetDefinition, 0, len(sets))
+	for _, set := range sets {
+		list = append(list, newdns.DefineSet(zone, set))
+	}
+
+	// encode sets
+	data, err := json.Marshal(list)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+func decodeSets(zone, data string) ([]newdns.Set, error) {
+	// decode definitions
+	var list []newdns.SetDefinition
+	err := json.Unmarshal([]byte(data), &list)
+	if err != nil {
+		return nil, err
+	}
+
+	// convert definitions
+	sets := make([]newdns.Set, 0, len(list))
+	for _, def := range list {
+		set, err := def.Set(zone)
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, set)
+	}
+
+	return sets, nil
+}
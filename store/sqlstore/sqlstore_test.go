@@ -0,0 +1,295 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/256dpi/newdns"
+	"github.com/256dpi/newdns/store"
+)
+
+func openDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	assert.NoError(t, err)
+	db.SetMaxOpenConns(1)
+
+	err = Migrate(context.Background(), db, SQLite)
+	assert.NoError(t, err)
+
+	return db
+}
+
+func TestRebind(t *testing.T) {
+	assert.Equal(t, "SELECT ? AND ?", SQLite.rebind("SELECT ? AND ?"))
+	assert.Equal(t, "SELECT $1 AND $2", Postgres.rebind("SELECT ? AND ?"))
+}
+
+func TestMigrate(t *testing.T) {
+	db := openDB(t)
+	defer db.Close()
+
+	err := Migrate(context.Background(), db, SQLite)
+	assert.NoError(t, err)
+
+	var version int
+	err = db.QueryRow("SELECT MAX(version) FROM newdns_migrations").Scan(&version)
+	assert.NoError(t, err)
+	assert.Equal(t, len(migrations), version)
+}
+
+func TestBackend(t *testing.T) {
+	db := openDB(t)
+	defer db.Close()
+
+	ctx := context.Background()
+
+	backend, err := New(ctx, Config{
+		DB:      db,
+		Dialect: SQLite,
+		Zone:    "example.com.",
+	})
+	assert.NoError(t, err)
+	defer backend.Close()
+
+	zone := &newdns.Zone{
+		Name:             "example.com.",
+		MasterNameServer: "ns1.example.com.",
+		AllNameServers:   []string{"ns1.example.com."},
+	}
+	store.Configure(zone, backend)
+	assert.Equal(t, uint32(1), zone.SerialFunc())
+
+	err = zone.UpdateHandler(ctx, []newdns.Update{
+		{
+			Operation: newdns.AddRecords,
+			Set: newdns.Set{
+				Name: "host.example.com.",
+				Type: newdns.A,
+				Records: []newdns.Record{
+					{Address: "1.2.3.4"},
+				},
+				TTL: time.Minute,
+			},
+		},
+		{
+			Operation: newdns.AddRecords,
+			Set: newdns.Set{
+				Name: "host.example.com.",
+				Type: newdns.TXT,
+				Records: []newdns.Record{
+					{Data: []string{"foo", "bar"}},
+				},
+			},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2), zone.SerialFunc())
+
+	sets, err := zone.Handler(ctx, "host")
+	assert.NoError(t, err)
+	assert.Equal(t, []newdns.Set{
+		{
+			Name: "host.example.com.",
+			Type: newdns.A,
+			Records: []newdns.Record{
+				{Address: "1.2.3.4"},
+			},
+			TTL: time.Minute,
+		},
+		{
+			Name: "host.example.com.",
+			Type: newdns.TXT,
+			Records: []newdns.Record{
+				{Data: []string{"foo", "bar"}},
+			},
+			TTL: 5 * time.Minute,
+		},
+	}, sets)
+
+	set, ok, err := backend.LookupType(ctx, "host.example.com.", newdns.TXT)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, newdns.TXT, set.Type)
+
+	_, ok, err = backend.LookupType(ctx, "host.example.com.", newdns.MX)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	err = zone.UpdateHandler(ctx, []newdns.Update{
+		{
+			Operation: newdns.AddRecords,
+			Set: newdns.Set{
+				Name: "host.example.com.",
+				Type: newdns.A,
+				Records: []newdns.Record{
+					{Address: "1.2.3.5"},
+				},
+			},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(3), zone.SerialFunc())
+
+	var list []string
+	err = zone.Lister(ctx, func(set newdns.Set) error {
+		list = append(list, set.Name)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"host.example.com.", "host.example.com."}, list)
+
+	changes, err := zone.Journal(ctx, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []newdns.Change{
+		{
+			From:    1,
+			To:      2,
+			Removed: []newdns.Set{},
+			Added: []newdns.Set{
+				{
+					Name: "host.example.com.",
+					Type: newdns.A,
+					Records: []newdns.Record{
+						{Address: "1.2.3.4"},
+					},
+					TTL: time.Minute,
+				},
+				{
+					Name: "host.example.com.",
+					Type: newdns.TXT,
+					Records: []newdns.Record{
+						{Data: []string{"foo", "bar"}},
+					},
+					TTL: 5 * time.Minute,
+				},
+			},
+		},
+		{
+			From: 2,
+			To:   3,
+			Removed: []newdns.Set{
+				{
+					Name: "host.example.com.",
+					Type: newdns.A,
+					Records: []newdns.Record{
+						{Address: "1.2.3.4"},
+					},
+					TTL: time.Minute,
+				},
+			},
+			Added: []newdns.Set{
+				{
+					Name: "host.example.com.",
+					Type: newdns.A,
+					Records: []newdns.Record{
+						{Address: "1.2.3.4"},
+						{Address: "1.2.3.5"},
+					},
+					TTL: time.Minute,
+				},
+			},
+		},
+	}, changes)
+
+	changes, err = zone.Journal(ctx, 2)
+	assert.NoError(t, err)
+	assert.Len(t, changes, 1)
+
+	changes, err = zone.Journal(ctx, 7)
+	assert.NoError(t, err)
+	assert.Empty(t, changes)
+
+	backend2, err := New(ctx, Config{
+		DB:      db,
+		Dialect: SQLite,
+		Zone:    "example.com.",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(3), backend2.Serial())
+	assert.NoError(t, backend2.Close())
+}
+
+func TestBackendJournalSize(t *testing.T) {
+	db := openDB(t)
+	defer db.Close()
+
+	ctx := context.Background()
+
+	backend, err := New(ctx, Config{
+		DB:          db,
+		Dialect:     SQLite,
+		Zone:        "example.com.",
+		JournalSize: 2,
+	})
+	assert.NoError(t, err)
+	defer backend.Close()
+
+	for _, addr := range []string{"1.2.3.4", "1.2.3.5", "1.2.3.6"} {
+		err = store.Commit(ctx, backend, []newdns.Update{
+			{
+				Operation: newdns.AddRecords,
+				Set: newdns.Set{
+					Name:    "host.example.com.",
+					Type:    newdns.A,
+					Records: []newdns.Record{{Address: addr}},
+				},
+			},
+		})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, uint32(4), backend.Serial())
+
+	changes, err := backend.Journal(ctx, 1)
+	assert.NoError(t, err)
+	assert.Empty(t, changes)
+
+	changes, err = backend.Journal(ctx, 2)
+	assert.NoError(t, err)
+	assert.Len(t, changes, 2)
+}
+
+func TestBackendPoll(t *testing.T) {
+	db := openDB(t)
+	defer db.Close()
+
+	ctx := context.Background()
+
+	backend1, err := New(ctx, Config{
+		DB:           db,
+		Dialect:      SQLite,
+		Zone:         "example.com.",
+		PollInterval: 10 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	defer backend1.Close()
+
+	backend2, err := New(ctx, Config{
+		DB:      db,
+		Dialect: SQLite,
+		Zone:    "example.com.",
+	})
+	assert.NoError(t, err)
+	defer backend2.Close()
+
+	err = store.Commit(ctx, backend2, []newdns.Update{
+		{
+			Operation: newdns.AddRecords,
+			Set: newdns.Set{
+				Name:    "host.example.com.",
+				Type:    newdns.A,
+				Records: []newdns.Record{{Address: "1.2.3.4"}},
+			},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2), backend2.Serial())
+
+	assert.Eventually(t, func() bool {
+		return backend1.Serial() == 2
+	}, time.Second, 10*time.Millisecond)
+}
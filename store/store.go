@@ -0,0 +1,275 @@
+// Package store provides storage backends for newdns zones that support
+// dynamic updates.
+package store
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/256dpi/newdns"
+)
+
+// Backend is implemented by storages that hold the sets of a zone.
+type Backend interface {
+	// Lookup returns all sets for the specified fully qualified name.
+	Lookup(ctx context.Context, name string) ([]newdns.Set, error)
+
+	// List calls the provided function for every stored set. Errors returned
+	// by the function must be returned immediately.
+	List(ctx context.Context, fn func(newdns.Set) error) error
+
+	// Serial returns the current serial of the zone.
+	Serial() uint32
+
+	// Update calls the provided function with a transaction. The changes
+	// must only be committed if the function returns no error.
+	Update(ctx context.Context, fn func(Tx) error) error
+}
+
+// NonTerminalBackend is implemented by backends that can efficiently detect
+// empty non-terminals.
+type NonTerminalBackend interface {
+	// NonTerminal returns whether sets exist below the specified fully
+	// qualified name.
+	NonTerminal(ctx context.Context, name string) (bool, error)
+}
+
+// JournalBackend is implemented by backends that record the changes made by
+// transactions.
+type JournalBackend interface {
+	// Journal returns the changes since the specified serial in ascending
+	// order.
+	Journal(ctx context.Context, serial uint32) ([]newdns.Change, error)
+}
+
+// Tx is a transaction of a backend.
+type Tx interface {
+	// Get returns all sets for the specified fully qualified name.
+	Get(name string) ([]newdns.Set, error)
+
+	// Put stores the set and replaces an existing set with the same name and
+	// type.
+	Put(set newdns.Set) error
+
+	// Delete removes the set with the specified name and type. If the type is
+	// zero all sets with the name are removed.
+	Delete(name string, typ newdns.Type) error
+
+	// Serial returns the serial of the zone.
+	Serial() uint32
+
+	// SetSerial updates the serial of the zone.
+	SetSerial(serial uint32) error
+}
+
+// Configure will set the handler, lister, serial callback and update handler
+// of the provided zone to use the backend. Dynamic updates are applied in a
+// single transaction that also increments the serial if the zone changed. The
+// non-terminal callback is set if the backend implements NonTerminalBackend
+// and the journal is set if the backend implements JournalBackend.
+func Configure(zone *newdns.Zone, backend Backend) {
+	// get zone name
+	zoneName := zone.Name
+
+	// prepare full name
+	fullName := func(name string) string {
+		if name == "" {
+			return strings.ToLower(zoneName)
+		}
+
+		return strings.ToLower(name + "." + zoneName)
+	}
+
+	// set handler
+	zone.Handler = func(ctx context.Context, name string) ([]newdns.Set, error) {
+		return backend.Lookup(ctx, fullName(name))
+	}
+
+	// set non-terminal callback
+	if ntb, ok := backend.(NonTerminalBackend); ok {
+		zone.NonTerminal = func(ctx context.Context, name string) (bool, error) {
+			return ntb.NonTerminal(ctx, fullName(name))
+		}
+	}
+
+	// set lister
+	zone.Lister = backend.List
+
+	// set journal
+	if jb, ok := backend.(JournalBackend); ok {
+		zone.Journal = jb.Journal
+	}
+
+	// set serial
+	zone.SerialFunc = backend.Serial
+
+	// set update handler
+	zone.UpdateHandler = func(ctx context.Context, updates []newdns.Update) error {
+		return Commit(ctx, backend, updates)
+	}
+}
+
+// Commit will apply the provided updates to the backend in a single
+// transaction that also increments the serial if the zone changed.
+func Commit(ctx context.Context, backend Backend, updates []newdns.Update) error {
+	return backend.Update(ctx, func(tx Tx) error {
+		// apply updates
+		changed, err := Apply(tx, updates)
+		if err != nil {
+			return err
+		}
+
+		// increment serial if changed
+		if changed {
+			serial := tx.Serial() + 1
+			if serial == 0 {
+				serial = 1
+			}
+
+			err = tx.SetSerial(serial)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Apply will apply the provided updates using the transaction and return
+// whether the zone has been changed.
+func Apply(tx Tx, updates []newdns.Update) (bool, error) {
+	// track changes
+	var changed bool
+
+	for _, update := range updates {
+		// get name
+		name := newdns.NormalizeDomain(update.Set.Name, true, true, false)
+
+		// handle name and set deletions
+		if update.Operation == newdns.DeleteName || update.Operation == newdns.DeleteSet {
+			// get sets
+			sets, err := tx.Get(name)
+			if err != nil {
+				return false, err
+			}
+
+			// check existence
+			if _, ok := findSet(sets, update.Set.Type, update.Operation == newdns.DeleteName); !ok {
+				continue
+			}
+
+			// delete sets
+			typ := update.Set.Type
+			if update.Operation == newdns.DeleteName {
+				typ = 0
+			}
+			err = tx.Delete(name, typ)
+			if err != nil {
+				return false, err
+			}
+
+			changed = true
+
+			continue
+		}
+
+		// get sets
+		sets, err := tx.Get(name)
+		if err != nil {
+			return false, err
+		}
+
+		// get existing set
+		set, exists := findSet(sets, update.Set.Type, false)
+		if !exists {
+			set = newdns.Set{
+				Name: name,
+				Type: update.Set.Type,
+				TTL:  update.Set.TTL,
+			}
+		}
+
+		// copy records
+		set.Records = append([]newdns.Record(nil), set.Records...)
+
+		// apply records
+		var modified bool
+		switch update.Operation {
+		case newdns.AddRecords:
+			for _, record := range update.Set.Records {
+				if _, ok := findRecord(set.Records, record); !ok {
+					set.Records = append(set.Records, record)
+					modified = true
+				}
+			}
+			if update.Set.TTL != 0 && update.Set.TTL != set.TTL {
+				set.TTL = update.Set.TTL
+				modified = true
+			}
+		case newdns.DeleteRecords:
+			for _, record := range update.Set.Records {
+				if i, ok := findRecord(set.Records, record); ok {
+					set.Records = append(set.Records[:i], set.Records[i+1:]...)
+					modified = true
+				}
+			}
+		default:
+			return false, fmt.Errorf("unsupported operation: %d", update.Operation)
+		}
+
+		// check modification
+		if !modified {
+			continue
+		}
+
+		// delete empty sets
+		if len(set.Records) == 0 {
+			err = tx.Delete(name, set.Type)
+			if err != nil {
+				return false, err
+			}
+
+			changed = true
+
+			continue
+		}
+
+		// validate set
+		err = set.Validate()
+		if err != nil {
+			return false, &newdns.Error{Kind: newdns.ErrValidation, Err: err}
+		}
+
+		// store set
+		err = tx.Put(set)
+		if err != nil {
+			return false, err
+		}
+
+		changed = true
+	}
+
+	return changed, nil
+}
+
+func findSet(sets []newdns.Set, typ newdns.Type, anyType bool) (newdns.Set, bool) {
+	for _, set := range sets {
+		if anyType || set.Type == typ {
+			return set, true
+		}
+	}
+
+	return newdns.Set{}, false
+}
+
+func findRecord(records []newdns.Record, record newdns.Record) (int, bool) {
+	for i, item := range records {
+		if strings.EqualFold(item.Address, record.Address) && item.Priority == record.Priority && item.Weight == record.Weight && item.Port == record.Port && strings.Join(item.Data, "\x00") == strings.Join(record.Data, "\x00") {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
@@ -0,0 +1,156 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/256dpi/newdns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigure(t *testing.T) {
+	backend := NewMemory()
+
+	zone := &newdns.Zone{
+		Name:             "example.com.",
+		MasterNameServer: "ns1.example.com.",
+		AllNameServers:   []string{"ns1.example.com."},
+	}
+	Configure(zone, backend)
+
+	ctx := context.Background()
+
+	err := zone.UpdateHandler(ctx, []newdns.Update{
+		{
+			Operation: newdns.AddRecords,
+			Set: newdns.Set{
+				Name: "host.example.com.",
+				Type: newdns.A,
+				Records: []newdns.Record{
+					{Address: "1.2.3.4"},
+					{Address: "1.2.3.5"},
+				},
+				TTL: time.Minute,
+			},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2), zone.SerialFunc())
+
+	sets, err := zone.Handler(ctx, "host")
+	assert.NoError(t, err)
+	assert.Equal(t, []newdns.Set{
+		{
+			Name: "host.example.com.",
+			Type: newdns.A,
+			Records: []newdns.Record{
+				{Address: "1.2.3.4"},
+				{Address: "1.2.3.5"},
+			},
+			TTL: time.Minute,
+		},
+	}, sets)
+
+	err = zone.UpdateHandler(ctx, []newdns.Update{
+		{
+			Operation: newdns.DeleteRecords,
+			Set: newdns.Set{
+				Name: "host.example.com.",
+				Type: newdns.A,
+				Records: []newdns.Record{
+					{Address: "1.2.3.4"},
+				},
+			},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(3), zone.SerialFunc())
+
+	sets, err = zone.Handler(ctx, "host")
+	assert.NoError(t, err)
+	assert.Len(t, sets, 1)
+	assert.Equal(t, []newdns.Record{{Address: "1.2.3.5"}}, sets[0].Records)
+
+	err = zone.UpdateHandler(ctx, []newdns.Update{
+		{
+			Operation: newdns.DeleteName,
+			Set:       newdns.Set{Name: "missing.example.com."},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(3), zone.SerialFunc())
+
+	err = zone.UpdateHandler(ctx, []newdns.Update{
+		{
+			Operation: newdns.DeleteName,
+			Set:       newdns.Set{Name: "host.example.com."},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(4), zone.SerialFunc())
+
+	var count int
+	err = zone.Lister(ctx, func(newdns.Set) error {
+		count++
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestMemoryRollback(t *testing.T) {
+	backend := NewMemory()
+
+	err := backend.Update(context.Background(), func(tx Tx) error {
+		err := tx.Put(newdns.Set{
+			Name:    "host.example.com.",
+			Type:    newdns.A,
+			Records: []newdns.Record{{Address: "1.2.3.4"}},
+		})
+		assert.NoError(t, err)
+
+		return errors.New("foo")
+	})
+	assert.Error(t, err)
+
+	sets, err := backend.Lookup(context.Background(), "host.example.com.")
+	assert.NoError(t, err)
+	assert.Empty(t, sets)
+}
+
+func TestMemoryNonTerminal(t *testing.T) {
+	backend := NewMemory()
+
+	err := backend.Update(context.Background(), func(tx Tx) error {
+		return tx.Put(newdns.Set{
+			Name:    "a.b.example.com.",
+			Type:    newdns.A,
+			Records: []newdns.Record{{Address: "1.2.3.4"}},
+		})
+	})
+	assert.NoError(t, err)
+
+	ok, err := backend.NonTerminal(context.Background(), "B.example.com.")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = backend.NonTerminal(context.Background(), "a.b.example.com.")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	ok, err = backend.NonTerminal(context.Background(), "ab.example.com.")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	err = backend.Update(context.Background(), func(tx Tx) error {
+		return tx.Delete("a.b.example.com.", newdns.A)
+	})
+	assert.NoError(t, err)
+
+	ok, err = backend.NonTerminal(context.Background(), "b.example.com.")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Empty(t, backend.below)
+}
@@ -0,0 +1,518 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/256dpi/newdns"
+)
+
+type trieNode struct {
+	edge     []string
+	sets     []newdns.Set
+	children map[string]*trieNode
+	owner    *trieTx
+}
+
+// Trie is an in-memory backend optimized for zones with millions of names.
+// Names are stored in a path compressed trie of labels that is never mutated
+// once committed. Updates copy the affected paths which allows taking
+// consistent snapshots, e.g. for zone transfers, in constant time. Nodes
+// copied by a transaction are mutated in place by the same transaction, so
+// loading many names in one update is linear. Lookups resolve wildcard names
+// (RFC 4592) if no set exists for a name.
+type Trie struct {
+	mutex  sync.RWMutex
+	root   *trieNode
+	serial uint32
+}
+
+// NewTrie creates and returns a new trie backend.
+func NewTrie() *Trie {
+	return &Trie{
+		root:   &trieNode{},
+		serial: 1,
+	}
+}
+
+// Snapshot returns an independent copy of the trie. Changes to the snapshot
+// and the trie do not affect each other.
+func (t *Trie) Snapshot() *Trie {
+	// acquire lock
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	return &Trie{
+		root:   t.root,
+		serial: t.serial,
+	}
+}
+
+// Lookup implements the Backend interface.
+func (t *Trie) Lookup(_ context.Context, name string) ([]newdns.Set, error) {
+	// get root
+	t.mutex.RLock()
+	root := t.root
+	t.mutex.RUnlock()
+
+	// normalize name
+	name = newdns.NormalizeDomain(name, true, true, false)
+
+	// find node
+	node, encloser, exists := trieFind(root, trieLabels(name))
+	if node != nil && len(node.sets) > 0 {
+		return node.sets, nil
+	} else if exists || encloser == nil {
+		return nil, nil
+	}
+
+	// get wildcard
+	wildcard := encloser.children["*"]
+	if wildcard == nil || len(wildcard.edge) != 1 || len(wildcard.sets) == 0 {
+		return nil, nil
+	}
+
+	// synthesize sets
+	sets := make([]newdns.Set, 0, len(wildcard.sets))
+	for _, set := range wildcard.sets {
+		set.Name = name
+		sets = append(sets, set)
+	}
+
+	return sets, nil
+}
+
+// NonTerminal implements the NonTerminalBackend interface.
+func (t *Trie) NonTerminal(_ context.Context, name string) (bool, error) {
+	// get root
+	t.mutex.RLock()
+	root := t.root
+	t.mutex.RUnlock()
+
+	// find node
+	node, _, exists := trieFind(root, trieLabels(newdns.NormalizeDomain(name, true, true, false)))
+	if !exists {
+		return false, nil
+	} else if node == nil {
+		return true, nil
+	}
+
+	return len(node.children) > 0, nil
+}
+
+// Match returns the longest name that has sets and is equal to or a parent of
+// the specified name together with its sets. It may be used to find zone
+// cuts.
+func (t *Trie) Match(name string) (string, []newdns.Set) {
+	// get root
+	t.mutex.RLock()
+	root := t.root
+	t.mutex.RUnlock()
+
+	// get labels
+	labels := trieLabels(newdns.NormalizeDomain(name, true, true, false))
+
+	// walk trie
+	var match []newdns.Set
+	var depth int
+	node, i := root, 0
+	for {
+		// remember node with sets
+		if len(node.sets) > 0 {
+			match = node.sets
+			depth = i
+		}
+
+		// check end
+		if i == len(labels) {
+			break
+		}
+
+		// get child
+		child := node.children[labels[i]]
+		if child == nil || len(child.edge) > len(labels)-i || trieCommon(child.edge, labels[i:]) < len(child.edge) {
+			break
+		}
+
+		// descend
+		node = child
+		i += len(child.edge)
+	}
+
+	// check match
+	if match == nil {
+		return "", nil
+	}
+
+	return trieName(labels[:depth]), match
+}
+
+// List implements the Backend interface.
+func (t *Trie) List(ctx context.Context, fn func(newdns.Set) error) error {
+	// get root
+	t.mutex.RLock()
+	root := t.root
+	t.mutex.RUnlock()
+
+	return trieWalk(root, fn)
+}
+
+// Serial implements the Backend interface.
+func (t *Trie) Serial() uint32 {
+	// acquire lock
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	return t.serial
+}
+
+// Update implements the Backend interface.
+func (t *Trie) Update(_ context.Context, fn func(Tx) error) error {
+	// acquire lock
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// prepare transaction
+	tx := &trieTx{
+		root:   t.root,
+		serial: t.serial,
+	}
+
+	// run function
+	err := fn(tx)
+	if err != nil {
+		return err
+	}
+
+	// commit
+	t.root = tx.root
+	t.serial = tx.serial
+
+	return nil
+}
+
+type trieTx struct {
+	root   *trieNode
+	serial uint32
+}
+
+func (t *trieTx) Get(name string) ([]newdns.Set, error) {
+	// find node
+	node, _, _ := trieFind(t.root, trieLabels(newdns.NormalizeDomain(name, true, true, false)))
+	if node == nil {
+		return nil, nil
+	}
+
+	return node.sets, nil
+}
+
+func (t *trieTx) Put(set newdns.Set) error {
+	// get name
+	name := newdns.NormalizeDomain(set.Name, true, true, false)
+	set.Name = name
+
+	// update node
+	t.root = t.update(t.root, trieLabels(name), func(sets []newdns.Set) []newdns.Set {
+		// replace or add set
+		var list []newdns.Set
+		for _, item := range sets {
+			if item.Type != set.Type {
+				list = append(list, item)
+			}
+		}
+		list = append(list, set)
+
+		// sort by type
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].Type < list[j].Type
+		})
+
+		return list
+	})
+
+	return nil
+}
+
+func (t *trieTx) Delete(name string, typ newdns.Type) error {
+	// get name
+	name = newdns.NormalizeDomain(name, true, true, false)
+
+	// update node
+	t.root = t.update(t.root, trieLabels(name), func(sets []newdns.Set) []newdns.Set {
+		// delete all sets
+		if typ == 0 {
+			return nil
+		}
+
+		// delete set
+		var list []newdns.Set
+		for _, item := range sets {
+			if item.Type != typ {
+				list = append(list, item)
+			}
+		}
+
+		return list
+	})
+
+	return nil
+}
+
+func (t *trieTx) Serial() uint32 {
+	return t.serial
+}
+
+func (t *trieTx) SetSerial(serial uint32) error {
+	t.serial = serial
+	return nil
+}
+
+func trieLabels(name string) []string {
+	// trim root
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return nil
+	}
+
+	// split and reverse labels
+	labels := strings.Split(name, ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+
+	return labels
+}
+
+func trieName(labels []string) string {
+	// check root
+	if len(labels) == 0 {
+		return "."
+	}
+
+	// reverse and join labels
+	list := make([]string, len(labels))
+	for i, label := range labels {
+		list[len(labels)-1-i] = label
+	}
+
+	return strings.Join(list, ".") + "."
+}
+
+func trieCommon(a, b []string) int {
+	var i int
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+
+	return i
+}
+
+// trieFind returns the node for the labels if it exists, the closest existing
+// node above the labels if it is the closest encloser and whether the name
+// exists either as a node or as an empty non-terminal within a compressed
+// edge.
+func trieFind(root *trieNode, labels []string) (*trieNode, *trieNode, bool) {
+	node, i := root, 0
+	for {
+		// check end
+		if i == len(labels) {
+			return node, node, true
+		}
+
+		// get child
+		child := node.children[labels[i]]
+		if child == nil {
+			return nil, node, false
+		}
+
+		// match edge, the closest existing name is within the edge if the
+		// edge only partially matches and cannot have a wildcard child
+		n := trieCommon(child.edge, labels[i:])
+		if n < len(child.edge) {
+			return nil, nil, i+n == len(labels)
+		}
+
+		// descend
+		node = child
+		i += n
+	}
+}
+
+// update returns a copy of the node with the sets at the labels replaced by
+// the result of the function. Nodes that become empty are removed. Nodes
+// owned by the transaction are updated in place.
+func (t *trieTx) update(node *trieNode, labels []string, fn func([]newdns.Set) []newdns.Set) *trieNode {
+	// update node
+	if len(labels) == 0 {
+		sets := fn(node.sets)
+		if len(sets) == 0 && len(node.sets) == 0 {
+			return node
+		}
+		node = t.own(node)
+		node.sets = sets
+		return node
+	}
+
+	// get child
+	child := node.children[labels[0]]
+
+	// add new child
+	if child == nil {
+		sets := fn(nil)
+		if len(sets) == 0 {
+			return node
+		}
+		return t.with(node, labels[0], &trieNode{
+			edge:  labels,
+			sets:  sets,
+			owner: t,
+		})
+	}
+
+	// update existing child
+	n := trieCommon(child.edge, labels)
+	if n == len(child.edge) {
+		updated := t.update(child, labels[n:], fn)
+		compacted := t.compact(updated)
+		if updated == child && compacted == child {
+			return node
+		}
+		return t.with(node, labels[0], compacted)
+	}
+
+	// get sets
+	sets := fn(nil)
+	if len(sets) == 0 {
+		return node
+	}
+
+	// split edge
+	middle := &trieNode{
+		edge: child.edge[:n],
+		children: map[string]*trieNode{
+			child.edge[n]: {
+				edge:     child.edge[n:],
+				sets:     child.sets,
+				children: child.children,
+				owner:    child.owner,
+			},
+		},
+		owner: t,
+	}
+
+	// add sets
+	if n == len(labels) {
+		middle.sets = sets
+	} else {
+		middle.children[labels[n]] = &trieNode{
+			edge:  labels[n:],
+			sets:  sets,
+			owner: t,
+		}
+	}
+
+	return t.with(node, labels[0], middle)
+}
+
+// own returns the node if it is owned by the transaction or a copy of the node
+// that is owned by the transaction.
+func (t *trieTx) own(n *trieNode) *trieNode {
+	// check owner
+	if n.owner == t {
+		return n
+	}
+
+	// copy children
+	var children map[string]*trieNode
+	if len(n.children) > 0 {
+		children = make(map[string]*trieNode, len(n.children)+1)
+		for k, v := range n.children {
+			children[k] = v
+		}
+	}
+
+	return &trieNode{
+		edge:     n.edge,
+		sets:     n.sets,
+		children: children,
+		owner:    t,
+	}
+}
+
+// with returns the owned node with the child set or removed if nil.
+func (t *trieTx) with(n *trieNode, key string, child *trieNode) *trieNode {
+	// get owned node
+	n = t.own(n)
+
+	// set or remove child
+	if child != nil {
+		if n.children == nil {
+			n.children = map[string]*trieNode{}
+		}
+		n.children[key] = child
+	} else {
+		delete(n.children, key)
+	}
+
+	return n
+}
+
+// compact returns nil for empty leaves and merges empty nodes with their
+// single child.
+func (t *trieTx) compact(n *trieNode) *trieNode {
+	// check sets
+	if len(n.sets) > 0 {
+		return n
+	}
+
+	// remove empty leaf
+	if len(n.children) == 0 {
+		return nil
+	}
+
+	// merge single child
+	if len(n.children) == 1 {
+		for _, child := range n.children {
+			edge := make([]string, 0, len(n.edge)+len(child.edge))
+			edge = append(edge, n.edge...)
+			edge = append(edge, child.edge...)
+			return &trieNode{
+				edge:     edge,
+				sets:     child.sets,
+				children: child.children,
+				owner:    child.owner,
+			}
+		}
+	}
+
+	return n
+}
+
+func trieWalk(node *trieNode, fn func(newdns.Set) error) error {
+	// yield sets
+	for _, set := range node.sets {
+		err := fn(set)
+		if err != nil {
+			return err
+		}
+	}
+
+	// sort children
+	keys := make([]string, 0, len(node.children))
+	for key := range node.children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// walk children
+	for _, key := range keys {
+		err := trieWalk(node.children[key], fn)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,229 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/256dpi/newdns"
+	"github.com/stretchr/testify/assert"
+)
+
+func trieSet(name string, typ newdns.Type) newdns.Set {
+	return newdns.Set{
+		Name: name,
+		Type: typ,
+		Records: []newdns.Record{
+			{Address: "1.2.3.4"},
+		},
+	}
+}
+
+func TestTrie(t *testing.T) {
+	trie := NewTrie()
+	ctx := context.Background()
+
+	err := trie.Update(ctx, func(tx Tx) error {
+		for _, set := range []newdns.Set{
+			trieSet("example.com.", newdns.NS),
+			trieSet("a.b.c.example.com.", newdns.A),
+			trieSet("a.b.c.example.com.", newdns.AAAA),
+			trieSet("x.b.c.example.com.", newdns.A),
+			trieSet("*.example.com.", newdns.A),
+			trieSet("Host.Example.com.", newdns.A),
+		} {
+			err := tx.Put(set)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	assert.NoError(t, err)
+
+	// exact
+	sets, err := trie.Lookup(ctx, "a.b.c.example.com.")
+	assert.NoError(t, err)
+	assert.Len(t, sets, 2)
+	assert.Equal(t, newdns.A, sets[0].Type)
+	assert.Equal(t, newdns.AAAA, sets[1].Type)
+
+	sets, err = trie.Lookup(ctx, "HOST.example.com.")
+	assert.NoError(t, err)
+	assert.Equal(t, []newdns.Set{trieSet("host.example.com.", newdns.A)}, sets)
+
+	// empty non-terminals
+	for _, name := range []string{"b.c.example.com.", "c.example.com.", "com."} {
+		sets, err = trie.Lookup(ctx, name)
+		assert.NoError(t, err)
+		assert.Empty(t, sets, name)
+
+		ok, err := trie.NonTerminal(ctx, name)
+		assert.NoError(t, err)
+		assert.True(t, ok, name)
+	}
+	for _, name := range []string{"a.b.c.example.com.", "d.c.example.com.", "foo.example.com."} {
+		ok, err := trie.NonTerminal(ctx, name)
+		assert.NoError(t, err)
+		assert.False(t, ok, name)
+	}
+
+	// wildcard
+	sets, err = trie.Lookup(ctx, "foo.example.com.")
+	assert.NoError(t, err)
+	assert.Equal(t, []newdns.Set{trieSet("foo.example.com.", newdns.A)}, sets)
+
+	sets, err = trie.Lookup(ctx, "bar.foo.example.com.")
+	assert.NoError(t, err)
+	assert.Equal(t, []newdns.Set{trieSet("bar.foo.example.com.", newdns.A)}, sets)
+
+	// no wildcard below existing names
+	sets, err = trie.Lookup(ctx, "foo.c.example.com.")
+	assert.NoError(t, err)
+	assert.Empty(t, sets)
+
+	sets, err = trie.Lookup(ctx, "foo.b.c.example.com.")
+	assert.NoError(t, err)
+	assert.Empty(t, sets)
+
+	// outside
+	sets, err = trie.Lookup(ctx, "example.org.")
+	assert.NoError(t, err)
+	assert.Empty(t, sets)
+
+	// longest match
+	name, sets := trie.Match("foo.a.b.c.example.com.")
+	assert.Equal(t, "a.b.c.example.com.", name)
+	assert.Len(t, sets, 2)
+
+	name, sets = trie.Match("foo.b.c.example.com.")
+	assert.Equal(t, "example.com.", name)
+	assert.Len(t, sets, 1)
+
+	name, sets = trie.Match("example.org.")
+	assert.Equal(t, "", name)
+	assert.Nil(t, sets)
+
+	// list
+	var names []string
+	err = trie.List(ctx, func(set newdns.Set) error {
+		names = append(names, fmt.Sprintf("%s/%d", set.Name, set.Type))
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"example.com./2",
+		"*.example.com./1",
+		"a.b.c.example.com./1",
+		"a.b.c.example.com./28",
+		"x.b.c.example.com./1",
+		"host.example.com./1",
+	}, names)
+}
+
+func TestTrieSnapshot(t *testing.T) {
+	trie := NewTrie()
+	ctx := context.Background()
+
+	err := trie.Update(ctx, func(tx Tx) error {
+		_ = tx.Put(trieSet("a.example.com.", newdns.A))
+		_ = tx.Put(trieSet("b.example.com.", newdns.A))
+		return tx.SetSerial(2)
+	})
+	assert.NoError(t, err)
+
+	snapshot := trie.Snapshot()
+	assert.Equal(t, uint32(2), snapshot.Serial())
+
+	err = trie.Update(ctx, func(tx Tx) error {
+		_ = tx.Delete("a.example.com.", 0)
+		_ = tx.Put(trieSet("c.example.com.", newdns.A))
+		_ = tx.Delete("b.example.com.", newdns.AAAA)
+		return tx.SetSerial(3)
+	})
+	assert.NoError(t, err)
+
+	count := func(trie *Trie) map[string]int {
+		names := map[string]int{}
+		_ = trie.List(ctx, func(set newdns.Set) error {
+			names[set.Name]++
+			return nil
+		})
+		return names
+	}
+
+	assert.Equal(t, map[string]int{"a.example.com.": 1, "b.example.com.": 1}, count(snapshot))
+	assert.Equal(t, map[string]int{"b.example.com.": 1, "c.example.com.": 1}, count(trie))
+	assert.Equal(t, uint32(3), trie.Serial())
+
+	err = trie.Update(ctx, func(tx Tx) error {
+		_ = tx.Delete("b.example.com.", newdns.A)
+		_ = tx.Delete("c.example.com.", 0)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, count(trie))
+	assert.Empty(t, trie.root.children)
+}
+
+func TestTrieLoad(t *testing.T) {
+	trie := NewTrie()
+	ctx := context.Background()
+
+	err := trie.Update(ctx, func(tx Tx) error {
+		for i := 0; i < 100000; i++ {
+			_ = tx.Put(trieSet(fmt.Sprintf("n%d.example.com.", i), newdns.A))
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	snapshot := trie.Snapshot()
+
+	err = trie.Update(ctx, func(tx Tx) error {
+		for i := 0; i < 100000; i += 2 {
+			_ = tx.Delete(fmt.Sprintf("n%d.example.com.", i), 0)
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	count := func(trie *Trie) int {
+		var n int
+		_ = trie.List(ctx, func(newdns.Set) error {
+			n++
+			return nil
+		})
+		return n
+	}
+
+	assert.Equal(t, 100000, count(snapshot))
+	assert.Equal(t, 50000, count(trie))
+}
+
+func TestTrieConfigure(t *testing.T) {
+	backend := NewTrie()
+
+	zone := &newdns.Zone{
+		Name:             "example.com.",
+		MasterNameServer: "ns1.example.com.",
+		AllNameServers:   []string{"ns1.example.com."},
+	}
+	Configure(zone, backend)
+
+	ctx := context.Background()
+
+	err := zone.UpdateHandler(ctx, []newdns.Update{
+		{
+			Operation: newdns.AddRecords,
+			Set:       trieSet("host.example.com.", newdns.A),
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2), zone.SerialFunc())
+
+	sets, err := zone.Handler(ctx, "host")
+	assert.NoError(t, err)
+	assert.Len(t, sets, 1)
+}
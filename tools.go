@@ -1,7 +1,15 @@
 package newdns
 
 import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
 	"math"
+	"net"
 	"strings"
 	"time"
 
@@ -9,7 +17,8 @@ import (
 )
 
 // IsDomain returns whether the name is a valid domain and if requested also
-// fully qualified.
+// fully qualified. Labels are not restricted to host names and may start with
+// an underscore like in "_dmarc.example.com.".
 func IsDomain(name string, fqdn bool) bool {
 	_, ok := dns.IsDomainName(name)
 	return ok && (!fqdn || dns.IsFqdn(name))
@@ -131,6 +140,238 @@ func emailToDomain(email string) string {
 	return dns.Fqdn(name)
 }
 
+func domainToEmail(name string) string {
+	// remove FQDN
+	name = NormalizeDomain(name, false, false, true)
+
+	// find first unescaped dot
+	for i := 0; i < len(name); i++ {
+		if name[i] == '\\' {
+			i++
+			continue
+		}
+
+		if name[i] == '.' {
+			user := strings.ReplaceAll(name[:i], "\\.", ".")
+			return user + "@" + name[i+1:]
+		}
+	}
+
+	return name
+}
+
+func stringInList(list []string, needle string) bool {
+	for _, item := range list {
+		if item == needle {
+			return true
+		}
+	}
+
+	return false
+}
+
+func intInList(list []int, needle int) bool {
+	for _, item := range list {
+		if item == needle {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasOption(opt *dns.OPT, code uint16) bool {
+	for _, option := range opt.Option {
+		if option.Option() == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+func verifyTSIG(w dns.ResponseWriter, req *dns.Msg, keys []string) bool {
+	// get key
+	key := signedKey(w, req)
+	if key == "" {
+		return false
+	}
+
+	return stringInList(keys, key)
+}
+
+func signedKey(w dns.ResponseWriter, req *dns.Msg) string {
+	// get TSIG record
+	tsig := req.IsTsig()
+	if tsig == nil {
+		return ""
+	}
+
+	// check status
+	if w.TsigStatus() != nil {
+		return ""
+	}
+
+	return NormalizeDomain(tsig.Hdr.Name, true, false, false)
+}
+
+func tsigError(w dns.ResponseWriter, req *dns.Msg) uint16 {
+	// check request
+	if req.IsTsig() == nil {
+		return dns.RcodeSuccess
+	}
+
+	// check status
+	switch w.TsigStatus() {
+	case nil:
+		return dns.RcodeSuccess
+	case dns.ErrSecret, dns.ErrKeyAlg:
+		return dns.RcodeBadKey
+	case dns.ErrTime:
+		return dns.RcodeBadTime
+	default:
+		return dns.RcodeBadSig
+	}
+}
+
+// tsigProvider verifies and signs messages using the keys looked up by their
+// normalized name.
+type tsigProvider map[string]string
+
+func (p tsigProvider) Generate(msg []byte, t *dns.TSIG) ([]byte, error) {
+	// get secret
+	secret, ok := p[NormalizeDomain(t.Hdr.Name, true, true, false)]
+	if !ok {
+		return nil, dns.ErrSecret
+	}
+
+	// decode secret
+	raw, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare hash
+	var h hash.Hash
+	switch dns.CanonicalName(t.Algorithm) {
+	case dns.HmacSHA1:
+		h = hmac.New(sha1.New, raw)
+	case dns.HmacSHA224:
+		h = hmac.New(sha256.New224, raw)
+	case dns.HmacSHA256:
+		h = hmac.New(sha256.New, raw)
+	case dns.HmacSHA384:
+		h = hmac.New(sha512.New384, raw)
+	case dns.HmacSHA512:
+		h = hmac.New(sha512.New, raw)
+	default:
+		return nil, dns.ErrKeyAlg
+	}
+
+	// compute MAC
+	h.Write(msg)
+
+	return h.Sum(nil), nil
+}
+
+func (p tsigProvider) Verify(msg []byte, t *dns.TSIG) error {
+	// compute MAC
+	mac, err := p.Generate(msg, t)
+	if err != nil {
+		return err
+	}
+
+	// decode MAC
+	expected, err := hex.DecodeString(t.MAC)
+	if err != nil {
+		return err
+	}
+
+	// compare MAC
+	if !hmac.Equal(mac, expected) {
+		return dns.ErrSig
+	}
+
+	return nil
+}
+
+func signTSIG(w dns.ResponseWriter, req, res *dns.Msg) {
+	// check request
+	tsig := req.IsTsig()
+	if tsig == nil || w.TsigStatus() != nil {
+		return
+	}
+
+	// sign response
+	res.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsig.Fudge, time.Now().Unix())
+}
+
+// tsigLen returns the length of the TSIG record that is added to the response
+// by signTSIG.
+func tsigLen(w dns.ResponseWriter, req *dns.Msg) int {
+	// check request
+	tsig := req.IsTsig()
+	if tsig == nil || w.TsigStatus() != nil {
+		return 0
+	}
+
+	// get MAC size
+	var size int
+	switch strings.ToLower(tsig.Algorithm) {
+	case dns.HmacSHA1:
+		size = sha1.Size
+	case dns.HmacSHA224:
+		size = sha256.Size224
+	case dns.HmacSHA256:
+		size = sha256.Size
+	case dns.HmacSHA384:
+		size = sha512.Size384
+	default:
+		size = sha512.Size
+	}
+
+	// prepare record
+	rr := &dns.TSIG{
+		Hdr:       dns.RR_Header{Name: tsig.Hdr.Name, Rrtype: dns.TypeTSIG, Class: dns.ClassANY},
+		Algorithm: tsig.Algorithm,
+		MAC:       strings.Repeat("00", size),
+	}
+
+	return (&dns.Msg{Extra: []dns.RR{rr}}).Len() - 12
+}
+
+// parseIPv4 parses the dotted decimal IPv4 address into the four byte slice
+// without allocating. Like net.ParseIP, it rejects octets with leading zeros.
+func parseIPv4(ip net.IP, addr string) bool {
+	// parse octets
+	var octet, digits, index int
+	for i := 0; i <= len(addr); i++ {
+		// handle separator
+		if i == len(addr) || addr[i] == '.' {
+			if digits == 0 || index > 3 {
+				return false
+			}
+			ip[index] = byte(octet)
+			octet, digits = 0, 0
+			index++
+			continue
+		}
+
+		// handle digit
+		c := addr[i]
+		if c < '0' || c > '9' || digits == 3 || (digits == 1 && octet == 0) {
+			return false
+		}
+		octet = octet*10 + int(c-'0')
+		digits++
+		if octet > 255 {
+			return false
+		}
+	}
+
+	return index == 4
+}
+
 func toSeconds(d time.Duration) uint32 {
 	return uint32(math.Ceil(d.Seconds()))
 }
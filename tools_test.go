@@ -14,6 +14,10 @@ func TestIsDomain(t *testing.T) {
 	assert.False(t, IsDomain("", false))
 	assert.True(t, IsDomain("x", false))
 	assert.True(t, IsDomain(".", false))
+	assert.True(t, IsDomain("_dmarc.example.com.", true))
+	assert.True(t, IsDomain("_acme-challenge.www.example.com.", true))
+	assert.True(t, IsDomain("_sip._tcp.example.com.", true))
+	assert.True(t, IsDomain("*.example.com.", true))
 }
 
 func TestInZone(t *testing.T) {
@@ -93,3 +97,9 @@ func TestTransferCase(t *testing.T) {
 		assert.Equal(t, item.out, TransferCase(item.src, item.dst), i)
 	}
 }
+
+func TestDomainToEmail(t *testing.T) {
+	assert.Equal(t, "hostmaster@example.com", domainToEmail("hostmaster.example.com."))
+	assert.Equal(t, "first.last@example.com", domainToEmail("first\\.last.example.com."))
+	assert.Equal(t, "awsdns-hostmaster@amazon.com", domainToEmail(emailToDomain("awsdns-hostmaster@amazon.com")))
+}
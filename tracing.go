@@ -0,0 +1,91 @@
+package newdns
+
+import (
+	"context"
+
+	"github.com/miekg/dns"
+)
+
+// Tracer creates spans to trace the processing of requests. It may be
+// implemented using an OpenTelemetry tracer to integrate DNS requests with
+// existing traces.
+type Tracer interface {
+	// Start creates a new span that is a child of the span in the provided
+	// context and returns a context that carries the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a single traced operation.
+type Span interface {
+	// SetAttribute sets an attribute on the span.
+	SetAttribute(key string, value interface{})
+
+	// RecordError records an error on the span.
+	RecordError(err error)
+
+	// End will end the span.
+	End()
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(string, interface{}) {}
+func (noopSpan) RecordError(error)                {}
+func (noopSpan) End()                             {}
+
+type tracerKey struct{}
+
+func withTracer(ctx context.Context, tracer Tracer) context.Context {
+	return context.WithValue(ctx, tracerKey{}, tracer)
+}
+
+func startSpan(ctx context.Context, name string) (context.Context, Span) {
+	// get tracer
+	tracer, _ := ctx.Value(tracerKey{}).(Tracer)
+	if tracer == nil {
+		return ctx, noopSpan{}
+	}
+
+	return tracer.Start(ctx, name)
+}
+
+type rcodeWriter struct {
+	dns.ResponseWriter
+	rcode int
+	done  bool
+}
+
+func (w *rcodeWriter) WriteMsg(msg *dns.Msg) error {
+	// record rcode
+	w.rcode = msg.Rcode
+	w.done = true
+
+	return w.ResponseWriter.WriteMsg(msg)
+}
+
+func traceHandler(tracer Tracer, name string, base func() context.Context, handler dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		// get parent context
+		ctx := base()
+		if state := requestStateOf(w); state != nil && state.ctx != nil {
+			ctx = state.ctx
+		}
+
+		// start span
+		_, span := tracer.Start(ctx, name)
+		defer span.End()
+
+		// set attributes
+		span.SetAttribute("dns.qname", req.Question[0].Name)
+		span.SetAttribute("dns.qtype", dns.TypeToString[req.Question[0].Qtype])
+
+		// serve request
+		rw := &rcodeWriter{ResponseWriter: w}
+		handler.ServeDNS(rw, req)
+
+		// set rcode
+		if rw.done {
+			span.SetAttribute("dns.rcode", dns.RcodeToString[rw.rcode])
+		}
+	})
+}
@@ -0,0 +1,277 @@
+package newdns
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// the size after which zone transfer messages are flushed
+const transferMessageSize = 16 * 1024
+
+func (s *Server) writeTransfer(ctx context.Context, w dns.ResponseWriter, rq, rs *dns.Msg, zone *Zone, name string) {
+	// determine if client is using UDP
+	isUDP := w.RemoteAddr().Network() == "udp"
+
+	// get type
+	incremental := rq.Question[0].Qtype == dns.TypeIXFR
+
+	// check transport
+	if isUDP && !incremental {
+		log(s.logger(w), Refused, nil, nil, "zone transfer over UDP")
+		s.writeError(w, rq, rs, nil, dns.RcodeRefused)
+		return
+	}
+
+	// check name
+	if name != zone.Name {
+		log(s.logger(w), Refused, nil, nil, "zone transfer for non apex name")
+		s.writeError(w, rq, rs, nil, dns.RcodeNotAuth)
+		return
+	}
+
+	// check lister and journal
+	if zone.Lister == nil && (!incremental || zone.Journal == nil) {
+		log(s.logger(w), Refused, nil, nil, "zone transfer not supported")
+		s.writeError(w, rq, rs, nil, dns.RcodeRefused)
+		return
+	}
+
+	// check permission
+	if !transferAllowed(w, rq, zone) {
+		log(s.logger(w), Refused, nil, nil, "zone transfer not allowed")
+		s.writeError(w, rq, rs, nil, dns.RcodeRefused)
+		return
+	}
+
+	// handle incremental transfers
+	if incremental {
+		// get client serial
+		var serial uint32
+		var found bool
+		for _, rr := range rq.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				serial = soa.Serial
+				found = true
+			}
+		}
+		if !found {
+			log(s.logger(w), Refused, nil, nil, "missing SOA record in IXFR request")
+			s.writeError(w, rq, rs, nil, dns.RcodeFormatError)
+			return
+		}
+
+		// answer with current SOA if the client is up-to-date or uses UDP
+		if !serialLess(serial, zone.Serial) || isUDP {
+			rs.Answer = append(rs.Answer, zone.soaRecord())
+			s.writeMessage(w, rq, rs)
+			return
+		}
+
+		// get changes
+		var changes []Change
+		if zone.Journal != nil {
+			var err error
+			changes, err = zone.Journal(ctx, serial)
+			if err != nil {
+				log(s.logger(w), BackendError, nil, fmt.Errorf("zone journal error: %w", err), "")
+				s.writeError(w, rq, rs, nil, dns.RcodeServerFailure)
+				return
+			}
+		}
+
+		// write incremental transfer if the changes are complete
+		if changesComplete(changes, serial, zone.Serial) {
+			s.writeIncrementalTransfer(w, rq, rs, zone, changes)
+			return
+		}
+
+		// otherwise check lister for a full transfer
+		if zone.Lister == nil {
+			log(s.logger(w), Refused, nil, nil, "incomplete zone journal")
+			s.writeError(w, rq, rs, nil, dns.RcodeRefused)
+			return
+		}
+	}
+
+	// prepare writer
+	tw := &transferWriter{s: s, w: w, rq: rq, rs: rs, msg: rs.Copy()}
+
+	// add soa and ns records
+	_ = tw.add(zone.soaRecord())
+	_ = tw.add(zone.nsRecords(zone.Name)...)
+
+	// list sets
+	err := zone.List(ctx, func(set Set) error {
+		return tw.add(convertSet(nil, set.Name, zone, set)...)
+	})
+	if err != nil {
+		tw.fail(rq, err)
+		return
+	}
+
+	// add final soa record
+	_ = tw.add(zone.soaRecord())
+
+	// flush message
+	tw.finish()
+}
+
+func (s *Server) writeIncrementalTransfer(w dns.ResponseWriter, rq, rs *dns.Msg, zone *Zone, changes []Change) {
+	// prepare writer
+	tw := &transferWriter{s: s, w: w, rq: rq, rs: rs, msg: rs.Copy()}
+
+	// add current soa record
+	err := tw.add(zone.soaRecord())
+
+	// add changes
+	for _, change := range changes {
+		// get old and new soa records
+		oldSOA := *zone.soaRecord()
+		oldSOA.Serial = change.From
+		newSOA := *zone.soaRecord()
+		newSOA.Serial = change.To
+
+		// add removed sets
+		if err == nil {
+			err = tw.add(&oldSOA)
+		}
+		for _, set := range change.Removed {
+			if err == nil {
+				err = tw.add(convertSet(nil, set.Name, zone, set)...)
+			}
+		}
+
+		// add added sets
+		if err == nil {
+			err = tw.add(&newSOA)
+		}
+		for _, set := range change.Added {
+			if err == nil {
+				err = tw.add(convertSet(nil, set.Name, zone, set)...)
+			}
+		}
+	}
+	if err != nil {
+		tw.fail(rq, err)
+		return
+	}
+
+	// add final soa record
+	_ = tw.add(zone.soaRecord())
+
+	// flush message
+	tw.finish()
+}
+
+type transferWriter struct {
+	s    *Server
+	w    dns.ResponseWriter
+	rq   *dns.Msg
+	rs   *dns.Msg
+	msg  *dns.Msg
+	sent bool
+}
+
+func (t *transferWriter) add(rrs ...dns.RR) error {
+	// add records
+	t.msg.Answer = append(t.msg.Answer, rrs...)
+
+	// flush if message is large enough
+	if t.msg.Len() >= transferMessageSize {
+		return t.flush()
+	}
+
+	return nil
+}
+
+func (t *transferWriter) flush() error {
+	// sign message
+	signTSIG(t.w, t.rq, t.msg)
+
+	// write message
+	err := t.w.WriteMsg(t.msg)
+	if err != nil {
+		return err
+	}
+
+	// only sign timers of subsequent messages
+	if t.rq.IsTsig() != nil {
+		t.w.TsigTimersOnly(true)
+	}
+
+	// log response
+	t.s.logResponse(t.w, t.msg)
+
+	// prepare next message
+	t.msg = t.rs.Copy()
+	t.sent = true
+
+	return nil
+}
+
+func (t *transferWriter) finish() {
+	// flush message
+	err := t.flush()
+	if err != nil {
+		log(t.s.logger(t.w), NetworkError, nil, err, "")
+		_ = t.w.Close()
+	}
+}
+
+func (t *transferWriter) fail(rq *dns.Msg, err error) {
+	// log error
+	log(t.s.logger(t.w), BackendError, nil, err, "")
+
+	// fail request if nothing has been sent yet
+	if !t.sent {
+		t.s.writeError(t.w, rq, t.rs, nil, dns.RcodeServerFailure)
+		return
+	}
+
+	// otherwise abort transfer
+	_ = t.w.Close()
+}
+
+func transferAllowed(w dns.ResponseWriter, rq *dns.Msg, zone *Zone) bool {
+	// refuse if not configured
+	if zone.AllowTransfer == nil && len(zone.TSIGKeys) == 0 {
+		return false
+	}
+
+	// check TSIG
+	if len(zone.TSIGKeys) > 0 && !verifyTSIG(w, rq, zone.TSIGKeys) {
+		return false
+	}
+
+	// check callback
+	if zone.AllowTransfer != nil && !zone.AllowTransfer(w.RemoteAddr()) {
+		return false
+	}
+
+	return true
+}
+
+func changesComplete(changes []Change, from, to uint32) bool {
+	// check changes
+	if len(changes) == 0 {
+		return false
+	}
+
+	// check chain
+	for _, change := range changes {
+		if change.From != from {
+			return false
+		}
+		from = change.To
+	}
+
+	return from == to
+}
+
+// serialLess compares two serials using the serial number arithmetic defined
+// in RFC 1982.
+func serialLess(a, b uint32) bool {
+	return a != b && int32(b-a) > 0
+}
@@ -0,0 +1,174 @@
+package newdns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+type tlsKey struct {
+	name string
+	tls  *tls.Config
+}
+
+var tlsConfigs = struct {
+	sync.Mutex
+	list map[tlsKey]*tls.Config
+}{
+	list: map[tlsKey]*tls.Config{},
+}
+
+var httpsClients = struct {
+	sync.Mutex
+	list map[*tls.Config]*http.Client
+}{
+	list: map[*tls.Config]*http.Client{},
+}
+
+func tlsUpstream(addr string, config *tls.Config) (string, *tls.Config, error) {
+	// parse address
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// get server name
+	name := u.Fragment
+	if name == "" {
+		name = u.Hostname()
+	}
+
+	// get host and port
+	host := u.Host
+	if u.Port() == "" {
+		port := "853"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	return host, serverName(config, name), nil
+}
+
+func serverName(config *tls.Config, name string) *tls.Config {
+	// use configured server name
+	if config != nil && config.ServerName != "" {
+		return config
+	}
+
+	// cache configs to keep connections reusable
+	tlsConfigs.Lock()
+	defer tlsConfigs.Unlock()
+
+	// get or create config
+	key := tlsKey{name: name, tls: config}
+	cfg, ok := tlsConfigs.list[key]
+	if !ok {
+		if config != nil {
+			cfg = config.Clone()
+		} else {
+			cfg = &tls.Config{}
+		}
+		cfg.ServerName = name
+		tlsConfigs.list[key] = cfg
+	}
+
+	return cfg
+}
+
+func exchangeHTTPS(ctx context.Context, req *dns.Msg, addr string, config *tls.Config) (*dns.Msg, error) {
+	// apply default timeout
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, pipeTimeout)
+		defer cancel()
+	}
+
+	// get TLS config
+	_, config, err := tlsUpstream(addr, config)
+	if err != nil {
+		return nil, err
+	}
+
+	// pack message with a zero ID to improve caching
+	msg := req.Copy()
+	msg.Id = 0
+	data, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare request
+	u, _ := url.Parse(addr)
+	u.Fragment = ""
+	hr, err := http.NewRequest("POST", u.String(), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	hr = hr.WithContext(ctx)
+	hr.Header.Set("Content-Type", "application/dns-message")
+	hr.Header.Set("Accept", "application/dns-message")
+
+	// perform request
+	res, err := httpsClient(config).Do(hr)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	// check status
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTPS upstream status: %d", res.StatusCode)
+	}
+
+	// read response
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	// unpack response
+	rs := new(dns.Msg)
+	err = rs.Unpack(body)
+	if err != nil {
+		return nil, err
+	}
+
+	// restore ID
+	rs.Id = req.Id
+
+	return rs, nil
+}
+
+func httpsClient(config *tls.Config) *http.Client {
+	// acquire mutex
+	httpsClients.Lock()
+	defer httpsClients.Unlock()
+
+	// get or create client
+	client, ok := httpsClients.list[config]
+	if !ok {
+		client = &http.Client{
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				TLSClientConfig:     config,
+				ForceAttemptHTTP2:   true,
+				MaxIdleConnsPerHost: 16,
+				IdleConnTimeout:     pipeIdleTimeout,
+			},
+		}
+		httpsClients.list[config] = client
+	}
+
+	return client
+}
@@ -0,0 +1,68 @@
+package newdns
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTLSUpstream(t *testing.T) {
+	addr, config, err := tlsUpstream("tls://1.1.1.1#cloudflare-dns.com", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.1.1.1:853", addr)
+	assert.Equal(t, "cloudflare-dns.com", config.ServerName)
+
+	addr, config, err = tlsUpstream("https://dns.google/dns-query", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "dns.google:443", addr)
+	assert.Equal(t, "dns.google", config.ServerName)
+
+	custom := &tls.Config{ServerName: "example.com"}
+	addr, config, err = tlsUpstream("tls://1.1.1.1:8853", custom)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.1.1.1:8853", addr)
+	assert.Equal(t, custom, config)
+}
+
+func TestExchangeHTTPS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/dns-message", r.Header.Get("Content-Type"))
+
+		data, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+
+		req := new(dns.Msg)
+		assert.NoError(t, req.Unpack(data))
+		assert.Equal(t, uint16(0), req.Id)
+
+		res := new(dns.Msg)
+		res.SetReply(req)
+		res.Answer = append(res.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300},
+			Txt: []string{"foo"},
+		})
+
+		data, err = res.Pack()
+		assert.NoError(t, err)
+
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(data)
+	}))
+	defer server.Close()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeTXT)
+
+	ret, err := exchange(context.Background(), req, server.URL+"/dns-query", &tls.Config{
+		InsecureSkipVerify: true,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, req.Id, ret.Id)
+	assert.Len(t, ret.Answer, 1)
+}
@@ -24,11 +24,18 @@ const (
 
 	// NS records delegate names to other name servers.
 	NS = Type(dns.TypeNS)
+
+	// PTR records point to other DNS names.
+	PTR = Type(dns.TypePTR)
+
+	// SRV records return the target hosts and ports of services with their
+	// priorities and weights.
+	SRV = Type(dns.TypeSRV)
 )
 
 func (t Type) supported() bool {
 	switch t {
-	case A, AAAA, CNAME, MX, TXT, NS:
+	case A, AAAA, CNAME, MX, TXT, NS, PTR, SRV:
 		return true
 	default:
 		return false
@@ -0,0 +1,463 @@
+package newdns
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// UpdateOperation denotes the kind of change requested by a dynamic update.
+type UpdateOperation int
+
+const (
+	// AddRecords adds the records to the set and creates the set if missing.
+	AddRecords UpdateOperation = iota
+
+	// DeleteRecords removes the records from the set.
+	DeleteRecords
+
+	// DeleteSet removes the set with the name and type.
+	DeleteSet
+
+	// DeleteName removes all sets with the name.
+	DeleteName
+)
+
+// Update is a single change requested by a dynamic update (RFC 2136).
+type Update struct {
+	// The operation.
+	Operation UpdateOperation
+
+	// The affected set. The type is missing for DeleteName operations and the
+	// records are missing for DeleteSet and DeleteName operations.
+	Set Set
+}
+
+func (s *Server) handleUpdate(ctx context.Context, w dns.ResponseWriter, rq, rs *dns.Msg, zone *Zone, name string) {
+	// updates are not authoritative answers
+	rs.Authoritative = false
+
+	// check support
+	if zone.UpdateHandler == nil {
+		log(s.logger(w), Refused, nil, nil, "update not supported")
+		s.writeError(w, rq, rs, nil, dns.RcodeRefused)
+		return
+	}
+
+	// check name
+	if name != zone.Name {
+		log(s.logger(w), Refused, nil, nil, "update for non apex name")
+		s.writeError(w, rq, rs, nil, dns.RcodeNotAuth)
+		return
+	}
+
+	// check TSIG
+	if len(zone.TSIGKeys) > 0 && !verifyTSIG(w, rq, zone.TSIGKeys) {
+		log(s.logger(w), Refused, nil, nil, "missing or invalid TSIG")
+		s.writeError(w, rq, rs, nil, dns.RcodeNotAuth)
+		return
+	}
+
+	// deny unauthenticated updates unless allowed by a policy
+	if len(zone.TSIGKeys) == 0 && zone.UpdatePolicy == nil {
+		log(s.logger(w), Refused, nil, nil, "update not allowed")
+		s.writeError(w, rq, rs, nil, dns.RcodeRefused)
+		return
+	}
+
+	// get updates
+	updates, code := parseUpdates(zone, rq.Ns)
+	if code != dns.RcodeSuccess {
+		log(s.logger(w), Refused, nil, nil, "invalid update", Field{"rcode", dns.RcodeToString[code]})
+		s.writeError(w, rq, rs, nil, code)
+		return
+	}
+
+	// check policy before the prerequisites to not disclose zone contents to
+	// unauthorized clients
+	if zone.UpdatePolicy != nil {
+		key := signedKey(w, rq)
+		for _, update := range updates {
+			if !zone.UpdatePolicy.Allowed(key, w.RemoteAddr(), update) {
+				log(s.logger(w), Refused, nil, nil, "update denied by policy", Field{"name", update.Set.Name})
+				s.writeError(w, rq, rs, nil, dns.RcodeRefused)
+				return
+			}
+		}
+	}
+
+	// check prerequisites
+	code, err := checkPrerequisites(ctx, zone, rq.Answer)
+	if err != nil {
+		log(s.logger(w), BackendError, nil, err, "")
+		s.writeError(w, rq, rs, nil, dns.RcodeServerFailure)
+		return
+	} else if code != dns.RcodeSuccess {
+		log(s.logger(w), Refused, nil, nil, "update prerequisite failed", Field{"rcode", dns.RcodeToString[code]})
+		s.writeError(w, rq, rs, nil, code)
+		return
+	}
+
+	// apply CNAME rules
+	updates, err = applyCNAMERules(ctx, zone, updates)
+	if err != nil {
+		log(s.logger(w), BackendError, nil, err, "")
+		s.writeError(w, rq, rs, nil, dns.RcodeServerFailure)
+		return
+	}
+
+	// apply updates
+	err = zone.UpdateHandler(ctx, updates)
+	if err != nil {
+		err = fmt.Errorf("zone update handler error: %w", err)
+		log(s.logger(w), BackendError, nil, err, "")
+		s.writeError(w, rq, rs, nil, dns.RcodeServerFailure)
+		return
+	}
+
+	// purge caches
+	if zone.Cache != nil {
+		zone.Cache.Purge(zone.Name)
+	}
+	s.PurgeResponses(zone.Name)
+
+	// write message
+	s.writeMessage(w, rq, rs)
+}
+
+func checkPrerequisites(ctx context.Context, zone *Zone, rrs []dns.RR) (int, error) {
+	// prepare cache
+	cache := map[string][]Set{}
+	getSets := func(name string) ([]Set, error) {
+		sets, ok := cache[name]
+		if ok {
+			return sets, nil
+		}
+
+		list, err := zone.fetch(ctx, []string{name})
+		if err != nil {
+			return nil, fmt.Errorf("zone handler error: %w", err)
+		}
+		sets = list[0]
+
+		cache[name] = sets
+
+		return sets, nil
+	}
+
+	// prepare value dependent sets
+	var order []string
+	expected := map[string]*Set{}
+
+	// check prerequisites
+	for _, rr := range rrs {
+		// get header
+		hdr := rr.Header()
+		owner := NormalizeDomain(hdr.Name, true, false, false)
+
+		// check zone
+		if !InZone(zone.Name, owner) {
+			return dns.RcodeNotZone, nil
+		}
+
+		// check TTL
+		if hdr.Ttl != 0 {
+			return dns.RcodeFormatError, nil
+		}
+
+		// handle value dependent prerequisites
+		if hdr.Class == dns.ClassINET {
+			typ, record, ok := fromRR(rr)
+			if !ok {
+				return dns.RcodeNXRrset, nil
+			}
+
+			key := fmt.Sprintf("%s/%d", owner, typ)
+			set, ok := expected[key]
+			if !ok {
+				set = &Set{Name: owner, Type: typ}
+				expected[key] = set
+				order = append(order, key)
+			}
+			set.Records = append(set.Records, record)
+
+			continue
+		}
+
+		// check class
+		if hdr.Class != dns.ClassANY && hdr.Class != dns.ClassNONE {
+			return dns.RcodeFormatError, nil
+		}
+
+		// get sets
+		sets, err := getSets(owner)
+		if err != nil {
+			return 0, err
+		}
+
+		// find set
+		var found bool
+		for _, set := range sets {
+			if set.Type == Type(hdr.Rrtype) {
+				found = true
+			}
+		}
+
+		// check prerequisite
+		switch {
+		case hdr.Class == dns.ClassANY && hdr.Rrtype == dns.TypeANY && len(sets) == 0:
+			return dns.RcodeNameError, nil
+		case hdr.Class == dns.ClassANY && hdr.Rrtype != dns.TypeANY && !found:
+			return dns.RcodeNXRrset, nil
+		case hdr.Class == dns.ClassNONE && hdr.Rrtype == dns.TypeANY && len(sets) > 0:
+			return dns.RcodeYXDomain, nil
+		case hdr.Class == dns.ClassNONE && hdr.Rrtype != dns.TypeANY && found:
+			return dns.RcodeYXRrset, nil
+		}
+	}
+
+	// check value dependent prerequisites
+	for _, key := range order {
+		// get expected set
+		exp := expected[key]
+
+		// get sets
+		sets, err := getSets(exp.Name)
+		if err != nil {
+			return 0, err
+		}
+
+		// find matching set
+		var found bool
+		for _, set := range sets {
+			if set.Type == exp.Type && recordsEqual(set.Records, exp.Records) {
+				found = true
+			}
+		}
+		if !found {
+			return dns.RcodeNXRrset, nil
+		}
+	}
+
+	return dns.RcodeSuccess, nil
+}
+
+func parseUpdates(zone *Zone, rrs []dns.RR) ([]Update, int) {
+	// prepare list
+	var list []Update
+
+	// add update and merge with previous if possible
+	add := func(update Update) {
+		if n := len(list); n > 0 {
+			prev := &list[n-1]
+			if (update.Operation == AddRecords || update.Operation == DeleteRecords) && prev.Operation == update.Operation && prev.Set.Name == update.Set.Name && prev.Set.Type == update.Set.Type {
+				prev.Set.Records = append(prev.Set.Records, update.Set.Records...)
+				return
+			}
+		}
+
+		list = append(list, update)
+	}
+
+	// check updates
+	for _, rr := range rrs {
+		// get header
+		hdr := rr.Header()
+		owner := NormalizeDomain(hdr.Name, true, false, false)
+
+		// check zone
+		if !InZone(zone.Name, owner) {
+			return nil, dns.RcodeNotZone
+		}
+
+		switch hdr.Class {
+		case dns.ClassINET:
+			// convert record
+			typ, record, ok := fromRR(rr)
+			if !ok {
+				return nil, dns.RcodeRefused
+			}
+
+			// add update
+			add(Update{
+				Operation: AddRecords,
+				Set: Set{
+					Name:    owner,
+					Type:    typ,
+					Records: []Record{record},
+					TTL:     time.Duration(hdr.Ttl) * time.Second,
+				},
+			})
+		case dns.ClassANY:
+			// check TTL
+			if hdr.Ttl != 0 {
+				return nil, dns.RcodeFormatError
+			}
+
+			// handle name deletion
+			if hdr.Rrtype == dns.TypeANY {
+				add(Update{
+					Operation: DeleteName,
+					Set:       Set{Name: owner},
+				})
+				continue
+			}
+
+			// ignore deletions of unsupported types
+			if !Type(hdr.Rrtype).supported() {
+				continue
+			}
+
+			// add update
+			add(Update{
+				Operation: DeleteSet,
+				Set: Set{
+					Name: owner,
+					Type: Type(hdr.Rrtype),
+				},
+			})
+		case dns.ClassNONE:
+			// check TTL
+			if hdr.Ttl != 0 {
+				return nil, dns.RcodeFormatError
+			}
+
+			// convert record
+			typ, record, ok := fromRR(rr)
+			if !ok {
+				continue
+			}
+
+			// add update
+			add(Update{
+				Operation: DeleteRecords,
+				Set: Set{
+					Name:    owner,
+					Type:    typ,
+					Records: []Record{record},
+				},
+			})
+		default:
+			return nil, dns.RcodeFormatError
+		}
+	}
+
+	// validate added sets
+	for _, update := range list {
+		if update.Operation == AddRecords {
+			err := update.Set.Validate()
+			if err != nil {
+				return nil, dns.RcodeFormatError
+			}
+		}
+	}
+
+	return list, dns.RcodeSuccess
+}
+
+// applyCNAMERules removes additions of CNAME records to names with other data
+// and of other data to names with CNAME records. Existing CNAME records are
+// replaced by added CNAME records (RFC 2136 3.4.2.2).
+func applyCNAMERules(ctx context.Context, zone *Zone, updates []Update) ([]Update, error) {
+	// prepare types
+	types := map[string]map[Type]bool{}
+	getTypes := func(name string) (map[Type]bool, error) {
+		// check cache
+		if list, ok := types[name]; ok {
+			return list, nil
+		}
+
+		// get sets
+		sets, err := zone.fetch(ctx, []string{name})
+		if err != nil {
+			return nil, fmt.Errorf("zone handler error: %w", err)
+		}
+
+		// collect types
+		list := map[Type]bool{}
+		for _, set := range sets[0] {
+			list[set.Type] = true
+		}
+		types[name] = list
+
+		return list, nil
+	}
+
+	// filter updates
+	var list []Update
+	for _, update := range updates {
+		// get types
+		name := NormalizeDomain(update.Set.Name, true, false, false)
+		existing, err := getTypes(name)
+		if err != nil {
+			return nil, err
+		}
+
+		switch update.Operation {
+		case AddRecords:
+			if update.Set.Type == CNAME {
+				// ignore CNAME records next to other data
+				var other bool
+				for typ := range existing {
+					if typ != CNAME {
+						other = true
+					}
+				}
+				if other {
+					continue
+				}
+
+				// replace existing CNAME record
+				if existing[CNAME] {
+					list = append(list, Update{
+						Operation: DeleteSet,
+						Set:       Set{Name: update.Set.Name, Type: CNAME},
+					})
+				}
+			} else if existing[CNAME] {
+				// ignore other data next to CNAME records
+				continue
+			}
+
+			existing[update.Set.Type] = true
+		case DeleteSet:
+			delete(existing, update.Set.Type)
+		case DeleteName:
+			types[name] = map[Type]bool{}
+		}
+
+		list = append(list, update)
+	}
+
+	return list, nil
+}
+
+func recordsEqual(a, b []Record) bool {
+	// check length
+	if len(a) != len(b) {
+		return false
+	}
+
+	// get keys
+	keys := func(list []Record) []string {
+		var keys []string
+		for _, record := range list {
+			keys = append(keys, fmt.Sprintf("%s/%d/%d/%d/%q", NormalizeDomain(record.Address, true, false, false), record.Priority, record.Weight, record.Port, record.Data))
+		}
+		sort.Strings(keys)
+		return keys
+	}
+
+	// compare keys
+	ka, kb := keys(a), keys(b)
+	for i := range ka {
+		if ka[i] != kb[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,218 @@
+package newdns
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Upstream describes an upstream DNS server.
+type Upstream struct {
+	// The address of the server.
+	Addr string
+
+	// The relative weight used to select the server.
+	//
+	// Default: 1.
+	Weight int
+}
+
+// PoolConfig provides configuration for a pooled proxy.
+type PoolConfig struct {
+	// The upstream servers.
+	Upstreams []Upstream
+
+	// Whether upstream servers are selected in the configured order instead
+	// of randomly by weight.
+	Failover bool
+
+	// The interval of health probes.
+	//
+	// Default: 5s.
+	ProbeInterval time.Duration
+
+	// The timeout of health probes.
+	//
+	// Default: 2s.
+	ProbeTimeout time.Duration
+
+	// The name queried by health probes.
+	//
+	// Default: ".".
+	ProbeName string
+
+	// The number of consecutive failures after which the circuit of an
+	// upstream server is opened and the server is ejected until it passes a
+	// health probe.
+	//
+	// Default: 3.
+	MaxFailures int
+
+	// The TLS configuration used for DNS-over-TLS and DNS-over-HTTPS servers.
+	TLSConfig *tls.Config
+
+	// The logger called with events about the processing of requests.
+	Logger Logger
+}
+
+type poolUpstream struct {
+	Upstream
+	breaker *breaker
+}
+
+type pool struct {
+	config    PoolConfig
+	upstreams []*poolUpstream
+}
+
+// PooledProxy returns a handler that proxies requests to a pool of upstream
+// servers. Servers are selected randomly by weight or in order if failover is
+// enabled. The circuits of servers that failed consecutively are opened and
+// the servers are ejected until they pass one of the periodic health probes,
+// which are stopped when the provided channel is closed. If all servers are
+// ejected, all servers are used. Addresses may use DNS-over-TLS and
+// DNS-over-HTTPS like with Proxy.
+func PooledProxy(config PoolConfig, done <-chan struct{}) dns.Handler {
+	// prepare pool
+	p := newPool(config)
+
+	// run prober
+	go p.prober(done)
+
+	return proxyHandler(proxyOptions{logger: p.config.Logger}, p.exchange)
+}
+
+func newPool(config PoolConfig) *pool {
+	// set default probe interval
+	if config.ProbeInterval <= 0 {
+		config.ProbeInterval = 5 * time.Second
+	}
+
+	// set default probe timeout
+	if config.ProbeTimeout <= 0 {
+		config.ProbeTimeout = 2 * time.Second
+	}
+
+	// set default probe name
+	if config.ProbeName == "" {
+		config.ProbeName = "."
+	}
+
+	// set default max failures
+	if config.MaxFailures <= 0 {
+		config.MaxFailures = 3
+	}
+
+	// prepare pool
+	p := &pool{config: config}
+	for _, upstream := range config.Upstreams {
+		if upstream.Weight <= 0 {
+			upstream.Weight = 1
+		}
+		p.upstreams = append(p.upstreams, &poolUpstream{
+			Upstream: upstream,
+			breaker:  newBreaker(config.MaxFailures, config.ProbeInterval),
+		})
+	}
+
+	return p
+}
+
+func (p *pool) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	// check upstreams
+	if len(p.upstreams) == 0 {
+		return nil, errors.New("no upstream servers")
+	}
+
+	// try upstreams until one succeeds
+	tried := map[*poolUpstream]bool{}
+	var lastErr error
+	for len(tried) < len(p.upstreams) {
+		// select upstream
+		up := p.selectUpstream(tried)
+		tried[up] = true
+
+		// exchange message, ejected servers are only selected if all servers
+		// have been ejected
+		rs, err := observe(ctx, req.Copy(), up.Addr, up.breaker, p.config.TLSConfig, p.config.Logger)
+		if err == nil {
+			return rs, nil
+		}
+
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
+
+func (p *pool) selectUpstream(tried map[*poolUpstream]bool) *poolUpstream {
+	// collect candidates, prefer healthy upstreams
+	var candidates []*poolUpstream
+	for _, healthy := range []bool{true, false} {
+		for _, up := range p.upstreams {
+			if !tried[up] && up.breaker.healthy() == healthy {
+				candidates = append(candidates, up)
+			}
+		}
+		if len(candidates) > 0 {
+			break
+		}
+	}
+
+	// select first candidate if failover
+	if p.config.Failover {
+		return candidates[0]
+	}
+
+	// get total weight
+	var total int
+	for _, up := range candidates {
+		total += up.Weight
+	}
+
+	// select by weight
+	n := rand.Intn(total)
+	for _, up := range candidates {
+		n -= up.Weight
+		if n < 0 {
+			return up
+		}
+	}
+
+	return candidates[len(candidates)-1]
+}
+
+func (p *pool) prober(done <-chan struct{}) {
+	// prepare ticker
+	ticker := time.NewTicker(p.config.ProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, up := range p.upstreams {
+				p.probe(up)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (p *pool) probe(up *poolUpstream) {
+	// prepare probe
+	req := new(dns.Msg)
+	req.SetQuestion(p.config.ProbeName, dns.TypeNS)
+
+	// exchange probe
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.ProbeTimeout)
+	defer cancel()
+	rs, err := exchange(ctx, req, up.Addr, p.config.TLSConfig)
+
+	// record result
+	up.breaker.report(err != nil || !validResponse(rs), up.Addr, p.config.Logger)
+}
@@ -0,0 +1,82 @@
+package newdns
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPooledProxy(t *testing.T) {
+	upstream := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		res := new(dns.Msg)
+		res.SetReply(req)
+		_ = w.WriteMsg(res)
+	})
+
+	live := "127.0.0.1:53031"
+	dead := "127.0.0.1:53032"
+
+	p := newPool(PoolConfig{
+		Upstreams: []Upstream{
+			{Addr: live, Weight: 1},
+			{Addr: dead, Weight: 100},
+		},
+		ProbeInterval: 50 * time.Millisecond,
+		ProbeTimeout:  50 * time.Millisecond,
+		MaxFailures:   2,
+	})
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	serve(upstream, live, func() {
+		for i := 0; i < 5; i++ {
+			ret, err := p.exchange(context.Background(), req)
+			assert.NoError(t, err)
+			assert.Equal(t, dns.RcodeSuccess, ret.Rcode)
+		}
+
+		assert.True(t, p.upstreams[0].breaker.healthy())
+		assert.False(t, p.upstreams[1].breaker.healthy())
+
+		closer := make(chan struct{})
+		defer close(closer)
+		go p.prober(closer)
+
+		serve(upstream, dead, func() {
+			time.Sleep(150 * time.Millisecond)
+			assert.True(t, p.upstreams[1].breaker.healthy())
+		})
+	})
+}
+
+func TestPooledProxyEmpty(t *testing.T) {
+	p := newPool(PoolConfig{})
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	ret, err := p.exchange(context.Background(), req)
+	assert.Error(t, err)
+	assert.Nil(t, ret)
+}
+
+func TestPoolFailover(t *testing.T) {
+	p := newPool(PoolConfig{
+		Upstreams: []Upstream{
+			{Addr: "a", Weight: 1},
+			{Addr: "b", Weight: 100},
+		},
+		Failover:    true,
+		MaxFailures: 1,
+	})
+
+	assert.Equal(t, "a", p.selectUpstream(nil).Addr)
+
+	p.upstreams[0].breaker.record(true, time.Now())
+	assert.Equal(t, "b", p.selectUpstream(nil).Addr)
+	assert.Equal(t, "a", p.selectUpstream(map[*poolUpstream]bool{p.upstreams[1]: true}).Addr)
+}
@@ -2,6 +2,7 @@ package newdns
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"sort"
 	"strings"
@@ -12,6 +13,59 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+// testZone returns a zone for "example.com." with a single name server that
+// looks up sets using the provided handler. A nil handler serves no sets.
+func testZone(handler func(ctx context.Context, name string) ([]Set, error)) *Zone {
+	// set default handler
+	if handler == nil {
+		handler = func(ctx context.Context, name string) ([]Set, error) {
+			return nil, nil
+		}
+	}
+
+	return &Zone{
+		Name:             "example.com.",
+		MasterNameServer: "ns1.example.com.",
+		AllNameServers: []string{
+			"ns1.example.com.",
+		},
+		Handler: handler,
+	}
+}
+
+// apexHandler serves an A record with the address "1.2.3.4" at the apex of
+// the test zone.
+func apexHandler(ctx context.Context, name string) ([]Set, error) {
+	// handle apex
+	if name == "" {
+		return []Set{
+			{
+				Name: "example.com.",
+				Type: A,
+				Records: []Record{
+					{Address: "1.2.3.4"},
+				},
+			},
+		}, nil
+	}
+
+	return nil, nil
+}
+
+// testHandler returns a server handler that returns the first zone the name
+// belongs to.
+func testHandler(zones ...*Zone) func(ctx context.Context, name string) (*Zone, error) {
+	return func(ctx context.Context, name string) (*Zone, error) {
+		for _, zone := range zones {
+			if InZone(zone.Name, name) {
+				return zone, nil
+			}
+		}
+
+		return nil, nil
+	}
+}
+
 func run(s *Server, addr string, fn func()) {
 	defer s.Close()
 
@@ -22,7 +76,7 @@ func run(s *Server, addr string, fn func()) {
 		}
 	}()
 
-	time.Sleep(100 * time.Millisecond)
+	<-s.Ready()
 
 	fn()
 }
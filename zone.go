@@ -1,12 +1,26 @@
 package newdns
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net"
+	"runtime"
+	"sync/atomic"
 	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	zoneUnvalidated uint32 = iota
+	zoneValidating
+	zoneValid
 )
 
-// Zone describes a single authoritative DNS zone.
+// Zone describes a single authoritative DNS zone. Zones are validated when
+// they are served for the first time and must not be modified afterwards.
+// Return a new zone from the server handler to change it.
 type Zone struct {
 	// The FQDN of the zone e.g. "example.com.".
 	Name string
@@ -40,6 +54,19 @@ type Zone struct {
 	// Default: 72h.
 	Expire time.Duration
 
+	// The serial of the zone that is announced in the SOA record. It must be
+	// increased whenever the contents of the zone change to allow secondaries
+	// to detect new versions.
+	//
+	// Default: 1.
+	Serial uint32
+
+	// The optional callback that returns the current serial of the zone. If
+	// set, it is called for every request and overrides the static serial.
+	// The UnixSerial and DateSerial helpers may be used to derive serials from
+	// modification times.
+	SerialFunc func() uint32
+
 	// The TTL for the SOA record.
 	//
 	// Default: 15m.
@@ -57,13 +84,183 @@ type Zone struct {
 	// Default: 5min.
 	MinTTL time.Duration
 
+	// The maximum TTL for records returned by the handler. Higher TTLs are
+	// reduced to this value.
+	//
+	// Default: 0 (unlimited).
+	MaxTTL time.Duration
+
+	// The TTL of sets returned by the handler and lister that do not specify
+	// a TTL.
+	//
+	// Default: 5m.
+	DefaultTTL time.Duration
+
+	// The TTLs per type that override the default TTL for sets that do not
+	// specify a TTL e.g. to use a higher TTL for MX sets.
+	DefaultTypeTTL map[Type]time.Duration
+
+	// The fraction between 0 and 1 by which the TTLs of answers are randomly
+	// reduced for every response to avoid that caches expire popular records
+	// at the same time. The TTLs are not reduced below the minimum TTL and
+	// jitter is applied to responses served from the response cache as well.
+	//
+	// Default: 0 (no jitter).
+	TTLJitter float64
+
 	// The handler that responds to requests for this zone. The returned sets
-	// must not be altered going forward.
-	Handler func(name string) ([]Set, error)
+	// must not be altered going forward. The provided context is cancelled once
+	// the request has been processed or the handler timeout of the server has
+	// been exceeded and may be used with GetRequestInfo, RequestOptions and
+	// AddResponseOption.
+	Handler func(ctx context.Context, name string) ([]Set, error)
+
+	// The provider that is used as the handler if no handler is set.
+	Provider SetProvider
+
+	// The optional handler that returns the sets for multiple names at once
+	// in the order of the names. If set, it is used instead of the handler.
+	// Multiple names are requested for the ancestors and wildcards of a name,
+	// the name servers of delegations and the targets of MX and SRV records.
+	// Names that depend on the results of previous calls, like the targets of
+	// CNAME records, require additional calls. All sets of the names must be
+	// returned as no types are requested.
+	BatchHandler func(ctx context.Context, names []string) ([][]Set, error)
+
+	// The optional handler that returns only the sets of the specified types
+	// for a name. The name is relative to the zone like in the handler. If
+	// set, it is called before the handler when sets are looked up for a
+	// query with the queried types, or the A and AAAA types for additional
+	// records, and the CNAME type. The handler is still called if no sets are
+	// returned to distinguish missing names from missing types and to
+	// synthesize wildcard sets. The returned sets are not cached.
+	TypeHandler func(ctx context.Context, name string, types []Type) ([]Set, error)
+
+	// The optional callback that reports whether names exist below the
+	// specified name. The name is relative to the zone like in the handler. It
+	// is called for names without sets to detect empty non-terminals, which
+	// are answered with NODATA instead of NXDOMAIN as expected by resolvers
+	// using query name minimisation (RFC 7816).
+	NonTerminal func(ctx context.Context, name string) (bool, error)
+
+	// Whether wildcard sets (RFC 4592) like "*.example.com." are used to
+	// synthesize sets for names that do not exist. Names that exist or are
+	// below an existing name are not matched by wildcards of their ancestors.
+	// Enabling wildcards requires additional handler calls for names without
+	// sets.
+	Wildcards bool
+
+	// Whether NS sets below the apex delegate names to child zones. If
+	// enabled, queries for names at or below a zone cut are answered with a
+	// referral that includes glue records from the zone. This requires
+	// additional handler calls for the ancestors of every queried name.
+	// Otherwise, NS sets below the apex are only returned in the authority
+	// section of NS queries for their name.
+	Delegations bool
+
+	// The order of the records of the sets in responses. Responses for the
+	// zone are not stored in the server response cache if the records are
+	// rotated or shuffled.
+	//
+	// Default: OrderHandler.
+	Order Order
+
+	// The optional cache that stores the sets returned by the handler to
+	// reduce the load on slow backends. The cache is purged for the zone when
+	// a dynamic update has been applied.
+	Cache *Cache
+
+	// The optional lister that enumerates all sets of the zone by calling the
+	// provided function for every set. The lister is required to serve zone
+	// transfers and to enumerate the zone using List. Errors returned by the
+	// function must be returned immediately.
+	Lister func(ctx context.Context, fn func(Set) error) error
+
+	// The optional journal that returns the changes since the specified serial
+	// in ascending order. It enables incremental zone transfers (IXFR). If the
+	// returned changes do not lead from the specified to the current serial,
+	// a full zone transfer is performed instead.
+	Journal func(ctx context.Context, serial uint32) ([]Change, error)
+
+	// The optional callback that decides whether a zone transfer (AXFR or
+	// IXFR) to the specified remote address is allowed.
+	AllowTransfer func(remote net.Addr) bool
+
+	// The names of the TSIG keys that are accepted for zone transfers and
+	// NOTIFY messages. If set, these messages must be signed with one of the
+	// keys. Transfers are refused if neither keys nor the AllowTransfer
+	// callback are configured.
+	TSIGKeys []string
+
+	// Whether regular queries must also be signed with one of the TSIG keys.
+	RequireTSIG bool
+
+	// The maximum size of UDP responses for this zone.
+	//
+	// Default: 0 (server setting).
+	MaxUDPSize int
+
+	// The maximum number of queries per second that are answered for this
+	// zone. Queries exceeding the rate are answered with REFUSED and an
+	// extended DNS error. Responses served from the server response cache are
+	// not limited.
+	//
+	// Default: 0 (unlimited).
+	QueryRate float64
+
+	// The number of queries that may exceed the query rate in a burst.
+	//
+	// Default: The query rate rounded up.
+	QueryBurst int
+
+	// The maximum number of queries per second that are answered for this
+	// zone per client IP address. A server tracks up to 10000 recently seen
+	// clients across all zones.
+	//
+	// Default: 0 (unlimited).
+	ClientQueryRate float64
+
+	// The number of queries per client that may exceed the client query rate
+	// in a burst.
+	//
+	// Default: The client query rate rounded up.
+	ClientQueryBurst int
+
+	// The optional handler that applies dynamic updates (RFC 2136). The
+	// prerequisites are checked using the zone handler before the updates are
+	// passed to the handler, which must apply them atomically. Additions that
+	// conflict with CNAME records are ignored. UPDATE messages are refused if
+	// not set. If TSIG keys are configured, UPDATE messages must be signed
+	// with one of the keys. Otherwise, an update policy is required to accept
+	// unauthenticated updates.
+	UpdateHandler func(ctx context.Context, updates []Update) error
+
+	// The optional policy that must grant every change of a dynamic update.
+	// Updates are refused as a whole if a single change is denied.
+	UpdatePolicy UpdatePolicy
+
+	// The optional callback that is called when a NOTIFY message for the zone
+	// has been received. NOTIFY messages are ignored if not set.
+	Notify func(remote net.Addr)
+
+	// The servers to which queries for names in the zone that do not exist
+	// are forwarded instead of answering with NXDOMAIN. Queries are forwarded
+	// to multiple servers using a hedged proxy. The fallback TLS, timeout,
+	// retry and failure settings of the server apply.
+	Forwarders []string
+
+	soa   *dns.SOA
+	ns    []dns.RR
+	valid uint32
 }
 
 // Validate will validate the zone and ensure the documented defaults.
 func (z *Zone) Validate() error {
+	// use provider as handler
+	if z.Handler == nil && z.Provider != nil {
+		z.Handler = z.Provider.Sets
+	}
+
 	// check name
 	if !IsDomain(z.Name, true) {
 		return fmt.Errorf("name not fully qualified: %s", z.Name)
@@ -96,6 +293,15 @@ func (z *Zone) Validate() error {
 		return fmt.Errorf("master name server not listed as name server: %s", z.MasterNameServer)
 	}
 
+	// normalize TSIG keys
+	if len(z.TSIGKeys) > 0 {
+		keys := make([]string, 0, len(z.TSIGKeys))
+		for _, key := range z.TSIGKeys {
+			keys = append(keys, NormalizeDomain(key, true, true, false))
+		}
+		z.TSIGKeys = keys
+	}
+
 	// set default admin email
 	if z.AdminEmail == "" {
 		z.AdminEmail = fmt.Sprintf("hostmaster@%s", z.Name)
@@ -121,6 +327,11 @@ func (z *Zone) Validate() error {
 		z.Expire = 72 * time.Hour
 	}
 
+	// set default serial
+	if z.Serial == 0 {
+		z.Serial = 1
+	}
+
 	// set default SOA TTL
 	if z.SOATTL == 0 {
 		z.SOATTL = 15 * time.Minute
@@ -136,6 +347,31 @@ func (z *Zone) Validate() error {
 		z.MinTTL = 5 * time.Minute
 	}
 
+	// set default TTL
+	if z.DefaultTTL == 0 {
+		z.DefaultTTL = 5 * time.Minute
+	}
+
+	// check default TTLs
+	if z.DefaultTTL < 0 {
+		return fmt.Errorf("default TTL must not be negative: %d", z.DefaultTTL)
+	}
+	for typ, ttl := range z.DefaultTypeTTL {
+		if ttl <= 0 {
+			return fmt.Errorf("default TTL of type %d must be positive: %d", typ, ttl)
+		}
+	}
+
+	// check max TTL
+	if z.MaxTTL != 0 && z.MaxTTL < z.MinTTL {
+		return fmt.Errorf("max TTL must not be less than min TTL: %d", z.MaxTTL)
+	}
+
+	// check TTL jitter
+	if z.TTLJitter < 0 || z.TTLJitter >= 1 {
+		return fmt.Errorf("TTL jitter must be between 0 and 1: %g", z.TTLJitter)
+	}
+
 	// check retry
 	if z.Retry >= z.Refresh {
 		return fmt.Errorf("retry must be less than refresh: %d", z.Retry)
@@ -146,13 +382,393 @@ func (z *Zone) Validate() error {
 		return fmt.Errorf("expire must be bigger than the sum of refresh and retry: %d", z.Expire)
 	}
 
+	// precompute records
+	z.soa = z.buildSOA()
+	z.ns = z.buildNS(z.Name)
+
 	return nil
 }
 
+// validate will validate the zone when it is served for the first time. Zones
+// are treated as immutable snapshots afterwards.
+func (z *Zone) validate() error {
+	for {
+		// check state
+		switch atomic.LoadUint32(&z.valid) {
+		case zoneValid:
+			return nil
+		case zoneValidating:
+			runtime.Gosched()
+			continue
+		}
+
+		// claim validation
+		if !atomic.CompareAndSwapUint32(&z.valid, zoneUnvalidated, zoneValidating) {
+			continue
+		}
+
+		// validate zone
+		err := z.Validate()
+		if err != nil {
+			atomic.StoreUint32(&z.valid, zoneUnvalidated)
+			return err
+		}
+
+		// set state
+		atomic.StoreUint32(&z.valid, zoneValid)
+
+		return nil
+	}
+}
+
+func (z *Zone) handle(ctx context.Context, name string) ([]Set, error) {
+	// load sets
+	list, err := z.load(ctx, []string{name})
+	if err != nil {
+		return nil, err
+	}
+
+	return list[0], nil
+}
+
+// load returns the sets for the specified names using the sets already loaded
+// by the request, the cache and the handlers in this order.
+func (z *Zone) load(ctx context.Context, names []string) ([][]Set, error) {
+	// get state
+	state := getRequestState(ctx)
+
+	// prepare result
+	result := make([][]Set, len(names))
+
+	// collect missing names
+	var missing []int
+	for i, name := range names {
+		// check request
+		if sets, ok := state.loaded(name); ok {
+			result[i] = sets
+			continue
+		}
+
+		// check cache
+		if sets, ok, expires := z.Cache.get(z.Name, name); ok {
+			if !expires.IsZero() {
+				go z.prefetch(ctx, name, expires)
+			}
+			result[i] = sets
+			continue
+		}
+
+		missing = append(missing, i)
+	}
+	if len(missing) == 0 {
+		return result, nil
+	}
+
+	// get names
+	list := make([]string, 0, len(missing))
+	for _, i := range missing {
+		list = append(list, names[i])
+	}
+
+	// call handler
+	hctx, span := startSpan(ctx, "newdns.ZoneHandler")
+	span.SetAttribute("dns.name", list[0])
+	if len(list) > 1 {
+		span.SetAttribute("dns.names", len(list))
+	}
+	start := time.Now()
+	sets, err := z.fetch(hctx, list)
+	if state != nil && state.info != nil {
+		state.info.handler(time.Since(start))
+	}
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+	if err != nil {
+		return nil, kindError(ErrHandler, fmt.Errorf("zone handler error: %w", err))
+	}
+
+	// store sets
+	for j, i := range missing {
+		result[i] = sets[j]
+		z.Cache.put(z, names[i], sets[j])
+		state.load(names[i], sets[j])
+	}
+
+	return result, nil
+}
+
+// fetch returns the sets for the specified names from the batch handler or
+// the handler.
+func (z *Zone) fetch(ctx context.Context, names []string) ([][]Set, error) {
+	// trim names
+	trimmed := make([]string, 0, len(names))
+	for _, name := range names {
+		trimmed = append(trimmed, TrimZone(z.Name, name))
+	}
+
+	// use batch handler
+	if z.BatchHandler != nil {
+		list, err := z.BatchHandler(ctx, trimmed)
+		if err != nil {
+			return nil, err
+		} else if len(list) != len(names) {
+			return nil, fmt.Errorf("expected %d results, got %d", len(names), len(list))
+		}
+
+		return list, nil
+	}
+
+	// use handler
+	list := make([][]Set, 0, len(names))
+	for _, name := range trimmed {
+		sets, err := z.Handler(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, sets)
+	}
+
+	return list, nil
+}
+
+// prefetch refreshes the cached sets of the name. The refresh keeps the values
+// of the request context and ends with the handler timeout of the request or
+// the expiry of the cached sets.
+func (z *Zone) prefetch(ctx context.Context, name string, expires time.Time) {
+	// get deadline
+	deadline := expires
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	// prepare context
+	ctx, cancel := context.WithDeadline(context.WithoutCancel(ctx), deadline)
+	defer cancel()
+
+	// fetch sets
+	list, err := z.fetch(ctx, []string{name})
+	if err != nil {
+		z.Cache.release(z.Name, name)
+		return
+	}
+
+	// cache sets
+	z.Cache.put(z, name, list[0])
+}
+
+// resolveTypes returns the sets of the specified types of the name using the
+// type handler if available or the sets returned by resolve otherwise.
+func (z *Zone) resolveTypes(ctx context.Context, name string, needle []Type) ([]Set, error) {
+	// check type handler
+	if z.TypeHandler == nil {
+		return z.resolve(ctx, name)
+	}
+
+	// prepare types
+	types := append(make([]Type, 0, len(needle)+1), needle...)
+	if !typeInList(types, CNAME) {
+		types = append(types, CNAME)
+	}
+
+	// call type handler
+	hctx, span := startSpan(ctx, "newdns.ZoneTypeHandler")
+	span.SetAttribute("dns.name", name)
+	start := time.Now()
+	sets, err := z.TypeHandler(hctx, TrimZone(z.Name, name), types)
+	if state := getRequestState(ctx); state != nil && state.info != nil {
+		state.info.handler(time.Since(start))
+	}
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+	if err != nil {
+		return nil, kindError(ErrHandler, fmt.Errorf("zone type handler error: %w", err))
+	} else if len(sets) > 0 {
+		return sets, nil
+	}
+
+	return z.resolve(ctx, name)
+}
+
+// resolve returns the sets of the name or the sets synthesized from the
+// matching wildcard if enabled.
+func (z *Zone) resolve(ctx context.Context, name string) ([]Set, error) {
+	// get sets
+	sets, err := z.handle(ctx, name)
+	if err != nil || len(sets) > 0 || !z.Wildcards || name == z.Name {
+		return sets, err
+	}
+
+	// wildcards do not match empty non-terminals
+	ok, err := z.nonTerminal(ctx, name)
+	if err != nil || ok {
+		return nil, err
+	}
+
+	// collect ancestors and their wildcards
+	var names []string
+	for ancestor := name; ancestor != z.Name; {
+		off, _ := dns.NextLabel(ancestor, 0)
+		ancestor = ancestor[off:]
+		names = append(names, "*."+ancestor, ancestor)
+	}
+
+	// load all names at once if supported
+	if z.BatchHandler != nil {
+		_, err = z.load(ctx, names)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// find closest encloser
+	for i := 0; i < len(names); i += 2 {
+		// get wildcard sets
+		wildcard, err := z.handle(ctx, names[i])
+		if err != nil {
+			return nil, err
+		}
+
+		// synthesize sets
+		if len(wildcard) > 0 {
+			sets = make([]Set, 0, len(wildcard))
+			for _, set := range wildcard {
+				set.Name = name
+				sets = append(sets, set)
+			}
+			return sets, nil
+		}
+
+		// stop at apex
+		if names[i+1] == z.Name {
+			break
+		}
+
+		// stop at existing ancestor
+		ancestor, err := z.handle(ctx, names[i+1])
+		if err != nil {
+			return nil, err
+		} else if len(ancestor) > 0 {
+			break
+		}
+
+		// stop at empty non-terminal ancestor
+		ok, err := z.nonTerminal(ctx, names[i+1])
+		if err != nil {
+			return nil, err
+		} else if ok {
+			break
+		}
+	}
+
+	return nil, nil
+}
+
+// delegation returns the NS set of the topmost zone cut at or above the
+// specified name. NS sets below the apex delegate the name and all names below
+// to other name servers.
+func (z *Zone) delegation(ctx context.Context, name string) (*Set, error) {
+	// collect name and ancestors below apex
+	var names []string
+	for ancestor := name; ancestor != z.Name && InZone(z.Name, ancestor); {
+		names = append([]string{ancestor}, names...)
+		off, _ := dns.NextLabel(ancestor, 0)
+		ancestor = ancestor[off:]
+	}
+
+	// load all names at once if supported
+	if z.BatchHandler != nil && len(names) > 1 {
+		_, err := z.load(ctx, names)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// find topmost NS set
+	for _, item := range names {
+		// get sets
+		sets, err := z.handle(ctx, item)
+		if err != nil {
+			return nil, err
+		}
+
+		// check sets
+		for _, set := range sets {
+			if set.Type == NS {
+				// validate set
+				err = z.validateSet(&set)
+				if err != nil {
+					return nil, kindError(ErrValidation, fmt.Errorf("invalid set: %w", err))
+				}
+
+				return &set, nil
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// glue returns the A and AAAA sets of the name servers that are in the zone.
+// The targets of CNAME records are not included.
+func (z *Zone) glue(ctx context.Context, servers []string) ([]Set, error) {
+	// collect in zone name servers
+	var names []string
+	for _, server := range servers {
+		if InZone(z.Name, server) {
+			names = append(names, NormalizeDomain(server, true, false, false))
+		}
+	}
+
+	// load all names at once if supported
+	if z.BatchHandler != nil && len(names) > 1 {
+		_, err := z.load(ctx, names)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// lookup sets
+	var list []Set
+	for _, name := range names {
+		for _, typ := range []Type{A, AAAA} {
+			sets, _, err := z.Lookup(ctx, name, typ)
+			if err != nil {
+				return nil, err
+			}
+			if len(sets) == 1 && sets[0].Type == typ {
+				list = append(list, sets[0])
+			}
+		}
+	}
+
+	return list, nil
+}
+
+// nonTerminal returns whether names exist below the specified name.
+func (z *Zone) nonTerminal(ctx context.Context, name string) (bool, error) {
+	// check callback
+	if z.NonTerminal == nil {
+		return false, nil
+	}
+
+	// call callback
+	ok, err := z.NonTerminal(ctx, TrimZone(z.Name, name))
+	if err != nil {
+		return false, kindError(ErrHandler, fmt.Errorf("zone non-terminal error: %w", err))
+	}
+
+	return ok, nil
+}
+
 // Lookup will lookup the specified name in the zone and return results for the
 // specified record types. If no results are returned, the second return value
-// indicates if there are other results for the specified name.
-func (z *Zone) Lookup(name string, needle ...Type) ([]Set, bool, error) {
+// indicates if there are other results for the specified name, including types
+// that are not supported, or if the name is the apex or an empty non-terminal.
+func (z *Zone) Lookup(ctx context.Context, name string, needle ...Type) ([]Set, bool, error) {
 	// check name
 	if !IsDomain(name, true) {
 		return nil, false, fmt.Errorf("invalid name: %s", name)
@@ -171,14 +787,24 @@ func (z *Zone) Lookup(name string, needle ...Type) ([]Set, bool, error) {
 
 	for i := 0; ; i++ {
 		// get sets
-		sets, err := z.Handler(TrimZone(z.Name, name))
+		sets, err := z.resolveTypes(ctx, name, needle)
 		if err != nil {
-			return nil, false, fmt.Errorf("zone handler error: %w", err)
+			return nil, false, err
 		}
 
-		// return immediately if initial set is empty
+		// return immediately if initial set is empty, but indicate that the
+		// name exists if it is the apex or an empty non-terminal
 		if i == 0 && len(sets) == 0 {
-			return nil, false, nil
+			if name == z.Name {
+				return nil, true, nil
+			}
+
+			ok, err := z.nonTerminal(ctx, name)
+			if err != nil {
+				return nil, false, err
+			}
+
+			return nil, ok, nil
 		}
 
 		// prepare counters
@@ -193,14 +819,14 @@ func (z *Zone) Lookup(name string, needle ...Type) ([]Set, bool, error) {
 		// validate sets
 		for _, set := range sets {
 			// validate set
-			err = set.Validate()
+			err = z.validateSet(&set)
 			if err != nil {
-				return nil, false, fmt.Errorf("invalid set: %w", err)
+				return nil, false, kindError(ErrValidation, fmt.Errorf("invalid set: %w", err))
 			}
 
 			// check relationship
 			if !InZone(z.Name, set.Name) {
-				return nil, false, fmt.Errorf("set does not belong to zone: %s", set.Name)
+				return nil, false, kindError(ErrValidation, fmt.Errorf("set does not belong to zone: %s", set.Name))
 			}
 
 			// increment counter
@@ -210,18 +836,18 @@ func (z *Zone) Lookup(name string, needle ...Type) ([]Set, bool, error) {
 		// check counters
 		for _, counter := range counters {
 			if counter > 1 {
-				return nil, false, errors.New("multiple sets for same type")
+				return nil, false, kindError(ErrValidation, errors.New("multiple sets for same type"))
 			}
 		}
 
 		// check apex CNAME
 		if counters[CNAME] > 0 && name == z.Name {
-			return nil, false, fmt.Errorf("invalid CNAME set at apex: %s", name)
+			return nil, false, kindError(ErrValidation, fmt.Errorf("invalid CNAME set at apex: %s", name))
 		}
 
 		// check CNAME is stand-alone
 		if counters[CNAME] > 0 && (len(sets) > 1) {
-			return nil, false, fmt.Errorf("other sets with CNAME set: %s", name)
+			return nil, false, kindError(ErrValidation, fmt.Errorf("other sets with CNAME set: %s", name))
 		}
 
 		// check if CNAME and query is not CNAME
@@ -260,3 +886,192 @@ func (z *Zone) Lookup(name string, needle ...Type) ([]Set, bool, error) {
 		return result, false, nil
 	}
 }
+
+// List will enumerate all sets of the zone using the lister and call the
+// provided function with every set. The sets are validated and the apex NS set
+// is skipped as it is derived from the name servers. Errors returned by the
+// function are returned immediately.
+func (z *Zone) List(ctx context.Context, fn func(Set) error) error {
+	// check lister
+	if z.Lister == nil {
+		return fmt.Errorf("missing lister for zone: %s", z.Name)
+	}
+
+	// list sets
+	var fnErr error
+	err := z.Lister(ctx, func(set Set) error {
+		// validate set
+		err := z.validateSet(&set)
+		if err != nil {
+			return kindError(ErrValidation, fmt.Errorf("invalid set: %w", err))
+		}
+
+		// check relationship
+		if !InZone(z.Name, set.Name) {
+			return kindError(ErrValidation, fmt.Errorf("set does not belong to zone: %s", set.Name))
+		}
+
+		// skip apex NS sets
+		if set.Type == NS && NormalizeDomain(set.Name, true, false, false) == z.Name {
+			return nil
+		}
+
+		// yield set
+		fnErr = fn(set)
+
+		return fnErr
+	})
+	if err != nil && err != fnErr {
+		return kindError(ErrHandler, fmt.Errorf("zone lister error: %w", err))
+	}
+
+	return err
+}
+
+// validateSet will set the default TTL of the zone if missing and validate the
+// set.
+func (z *Zone) validateSet(set *Set) error {
+	// set default TTL
+	if set.TTL == 0 {
+		set.TTL = z.defaultTTL(set.Type)
+	}
+
+	return set.Validate()
+}
+
+func (z *Zone) defaultTTL(typ Type) time.Duration {
+	// check type TTL
+	if ttl, ok := z.DefaultTypeTTL[typ]; ok {
+		return ttl
+	}
+
+	return z.DefaultTTL
+}
+
+func (z *Zone) withSerial() *Zone {
+	// check callback
+	if z.SerialFunc == nil {
+		return z
+	}
+
+	// get serial
+	serial := z.SerialFunc()
+	if serial == 0 {
+		return z
+	}
+
+	// copy zone
+	zone := z.clone()
+	zone.Serial = serial
+	zone.soa = z.soa
+	zone.ns = z.ns
+	zone.valid = zoneValid
+
+	return zone
+}
+
+// clone returns a copy of the zone settings. The validation state is not
+// copied as it may be changed concurrently.
+func (z *Zone) clone() *Zone {
+	return &Zone{
+		Name:             z.Name,
+		MasterNameServer: z.MasterNameServer,
+		AllNameServers:   z.AllNameServers,
+		AdminEmail:       z.AdminEmail,
+		Refresh:          z.Refresh,
+		Retry:            z.Retry,
+		Expire:           z.Expire,
+		Serial:           z.Serial,
+		SerialFunc:       z.SerialFunc,
+		SOATTL:           z.SOATTL,
+		NSTTL:            z.NSTTL,
+		MinTTL:           z.MinTTL,
+		MaxTTL:           z.MaxTTL,
+		DefaultTTL:       z.DefaultTTL,
+		DefaultTypeTTL:   z.DefaultTypeTTL,
+		TTLJitter:        z.TTLJitter,
+		Handler:          z.Handler,
+		Provider:         z.Provider,
+		BatchHandler:     z.BatchHandler,
+		TypeHandler:      z.TypeHandler,
+		NonTerminal:      z.NonTerminal,
+		Wildcards:        z.Wildcards,
+		Delegations:      z.Delegations,
+		Order:            z.Order,
+		Cache:            z.Cache,
+		Lister:           z.Lister,
+		Journal:          z.Journal,
+		AllowTransfer:    z.AllowTransfer,
+		TSIGKeys:         z.TSIGKeys,
+		RequireTSIG:      z.RequireTSIG,
+		MaxUDPSize:       z.MaxUDPSize,
+		QueryRate:        z.QueryRate,
+		QueryBurst:       z.QueryBurst,
+		ClientQueryRate:  z.ClientQueryRate,
+		ClientQueryBurst: z.ClientQueryBurst,
+		UpdateHandler:    z.UpdateHandler,
+		UpdatePolicy:     z.UpdatePolicy,
+		Notify:           z.Notify,
+		Forwarders:       z.Forwarders,
+	}
+}
+
+// soaRecord returns the shared SOA record of the zone which must not be
+// modified.
+func (z *Zone) soaRecord() *dns.SOA {
+	// use precomputed record if current
+	if z.soa != nil && z.soa.Serial == z.Serial {
+		return z.soa
+	}
+
+	return z.buildSOA()
+}
+
+// nsRecords returns the shared NS records of the zone which must not be
+// modified.
+func (z *Zone) nsRecords(owner string) []dns.RR {
+	// use precomputed records if owner matches
+	if z.ns != nil && owner == z.Name {
+		return z.ns
+	}
+
+	return z.buildNS(owner)
+}
+
+func (z *Zone) buildSOA() *dns.SOA {
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   z.Name,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    toSeconds(z.SOATTL),
+		},
+		Ns:      z.MasterNameServer,
+		Mbox:    emailToDomain(z.AdminEmail),
+		Serial:  z.Serial,
+		Refresh: toSeconds(z.Refresh),
+		Retry:   toSeconds(z.Retry),
+		Expire:  toSeconds(z.Expire),
+		Minttl:  toSeconds(z.MinTTL),
+	}
+}
+
+func (z *Zone) buildNS(owner string) []dns.RR {
+	// prepare list
+	list := make([]dns.RR, 0, len(z.AllNameServers))
+
+	// add records
+	for _, ns := range z.AllNameServers {
+		list = append(list, &dns.NS{
+			Hdr: dns.RR_Header{
+				Name:   owner,
+				Rrtype: dns.TypeNS,
+				Class:  dns.ClassINET,
+				Ttl:    toSeconds(z.NSTTL),
+			},
+			Ns: ns,
+		})
+	}
+
+	return list
+}
@@ -1,8 +1,11 @@
 package newdns
 
 import (
+	"context"
+	"errors"
 	"io"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -96,6 +99,28 @@ func TestZoneValidate(t *testing.T) {
 			},
 			err: "expire must be bigger than the sum of refresh and retry: 1",
 		},
+		{
+			zne: Zone{
+				Name:             "example.com.",
+				MasterNameServer: "n1.example.com.",
+				AllNameServers: []string{
+					"n1.example.com.",
+				},
+				MaxTTL: time.Minute,
+			},
+			err: "max TTL must not be less than min TTL: 60000000000",
+		},
+		{
+			zne: Zone{
+				Name:             "example.com.",
+				MasterNameServer: "n1.example.com.",
+				AllNameServers: []string{
+					"n1.example.com.",
+				},
+				TTLJitter: 1,
+			},
+			err: "TTL jitter must be between 0 and 1: 1",
+		},
 	}
 
 	for i, item := range table {
@@ -116,7 +141,7 @@ func TestZoneLookup(t *testing.T) {
 			"ns1.example.com.",
 			"ns2.example.com.",
 		},
-		Handler: func(name string) ([]Set, error) {
+		Handler: func(ctx context.Context, name string) ([]Set, error) {
 			if name == "error" {
 				return nil, io.EOF
 			}
@@ -199,9 +224,363 @@ func TestZoneLookup(t *testing.T) {
 	}
 
 	for i, item := range table {
-		res, exists, err := zone.Lookup(item.name, A)
+		res, exists, err := zone.Lookup(context.Background(), item.name, A)
 		assert.Equal(t, item.err, err.Error(), i)
 		assert.False(t, exists, i)
 		assert.Nil(t, res, i)
 	}
 }
+
+func TestZoneSerialFunc(t *testing.T) {
+	zone := &Zone{
+		Name:             "example.com.",
+		MasterNameServer: "ns1.example.com.",
+		AllNameServers:   []string{"ns1.example.com."},
+		SerialFunc: func() uint32 {
+			return 42
+		},
+	}
+
+	err := zone.Validate()
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1), zone.Serial)
+	assert.Equal(t, uint32(42), zone.withSerial().soaRecord().Serial)
+	assert.Equal(t, uint32(1), zone.Serial)
+}
+
+func TestZonePrecomputedRecords(t *testing.T) {
+	zone := &Zone{
+		Name:             "example.com.",
+		MasterNameServer: "ns1.example.com.",
+		AllNameServers: []string{
+			"ns1.example.com.",
+			"ns2.example.com.",
+		},
+	}
+
+	err := zone.Validate()
+	assert.NoError(t, err)
+
+	soa := zone.soaRecord()
+	assert.True(t, soa == zone.soaRecord())
+	assert.Equal(t, uint32(1), soa.Serial)
+
+	ns := zone.nsRecords("example.com.")
+	assert.Len(t, ns, 2)
+	assert.True(t, &ns[0] == &zone.nsRecords("example.com.")[0])
+
+	other := zone.nsRecords("EXAMPLE.com.")
+	assert.Len(t, other, 2)
+	assert.Equal(t, "EXAMPLE.com.", other[0].Header().Name)
+
+	zone.Serial = 2
+	assert.False(t, soa == zone.soaRecord())
+	assert.Equal(t, uint32(2), zone.soaRecord().Serial)
+	assert.Equal(t, uint32(1), soa.Serial)
+}
+
+func TestZoneValidateOnce(t *testing.T) {
+	zone := &Zone{
+		Name:             "example.com.",
+		MasterNameServer: "ns1.example.com.",
+		AllNameServers: []string{
+			"ns1.example.com.",
+		},
+	}
+
+	err := zone.validate()
+	assert.NoError(t, err)
+	assert.Equal(t, zoneValid, zone.valid)
+	assert.Equal(t, 15*time.Minute, zone.SOATTL)
+
+	zone.SOATTL = 0
+	err = zone.validate()
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), zone.SOATTL)
+
+	invalid := &Zone{
+		Name: "example.com.",
+	}
+
+	err = invalid.validate()
+	assert.Error(t, err)
+	assert.Equal(t, zoneUnvalidated, invalid.valid)
+}
+
+func TestZoneWildcards(t *testing.T) {
+	zone := Zone{
+		Name:             "example.com.",
+		MasterNameServer: "ns1.example.com.",
+		AllNameServers: []string{
+			"ns1.example.com.",
+		},
+		Wildcards: true,
+		Handler: func(ctx context.Context, name string) ([]Set, error) {
+			switch name {
+			case "*":
+				return []Set{
+					{Name: "*.example.com.", Type: A, Records: []Record{{Address: "1.2.3.4"}}},
+				}, nil
+			case "foo":
+				return []Set{
+					{Name: "foo.example.com.", Type: TXT, Records: []Record{{Data: []string{"foo"}}}},
+				}, nil
+			case "*.bar":
+				return []Set{
+					{Name: "*.bar.example.com.", Type: CNAME, Records: []Record{{Address: "foo.example.com."}}},
+				}, nil
+			}
+
+			return nil, nil
+		},
+	}
+
+	err := zone.Validate()
+	assert.NoError(t, err)
+
+	res, exists, err := zone.Lookup(context.Background(), "baz.example.com.", A)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, []Set{
+		{Name: "baz.example.com.", Type: A, Records: []Record{{Address: "1.2.3.4"}}},
+	}, res)
+
+	res, exists, err = zone.Lookup(context.Background(), "a.b.example.com.", A)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, []Set{
+		{Name: "a.b.example.com.", Type: A, Records: []Record{{Address: "1.2.3.4"}}},
+	}, res)
+
+	res, exists, err = zone.Lookup(context.Background(), "foo.example.com.", A)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.Nil(t, res)
+
+	res, exists, err = zone.Lookup(context.Background(), "baz.foo.example.com.", A)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.Nil(t, res)
+
+	res, exists, err = zone.Lookup(context.Background(), "baz.bar.example.com.", TXT)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, []Set{
+		{Name: "baz.bar.example.com.", Type: CNAME, Records: []Record{{Address: "foo.example.com."}}},
+		{Name: "foo.example.com.", Type: TXT, Records: []Record{{Data: []string{"foo"}}}},
+	}, res)
+}
+
+func TestZoneNonTerminal(t *testing.T) {
+	zone := Zone{
+		Name:             "example.com.",
+		MasterNameServer: "ns1.example.com.",
+		AllNameServers: []string{
+			"ns1.example.com.",
+		},
+		Wildcards: true,
+		Handler: func(ctx context.Context, name string) ([]Set, error) {
+			switch name {
+			case "*":
+				return []Set{
+					{Name: "*.example.com.", Type: A, Records: []Record{{Address: "1.2.3.4"}}},
+				}, nil
+			case "foo.bar":
+				return []Set{
+					{Name: "foo.bar.example.com.", Type: A, Records: []Record{{Address: "1.2.3.4"}}},
+				}, nil
+			}
+
+			return nil, nil
+		},
+		NonTerminal: func(ctx context.Context, name string) (bool, error) {
+			return name == "bar", nil
+		},
+	}
+
+	err := zone.Validate()
+	assert.NoError(t, err)
+
+	res, exists, err := zone.Lookup(context.Background(), "bar.example.com.", A)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.Nil(t, res)
+
+	res, exists, err = zone.Lookup(context.Background(), "baz.bar.example.com.", A)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.Nil(t, res)
+
+	res, exists, err = zone.Lookup(context.Background(), "baz.example.com.", A)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.Len(t, res, 1)
+
+	zone.NonTerminal = func(ctx context.Context, name string) (bool, error) {
+		return false, io.EOF
+	}
+
+	_, _, err = zone.Lookup(context.Background(), "bar.example.com.", A)
+	assert.Error(t, err)
+	assert.True(t, errors.Is(err, ErrHandler))
+}
+
+func TestZoneList(t *testing.T) {
+	sets := []Set{
+		{Name: "example.com.", Type: NS, Records: []Record{{Address: "ns1.example.com."}}},
+		{Name: "example.com.", Type: A, Records: []Record{{Address: "1.2.3.4"}}},
+		{Name: "www.example.com.", Type: CNAME, Records: []Record{{Address: "example.com."}}},
+	}
+
+	zone := Zone{
+		Name:             "example.com.",
+		MasterNameServer: "ns1.example.com.",
+		AllNameServers: []string{
+			"ns1.example.com.",
+		},
+		Handler: func(ctx context.Context, name string) ([]Set, error) {
+			return nil, nil
+		},
+	}
+
+	err := zone.List(context.Background(), func(Set) error {
+		return nil
+	})
+	assert.Error(t, err)
+	assert.Equal(t, "missing lister for zone: example.com.", err.Error())
+
+	zone.Lister = func(ctx context.Context, fn func(Set) error) error {
+		for _, set := range sets {
+			err := fn(set)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var list []Set
+	err = zone.List(context.Background(), func(set Set) error {
+		list = append(list, set)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []Set{
+		{Name: "example.com.", Type: A, Records: []Record{{Address: "1.2.3.4"}}, TTL: 5 * time.Minute},
+		{Name: "www.example.com.", Type: CNAME, Records: []Record{{Address: "example.com."}}, TTL: 5 * time.Minute},
+	}, list)
+
+	err = zone.List(context.Background(), func(set Set) error {
+		return io.EOF
+	})
+	assert.Equal(t, io.EOF, err)
+
+	sets = append(sets, Set{Name: "foo.example.org.", Type: A, Records: []Record{{Address: "1.2.3.4"}}})
+
+	err = zone.List(context.Background(), func(set Set) error {
+		return nil
+	})
+	assert.Error(t, err)
+	assert.True(t, errors.Is(err, ErrValidation))
+	assert.Equal(t, "zone lister error: set does not belong to zone: foo.example.org.", err.Error())
+}
+
+func TestZoneDefaultTTL(t *testing.T) {
+	zone, err := NewStaticZone("example.com.", map[string][]Set{
+		"": {
+			{Name: "example.com.", Type: NS, Records: []Record{{Address: "ns1.example.com."}}},
+			{Name: "example.com.", Type: A, Records: []Record{{Address: "1.2.3.4"}}},
+			{Name: "example.com.", Type: MX, Records: []Record{{Address: "mail.example.com."}}},
+			{Name: "example.com.", Type: TXT, Records: []Record{{Data: []string{"foo"}}}, TTL: time.Minute},
+		},
+	}, func(zone *Zone) {
+		zone.DefaultTTL = time.Hour
+		zone.DefaultTypeTTL = map[Type]time.Duration{
+			MX: 2 * time.Hour,
+		}
+	})
+	assert.NoError(t, err)
+
+	var list []Set
+	err = zone.List(context.Background(), func(set Set) error {
+		list = append(list, set)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, time.Hour, list[0].TTL)
+	assert.Equal(t, 2*time.Hour, list[1].TTL)
+	assert.Equal(t, time.Minute, list[2].TTL)
+
+	var ttls []uint32
+	for _, typ := range []Type{A, MX, TXT} {
+		res, _, err := zone.Lookup(context.Background(), "example.com.", typ)
+		assert.NoError(t, err)
+		assert.Len(t, res, 1)
+		rrs := convertSet(nil, "example.com.", zone, res[0])
+		ttls = append(ttls, rrs[0].Header().Ttl)
+	}
+	assert.Equal(t, []uint32{3600, 7200, 300}, ttls)
+
+	zone.valid = zoneUnvalidated
+	zone.DefaultTypeTTL[MX] = -1
+	err = zone.Validate()
+	assert.Error(t, err)
+}
+
+func TestZoneTypeHandler(t *testing.T) {
+	var calls []string
+
+	zone := Zone{
+		Name:             "example.com.",
+		MasterNameServer: "ns1.example.com.",
+		AllNameServers: []string{
+			"ns1.example.com.",
+		},
+		Handler: func(ctx context.Context, name string) ([]Set, error) {
+			calls = append(calls, "handler:"+name)
+			if name == "foo" {
+				return []Set{
+					{Name: "foo.example.com.", Type: A, Records: []Record{{Address: "1.2.3.4"}}},
+					{Name: "foo.example.com.", Type: TXT, Records: []Record{{Data: []string{"foo"}}}},
+				}, nil
+			}
+			return nil, nil
+		},
+		TypeHandler: func(ctx context.Context, name string, types []Type) ([]Set, error) {
+			calls = append(calls, "types:"+name)
+			assert.Equal(t, []Type{A, AAAA, CNAME}, types)
+			if name == "foo" {
+				return []Set{
+					{Name: "foo.example.com.", Type: A, Records: []Record{{Address: "1.2.3.4"}}},
+				}, nil
+			}
+			return nil, nil
+		},
+	}
+
+	err := zone.Validate()
+	assert.NoError(t, err)
+
+	res, exists, err := zone.Lookup(context.Background(), "foo.example.com.", A, AAAA)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, []Set{
+		{Name: "foo.example.com.", Type: A, Records: []Record{{Address: "1.2.3.4"}}},
+	}, res)
+	assert.Equal(t, []string{"types:foo"}, calls)
+
+	calls = nil
+	res, exists, err = zone.Lookup(context.Background(), "bar.example.com.", A, AAAA)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.Nil(t, res)
+	assert.Equal(t, []string{"types:bar", "handler:bar"}, calls)
+
+	zone.TypeHandler = func(ctx context.Context, name string, types []Type) ([]Set, error) {
+		return nil, io.EOF
+	}
+
+	_, _, err = zone.Lookup(context.Background(), "foo.example.com.", A)
+	assert.Error(t, err)
+	assert.True(t, errors.Is(err, ErrHandler))
+}
@@ -0,0 +1,138 @@
+package newdns
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// LoadZone parses a zone in the standard master file format (RFC 1035) from
+// the provided reader and returns a static zone that serves its records. The
+// origin is the name of the zone and used for relative names unless changed
+// by an $ORIGIN directive. The SOA record at the apex is mapped onto the zone
+// fields and the apex NS records define the name servers. Records of types
+// that are not supported cause an error. The file name is used in errors and
+// to resolve $INCLUDE directives, which are not allowed unless it is set.
+func LoadZone(r io.Reader, origin, file string, opts ...ZoneOption) (*Zone, error) {
+	// normalize name
+	name := NormalizeDomain(origin, true, true, false)
+
+	// prepare parser
+	zp := dns.NewZoneParser(r, name, file)
+	zp.SetIncludeAllowed(file != "")
+
+	// parse records
+	var list []dns.RR
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		list = append(list, rr)
+	}
+
+	// check error
+	err := zp.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return zoneFromRRs(name, list, opts...)
+}
+
+// zoneFromRRs returns a static zone that serves the provided records. The SOA
+// record at the apex is mapped onto the zone fields and the apex NS records
+// define the name servers.
+func zoneFromRRs(name string, list []dns.RR, opts ...ZoneOption) (*Zone, error) {
+	// prepare state
+	var soa *dns.SOA
+	var nsTTL time.Duration
+	var order []string
+	sets := map[string]*Set{}
+
+	// group records
+	for _, rr := range list {
+		// get header
+		hdr := rr.Header()
+		owner := NormalizeDomain(hdr.Name, true, false, false)
+		ttl := time.Duration(hdr.Ttl) * time.Second
+
+		// check owner
+		if !InZone(name, owner) {
+			return nil, fmt.Errorf("record not in zone: %s", hdr.Name)
+		}
+
+		// handle SOA record
+		if record, ok := rr.(*dns.SOA); ok {
+			if owner != name || soa != nil {
+				return nil, fmt.Errorf("unexpected SOA record: %s", hdr.Name)
+			}
+			soa = record
+			continue
+		}
+
+		// remember apex NS TTL
+		if hdr.Rrtype == dns.TypeNS && owner == name {
+			nsTTL = ttl
+		}
+
+		// convert record
+		typ, record, ok := fromRR(rr)
+		if !ok {
+			return nil, fmt.Errorf("unsupported record type: %s", dns.TypeToString[hdr.Rrtype])
+		}
+
+		// get set
+		key := fmt.Sprintf("%s/%d", owner, typ)
+		set, ok := sets[key]
+		if !ok {
+			set = &Set{
+				Name: owner,
+				Type: typ,
+				TTL:  ttl,
+			}
+			sets[key] = set
+			order = append(order, key)
+		}
+
+		// add record
+		set.Records = append(set.Records, record)
+
+		// use lowest TTL
+		if ttl < set.TTL {
+			set.TTL = ttl
+		}
+	}
+
+	// check SOA
+	if soa == nil {
+		return nil, fmt.Errorf("missing SOA record for zone: %s", name)
+	}
+
+	// index sets by relative name
+	index := map[string][]Set{}
+	for _, key := range order {
+		set := *sets[key]
+		sub := TrimZone(name, set.Name)
+		index[sub] = append(index[sub], set)
+	}
+
+	// prepare options
+	opts = append([]ZoneOption{func(zone *Zone) {
+		// map SOA record
+		zone.AdminEmail = domainToEmail(soa.Mbox)
+		zone.Serial = soa.Serial
+		zone.Refresh = time.Duration(soa.Refresh) * time.Second
+		zone.Retry = time.Duration(soa.Retry) * time.Second
+		zone.Expire = time.Duration(soa.Expire) * time.Second
+		zone.MinTTL = time.Duration(soa.Minttl) * time.Second
+		zone.SOATTL = time.Duration(soa.Hdr.Ttl) * time.Second
+		zone.NSTTL = nsTTL
+
+		// use the first name server as master if the primary is hidden
+		master := NormalizeDomain(soa.Ns, true, false, false)
+		if len(zone.AllNameServers) == 0 || stringInList(zone.AllNameServers, master) {
+			zone.MasterNameServer = master
+		}
+	}}, opts...)
+
+	return NewStaticZone(name, index, opts...)
+}
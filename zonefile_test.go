@@ -0,0 +1,80 @@
+package newdns
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testZoneFile = `$ORIGIN example.com.
+$TTL 1h
+@	IN	SOA	ns1.example.com. admin.example.com. (
+			42	; serial
+			2h	; refresh
+			30m	; retry
+			2w	; expire
+			5m )	; minimum
+	IN	NS	ns1
+	IN	NS	ns2.example.com.
+	IN	A	1.2.3.4
+	IN	MX	10 mail
+www	300	IN	CNAME	@
+mail	IN	A	1.2.3.5
+	IN	A	1.2.3.6
+txt	IN	TXT	"foo" "bar"
+`
+
+func TestLoadZone(t *testing.T) {
+	zone, err := LoadZone(strings.NewReader(testZoneFile), "example.com.", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "example.com.", zone.Name)
+	assert.Equal(t, "ns1.example.com.", zone.MasterNameServer)
+	assert.Equal(t, []string{"ns1.example.com.", "ns2.example.com."}, zone.AllNameServers)
+	assert.Equal(t, "admin@example.com", zone.AdminEmail)
+	assert.Equal(t, uint32(42), zone.Serial)
+	assert.Equal(t, 2*time.Hour, zone.Refresh)
+	assert.Equal(t, 30*time.Minute, zone.Retry)
+	assert.Equal(t, 14*24*time.Hour, zone.Expire)
+	assert.Equal(t, 5*time.Minute, zone.MinTTL)
+	assert.Equal(t, time.Hour, zone.SOATTL)
+	assert.Equal(t, time.Hour, zone.NSTTL)
+
+	res, exists, err := zone.Lookup(context.Background(), "www.example.com.", A)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, []Set{
+		{Name: "www.example.com.", Type: CNAME, Records: []Record{{Address: "example.com."}}, TTL: 5 * time.Minute},
+	}, res[:1])
+
+	res, exists, err = zone.Lookup(context.Background(), "mail.example.com.", A)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, []Set{
+		{Name: "mail.example.com.", Type: A, Records: []Record{{Address: "1.2.3.5"}, {Address: "1.2.3.6"}}, TTL: time.Hour},
+	}, res)
+
+	res, exists, err = zone.Lookup(context.Background(), "txt.example.com.", TXT)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, []string{"foo", "bar"}, res[0].Records[0].Data)
+}
+
+func TestLoadZoneErrors(t *testing.T) {
+	_, err := LoadZone(strings.NewReader("@ 60 IN NS ns1.example.com.\n"), "example.com.", "")
+	assert.Error(t, err)
+	assert.Equal(t, "missing SOA record for zone: example.com.", err.Error())
+
+	_, err = LoadZone(strings.NewReader("foo.other.com. 60 IN A 1.2.3.4\n"), "example.com.", "")
+	assert.Error(t, err)
+	assert.Equal(t, "record not in zone: foo.other.com.", err.Error())
+
+	_, err = LoadZone(strings.NewReader("@ 60 IN HINFO foo bar\n"), "example.com.", "")
+	assert.Error(t, err)
+	assert.Equal(t, "unsupported record type: HINFO", err.Error())
+
+	_, err = LoadZone(strings.NewReader("@ 60 IN A\n"), "example.com.", "")
+	assert.Error(t, err)
+}